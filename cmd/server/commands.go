@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+
+	"github.com/davemolk/chuck/internal/config"
+	"github.com/davemolk/chuck/internal/sql"
+	"go.uber.org/zap"
+)
+
+// commands are the subcommands. They only need the db settings, the rest of
+// the config can be left unset.
+var commands = map[string]func(*config.Config, []string) error{
+	"export":  runExport,
+	"import":  runImport,
+	"migrate": runMigrate,
+	"seed":    runSeed,
+}
+
+// runCommand runs a subcommand instead of the server.
+func runCommand(cfg *config.Config, args []string) error {
+	return commands[args[0]](cfg, args[1:])
+}
+
+// checkCommand makes sure args start with a known command.
+func checkCommand(args []string) error {
+	if _, ok := commands[args[0]]; !ok {
+		return fmt.Errorf("unknown command %q, want one of %s", args[0], strings.Join(slices.Sorted(maps.Keys(commands)), ", "))
+	}
+	return nil
+}
+
+// commandDeps sets up what the db commands share. cleanup closes the db and
+// flushes the logger.
+func commandDeps(cfg *config.Config) (*zap.Logger, *sql.DB, func(), error) {
+	logger, err := rootLogger(cfg.Production, zap.NewAtomicLevelAt(cfg.Level()))
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to get logger: %w", err)
+	}
+
+	// no query timeout, an import runs as long as its file
+	db, err := sql.New(logger, cfg.DB.URL, nil, sql.PoolConfig{MaxOpenConns: 2, MaxIdleConns: 1, SlowQuery: cfg.DB.SlowQuery})
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to create db: %w", err)
+	}
+
+	cleanup := func() {
+		_ = db.Close()
+		_ = logger.Sync()
+	}
+	return logger, db, cleanup, nil
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/davemolk/chuck/internal/config"
+	"github.com/davemolk/chuck/internal/jokeio"
+	"github.com/davemolk/chuck/internal/service/joke"
+	"github.com/davemolk/chuck/internal/store"
+)
+
+const exportUsage = `usage: chuck [flags] export [--format ndjson|csv|json] [--output file]
+
+writes every joke to stdout, or the output file. the format defaults to the
+output file's extension, or ndjson.`
+
+const importUsage = `usage: chuck [flags] import [--format ndjson|csv|json] <file or ->
+
+upserts jokes by external_id, reading stdin for -. the format defaults to the
+file's extension, or ndjson. bad jokes are skipped and reported.`
+
+func runExport(cfg *config.Config, args []string) error {
+	fs := flag.NewFlagSet("export", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	formatName := fs.String("format", "", "")
+	output := fs.String("output", "", "")
+	if err := fs.Parse(args); err != nil || fs.NArg() > 0 {
+		return errors.New(exportUsage)
+	}
+
+	format, err := commandFormat(*formatName, *output)
+	if err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	logger, db, cleanup, err := commandDeps(cfg)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	out := os.Stdout
+	if *output != "" {
+		if out, err = os.Create(*output); err != nil {
+			return fmt.Errorf("failed to create output file: %w", err)
+		}
+		defer out.Close()
+	}
+
+	jw, err := jokeio.NewWriter(out, format)
+	if err != nil {
+		return err
+	}
+
+	if err = joke.NewService(logger, store.New(db), nil, nil).ExportJokes(ctx, jw); err != nil {
+		return err
+	}
+	if *output != "" {
+		if err = out.Close(); err != nil {
+			return fmt.Errorf("failed to write output file: %w", err)
+		}
+	}
+
+	fmt.Fprintf(os.Stderr, "exported %d jokes\n", jw.Count())
+	return nil
+}
+
+func runImport(cfg *config.Config, args []string) error {
+	fs := flag.NewFlagSet("import", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	formatName := fs.String("format", "", "")
+	if err := fs.Parse(args); err != nil || fs.NArg() != 1 {
+		return errors.New(importUsage)
+	}
+
+	name := fs.Arg(0)
+	var in io.Reader = os.Stdin
+	if name != "-" {
+		f, err := os.Open(name)
+		if err != nil {
+			return fmt.Errorf("failed to open import file: %w", err)
+		}
+		defer f.Close()
+		in = f
+	} else {
+		name = ""
+	}
+
+	format, err := commandFormat(*formatName, name)
+	if err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	logger, db, cleanup, err := commandDeps(cfg)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	jr, err := jokeio.NewReader(in, format)
+	if err != nil {
+		return err
+	}
+
+	report, importErr := joke.NewService(logger, store.New(db), nil, nil).ImportJokes(ctx, jr)
+
+	// the report is worth having even when the import stopped partway
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "    ")
+	if err = enc.Encode(report); err != nil {
+		return err
+	}
+
+	return importErr
+}
+
+// commandFormat is the format flag if there is one, else the file's
+// extension, else ndjson.
+func commandFormat(flagValue, file string) (jokeio.Format, error) {
+	if flagValue != "" {
+		return jokeio.ParseFormat(flagValue)
+	}
+	if file != "" {
+		if format, err := jokeio.FormatOf(file); err == nil {
+			return format, nil
+		}
+	}
+	return jokeio.FormatNDJSON, nil
+}
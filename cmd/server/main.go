@@ -2,53 +2,128 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
+	"flag"
 	"fmt"
 	"log"
+	"maps"
 	"net/http"
 	"os"
 	"os/signal"
-	"strconv"
 	"syscall"
 	"time"
 
 	apihttp "github.com/davemolk/chuck/internal/api/http"
+	"github.com/davemolk/chuck/internal/api/http/middleware"
 	"github.com/davemolk/chuck/internal/clients/chuck"
+	"github.com/davemolk/chuck/internal/clients/mailer"
+	"github.com/davemolk/chuck/internal/config"
+	"github.com/davemolk/chuck/internal/hasher"
+	"github.com/davemolk/chuck/internal/health"
+	"github.com/davemolk/chuck/internal/metrics"
+	"github.com/davemolk/chuck/internal/outbox"
+	"github.com/davemolk/chuck/internal/passpolicy"
+	"github.com/davemolk/chuck/internal/ratelimit"
 	"github.com/davemolk/chuck/internal/service/auth"
 	"github.com/davemolk/chuck/internal/service/joke"
+	"github.com/davemolk/chuck/internal/service/mfa"
 	"github.com/davemolk/chuck/internal/service/token"
+	"github.com/davemolk/chuck/internal/service/usage"
 	"github.com/davemolk/chuck/internal/service/user"
 	"github.com/davemolk/chuck/internal/sql"
+	"github.com/davemolk/chuck/internal/store"
+	"github.com/davemolk/chuck/internal/tlscert"
+	"github.com/davemolk/chuck/internal/tracing"
 	"go.uber.org/zap"
 )
 
-type config struct {
-	Production bool
-	Port       int
-	DbURL      string
-}
-
 func main() {
+	cfg, opts, err := config.Load(os.Args[1:], os.LookupEnv)
+	if errors.Is(err, flag.ErrHelp) {
+		fmt.Fprintln(os.Stderr, err)
+		return
+	}
+
+	if opts.PrintConfig {
+		if cfg != nil {
+			out, printErr := cfg.Redacted()
+			if printErr != nil {
+				log.Fatal(printErr)
+			}
+			os.Stdout.Write(out)
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if len(opts.Args) > 0 {
+		if err := checkCommand(opts.Args); err != nil {
+			log.Fatal(err)
+		}
+
+		var verr *config.ValidationError
+		if errors.As(err, &verr) {
+			err = verr.Only("db.")
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		if err := runCommand(cfg, opts.Args); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	ctx := context.Background()
-	if err := run(ctx); err != nil {
+	if err := run(ctx, cfg); err != nil {
 		log.Fatal(err)
 	}
 }
 
-func run(ctx context.Context) error {
-	cfg, err := fromEnv()
-	if err != nil {
-		return fmt.Errorf("failed to get config: %w", err)
-	}
+func run(ctx context.Context, cfg *config.Config) error {
+	level := zap.NewAtomicLevelAt(cfg.Level())
 
-	logger, err := rootLogger(cfg.Production)
+	logger, err := rootLogger(cfg.Production, level)
 	if err != nil {
 		return fmt.Errorf("failed to get logger: %w", err)
 	}
 
 	defer func() { _ = logger.Sync() }()
 
-	db, err := sql.New(logger, cfg.DbURL)
+	shutdownTracing, err := tracing.Setup(ctx, tracing.Config{
+		Exporter:    cfg.Tracing.Exporter,
+		ServiceName: cfg.Tracing.ServiceName,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to set up tracing: %w", err)
+	}
+
+	defer func() {
+		// flush whatever spans are left, the server is already down
+		flushCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := shutdownTracing(flushCtx); err != nil {
+			logger.Error("failed to flush traces", zap.Error(err))
+		}
+	}()
+
+	db, err := sql.New(logger, cfg.DB.URL, cfg.DB.ReplicaURLs, sql.PoolConfig{
+		MaxOpenConns:    cfg.DB.MaxOpenConns,
+		MaxIdleConns:    cfg.DB.MaxIdleConns,
+		ConnMaxIdleTime: cfg.DB.ConnMaxIdleTime,
+		ConnMaxLifetime: cfg.DB.ConnMaxLifetime,
+		QueryTimeout:    cfg.DB.QueryTimeout,
+		SlowQuery:       cfg.DB.SlowQuery,
+		RequestID:       middleware.RequestIDFromCtx,
+	})
 	if err != nil {
 		return fmt.Errorf("failed to create db: %w", err)
 	}
@@ -56,20 +131,170 @@ func run(ctx context.Context) error {
 	if err = db.Ping(ctx); err != nil {
 		return fmt.Errorf("failed to ping db: %w", err)
 	}
+	logger.Info("using database", zap.String("driver", string(db.Driver())), zap.Int("replicas", len(cfg.DB.ReplicaURLs)))
 
-	chuckClient := chuck.NewClient(logger)
-	jokeService := joke.NewService(logger, db, chuckClient)
-	tokenService := token.NewService(logger, db)
-	userService := user.NewService(logger, db)
-	authService := auth.NewService(logger, db, userService, tokenService)
+	if cfg.DB.MigrateOnStart {
+		report, err := migrateUp(ctx, logger, db)
+		if err != nil {
+			return err
+		}
+		logger.Info("migrated", zap.Uint("from", report.From), zap.Uint("to", report.To), zap.Int("applied", len(report.Applied)))
+	}
+
+	if err = metrics.RegisterDB("chuck", db.DB); err != nil {
+		return fmt.Errorf("failed to register db metrics: %w", err)
+	}
+	for name, pool := range db.ReplicaPools() {
+		if err = metrics.RegisterDB("chuck_replica_"+name, pool); err != nil {
+			return fmt.Errorf("failed to register replica db metrics: %w", err)
+		}
+	}
+
+	// reads fall back to the primary while a replica is down
+	dbCtx, stopDB := context.WithCancel(ctx)
+	defer stopDB()
+	go db.WatchReplicas(dbCtx, 10*time.Second)
+	if cfg.DB.StatsInterval > 0 {
+		go db.LogStatsEvery(dbCtx, cfg.DB.StatsInterval)
+	}
+
+	// postgres or sqlite, whichever the url names
+	st := store.New(db)
+
+	chuckClient := chuck.NewClient(logger, cfg.Chuck.BaseURL, cfg.Chuck.Timeout)
+	usageService := usage.NewService(logger, db, usage.DefaultPlans)
+	jokeService := joke.NewService(logger, st, chuckClient, usageService)
+	tokenService := token.NewService(logger, st)
+
+	mfaService, err := mfa.NewService(logger, db, cfg.Auth.TOTPKeyBytes())
+	if err != nil {
+		return fmt.Errorf("failed to create mfa service: %w", err)
+	}
+
+	mail, err := newMailer(logger, cfg.Mail)
+	if err != nil {
+		return fmt.Errorf("failed to create mailer: %w", err)
+	}
+
+	passwordHasher, err := hasher.New(hasher.Params{
+		Memory:      cfg.Password.Argon2MemoryKiB,
+		Iterations:  cfg.Password.Argon2Iterations,
+		Parallelism: cfg.Password.Argon2Parallelism,
+		SaltLength:  hasher.DefaultParams.SaltLength,
+		KeyLength:   hasher.DefaultParams.KeyLength,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create password hasher: %w", err)
+	}
+
+	policy, err := newPasswordPolicy(logger, cfg.Password)
+	if err != nil {
+		return fmt.Errorf("failed to create password policy: %w", err)
+	}
+
+	userService := user.NewService(logger, st, passwordHasher, policy, tokenService, mfaService, usageService, mail)
+	authService := auth.NewService(logger, db, passwordHasher, userService, tokenService, mfaService, mail, cfg.Auth.TokenTTL)
+
+	limitStore, err := newRateLimitStore(logger, cfg.RateLimit, db)
+	if err != nil {
+		return fmt.Errorf("failed to create rate limit store: %w", err)
+	}
+
+	sweepCtx, stopSweeping := context.WithCancel(ctx)
+	defer stopSweeping()
+	go ratelimit.SweepEvery(sweepCtx, logger, limitStore, time.Minute)
+
+	// events are delivered by whichever instance claims them first. Nothing
+	// subscribes yet, they're cleared out as they're delivered.
+	dispatcher := outbox.NewDispatcher(logger, db)
+	go dispatcher.Run(dbCtx, time.Second)
+
+	checks := []health.Check{
+		health.DB(db),
+		health.Migrations(db),
+		health.Upstream(chuckClient),
+	}
+	if len(cfg.DB.ReplicaURLs) > 0 {
+		checks = append(checks, health.Replicas(db))
+	}
+	checker := health.NewChecker(2*time.Second, checks...)
+
+	limits := middleware.NewLimits(rateLimits(cfg.RateLimit))
+
+	// in plain mode tls terminates at a proxy and there are no certs
+	var certs *tlscert.Reloader
+	var tlsConfig *tls.Config
+	if cfg.Server.Mode != config.ModePlain {
+		certs, err = tlscert.NewReloader(logger, cfg.Server.TLSCertFile, cfg.Server.TLSKeyFile)
+		if err != nil {
+			return fmt.Errorf("failed to create cert reloader: %w", err)
+		}
+
+		tlsConfig, err = newTLSConfig(cfg.Server, certs)
+		if err != nil {
+			return fmt.Errorf("failed to create tls config: %w", err)
+		}
+
+		watchCtx, stopWatching := context.WithCancel(ctx)
+		defer stopWatching()
+		go certs.Watch(watchCtx, 10*time.Second)
+	}
+
+	var certPrincipals map[string]middleware.CertPrincipal
+	if cfg.Server.ClientAuth != tlscert.ClientAuthNone {
+		certPrincipals = cfg.Auth.CertPrincipalMap()
+	}
 
 	router := apihttp.NewRoutes(logger, &apihttp.Services{
-		JokeService: jokeService,
-		UserService: userService,
-		AuthService: authService,
+		JokeService:  jokeService,
+		UserService:  userService,
+		AuthService:  authService,
+		MFAService:   mfaService,
+		UsageService: usageService,
+	}, apihttp.RoutesConfig{
+		UnverifiedRoutes: cfg.Server.UnverifiedRoutes,
+		RateLimitStore:   limitStore,
+		RateLimits:       limits,
+		Health:           checker,
+		CertPrincipals:   certPrincipals,
+		TrustedProxies:   cfg.Server.TrustedProxyPrefixes(),
+		ReadYourWrites:   cfg.DB.ReadYourWrites,
 	})
 
-	srv := apihttp.NewServer(logger, cfg.Port, router)
+	srv := apihttp.NewServer(logger, apihttp.ServerConfig{
+		Port:              cfg.Server.Port,
+		TLS:               tlsConfig,
+		H2C:               cfg.Server.H2C,
+		ReadHeaderTimeout: cfg.Server.ReadHeaderTimeout,
+		ReadTimeout:       cfg.Server.ReadTimeout,
+		WriteTimeout:      cfg.Server.WriteTimeout,
+		IdleTimeout:       cfg.Server.IdleTimeout,
+	}, router)
+	adminSrv := apihttp.NewAdminServer(logger, cfg.Server.AdminPort)
+
+	go func() {
+		if err := adminSrv.Run(); !errors.Is(err, http.ErrServerClosed) {
+			logger.Error("admin server failed", zap.Error(err))
+		}
+	}()
+
+	var redirectSrv *apihttp.Server
+	if cfg.Server.Mode == config.ModeBoth {
+		redirectSrv = apihttp.NewRedirectServer(logger, cfg.Server.RedirectPort, cfg.Server.Port)
+		go func() {
+			if err := redirectSrv.Run(); !errors.Is(err, http.ErrServerClosed) {
+				logger.Error("redirect server failed", zap.Error(err))
+			}
+		}()
+	}
+
+	go func() {
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		for range hup {
+			reload(logger, cfg, certs, level, limits)
+		}
+	}()
 
 	shutdownErr := make(chan error)
 	go func() {
@@ -79,24 +304,42 @@ func run(ctx context.Context) error {
 
 		logger.Info("starting graceful shutdown", zap.Stringer("signal", sigRecv))
 
-		shutdownCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		// fail readiness first and give load balancers a chance to notice,
+		// requests still arriving in the meantime are served as usual
+		checker.Drain()
+		logger.Info("draining", zap.Duration("delay", cfg.Server.DrainDelay))
+		time.Sleep(cfg.Server.DrainDelay)
+
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.Server.ShutdownTimeout)
 		defer cancel()
 
-		err := srv.Shutdown(shutdownCtx)
-		if err != nil {
-			shutdownErr <- err
+		// every step runs even if an earlier one failed, so nothing is left
+		// open, and the errors are reported together
+		var errs []error
+		if err := srv.Shutdown(shutdownCtx); err != nil {
+			errs = append(errs, fmt.Errorf("server: %w", err))
+		}
+
+		if redirectSrv != nil {
+			if err := redirectSrv.Shutdown(shutdownCtx); err != nil {
+				errs = append(errs, fmt.Errorf("redirect server: %w", err))
+			}
+		}
+
+		// metrics stay up until the api is done, so the drain is visible
+		if err := adminSrv.Shutdown(shutdownCtx); err != nil {
+			errs = append(errs, fmt.Errorf("admin server: %w", err))
 		}
 
 		logger.Info("chuck norris delivered a roundhouse to the server")
 
-		err = db.Close()
-		if err != nil {
-			shutdownErr <- err
+		if err := db.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("db: %w", err))
 		}
 
 		logger.Info("chuck norris told the db to get chucked")
 
-		shutdownErr <- nil
+		shutdownErr <- errors.Join(errs...)
 	}()
 
 	err = srv.Run()
@@ -114,47 +357,131 @@ func run(ctx context.Context) error {
 	return nil
 }
 
-func rootLogger(prod bool) (*zap.Logger, error) {
-	var l *zap.Logger
-	var err error
+// reload re-reads the cert and config on SIGHUP. Whatever fails to load is
+// logged and the current value kept.
+func reload(logger *zap.Logger, running *config.Config, certs *tlscert.Reloader, level zap.AtomicLevel, limits *middleware.Limits) {
+	logger.Info("reloading")
 
-	if prod {
-		l, err = zap.NewProduction()
-	} else {
-		l, err = zap.NewDevelopment()
+	if certs != nil {
+		if err := certs.Reload(); err != nil {
+			logger.Error("failed to reload tls certificate, keeping the current one", zap.Error(err))
+		}
 	}
+
+	// env vars can't change under a running process, but the file can
+	next, _, err := config.Load(os.Args[1:], os.LookupEnv)
 	if err != nil {
-		return nil, fmt.Errorf("failed to init logger: %w", err)
+		logger.Error("failed to reload config, keeping the current one", zap.Error(err))
+		return
 	}
 
-	return l, nil
+	level.SetLevel(next.Level())
+	limits.Store(rateLimits(next.RateLimit))
+
+	if paths := running.RestartRequired(next); len(paths) > 0 {
+		logger.Warn("config changes need a restart to apply", zap.Strings("settings", paths))
+	}
+
+	logger.Info("reloaded config", zap.Stringer("log_level", next.Level()))
 }
 
-func fromEnv() (*config, error) {
-	prodStr := os.Getenv("PRODUCTION")
-	portStr := os.Getenv("PORT")
-	dbURL := os.Getenv("DATABASE_URL")
+// newTLSConfig serves the reloadable cert, and verifies client certs against
+// the client CA bundle when client auth is on.
+func newTLSConfig(cfg config.ServerConfig, certs *tlscert.Reloader) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: certs.GetCertificate,
+	}
+
+	clientAuth, err := tlscert.ClientAuthType(cfg.ClientAuth)
+	if err != nil {
+		return nil, err
+	}
+	if clientAuth == tls.NoClientCert {
+		return tlsConfig, nil
+	}
 
-	prod, err := strconv.ParseBool(prodStr)
+	pool, err := tlscert.LoadCAPool(cfg.ClientCAFile)
 	if err != nil {
-		return nil, fmt.Errorf("parsing production bool: %w", err)
+		return nil, err
+	}
+	tlsConfig.ClientAuth = clientAuth
+	tlsConfig.ClientCAs = pool
+
+	return tlsConfig, nil
+}
+
+// rateLimits applies the configured overrides to the built in limits.
+func rateLimits(cfg config.RateLimitConfig) middleware.RateLimits {
+	def, routes := cfg.Limits()
+
+	limits := middleware.RateLimits{
+		Default: apihttp.DefaultRateLimits.Default,
+		Routes:  maps.Clone(apihttp.DefaultRateLimits.Routes),
+	}
+	if def != nil {
+		limits.Default = *def
+	}
+	maps.Copy(limits.Routes, routes)
+
+	return limits
+}
+
+// rootLogger logs at level, which can be changed while running.
+func rootLogger(prod bool, level zap.AtomicLevel) (*zap.Logger, error) {
+	zcfg := zap.NewDevelopmentConfig()
+	if prod {
+		zcfg = zap.NewProductionConfig()
 	}
+	zcfg.Level = level
 
-	port, err := strconv.Atoi(portStr)
+	l, err := zcfg.Build()
 	if err != nil {
-		return nil, fmt.Errorf("parsing port: %w", err)
+		return nil, fmt.Errorf("failed to init logger: %w", err)
+	}
+
+	return l, nil
+}
+
+func newPasswordPolicy(logger *zap.Logger, cfg config.PasswordConfig) (*passpolicy.Policy, error) {
+	rules := []passpolicy.Rule{
+		passpolicy.MinScore(cfg.MinScore),
+		passpolicy.ForbiddenWords("chucknorris"),
+		passpolicy.NoEmail(),
 	}
-	if port == 0 {
-		return nil, errors.New("port must be set")
+
+	if cfg.BreachedDir != "" {
+		list, err := passpolicy.OpenRangeDir(cfg.BreachedDir)
+		if err != nil {
+			return nil, err
+		}
+		logger.Info("checking passwords against breached password ranges", zap.String("dir", cfg.BreachedDir))
+		rules = append(rules, passpolicy.NotBreached(logger, list))
 	}
 
-	if dbURL == "" {
-		return nil, errors.New("database url must be set")
+	return passpolicy.New(rules...), nil
+}
+
+func newMailer(logger *zap.Logger, cfg config.MailConfig) (mailer.Mailer, error) {
+	switch cfg.Mailer {
+	case "", "log":
+		logger.Info("using log mailer, emails will not be sent")
+		return mailer.NewLog(logger), nil
+	case "smtp":
+		return mailer.NewSMTP(logger, cfg.SMTPHost, cfg.SMTPPort, cfg.SMTPUsername, cfg.SMTPPassword, cfg.From), nil
+	default:
+		return nil, fmt.Errorf("unknown mailer %q", cfg.Mailer)
 	}
+}
 
-	return &config{
-		Production: prod,
-		Port:       port,
-		DbURL:      dbURL,
-	}, nil
+func newRateLimitStore(logger *zap.Logger, cfg config.RateLimitConfig, db *sql.DB) (ratelimit.Store, error) {
+	switch cfg.Store {
+	case "", "memory":
+		logger.Info("using in-memory rate limits, they won't be shared between instances")
+		return ratelimit.NewMemory(), nil
+	case "postgres":
+		return ratelimit.NewPostgres(db), nil
+	default:
+		return nil, fmt.Errorf("unknown rate limit store %q", cfg.Store)
+	}
 }
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os/signal"
+	"strconv"
+	"syscall"
+
+	"github.com/davemolk/chuck/internal/config"
+	"github.com/davemolk/chuck/internal/migrations"
+	"github.com/davemolk/chuck/internal/sql"
+	"go.uber.org/zap"
+)
+
+const migrateUsage = `usage: chuck [flags] migrate <command>
+
+commands:
+  up        run every pending migration
+  down [N]  roll back the last N migrations, default 1
+  goto N    migrate up or down to version N
+  version   print the current version
+  force N   record version N without running anything, after fixing a
+            failed migration by hand, -1 for none`
+
+func runMigrate(cfg *config.Config, args []string) error {
+	if len(args) == 0 {
+		return errors.New(migrateUsage)
+	}
+
+	// ctrl-c gives up waiting for the lock, a migration already running is
+	// left to finish
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	logger, db, cleanup, err := commandDeps(cfg)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	m, err := migrations.NewMigrator(ctx, logger, db)
+	if err != nil {
+		return err
+	}
+	defer m.Close()
+
+	var report migrations.Report
+	switch cmd, n := args[0], args[1:]; {
+	case cmd == "up" && len(n) == 0:
+		report, err = m.Up()
+	case cmd == "down" && len(n) <= 1:
+		steps := 1
+		if len(n) == 1 {
+			if steps, err = strconv.Atoi(n[0]); err != nil {
+				return fmt.Errorf("invalid number of steps %q", n[0])
+			}
+		}
+		report, err = m.Down(steps)
+	case cmd == "goto" && len(n) == 1:
+		version, parseErr := strconv.ParseUint(n[0], 10, 32)
+		if parseErr != nil {
+			return fmt.Errorf("invalid version %q", n[0])
+		}
+		report, err = m.Goto(uint(version))
+	case cmd == "version" && len(n) == 0:
+		return printVersion(m)
+	case cmd == "force" && len(n) == 1:
+		version, parseErr := strconv.Atoi(n[0])
+		if parseErr != nil {
+			return fmt.Errorf("invalid version %q", n[0])
+		}
+		if err = m.Force(version); err != nil {
+			return err
+		}
+		fmt.Printf("forced version %d\n", version)
+		return nil
+	default:
+		return errors.New(migrateUsage)
+	}
+
+	// what got applied is worth showing even when a later migration failed
+	if len(report.Applied) > 0 || err == nil {
+		fmt.Println(report)
+	}
+	return err
+}
+
+func printVersion(m *migrations.Migrator) error {
+	version, dirty, err := m.Version()
+	if err != nil {
+		return err
+	}
+	latest, err := m.Latest()
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("version %d, latest %d", version, latest)
+	if dirty {
+		fmt.Print(", dirty")
+	}
+	fmt.Println()
+	return nil
+}
+
+// migrateUp runs pending migrations at startup. Every replica can do this,
+// they wait on each other and the later ones find nothing to do.
+func migrateUp(ctx context.Context, logger *zap.Logger, db *sql.DB) (migrations.Report, error) {
+	m, err := migrations.NewMigrator(ctx, logger, db)
+	if err != nil {
+		return migrations.Report{}, err
+	}
+	defer func() {
+		if err := m.Close(); err != nil {
+			logger.Error("failed to release migration lock", zap.Error(err))
+		}
+	}()
+
+	report, err := m.Up()
+	for _, applied := range report.Applied {
+		logger.Info("applied migration", zap.Uint("version", applied.Version), zap.String("name", applied.Name))
+	}
+	if err != nil {
+		return report, err
+	}
+
+	return report, nil
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/davemolk/chuck/internal/config"
+	"github.com/davemolk/chuck/internal/domain"
+	"github.com/davemolk/chuck/internal/seed"
+	"github.com/davemolk/chuck/internal/service/joke"
+	"github.com/davemolk/chuck/internal/store"
+)
+
+func seedUsage() string {
+	return `usage: chuck [flags] seed [--dry-run] <dataset or file>...
+
+loads jokes, adding new ones and updating ones whose url or content changed.
+a dataset is one of ` + strings.Join(seed.Datasets(), ", ") + `, or a .json, .ndjson, .jsonl
+or .csv file. with more than one, later ones win.
+
+  --dry-run  print what would change without changing it`
+}
+
+func runSeed(cfg *config.Config, args []string) error {
+	fs := flag.NewFlagSet("seed", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	dryRun := fs.Bool("dry-run", false, "")
+	if err := fs.Parse(args); err != nil || fs.NArg() == 0 {
+		return errors.New(seedUsage())
+	}
+
+	jokes, err := openDatasets(fs.Args())
+	if err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	logger, db, cleanup, err := commandDeps(cfg)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	// lets a fresh database be seeded in one go
+	if cfg.DB.MigrateOnStart {
+		if _, err = migrateUp(ctx, logger, db); err != nil {
+			return err
+		}
+	}
+
+	jokeService := joke.NewService(logger, store.New(db), nil, nil)
+
+	diff, err := seed.Plan(ctx, jokeService, jokes)
+	if err != nil {
+		return fmt.Errorf("failed to compare with the database: %w", err)
+	}
+	fmt.Println(diff)
+
+	if *dryRun || len(diff.Add)+len(diff.Change) == 0 {
+		return nil
+	}
+
+	if err = seed.Apply(ctx, jokeService, diff); err != nil {
+		return err
+	}
+	fmt.Println("seeded")
+
+	return nil
+}
+
+// openDatasets loads each dataset in turn. A joke in more than one keeps its
+// position from the first and its contents from the last.
+func openDatasets(names []string) ([]*domain.Joke, error) {
+	var jokes []*domain.Joke
+	index := make(map[string]int)
+
+	for _, name := range names {
+		loaded, err := seed.Open(name)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, j := range loaded {
+			if i, ok := index[j.ExternalID]; ok {
+				jokes[i] = j
+				continue
+			}
+			index[j.ExternalID] = len(jokes)
+			jokes = append(jokes, j)
+		}
+	}
+
+	return jokes, nil
+}
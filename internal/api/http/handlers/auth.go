@@ -1,8 +1,11 @@
 package handlers
 
 import (
+	"errors"
 	"net/http"
 
+	"github.com/davemolk/chuck/internal/api/http/middleware"
+	"github.com/davemolk/chuck/internal/domain"
 	"github.com/davemolk/chuck/internal/service"
 	"go.uber.org/zap"
 )
@@ -40,9 +43,20 @@ func (h *AuthHandlers) Login(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	token, err := h.authService.Login(r.Context(), req.Email, req.Password)
+	token, err := h.authService.Login(r.Context(), req.Email, req.Password, middleware.ClientIPFromCtx(r.Context()))
 	if err != nil {
-		respondError(w, r, h.logger, errToStatusCode(err), err)
+		respondAuthError(w, r, h.logger, err)
+		return
+	}
+
+	if token.Scope == domain.ScopeMFA {
+		data := map[string]any{
+			"mfa_required": true,
+			"challenge":    token.Plaintext,
+			"expires_at":   token.ExpiresAt,
+		}
+
+		respondJSON(w, http.StatusOK, data)
 		return
 	}
 
@@ -53,3 +67,139 @@ func (h *AuthHandlers) Login(w http.ResponseWriter, r *http.Request) {
 
 	respondJSON(w, http.StatusOK, data)
 }
+
+func (h *AuthHandlers) VerifyMFA(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Challenge string `json:"challenge"`
+		Code      string `json:"code"`
+	}
+
+	if err := readJSON(w, r, &req); err != nil {
+		respondError(w, r, h.logger, http.StatusBadRequest, err)
+		return
+	}
+
+	if req.Challenge == "" {
+		respondError(w, r, h.logger, http.StatusBadRequest, errors.New("challenge is required"))
+		return
+	}
+
+	if err := validateMFACode(req.Code); err != nil {
+		respondError(w, r, h.logger, http.StatusBadRequest, err)
+		return
+	}
+
+	token, err := h.authService.VerifyMFA(r.Context(), req.Challenge, req.Code, middleware.ClientIPFromCtx(r.Context()))
+	if err != nil {
+		respondAuthError(w, r, h.logger, err)
+		return
+	}
+
+	data := map[string]any{
+		"token":      token.Plaintext,
+		"expires_at": token.ExpiresAt,
+	}
+
+	respondJSON(w, http.StatusOK, data)
+}
+
+func (h *AuthHandlers) ChangePassword(w http.ResponseWriter, r *http.Request) {
+	user, err := middleware.UserFromCtx(r.Context())
+	if err != nil {
+		respondError(w, r, h.logger, http.StatusUnauthorized, err)
+		return
+	}
+
+	var req struct {
+		OldPassword string `json:"old_password"`
+		NewPassword string `json:"new_password"`
+	}
+
+	if err := readJSON(w, r, &req); err != nil {
+		respondError(w, r, h.logger, http.StatusBadRequest, err)
+		return
+	}
+
+	if req.OldPassword == "" {
+		respondError(w, r, h.logger, http.StatusBadRequest, errors.New("old password is required"))
+		return
+	}
+
+	if err := validatePassword(req.NewPassword); err != nil {
+		respondError(w, r, h.logger, http.StatusBadRequest, err)
+		return
+	}
+
+	err = h.authService.ChangePassword(r.Context(), user.ID, req.OldPassword, req.NewPassword, middleware.TokenFromCtx(r.Context()))
+	if err != nil {
+		respondAuthError(w, r, h.logger, err)
+		return
+	}
+
+	data := map[string]any{
+		"message": "password updated, other sessions have been signed out",
+	}
+
+	respondJSON(w, http.StatusOK, data)
+}
+
+func (h *AuthHandlers) RequestPasswordReset(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Email string `json:"email"`
+	}
+
+	if err := readJSON(w, r, &req); err != nil {
+		respondError(w, r, h.logger, http.StatusBadRequest, err)
+		return
+	}
+
+	if err := validateEmail(req.Email); err != nil {
+		respondError(w, r, h.logger, http.StatusBadRequest, err)
+		return
+	}
+
+	if err := h.authService.RequestPasswordReset(r.Context(), req.Email); err != nil {
+		respondError(w, r, h.logger, errToStatusCode(err), err)
+		return
+	}
+
+	// same response whether or not the account exists
+	data := map[string]any{
+		"message": "if an account exists for that email, a reset token has been sent",
+	}
+
+	respondJSON(w, http.StatusAccepted, data)
+}
+
+func (h *AuthHandlers) ResetPassword(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Token    string `json:"token"`
+		Password string `json:"password"`
+	}
+
+	if err := readJSON(w, r, &req); err != nil {
+		respondError(w, r, h.logger, http.StatusBadRequest, err)
+		return
+	}
+
+	if req.Token == "" {
+		respondError(w, r, h.logger, http.StatusBadRequest, errors.New("token is required"))
+		return
+	}
+
+	if err := validatePassword(req.Password); err != nil {
+		respondError(w, r, h.logger, http.StatusBadRequest, err)
+		return
+	}
+
+	if err := h.authService.ResetPassword(r.Context(), req.Token, req.Password); err != nil {
+		respondError(w, r, h.logger, errToStatusCode(err), err)
+		return
+	}
+
+	data := map[string]any{
+		"message": "password updated, please log in again",
+	}
+
+	respondJSON(w, http.StatusOK, data)
+}
@@ -7,9 +7,12 @@ import (
 	"net/http/httptest"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/davemolk/chuck/internal/api/http/middleware"
 	"github.com/davemolk/chuck/internal/domain"
 	"github.com/davemolk/chuck/internal/service/auth"
+	"github.com/davemolk/chuck/internal/service/token"
 	"github.com/davemolk/chuck/internal/tests/fixture"
 	"github.com/davemolk/chuck/internal/tests/mock"
 	"github.com/stretchr/testify/require"
@@ -20,7 +23,7 @@ func TestLogin(t *testing.T) {
 	var gotEmail, gotPW string
 
 	authService := &mock.AuthService{
-		LoginFn: func(ctx context.Context, email, password string) (*domain.Token, error) {
+		LoginFn: func(ctx context.Context, email, password, ip string) (*domain.Token, error) {
 			return nil, auth.ErrInvalidCredentials
 		},
 	}
@@ -64,7 +67,7 @@ func TestLogin(t *testing.T) {
 		email := "walker@ranger"
 		pw := "roundhouse"
 		authService := &mock.AuthService{
-			LoginFn: func(ctx context.Context, email, password string) (*domain.Token, error) {
+			LoginFn: func(ctx context.Context, email, password, ip string) (*domain.Token, error) {
 				gotCtx = ctx
 				gotEmail = email
 				gotPW = pw
@@ -96,3 +99,290 @@ func TestLogin(t *testing.T) {
 		require.Equal(t, "blah", got["token"])
 	})
 }
+
+func TestLoginMFARequired(t *testing.T) {
+	authService := &mock.AuthService{
+		LoginFn: func(ctx context.Context, email, password, ip string) (*domain.Token, error) {
+			return &domain.Token{
+				Plaintext: "challenge",
+				Scope:     domain.ScopeMFA,
+			}, nil
+		},
+	}
+	h := NewAuthHandlers(fixture.TestLogger(t), authService)
+
+	body := strings.NewReader(`{"email":"walker@ranger", "password":"roundhouse"}`)
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/api/v1/auth/login", body)
+
+	h.Login(w, r)
+
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var got map[string]any
+	err := json.NewDecoder(w.Body).Decode(&got)
+	require.NoError(t, err)
+
+	require.Equal(t, true, got["mfa_required"])
+	require.Equal(t, "challenge", got["challenge"])
+	require.NotContains(t, got, "token")
+}
+
+func TestVerifyMFA(t *testing.T) {
+	authService := &mock.AuthService{
+		VerifyMFAFn: func(ctx context.Context, challenge, code, ip string) (*domain.Token, error) {
+			return nil, auth.ErrInvalidCredentials
+		},
+	}
+	h := NewAuthHandlers(fixture.TestLogger(t), authService)
+
+	t.Run("challenge required", func(t *testing.T) {
+		body := strings.NewReader(`{"code":"123456"}`)
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/api/v1/auth/login/mfa", body)
+
+		h.VerifyMFA(w, r)
+
+		require.False(t, authService.VerifyMFACalled)
+		require.Equal(t, http.StatusBadRequest, w.Code)
+	})
+
+	t.Run("code required", func(t *testing.T) {
+		body := strings.NewReader(`{"challenge":"blah"}`)
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/api/v1/auth/login/mfa", body)
+
+		h.VerifyMFA(w, r)
+
+		require.False(t, authService.VerifyMFACalled)
+		require.Equal(t, http.StatusBadRequest, w.Code)
+	})
+
+	t.Run("handle service error", func(t *testing.T) {
+		body := strings.NewReader(`{"challenge":"blah", "code":"123456"}`)
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/api/v1/auth/login/mfa", body)
+
+		h.VerifyMFA(w, r)
+
+		require.True(t, authService.VerifyMFACalled)
+		require.Equal(t, http.StatusUnauthorized, w.Code)
+		authService.ResetCalls()
+	})
+
+	t.Run("success", func(t *testing.T) {
+		var gotChallenge, gotCode string
+		authService := &mock.AuthService{
+			VerifyMFAFn: func(ctx context.Context, challenge, code, ip string) (*domain.Token, error) {
+				gotChallenge = challenge
+				gotCode = code
+				return &domain.Token{
+					Plaintext: "blah",
+					Scope:     domain.ScopeAuthentication,
+				}, nil
+			},
+		}
+		h.authService = authService
+
+		body := strings.NewReader(`{"challenge":"challenge", "code":"123456"}`)
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/api/v1/auth/login/mfa", body)
+
+		h.VerifyMFA(w, r)
+
+		require.Equal(t, http.StatusOK, w.Code)
+		require.Equal(t, "challenge", gotChallenge)
+		require.Equal(t, "123456", gotCode)
+
+		var got map[string]any
+		err := json.NewDecoder(w.Body).Decode(&got)
+		require.NoError(t, err)
+
+		require.Equal(t, "blah", got["token"])
+	})
+}
+
+func TestLoginThrottled(t *testing.T) {
+	var gotIP string
+	authService := &mock.AuthService{
+		LoginFn: func(ctx context.Context, email, password, ip string) (*domain.Token, error) {
+			gotIP = ip
+			return nil, &auth.ThrottledError{RetryAfter: 1500 * time.Millisecond}
+		},
+	}
+	h := NewAuthHandlers(fixture.TestLogger(t), authService)
+
+	body := strings.NewReader(`{"email":"walker@ranger", "password":"roundhouse"}`)
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/api/v1/auth/login", body)
+	r = r.WithContext(middleware.ClientIPToCtx(r.Context(), "10.0.0.1"))
+
+	h.Login(w, r)
+
+	require.Equal(t, "10.0.0.1", gotIP)
+	require.Equal(t, http.StatusTooManyRequests, w.Code)
+	require.Equal(t, "2", w.Header().Get("Retry-After"))
+}
+
+func TestChangePassword(t *testing.T) {
+	user := &domain.User{ID: 1, Email: "walker@ranger"}
+	authService := &mock.AuthService{
+		ChangePasswordFn: func(ctx context.Context, userID int64, oldPassword, newPassword, currentToken string) error {
+			return auth.ErrInvalidCredentials
+		},
+	}
+	h := NewAuthHandlers(fixture.TestLogger(t), authService)
+
+	newRequest := func(body string) *http.Request {
+		r := httptest.NewRequest("PUT", "/api/v1/me/password", strings.NewReader(body))
+		ctx := middleware.UserToCtx(r.Context(), user)
+		ctx = middleware.TokenToCtx(ctx, "current")
+		return r.WithContext(ctx)
+	}
+
+	t.Run("old password required", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		h.ChangePassword(w, newRequest(`{"new_password":"roundhouse"}`))
+
+		require.False(t, authService.ChangePasswordCalled)
+		require.Equal(t, http.StatusBadRequest, w.Code)
+	})
+
+	t.Run("new password validated", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		h.ChangePassword(w, newRequest(`{"old_password":"roundhouse", "new_password":"short"}`))
+
+		require.False(t, authService.ChangePasswordCalled)
+		require.Equal(t, http.StatusBadRequest, w.Code)
+	})
+
+	t.Run("handle service error", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		h.ChangePassword(w, newRequest(`{"old_password":"roundhouse", "new_password":"roundhouse2"}`))
+
+		require.True(t, authService.ChangePasswordCalled)
+		require.Equal(t, http.StatusUnauthorized, w.Code)
+		authService.ResetCalls()
+	})
+
+	t.Run("success", func(t *testing.T) {
+		var gotID int64
+		var gotOld, gotNew, gotToken string
+		authService := &mock.AuthService{
+			ChangePasswordFn: func(ctx context.Context, userID int64, oldPassword, newPassword, currentToken string) error {
+				gotID = userID
+				gotOld = oldPassword
+				gotNew = newPassword
+				gotToken = currentToken
+				return nil
+			},
+		}
+		h.authService = authService
+
+		w := httptest.NewRecorder()
+		h.ChangePassword(w, newRequest(`{"old_password":"roundhouse", "new_password":"roundhouse2"}`))
+
+		require.Equal(t, http.StatusOK, w.Code)
+		require.Equal(t, user.ID, gotID)
+		require.Equal(t, "roundhouse", gotOld)
+		require.Equal(t, "roundhouse2", gotNew)
+		require.Equal(t, "current", gotToken)
+	})
+}
+
+func TestRequestPasswordReset(t *testing.T) {
+	var gotEmail string
+	authService := &mock.AuthService{
+		RequestPasswordResetFn: func(ctx context.Context, email string) error {
+			gotEmail = email
+			return nil
+		},
+	}
+	h := NewAuthHandlers(fixture.TestLogger(t), authService)
+
+	t.Run("email required", func(t *testing.T) {
+		body := strings.NewReader(`{}`)
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/api/v1/auth/password-reset", body)
+
+		h.RequestPasswordReset(w, r)
+
+		require.False(t, authService.RequestPasswordResetCalled)
+		require.Equal(t, http.StatusBadRequest, w.Code)
+	})
+
+	t.Run("success", func(t *testing.T) {
+		body := strings.NewReader(`{"email":"walker@ranger"}`)
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/api/v1/auth/password-reset", body)
+
+		h.RequestPasswordReset(w, r)
+
+		require.True(t, authService.RequestPasswordResetCalled)
+		require.Equal(t, http.StatusAccepted, w.Code)
+		require.Equal(t, "walker@ranger", gotEmail)
+	})
+}
+
+func TestResetPassword(t *testing.T) {
+	authService := &mock.AuthService{
+		ResetPasswordFn: func(ctx context.Context, tokenStr, password string) error {
+			return token.ErrInvalidToken
+		},
+	}
+	h := NewAuthHandlers(fixture.TestLogger(t), authService)
+
+	t.Run("token required", func(t *testing.T) {
+		body := strings.NewReader(`{"password":"roundhouse"}`)
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/api/v1/auth/password-reset/confirm", body)
+
+		h.ResetPassword(w, r)
+
+		require.False(t, authService.ResetPasswordCalled)
+		require.Equal(t, http.StatusBadRequest, w.Code)
+	})
+
+	t.Run("pw required", func(t *testing.T) {
+		body := strings.NewReader(`{"token":"blah"}`)
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/api/v1/auth/password-reset/confirm", body)
+
+		h.ResetPassword(w, r)
+
+		require.False(t, authService.ResetPasswordCalled)
+		require.Equal(t, http.StatusBadRequest, w.Code)
+	})
+
+	t.Run("handle service error", func(t *testing.T) {
+		body := strings.NewReader(`{"token":"blah", "password":"roundhouse"}`)
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/api/v1/auth/password-reset/confirm", body)
+
+		h.ResetPassword(w, r)
+
+		require.True(t, authService.ResetPasswordCalled)
+		require.Equal(t, http.StatusUnauthorized, w.Code)
+	})
+
+	t.Run("success", func(t *testing.T) {
+		var gotToken, gotPW string
+		h.authService = &mock.AuthService{
+			ResetPasswordFn: func(ctx context.Context, tokenStr, password string) error {
+				gotToken = tokenStr
+				gotPW = password
+				return nil
+			},
+		}
+
+		body := strings.NewReader(`{"token":"blah", "password":"roundhouse"}`)
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/api/v1/auth/password-reset/confirm", body)
+
+		h.ResetPassword(w, r)
+
+		require.Equal(t, http.StatusOK, w.Code)
+		require.Equal(t, "blah", gotToken)
+		require.Equal(t, "roundhouse", gotPW)
+	})
+}
@@ -1,13 +1,42 @@
 package handlers
 
-import "net/http"
+import (
+	"context"
+	"net/http"
 
-type HealthHandlers struct{}
+	"github.com/davemolk/chuck/internal/health"
+)
 
-func NewHealthHandlers() *HealthHandlers {
-	return &HealthHandlers{}
+type readinessChecker interface {
+	Ready(ctx context.Context) (health.Report, bool)
 }
 
-func (h *HealthHandlers) HealthCheck(w http.ResponseWriter, r *http.Request) {
-	_, _ = w.Write([]byte("i'm healthy!"))
+type HealthHandlers struct {
+	checker readinessChecker
+}
+
+func NewHealthHandlers(checker readinessChecker) *HealthHandlers {
+	return &HealthHandlers{
+		checker: checker,
+	}
+}
+
+// Livez reports the process is up and serving. It deliberately doesn't check
+// any dependencies, a restart won't fix a database outage.
+func (h *HealthHandlers) Livez(w http.ResponseWriter, r *http.Request) {
+	respondJSON(w, http.StatusOK, map[string]string{"status": health.StatusOK})
+}
+
+// Readyz reports whether the service should get traffic, with the status
+// and latency of each dependency. It fails with a 503 when a required
+// dependency is down or the server is draining for shutdown.
+func (h *HealthHandlers) Readyz(w http.ResponseWriter, r *http.Request) {
+	report, ready := h.checker.Ready(r.Context())
+
+	status := http.StatusOK
+	if !ready {
+		status = http.StatusServiceUnavailable
+	}
+
+	respondJSON(w, status, report)
 }
@@ -0,0 +1,71 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/davemolk/chuck/internal/health"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadyz(t *testing.T) {
+	var dbErr error
+	checker := health.NewChecker(time.Second,
+		health.Check{Name: "db", Run: func(ctx context.Context) (any, error) { return nil, dbErr }},
+		health.Check{Name: "upstream", Informational: true, Run: func(ctx context.Context) (any, error) {
+			return nil, errors.New("chuck is busy")
+		}},
+	)
+	h := NewHealthHandlers(checker)
+
+	get := func() (int, health.Report) {
+		w := httptest.NewRecorder()
+		h.Readyz(w, httptest.NewRequest("GET", "/readyz", nil))
+
+		var report health.Report
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&report))
+		return w.Code, report
+	}
+
+	t.Run("informational checks don't count", func(t *testing.T) {
+		code, report := get()
+		require.Equal(t, http.StatusOK, code)
+		require.Equal(t, health.StatusOK, report.Status)
+		require.Equal(t, health.StatusFailing, report.Checks["upstream"].Status)
+		require.Equal(t, "chuck is busy", report.Checks["upstream"].Error)
+	})
+
+	t.Run("required check failing", func(t *testing.T) {
+		dbErr = errors.New("connection refused")
+		defer func() { dbErr = nil }()
+
+		code, report := get()
+		require.Equal(t, http.StatusServiceUnavailable, code)
+		require.Equal(t, health.StatusFailing, report.Status)
+		require.Equal(t, health.StatusFailing, report.Checks["db"].Status)
+	})
+
+	t.Run("draining", func(t *testing.T) {
+		checker.Drain()
+
+		code, report := get()
+		require.Equal(t, http.StatusServiceUnavailable, code)
+		require.Equal(t, health.StatusDraining, report.Status)
+		require.Equal(t, health.StatusOK, report.Checks["db"].Status)
+	})
+}
+
+func TestLivez(t *testing.T) {
+	checker := health.NewChecker(time.Second)
+	checker.Drain()
+	h := NewHealthHandlers(checker)
+
+	w := httptest.NewRecorder()
+	h.Livez(w, httptest.NewRequest("GET", "/livez", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+}
@@ -2,13 +2,21 @@ package handlers
 
 import (
 	"encoding/json"
+	"errors"
+	"math"
 	"net/http"
+	"strconv"
+	"time"
 
 	"github.com/davemolk/chuck/internal/domain"
+	"github.com/davemolk/chuck/internal/passpolicy"
 	"github.com/davemolk/chuck/internal/service/auth"
 	"github.com/davemolk/chuck/internal/service/joke"
+	"github.com/davemolk/chuck/internal/service/mfa"
 	"github.com/davemolk/chuck/internal/service/token"
+	"github.com/davemolk/chuck/internal/service/usage"
 	"github.com/davemolk/chuck/internal/service/user"
+	"github.com/davemolk/chuck/internal/tracing"
 
 	"github.com/davemolk/chuck/internal/api/http/middleware"
 	"go.uber.org/zap"
@@ -40,19 +48,68 @@ type errResponse struct {
 	Error      string
 	RequestID  string
 	StatusCode int
+	// Code is a stable identifier for errors clients act on, e.g.
+	// middleware.ErrCodeEmailUnverified.
+	Code string `json:",omitempty"`
+	// Reasons explains a rejected password, one entry per failed rule.
+	Reasons []passpolicy.Reason `json:",omitempty"`
+	// ResetAt is when a used up quota starts over.
+	ResetAt *time.Time `json:",omitempty"`
 }
 
 func respondError(w http.ResponseWriter, r *http.Request, logger *zap.Logger, status int, err error) {
 	requestID := middleware.RequestIDFromCtx(r.Context())
-	logger.Error("request error", zap.Int("status", status), zap.String("request_id", requestID), zap.Error(err))
-	respondJSON(w, status, errResponse{
+	logger.With(tracing.LogFields(r.Context())...).Error("request error", zap.Int("status", status), zap.String("request_id", requestID), zap.Error(err))
+
+	resp := errResponse{
 		Error:      err.Error(),
 		RequestID:  requestID,
 		StatusCode: status,
-	})
+	}
+
+	var policyErr *passpolicy.Error
+	if errors.As(err, &policyErr) {
+		resp.Error = "password rejected"
+		resp.Reasons = policyErr.Reasons
+	}
+
+	var quotaErr *usage.QuotaExceededError
+	if errors.As(err, &quotaErr) {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(time.Until(quotaErr.ResetAt).Seconds()))))
+		resp.ResetAt = &quotaErr.ResetAt
+	}
+
+	respondJSON(w, status, resp)
+}
+
+// respondAuthError handles throttled requests, which need a Retry-After header,
+// before falling back to the usual error response.
+func respondAuthError(w http.ResponseWriter, r *http.Request, logger *zap.Logger, err error) {
+	var throttled *auth.ThrottledError
+	if errors.As(err, &throttled) {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(throttled.RetryAfter.Seconds()))))
+		respondError(w, r, logger, http.StatusTooManyRequests, err)
+		return
+	}
+
+	respondError(w, r, logger, errToStatusCode(err), err)
 }
 
 func errToStatusCode(err error) int {
+	var policyErr *passpolicy.Error
+	if errors.As(err, &policyErr) {
+		return http.StatusBadRequest
+	}
+
+	var quotaErr *usage.QuotaExceededError
+	if errors.As(err, &quotaErr) {
+		return http.StatusTooManyRequests
+	}
+
+	if errors.Is(err, joke.ErrBadImport) {
+		return http.StatusBadRequest
+	}
+
 	switch err {
 	case domain.ErrNotFound:
 		return http.StatusNotFound
@@ -62,8 +119,14 @@ func errToStatusCode(err error) int {
 		return http.StatusUnauthorized
 	case token.ErrInvalidToken:
 		return http.StatusUnauthorized
-	case user.ErrDuplicateEmail:
+	case user.ErrDuplicateEmail, user.ErrAlreadyVerified:
+		return http.StatusBadRequest
+	case user.ErrResendRateLimited:
+		return http.StatusTooManyRequests
+	case mfa.ErrInvalidCode, mfa.ErrNotEnrolled:
 		return http.StatusBadRequest
+	case mfa.ErrAlreadyEnrolled:
+		return http.StatusConflict
 	default:
 		return http.StatusInternalServerError
 	}
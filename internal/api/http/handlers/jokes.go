@@ -1,24 +1,50 @@
 package handlers
 
 import (
+	"fmt"
+	"io"
+	"mime"
 	"net/http"
+	"time"
 
+	"github.com/davemolk/chuck/internal/api/http/middleware"
+	"github.com/davemolk/chuck/internal/domain"
+	"github.com/davemolk/chuck/internal/jokeio"
 	"github.com/davemolk/chuck/internal/service"
 	"go.uber.org/zap"
 )
 
 type JokeHandlers struct {
-	logger      *zap.Logger
-	jokeService service.JokeService
+	logger       *zap.Logger
+	jokeService  service.JokeService
+	usageService service.UsageService
 }
 
-func NewJokeHandlers(logger *zap.Logger, jokeService service.JokeService) *JokeHandlers {
+func NewJokeHandlers(logger *zap.Logger, jokeService service.JokeService, usageService service.UsageService) *JokeHandlers {
 	return &JokeHandlers{
-		logger:      logger,
-		jokeService: jokeService,
+		logger:       logger,
+		jokeService:  jokeService,
+		usageService: usageService,
 	}
 }
 
+// recordUsage meters the request against the logged in user, if there is
+// one, and reports whether the request can go ahead. Anonymous requests
+// aren't metered, the rate limits cover those.
+func (h *JokeHandlers) recordUsage(w http.ResponseWriter, r *http.Request, event string) bool {
+	user, err := middleware.UserFromCtx(r.Context())
+	if err != nil {
+		return true
+	}
+
+	if err = h.usageService.Record(r.Context(), user, event); err != nil {
+		respondError(w, r, h.logger, errToStatusCode(err), err)
+		return false
+	}
+
+	return true
+}
+
 func (h *JokeHandlers) GetPersonalizedJoke(w http.ResponseWriter, r *http.Request) {
 	name := r.URL.Query().Get("name")
 
@@ -27,6 +53,10 @@ func (h *JokeHandlers) GetPersonalizedJoke(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
+	if !h.recordUsage(w, r, domain.EventPersonalizedJoke) {
+		return
+	}
+
 	joke, err := h.jokeService.GetPersonalizedJoke(r.Context(), name)
 	if err != nil {
 		respondError(w, r, h.logger, errToStatusCode(err), err)
@@ -45,6 +75,10 @@ func (h *JokeHandlers) GetPersonalizedJoke(w http.ResponseWriter, r *http.Reques
 }
 
 func (h *JokeHandlers) GetRandomJoke(w http.ResponseWriter, r *http.Request) {
+	if !h.recordUsage(w, r, domain.EventRandomJoke) {
+		return
+	}
+
 	joke, err := h.jokeService.GetRandomJoke(r.Context())
 	if err != nil {
 		respondError(w, r, h.logger, errToStatusCode(err), err)
@@ -70,7 +104,11 @@ func (h *JokeHandlers) GetRandomJokeByQuery(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
-	joke, err := h.jokeService.GetRandomJokeByQuery(r.Context(), query)
+	// metered by the joke service, since only searches that go to the
+	// chuck norris api count
+	user, _ := middleware.UserFromCtx(r.Context())
+
+	joke, err := h.jokeService.GetRandomJokeByQuery(r.Context(), user, query)
 	if err != nil {
 		respondError(w, r, h.logger, errToStatusCode(err), err)
 		return
@@ -86,3 +124,99 @@ func (h *JokeHandlers) GetRandomJokeByQuery(w http.ResponseWriter, r *http.Reque
 
 	respondJSON(w, http.StatusOK, data)
 }
+
+// ExportJokes streams every joke as ndjson, the default, or csv, e.g. to
+// import somewhere else.
+func (h *JokeHandlers) ExportJokes(w http.ResponseWriter, r *http.Request) {
+	format := jokeio.FormatNDJSON
+	if v := r.URL.Query().Get("format"); v != "" {
+		var err error
+		if format, err = jokeio.ParseFormat(v); err != nil {
+			respondError(w, r, h.logger, http.StatusBadRequest, err)
+			return
+		}
+	}
+
+	// a big export can outlast the server's write timeout
+	_ = http.NewResponseController(w).SetWriteDeadline(time.Time{})
+
+	out := &startedWriter{w: w}
+	jw, err := jokeio.NewWriter(out, format)
+	if err != nil {
+		respondError(w, r, h.logger, http.StatusBadRequest, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", format.ContentType())
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="jokes.%s"`, format))
+
+	if err = h.jokeService.ExportJokes(r.Context(), jw); err != nil {
+		if !out.started {
+			w.Header().Del("Content-Disposition")
+			respondError(w, r, h.logger, errToStatusCode(err), err)
+			return
+		}
+
+		// too late for an error response, cut the connection so the client
+		// can tell the export is incomplete
+		h.logger.Error("joke export failed partway", zap.Int("written", jw.Count()), zap.Error(err))
+		panic(http.ErrAbortHandler)
+	}
+}
+
+// ImportJokes upserts jokes from the request body, in the format given by
+// the format param or else the content type, ndjson by default. Bad jokes
+// are skipped and listed in the response.
+func (h *JokeHandlers) ImportJokes(w http.ResponseWriter, r *http.Request) {
+	format, err := importFormat(r)
+	if err != nil {
+		respondError(w, r, h.logger, http.StatusBadRequest, err)
+		return
+	}
+
+	// the body isn't size limited, it's admin only and streamed, but a big
+	// upload can outlast the server's read timeout
+	_ = http.NewResponseController(w).SetReadDeadline(time.Time{})
+
+	jr, err := jokeio.NewReader(r.Body, format)
+	if err != nil {
+		respondError(w, r, h.logger, http.StatusBadRequest, err)
+		return
+	}
+
+	report, err := h.jokeService.ImportJokes(r.Context(), jr)
+	if err != nil {
+		respondError(w, r, h.logger, errToStatusCode(err), err)
+		return
+	}
+
+	respondJSON(w, http.StatusOK, report)
+}
+
+func importFormat(r *http.Request) (jokeio.Format, error) {
+	if v := r.URL.Query().Get("format"); v != "" {
+		return jokeio.ParseFormat(v)
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch mediaType {
+	case "text/csv":
+		return jokeio.FormatCSV, nil
+	case "application/json":
+		return jokeio.FormatJSON, nil
+	default:
+		return jokeio.FormatNDJSON, nil
+	}
+}
+
+// startedWriter notes whether anything has been written, after which the
+// status can't change.
+type startedWriter struct {
+	w       io.Writer
+	started bool
+}
+
+func (sw *startedWriter) Write(b []byte) (int, error) {
+	sw.started = true
+	return sw.w.Write(b)
+}
@@ -5,11 +5,19 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/davemolk/chuck/internal/api/http/middleware"
 	"github.com/davemolk/chuck/internal/domain"
+	"github.com/davemolk/chuck/internal/jokeio"
+	"github.com/davemolk/chuck/internal/service/joke"
+	"github.com/davemolk/chuck/internal/service/usage"
+	"github.com/davemolk/chuck/internal/store"
 	"github.com/davemolk/chuck/internal/tests/fixture"
 	"github.com/davemolk/chuck/internal/tests/mock"
 	"github.com/stretchr/testify/require"
@@ -24,7 +32,7 @@ func TestGetRandomJoke(t *testing.T) {
 		},
 	}
 
-	h := NewJokeHandlers(fixture.TestLogger(t), jokeService)
+	h := NewJokeHandlers(fixture.TestLogger(t), jokeService, &mock.UsageService{})
 	t.Run("handle service error", func(t *testing.T) {
 		w := httptest.NewRecorder()
 		r := httptest.NewRequest("GET", "/api/v1/jokes/random", nil)
@@ -68,13 +76,13 @@ func TestGetRandomJokeByQuery(t *testing.T) {
 	var gotQuery string
 	query := "beard"
 	jokeService := &mock.JokeService{
-		GetRandomJokeByQueryFn: func(ctx context.Context, query string) (*domain.Joke, error) {
+		GetRandomJokeByQueryFn: func(ctx context.Context, user *domain.User, query string) (*domain.Joke, error) {
 			gotCtx = ctx
 			gotQuery = query
 			return nil, errors.New("blah")
 		},
 	}
-	h := NewJokeHandlers(fixture.TestLogger(t), jokeService)
+	h := NewJokeHandlers(fixture.TestLogger(t), jokeService, &mock.UsageService{})
 
 	t.Run("query required", func(t *testing.T) {
 		w := httptest.NewRecorder()
@@ -99,7 +107,7 @@ func TestGetRandomJokeByQuery(t *testing.T) {
 
 	t.Run("success", func(t *testing.T) {
 		jokeService = &mock.JokeService{
-			GetRandomJokeByQueryFn: func(ctx context.Context, query string) (*domain.Joke, error) {
+			GetRandomJokeByQueryFn: func(ctx context.Context, user *domain.User, query string) (*domain.Joke, error) {
 				gotCtx = ctx
 				gotQuery = query
 				return &domain.Joke{
@@ -139,7 +147,7 @@ func TestGetPersonalizedJoke(t *testing.T) {
 			return nil, errors.New("blah")
 		},
 	}
-	h := NewJokeHandlers(fixture.TestLogger(t), jokeService)
+	h := NewJokeHandlers(fixture.TestLogger(t), jokeService, &mock.UsageService{})
 
 	t.Run("name required", func(t *testing.T) {
 		w := httptest.NewRecorder()
@@ -192,3 +200,243 @@ func TestGetPersonalizedJoke(t *testing.T) {
 		require.Equal(t, name, got["joke"])
 	})
 }
+
+func TestJokeUsage(t *testing.T) {
+	user := &domain.User{ID: 1, Plan: "free"}
+
+	// counts searches the way the usage service does, less the database
+	count := 0
+	limit := 2
+	usageService := &mock.UsageService{
+		RecordFn: func(ctx context.Context, user *domain.User, event string) error {
+			require.Equal(t, domain.EventSearch, event)
+			if count >= limit {
+				return &usage.QuotaExceededError{Event: event, Limit: limit, ResetAt: time.Now().Add(time.Hour).UTC().Truncate(time.Second)}
+			}
+			count++
+			return nil
+		},
+		RefundFn: func(ctx context.Context, user *domain.User, event string) error {
+			count--
+			return nil
+		},
+	}
+
+	client := &mock.ChuckClient{}
+	jokeService := joke.NewService(fixture.TestLogger(t), store.NewMemory(), client, usageService)
+	require.NoError(t, jokeService.SaveJokes(context.Background(), []*domain.Joke{
+		{ExternalID: "a", URL: "https://example.com/a", Content: "Chuck Norris grew a beard in a day.", CreatedAt: time.Now()},
+	}))
+	h := NewJokeHandlers(fixture.TestLogger(t), jokeService, usageService)
+
+	search := func(t *testing.T, query string, loggedIn bool) *httptest.ResponseRecorder {
+		t.Helper()
+		r := httptest.NewRequest("GET", "/api/v1/jokes/search?query="+query, nil)
+		if loggedIn {
+			r = r.WithContext(middleware.UserToCtx(r.Context(), user))
+		}
+		w := httptest.NewRecorder()
+		h.GetRandomJokeByQuery(w, r)
+		return w
+	}
+
+	found := func(ctx context.Context, query string, limit int) ([]*domain.Joke, error) {
+		return []*domain.Joke{{ExternalID: query, URL: "https://example.com/" + query, Content: "Chuck Norris found " + query, CreatedAt: time.Now()}}, nil
+	}
+
+	t.Run("cached searches aren't metered", func(t *testing.T) {
+		w := search(t, "beard", true)
+
+		require.Equal(t, http.StatusOK, w.Code)
+		require.False(t, client.SearchCalled)
+		require.Zero(t, count)
+	})
+
+	t.Run("failed upstream call is refunded", func(t *testing.T) {
+		client.SearchFn = func(ctx context.Context, query string, limit int) ([]*domain.Joke, error) {
+			return nil, errors.New("upstream is down")
+		}
+		w := search(t, "kale", true)
+
+		require.Equal(t, http.StatusInternalServerError, w.Code)
+		require.True(t, client.SearchCalled)
+		require.True(t, usageService.RefundCalled)
+		require.Zero(t, count)
+		usageService.ResetCalls()
+	})
+
+	t.Run("empty upstream result is refunded", func(t *testing.T) {
+		client.SearchFn = func(ctx context.Context, query string, limit int) ([]*domain.Joke, error) {
+			return nil, nil
+		}
+		w := search(t, "kale", true)
+
+		require.Equal(t, http.StatusNotFound, w.Code)
+		require.Zero(t, count)
+		usageService.ResetCalls()
+	})
+
+	t.Run("anonymous requests aren't metered", func(t *testing.T) {
+		client.SearchFn = found
+		w := search(t, "roundhouse", false)
+
+		require.Equal(t, http.StatusOK, w.Code)
+		require.False(t, usageService.RecordCalled)
+	})
+
+	t.Run("upstream search is metered", func(t *testing.T) {
+		for _, query := range []string{"ninja", "school"} {
+			w := search(t, query, true)
+			require.Equal(t, http.StatusOK, w.Code)
+		}
+		require.Equal(t, 2, count)
+	})
+
+	t.Run("quota exceeded", func(t *testing.T) {
+		client.SearchCalled = false
+		w := search(t, "texas", true)
+
+		require.Equal(t, http.StatusTooManyRequests, w.Code)
+		require.False(t, client.SearchCalled)
+		require.NotEmpty(t, w.Header().Get("Retry-After"))
+
+		var got errResponse
+		err := json.NewDecoder(w.Body).Decode(&got)
+		require.NoError(t, err)
+		require.NotNil(t, got.ResetAt)
+
+		// cache hits still work with the quota used up
+		require.Equal(t, http.StatusOK, search(t, "beard", true).Code)
+	})
+}
+
+func TestExportJokes(t *testing.T) {
+	jokes := []*domain.Joke{
+		{ExternalID: "a", URL: "https://example.com/a", Content: "Chuck Norris counted to infinity, twice.", CreatedAt: time.Date(2020, 1, 5, 0, 0, 0, 0, time.UTC)},
+		{ExternalID: "b", URL: "https://example.com/b", Content: "Chuck Norris can unscramble an egg.", CreatedAt: time.Date(2021, 1, 5, 0, 0, 0, 0, time.UTC)},
+	}
+
+	jokeService := &mock.JokeService{
+		ExportJokesFn: func(ctx context.Context, w *jokeio.Writer) error {
+			for _, j := range jokes {
+				if err := w.Write(j); err != nil {
+					return err
+				}
+			}
+			return w.Close()
+		},
+	}
+	h := NewJokeHandlers(fixture.TestLogger(t), jokeService, &mock.UsageService{})
+
+	t.Run("ndjson by default", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		h.ExportJokes(w, httptest.NewRequest("GET", "/api/v1/admin/jokes/export", nil))
+
+		require.Equal(t, http.StatusOK, w.Code)
+		require.Equal(t, "application/x-ndjson", w.Header().Get("Content-Type"))
+		require.Equal(t, `attachment; filename="jokes.ndjson"`, w.Header().Get("Content-Disposition"))
+		require.Equal(t, 2, strings.Count(w.Body.String(), "\n"))
+	})
+
+	t.Run("csv", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		h.ExportJokes(w, httptest.NewRequest("GET", "/api/v1/admin/jokes/export?format=csv", nil))
+
+		require.Equal(t, http.StatusOK, w.Code)
+		require.Equal(t, "text/csv; charset=utf-8", w.Header().Get("Content-Type"))
+		require.True(t, strings.HasPrefix(w.Body.String(), "external_id,url,content,created_at\na,https://example.com/a,"))
+	})
+
+	t.Run("error: unknown format", func(t *testing.T) {
+		jokeService.ResetCalls()
+
+		w := httptest.NewRecorder()
+		h.ExportJokes(w, httptest.NewRequest("GET", "/api/v1/admin/jokes/export?format=xml", nil))
+
+		require.Equal(t, http.StatusBadRequest, w.Code)
+		require.False(t, jokeService.ExportJokesCalled)
+	})
+
+	t.Run("error before anything is written", func(t *testing.T) {
+		h := NewJokeHandlers(fixture.TestLogger(t), &mock.JokeService{
+			ExportJokesFn: func(ctx context.Context, w *jokeio.Writer) error {
+				return errors.New("db down")
+			},
+		}, &mock.UsageService{})
+
+		w := httptest.NewRecorder()
+		h.ExportJokes(w, httptest.NewRequest("GET", "/api/v1/admin/jokes/export", nil))
+
+		require.Equal(t, http.StatusInternalServerError, w.Code)
+		require.Equal(t, "application/json", w.Header().Get("Content-Type"))
+		require.Empty(t, w.Header().Get("Content-Disposition"))
+	})
+
+	t.Run("error partway aborts", func(t *testing.T) {
+		h := NewJokeHandlers(fixture.TestLogger(t), &mock.JokeService{
+			ExportJokesFn: func(ctx context.Context, w *jokeio.Writer) error {
+				require.NoError(t, w.Write(jokes[0]))
+				require.NoError(t, w.Flush())
+				return errors.New("connection reset")
+			},
+		}, &mock.UsageService{})
+
+		w := httptest.NewRecorder()
+		require.PanicsWithValue(t, http.ErrAbortHandler, func() {
+			h.ExportJokes(w, httptest.NewRequest("GET", "/api/v1/admin/jokes/export", nil))
+		})
+	})
+}
+
+func TestImportJokes(t *testing.T) {
+	var gotJokes []*domain.Joke
+	jokeService := &mock.JokeService{
+		ImportJokesFn: func(ctx context.Context, r *jokeio.Reader) (*domain.JokeImport, error) {
+			gotJokes = nil
+			for {
+				j, err := r.Read()
+				if errors.Is(err, io.EOF) {
+					break
+				}
+				if err != nil {
+					return nil, fmt.Errorf("%w: %w", joke.ErrBadImport, err)
+				}
+				gotJokes = append(gotJokes, j)
+			}
+			return &domain.JokeImport{Read: len(gotJokes), Imported: len(gotJokes), Errors: []domain.ImportError{}}, nil
+		},
+	}
+	h := NewJokeHandlers(fixture.TestLogger(t), jokeService, &mock.UsageService{})
+
+	tests := []struct {
+		name        string
+		query       string
+		contentType string
+		body        string
+		wantCode    int
+		wantJokes   int
+	}{
+		{name: "ndjson by default", body: `{"external_id": "a", "url": "u", "content": "c"}`, wantCode: http.StatusOK, wantJokes: 1},
+		{name: "format from content type", contentType: "text/csv; charset=utf-8", body: "external_id,url,content\na,u,c\nb,v,d\n", wantCode: http.StatusOK, wantJokes: 2},
+		{name: "format param wins", query: "?format=json", contentType: "text/csv", body: `[{"external_id": "a", "url": "u", "content": "c"}]`, wantCode: http.StatusOK, wantJokes: 1},
+		{name: "error: unknown format", query: "?format=xml", wantCode: http.StatusBadRequest},
+		{name: "error: unreadable file", contentType: "text/csv", body: "id,joke\n1,c\n", wantCode: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer jokeService.ResetCalls()
+
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest("POST", "/api/v1/admin/jokes/import"+tt.query, strings.NewReader(tt.body))
+			r.Header.Set("Content-Type", tt.contentType)
+
+			h.ImportJokes(w, r)
+
+			require.Equal(t, tt.wantCode, w.Code)
+			if tt.wantCode == http.StatusOK {
+				require.Len(t, gotJokes, tt.wantJokes)
+			}
+		})
+	}
+}
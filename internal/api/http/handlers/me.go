@@ -0,0 +1,139 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/davemolk/chuck/internal/api/http/middleware"
+	"github.com/davemolk/chuck/internal/domain"
+	"github.com/davemolk/chuck/internal/service"
+	"go.uber.org/zap"
+)
+
+// MeHandlers let a logged in user manage their own account.
+type MeHandlers struct {
+	logger      *zap.Logger
+	userService service.UserService
+	authService service.AuthService
+}
+
+func NewMeHandlers(logger *zap.Logger, userService service.UserService, authService service.AuthService) *MeHandlers {
+	return &MeHandlers{
+		logger:      logger,
+		userService: userService,
+		authService: authService,
+	}
+}
+
+func (h *MeHandlers) GetMe(w http.ResponseWriter, r *http.Request) {
+	user, err := middleware.UserFromCtx(r.Context())
+	if err != nil {
+		respondError(w, r, h.logger, http.StatusUnauthorized, err)
+		return
+	}
+
+	stats, err := h.userService.GetUserStats(r.Context(), user.ID)
+	if err != nil {
+		respondError(w, r, h.logger, errToStatusCode(err), err)
+		return
+	}
+
+	data := struct {
+		*domain.User
+		Stats *domain.UserStats `json:"stats"`
+	}{
+		User:  user,
+		Stats: stats,
+	}
+
+	respondJSON(w, http.StatusOK, data)
+}
+
+func (h *MeHandlers) UpdateMe(w http.ResponseWriter, r *http.Request) {
+	user, err := middleware.UserFromCtx(r.Context())
+	if err != nil {
+		respondError(w, r, h.logger, http.StatusUnauthorized, err)
+		return
+	}
+
+	var req struct {
+		Email    string `json:"email"`
+		Password string `json:"password"`
+	}
+
+	if err = readJSON(w, r, &req); err != nil {
+		respondError(w, r, h.logger, http.StatusBadRequest, err)
+		return
+	}
+
+	// email is the only thing that can change for now, so it's required
+	if err = validateEmail(req.Email); err != nil {
+		respondError(w, r, h.logger, http.StatusBadRequest, err)
+		return
+	}
+
+	if req.Password == "" {
+		respondError(w, r, h.logger, http.StatusBadRequest, errors.New("password is required"))
+		return
+	}
+
+	if err = h.authService.ChangeEmail(r.Context(), user.ID, req.Password, req.Email); err != nil {
+		respondAuthError(w, r, h.logger, err)
+		return
+	}
+
+	updated, err := h.userService.GetUserByID(r.Context(), user.ID)
+	if err != nil {
+		respondError(w, r, h.logger, errToStatusCode(err), err)
+		return
+	}
+
+	respondJSON(w, http.StatusOK, updated)
+}
+
+func (h *MeHandlers) ExportMe(w http.ResponseWriter, r *http.Request) {
+	user, err := middleware.UserFromCtx(r.Context())
+	if err != nil {
+		respondError(w, r, h.logger, http.StatusUnauthorized, err)
+		return
+	}
+
+	export, err := h.userService.ExportUser(r.Context(), user.ID)
+	if err != nil {
+		respondError(w, r, h.logger, errToStatusCode(err), err)
+		return
+	}
+
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="chuck-export-%d.json"`, user.ID))
+	respondJSON(w, http.StatusOK, export)
+}
+
+func (h *MeHandlers) DeleteMe(w http.ResponseWriter, r *http.Request) {
+	user, err := middleware.UserFromCtx(r.Context())
+	if err != nil {
+		respondError(w, r, h.logger, http.StatusUnauthorized, err)
+		return
+	}
+
+	var req struct {
+		Password string `json:"password"`
+	}
+
+	if err = readJSON(w, r, &req); err != nil {
+		respondError(w, r, h.logger, http.StatusBadRequest, err)
+		return
+	}
+
+	if req.Password == "" {
+		respondError(w, r, h.logger, http.StatusBadRequest, errors.New("password is required"))
+		return
+	}
+
+	if err = h.authService.DeleteAccount(r.Context(), user.ID, req.Password); err != nil {
+		respondAuthError(w, r, h.logger, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
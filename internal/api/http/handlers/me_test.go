@@ -0,0 +1,205 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/davemolk/chuck/internal/api/http/middleware"
+	"github.com/davemolk/chuck/internal/domain"
+	"github.com/davemolk/chuck/internal/service/auth"
+	"github.com/davemolk/chuck/internal/service/user"
+	"github.com/davemolk/chuck/internal/tests/fixture"
+	"github.com/davemolk/chuck/internal/tests/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetMe(t *testing.T) {
+	u := &domain.User{ID: 1, Email: "walker@ranger", HashedPW: []byte("secret")}
+	userService := &mock.UserService{
+		GetUserStatsFn: func(ctx context.Context, userID int64) (*domain.UserStats, error) {
+			return &domain.UserStats{ActiveSessions: 2, MFAEnabled: true}, nil
+		},
+	}
+	h := NewMeHandlers(fixture.TestLogger(t), userService, &mock.AuthService{})
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/api/v1/me", nil)
+	r = r.WithContext(middleware.UserToCtx(r.Context(), u))
+
+	h.GetMe(w, r)
+
+	require.Equal(t, http.StatusOK, w.Code)
+	require.NotContains(t, w.Body.String(), "secret")
+
+	var got map[string]any
+	err := json.NewDecoder(w.Body).Decode(&got)
+	require.NoError(t, err)
+
+	require.Equal(t, "walker@ranger", got["email"])
+	require.Nil(t, got["verified_at"])
+	stats := got["stats"].(map[string]any)
+	require.Equal(t, float64(2), stats["active_sessions"])
+	require.Equal(t, true, stats["mfa_enabled"])
+}
+
+func TestUpdateMe(t *testing.T) {
+	u := &domain.User{ID: 1, Email: "walker@ranger"}
+	authService := &mock.AuthService{
+		ChangeEmailFn: func(ctx context.Context, userID int64, password, email string) error {
+			return user.ErrDuplicateEmail
+		},
+	}
+	userService := &mock.UserService{}
+	h := NewMeHandlers(fixture.TestLogger(t), userService, authService)
+
+	tests := []struct {
+		name string
+		body string
+	}{
+		{"email required", `{"password":"roundhouse"}`},
+		{"invalid email", `{"email":"walker", "password":"roundhouse"}`},
+		{"password required", `{"email":"cordell@ranger"}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest("PATCH", "/api/v1/me", strings.NewReader(tt.body))
+			r = r.WithContext(middleware.UserToCtx(r.Context(), u))
+
+			h.UpdateMe(w, r)
+
+			require.False(t, authService.ChangeEmailCalled)
+			require.Equal(t, http.StatusBadRequest, w.Code)
+		})
+	}
+
+	t.Run("handle service error", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("PATCH", "/api/v1/me", strings.NewReader(`{"email":"cordell@ranger", "password":"roundhouse"}`))
+		r = r.WithContext(middleware.UserToCtx(r.Context(), u))
+
+		h.UpdateMe(w, r)
+
+		require.True(t, authService.ChangeEmailCalled)
+		require.Equal(t, http.StatusBadRequest, w.Code)
+		authService.ResetCalls()
+	})
+
+	t.Run("success", func(t *testing.T) {
+		var gotPW, gotEmail string
+		h.authService = &mock.AuthService{
+			ChangeEmailFn: func(ctx context.Context, userID int64, password, email string) error {
+				gotPW = password
+				gotEmail = email
+				return nil
+			},
+		}
+		h.userService = &mock.UserService{
+			GetUserByIDFn: func(ctx context.Context, id int64) (*domain.User, error) {
+				return &domain.User{ID: id, Email: gotEmail}, nil
+			},
+		}
+
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("PATCH", "/api/v1/me", strings.NewReader(`{"email":"cordell@ranger", "password":"roundhouse"}`))
+		r = r.WithContext(middleware.UserToCtx(r.Context(), u))
+
+		h.UpdateMe(w, r)
+
+		require.Equal(t, http.StatusOK, w.Code)
+		require.Equal(t, "roundhouse", gotPW)
+		require.Equal(t, "cordell@ranger", gotEmail)
+
+		var got domain.User
+		err := json.NewDecoder(w.Body).Decode(&got)
+		require.NoError(t, err)
+		require.Equal(t, "cordell@ranger", got.Email)
+		require.False(t, got.Verified())
+	})
+}
+
+func TestExportMe(t *testing.T) {
+	u := &domain.User{ID: 1, Email: "walker@ranger"}
+	userService := &mock.UserService{
+		ExportUserFn: func(ctx context.Context, userID int64) (*domain.UserExport, error) {
+			return &domain.UserExport{
+				User:     u,
+				Sessions: []domain.Session{{CreatedAt: time.Now(), ExpiresAt: time.Now().Add(time.Hour)}},
+			}, nil
+		},
+	}
+	h := NewMeHandlers(fixture.TestLogger(t), userService, &mock.AuthService{})
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/api/v1/me/export", nil)
+	r = r.WithContext(middleware.UserToCtx(r.Context(), u))
+
+	h.ExportMe(w, r)
+
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, `attachment; filename="chuck-export-1.json"`, w.Header().Get("Content-Disposition"))
+
+	var got domain.UserExport
+	err := json.NewDecoder(w.Body).Decode(&got)
+	require.NoError(t, err)
+	require.Equal(t, u.Email, got.User.Email)
+	require.Len(t, got.Sessions, 1)
+}
+
+func TestDeleteMe(t *testing.T) {
+	u := &domain.User{ID: 1, Email: "walker@ranger"}
+	authService := &mock.AuthService{
+		DeleteAccountFn: func(ctx context.Context, userID int64, password string) error {
+			return auth.ErrInvalidCredentials
+		},
+	}
+	h := NewMeHandlers(fixture.TestLogger(t), &mock.UserService{}, authService)
+
+	t.Run("password required", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("DELETE", "/api/v1/me", strings.NewReader(`{}`))
+		r = r.WithContext(middleware.UserToCtx(r.Context(), u))
+
+		h.DeleteMe(w, r)
+
+		require.False(t, authService.DeleteAccountCalled)
+		require.Equal(t, http.StatusBadRequest, w.Code)
+	})
+
+	t.Run("wrong password", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("DELETE", "/api/v1/me", strings.NewReader(`{"password":"nope"}`))
+		r = r.WithContext(middleware.UserToCtx(r.Context(), u))
+
+		h.DeleteMe(w, r)
+
+		require.True(t, authService.DeleteAccountCalled)
+		require.Equal(t, http.StatusUnauthorized, w.Code)
+		authService.ResetCalls()
+	})
+
+	t.Run("success", func(t *testing.T) {
+		var gotID int64
+		h.authService = &mock.AuthService{
+			DeleteAccountFn: func(ctx context.Context, userID int64, password string) error {
+				gotID = userID
+				return nil
+			},
+		}
+
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("DELETE", "/api/v1/me", strings.NewReader(`{"password":"roundhouse"}`))
+		r = r.WithContext(middleware.UserToCtx(r.Context(), u))
+
+		h.DeleteMe(w, r)
+
+		require.Equal(t, http.StatusNoContent, w.Code)
+		require.Equal(t, u.ID, gotID)
+	})
+}
@@ -0,0 +1,72 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/davemolk/chuck/internal/api/http/middleware"
+	"github.com/davemolk/chuck/internal/service"
+	"go.uber.org/zap"
+)
+
+type MFAHandlers struct {
+	logger     *zap.Logger
+	mfaService service.MFAService
+}
+
+func NewMFAHandlers(logger *zap.Logger, mfaService service.MFAService) *MFAHandlers {
+	return &MFAHandlers{
+		logger:     logger,
+		mfaService: mfaService,
+	}
+}
+
+func (h *MFAHandlers) EnrollTOTP(w http.ResponseWriter, r *http.Request) {
+	user, err := middleware.UserFromCtx(r.Context())
+	if err != nil {
+		respondError(w, r, h.logger, http.StatusUnauthorized, err)
+		return
+	}
+
+	enrollment, err := h.mfaService.EnrollTOTP(r.Context(), user)
+	if err != nil {
+		respondError(w, r, h.logger, errToStatusCode(err), err)
+		return
+	}
+
+	// qr_png is base64 encoded by encoding/json
+	respondJSON(w, http.StatusOK, enrollment)
+}
+
+func (h *MFAHandlers) ConfirmTOTP(w http.ResponseWriter, r *http.Request) {
+	user, err := middleware.UserFromCtx(r.Context())
+	if err != nil {
+		respondError(w, r, h.logger, http.StatusUnauthorized, err)
+		return
+	}
+
+	var req struct {
+		Code string `json:"code"`
+	}
+
+	if err := readJSON(w, r, &req); err != nil {
+		respondError(w, r, h.logger, http.StatusBadRequest, err)
+		return
+	}
+
+	if err := validateMFACode(req.Code); err != nil {
+		respondError(w, r, h.logger, http.StatusBadRequest, err)
+		return
+	}
+
+	codes, err := h.mfaService.ConfirmTOTP(r.Context(), user.ID, req.Code)
+	if err != nil {
+		respondError(w, r, h.logger, errToStatusCode(err), err)
+		return
+	}
+
+	data := map[string]any{
+		"recovery_codes": codes,
+	}
+
+	respondJSON(w, http.StatusOK, data)
+}
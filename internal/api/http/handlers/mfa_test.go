@@ -0,0 +1,131 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/davemolk/chuck/internal/api/http/middleware"
+	"github.com/davemolk/chuck/internal/domain"
+	"github.com/davemolk/chuck/internal/service/mfa"
+	"github.com/davemolk/chuck/internal/tests/fixture"
+	"github.com/davemolk/chuck/internal/tests/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEnrollTOTP(t *testing.T) {
+	user := &domain.User{ID: 1, Email: "walker@ranger"}
+	mfaService := &mock.MFAService{
+		EnrollTOTPFn: func(ctx context.Context, user *domain.User) (*domain.TOTPEnrollment, error) {
+			return nil, mfa.ErrAlreadyEnrolled
+		},
+	}
+	h := NewMFAHandlers(fixture.TestLogger(t), mfaService)
+
+	t.Run("handle service error", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/api/v1/me/mfa/totp", nil)
+		r = r.WithContext(middleware.UserToCtx(r.Context(), user))
+
+		h.EnrollTOTP(w, r)
+
+		require.True(t, mfaService.EnrollTOTPCalled)
+		require.Equal(t, http.StatusConflict, w.Code)
+	})
+
+	t.Run("success", func(t *testing.T) {
+		var gotUser *domain.User
+		mfaService := &mock.MFAService{
+			EnrollTOTPFn: func(ctx context.Context, user *domain.User) (*domain.TOTPEnrollment, error) {
+				gotUser = user
+				return &domain.TOTPEnrollment{
+					Secret: "SECRET",
+					URI:    "otpauth://totp/chuck:walker@ranger?secret=SECRET",
+					QRCode: []byte("png"),
+				}, nil
+			},
+		}
+		h.mfaService = mfaService
+
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/api/v1/me/mfa/totp", nil)
+		r = r.WithContext(middleware.UserToCtx(r.Context(), user))
+
+		h.EnrollTOTP(w, r)
+
+		require.Equal(t, http.StatusOK, w.Code)
+		require.Equal(t, user, gotUser)
+
+		var got map[string]any
+		err := json.NewDecoder(w.Body).Decode(&got)
+		require.NoError(t, err)
+
+		require.Equal(t, "SECRET", got["secret"])
+		require.Equal(t, "cG5n", got["qr_png"])
+	})
+}
+
+func TestConfirmTOTP(t *testing.T) {
+	user := &domain.User{ID: 1, Email: "walker@ranger"}
+	mfaService := &mock.MFAService{
+		ConfirmTOTPFn: func(ctx context.Context, userID int64, code string) ([]string, error) {
+			return nil, mfa.ErrInvalidCode
+		},
+	}
+	h := NewMFAHandlers(fixture.TestLogger(t), mfaService)
+
+	t.Run("code required", func(t *testing.T) {
+		body := strings.NewReader(`{}`)
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/api/v1/me/mfa/totp/confirm", body)
+		r = r.WithContext(middleware.UserToCtx(r.Context(), user))
+
+		h.ConfirmTOTP(w, r)
+
+		require.False(t, mfaService.ConfirmTOTPCalled)
+		require.Equal(t, http.StatusBadRequest, w.Code)
+	})
+
+	t.Run("handle service error", func(t *testing.T) {
+		body := strings.NewReader(`{"code":"123456"}`)
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/api/v1/me/mfa/totp/confirm", body)
+		r = r.WithContext(middleware.UserToCtx(r.Context(), user))
+
+		h.ConfirmTOTP(w, r)
+
+		require.True(t, mfaService.ConfirmTOTPCalled)
+		require.Equal(t, http.StatusBadRequest, w.Code)
+		mfaService.ResetCalls()
+	})
+
+	t.Run("success", func(t *testing.T) {
+		var gotCode string
+		mfaService := &mock.MFAService{
+			ConfirmTOTPFn: func(ctx context.Context, userID int64, code string) ([]string, error) {
+				gotCode = code
+				return []string{"abcdefgh-ijklmnop"}, nil
+			},
+		}
+		h.mfaService = mfaService
+
+		body := strings.NewReader(`{"code":"123456"}`)
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/api/v1/me/mfa/totp/confirm", body)
+		r = r.WithContext(middleware.UserToCtx(r.Context(), user))
+
+		h.ConfirmTOTP(w, r)
+
+		require.Equal(t, http.StatusOK, w.Code)
+		require.Equal(t, "123456", gotCode)
+
+		var got map[string]any
+		err := json.NewDecoder(w.Body).Decode(&got)
+		require.NoError(t, err)
+
+		require.Equal(t, []any{"abcdefgh-ijklmnop"}, got["recovery_codes"])
+	})
+}
@@ -0,0 +1,96 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/davemolk/chuck/internal/api/http/middleware"
+	"github.com/davemolk/chuck/internal/service"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultUsageDays = 30
+	maxUsageDays     = 366
+)
+
+type UsageHandlers struct {
+	logger       *zap.Logger
+	usageService service.UsageService
+}
+
+func NewUsageHandlers(logger *zap.Logger, usageService service.UsageService) *UsageHandlers {
+	return &UsageHandlers{
+		logger:       logger,
+		usageService: usageService,
+	}
+}
+
+// GetMyUsage shows the current user's usage for today against their plan's
+// quotas, plus their daily history.
+func (h *UsageHandlers) GetMyUsage(w http.ResponseWriter, r *http.Request) {
+	user, err := middleware.UserFromCtx(r.Context())
+	if err != nil {
+		respondError(w, r, h.logger, http.StatusUnauthorized, err)
+		return
+	}
+
+	days := defaultUsageDays
+	if v := r.URL.Query().Get("days"); v != "" {
+		days, err = strconv.Atoi(v)
+		if err != nil || days < 1 || days > maxUsageDays {
+			respondError(w, r, h.logger, http.StatusBadRequest, errors.New("days must be between 1 and 366"))
+			return
+		}
+	}
+
+	usage, err := h.usageService.GetUsage(r.Context(), user, days)
+	if err != nil {
+		respondError(w, r, h.logger, errToStatusCode(err), err)
+		return
+	}
+
+	respondJSON(w, http.StatusOK, usage)
+}
+
+// GetReport totals usage per user and event for billing. The range defaults
+// to the last 30 days and both ends are inclusive utc dates (YYYY-MM-DD).
+func (h *UsageHandlers) GetReport(w http.ResponseWriter, r *http.Request) {
+	to := time.Now().UTC()
+	from := to.AddDate(0, 0, -(defaultUsageDays - 1))
+
+	var err error
+	if v := r.URL.Query().Get("from"); v != "" {
+		if from, err = time.Parse(time.DateOnly, v); err != nil {
+			respondError(w, r, h.logger, http.StatusBadRequest, errors.New("from must be a date like 2006-01-02"))
+			return
+		}
+	}
+	if v := r.URL.Query().Get("to"); v != "" {
+		if to, err = time.Parse(time.DateOnly, v); err != nil {
+			respondError(w, r, h.logger, http.StatusBadRequest, errors.New("to must be a date like 2006-01-02"))
+			return
+		}
+	}
+
+	if to.Before(from) || to.Sub(from) >= maxUsageDays*24*time.Hour {
+		respondError(w, r, h.logger, http.StatusBadRequest, errors.New("range must run forwards and cover at most 366 days"))
+		return
+	}
+
+	report, err := h.usageService.Report(r.Context(), from, to)
+	if err != nil {
+		respondError(w, r, h.logger, errToStatusCode(err), err)
+		return
+	}
+
+	data := map[string]any{
+		"from": from.Format(time.DateOnly),
+		"to":   to.Format(time.DateOnly),
+		"rows": report,
+	}
+
+	respondJSON(w, http.StatusOK, data)
+}
@@ -0,0 +1,97 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/davemolk/chuck/internal/api/http/middleware"
+	"github.com/davemolk/chuck/internal/domain"
+	"github.com/davemolk/chuck/internal/tests/fixture"
+	"github.com/davemolk/chuck/internal/tests/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetMyUsage(t *testing.T) {
+	user := &domain.User{ID: 1, Plan: "free"}
+
+	var gotDays int
+	usageService := &mock.UsageService{
+		GetUsageFn: func(ctx context.Context, user *domain.User, days int) (*domain.Usage, error) {
+			gotDays = days
+			return &domain.Usage{Plan: user.Plan}, nil
+		},
+	}
+	h := NewUsageHandlers(fixture.TestLogger(t), usageService)
+
+	tests := []struct {
+		name     string
+		query    string
+		wantCode int
+		wantDays int
+	}{
+		{name: "default days", query: "", wantCode: http.StatusOK, wantDays: defaultUsageDays},
+		{name: "days", query: "?days=7", wantCode: http.StatusOK, wantDays: 7},
+		{name: "error: zero days", query: "?days=0", wantCode: http.StatusBadRequest},
+		{name: "error: too many days", query: "?days=1000", wantCode: http.StatusBadRequest},
+		{name: "error: not a number", query: "?days=lots", wantCode: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer usageService.ResetCalls()
+
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest("GET", "/api/v1/me/usage"+tt.query, nil)
+			r = r.WithContext(middleware.UserToCtx(r.Context(), user))
+
+			h.GetMyUsage(w, r)
+
+			require.Equal(t, tt.wantCode, w.Code)
+			require.Equal(t, tt.wantCode == http.StatusOK, usageService.GetUsageCalled)
+			if tt.wantCode == http.StatusOK {
+				require.Equal(t, tt.wantDays, gotDays)
+			}
+		})
+	}
+}
+
+func TestGetUsageReport(t *testing.T) {
+	var gotFrom, gotTo time.Time
+	usageService := &mock.UsageService{
+		ReportFn: func(ctx context.Context, from, to time.Time) ([]domain.UsageReportRow, error) {
+			gotFrom, gotTo = from, to
+			return []domain.UsageReportRow{}, nil
+		},
+	}
+	h := NewUsageHandlers(fixture.TestLogger(t), usageService)
+
+	t.Run("range", func(t *testing.T) {
+		defer usageService.ResetCalls()
+
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/api/v1/admin/usage?from=2025-01-01&to=2025-01-31", nil)
+
+		h.GetReport(w, r)
+
+		require.Equal(t, http.StatusOK, w.Code)
+		require.Equal(t, "2025-01-01", gotFrom.Format(time.DateOnly))
+		require.Equal(t, "2025-01-31", gotTo.Format(time.DateOnly))
+	})
+
+	for _, query := range []string{"?from=yesterday", "?from=2025-02-01&to=2025-01-01", "?from=2023-01-01&to=2025-01-01"} {
+		t.Run("error: "+query, func(t *testing.T) {
+			defer usageService.ResetCalls()
+
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest("GET", "/api/v1/admin/usage"+query, nil)
+
+			h.GetReport(w, r)
+
+			require.Equal(t, http.StatusBadRequest, w.Code)
+			require.False(t, usageService.ReportCalled)
+		})
+	}
+}
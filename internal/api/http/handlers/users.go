@@ -1,8 +1,10 @@
 package handlers
 
 import (
+	"errors"
 	"net/http"
 
+	"github.com/davemolk/chuck/internal/api/http/middleware"
 	"github.com/davemolk/chuck/internal/service"
 	"go.uber.org/zap"
 )
@@ -52,3 +54,49 @@ func (h *UserHandlers) CreateUser(w http.ResponseWriter, r *http.Request) {
 
 	respondJSON(w, http.StatusCreated, data)
 }
+
+func (h *UserHandlers) VerifyEmail(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Token string `json:"token"`
+	}
+
+	if err := readJSON(w, r, &req); err != nil {
+		respondError(w, r, h.logger, http.StatusBadRequest, err)
+		return
+	}
+
+	if req.Token == "" {
+		respondError(w, r, h.logger, http.StatusBadRequest, errors.New("token is required"))
+		return
+	}
+
+	if err := h.userService.VerifyEmail(r.Context(), req.Token); err != nil {
+		respondError(w, r, h.logger, errToStatusCode(err), err)
+		return
+	}
+
+	data := map[string]any{
+		"message": "email verified",
+	}
+
+	respondJSON(w, http.StatusOK, data)
+}
+
+func (h *UserHandlers) ResendVerification(w http.ResponseWriter, r *http.Request) {
+	user, err := middleware.UserFromCtx(r.Context())
+	if err != nil {
+		respondError(w, r, h.logger, http.StatusUnauthorized, err)
+		return
+	}
+
+	if err = h.userService.ResendVerification(r.Context(), user.ID); err != nil {
+		respondError(w, r, h.logger, errToStatusCode(err), err)
+		return
+	}
+
+	data := map[string]any{
+		"message": "verification email sent",
+	}
+
+	respondJSON(w, http.StatusAccepted, data)
+}
@@ -9,6 +9,11 @@ import (
 	"strings"
 	"testing"
 
+	"github.com/davemolk/chuck/internal/api/http/middleware"
+	"github.com/davemolk/chuck/internal/domain"
+	"github.com/davemolk/chuck/internal/passpolicy"
+	"github.com/davemolk/chuck/internal/service/token"
+	"github.com/davemolk/chuck/internal/service/user"
 	"github.com/davemolk/chuck/internal/tests/fixture"
 	"github.com/davemolk/chuck/internal/tests/mock"
 	"github.com/stretchr/testify/require"
@@ -36,6 +41,19 @@ func TestCreateUser(t *testing.T) {
 		require.Equal(t, http.StatusBadRequest, w.Code)
 	})
 
+	t.Run("email must be an address", func(t *testing.T) {
+		for _, email := range []string{"chuck", "chuck@", "Chuck <chuck@norris.com>", " chuck@norris.com"} {
+			body := strings.NewReader(`{"email":"` + email + `", "password":"roundhouse"}`)
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest("POST", "/api/v1/users", body)
+
+			h.CreateUser(w, r)
+
+			require.False(t, userService.CreateUserCalled, email)
+			require.Equal(t, http.StatusBadRequest, w.Code, email)
+		}
+	})
+
 	t.Run("pw required", func(t *testing.T) {
 		body := strings.NewReader(`{"email":"blah@google"}`)
 		w := httptest.NewRecorder()
@@ -47,8 +65,19 @@ func TestCreateUser(t *testing.T) {
 		require.Equal(t, http.StatusBadRequest, w.Code)
 	})
 
+	t.Run("pw too long", func(t *testing.T) {
+		body := strings.NewReader(`{"email":"blah@google", "password":"` + strings.Repeat("a", 257) + `"}`)
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/api/v1/users", body)
+
+		h.CreateUser(w, r)
+
+		require.False(t, userService.CreateUserCalled)
+		require.Equal(t, http.StatusBadRequest, w.Code)
+	})
+
 	t.Run("handle service error", func(t *testing.T) {
-		body := strings.NewReader(`{"email":"blah@google", "password":"roundhouse"}`)
+		body := strings.NewReader(`{"email":"blah@google", "password":"` + strings.Repeat("a", 256) + `"}`)
 		w := httptest.NewRecorder()
 		r := httptest.NewRequest("POST", "/api/v1/users", body)
 
@@ -92,3 +121,119 @@ func TestCreateUser(t *testing.T) {
 		require.Equal(t, float64(1), got["user_id"])
 	})
 }
+
+func TestCreateUserPolicyRejected(t *testing.T) {
+	userService := &mock.UserService{
+		CreateUserFn: func(ctx context.Context, email, password string) (int64, error) {
+			return 0, &passpolicy.Error{Reasons: []passpolicy.Reason{
+				{Code: "too_weak", Message: "too weak"},
+				{Code: "contains_email", Message: "contains email"},
+			}}
+		},
+	}
+	h := NewUserHandlers(fixture.TestLogger(t), userService)
+
+	body := strings.NewReader(`{"email":"walker@ranger", "password":"walker123"}`)
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/api/v1/users", body)
+
+	h.CreateUser(w, r)
+
+	require.Equal(t, http.StatusBadRequest, w.Code)
+
+	var got errResponse
+	err := json.NewDecoder(w.Body).Decode(&got)
+	require.NoError(t, err)
+	require.Equal(t, "password rejected", got.Error)
+	require.Len(t, got.Reasons, 2)
+	require.Equal(t, "too_weak", got.Reasons[0].Code)
+	require.Equal(t, "contains email", got.Reasons[1].Message)
+}
+
+func TestVerifyEmail(t *testing.T) {
+	userService := &mock.UserService{
+		VerifyEmailFn: func(ctx context.Context, tok string) error {
+			return token.ErrInvalidToken
+		},
+	}
+	h := NewUserHandlers(fixture.TestLogger(t), userService)
+
+	t.Run("token required", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/api/v1/users/verify", strings.NewReader(`{}`))
+
+		h.VerifyEmail(w, r)
+
+		require.False(t, userService.VerifyEmailCalled)
+		require.Equal(t, http.StatusBadRequest, w.Code)
+	})
+
+	t.Run("invalid token", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/api/v1/users/verify", strings.NewReader(`{"token":"foo"}`))
+
+		h.VerifyEmail(w, r)
+
+		require.True(t, userService.VerifyEmailCalled)
+		require.Equal(t, http.StatusUnauthorized, w.Code)
+		userService.ResetCalls()
+	})
+
+	t.Run("success", func(t *testing.T) {
+		var gotToken string
+		h.userService = &mock.UserService{
+			VerifyEmailFn: func(ctx context.Context, tok string) error {
+				gotToken = tok
+				return nil
+			},
+		}
+
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/api/v1/users/verify", strings.NewReader(`{"token":"foo"}`))
+
+		h.VerifyEmail(w, r)
+
+		require.Equal(t, http.StatusOK, w.Code)
+		require.Equal(t, "foo", gotToken)
+	})
+}
+
+func TestResendVerification(t *testing.T) {
+	u := &domain.User{ID: 1, Email: "walker@ranger"}
+	userService := &mock.UserService{
+		ResendVerificationFn: func(ctx context.Context, userID int64) error {
+			return user.ErrResendRateLimited
+		},
+	}
+	h := NewUserHandlers(fixture.TestLogger(t), userService)
+
+	t.Run("rate limited", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/api/v1/users/verify/resend", nil)
+		r = r.WithContext(middleware.UserToCtx(r.Context(), u))
+
+		h.ResendVerification(w, r)
+
+		require.True(t, userService.ResendVerificationCalled)
+		require.Equal(t, http.StatusTooManyRequests, w.Code)
+	})
+
+	t.Run("success", func(t *testing.T) {
+		var gotID int64
+		h.userService = &mock.UserService{
+			ResendVerificationFn: func(ctx context.Context, userID int64) error {
+				gotID = userID
+				return nil
+			},
+		}
+
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/api/v1/users/verify/resend", nil)
+		r = r.WithContext(middleware.UserToCtx(r.Context(), u))
+
+		h.ResendVerification(w, r)
+
+		require.Equal(t, http.StatusAccepted, w.Code)
+		require.Equal(t, u.ID, gotID)
+	})
+}
@@ -3,18 +3,22 @@ package handlers
 import (
 	"errors"
 	"fmt"
+	"net/mail"
 )
 
 const (
 	// https://www.rfc-editor.org/errata/eid1690
 	maxEmailLength    = 254
-	maxPasswordLength = 30
+	maxPasswordLength = 256
 	minPasswordLength = 8
 	maxNameLength     = 100
 	minNameLength     = 1
 	// minQueryLength is a limit set by the Chuck Norris API.
 	minQueryLength = 3
 	maxQueryLength = 120
+	// mfa codes are either a 6 digit totp code or a recovery code, which is
+	// 16 characters plus an optional dash.
+	maxMFACodeLength = 17
 )
 
 func validateEmail(email string) error {
@@ -25,8 +29,14 @@ func validateEmail(email string) error {
 		return fmt.Errorf("max email length is %d", maxEmailLength)
 	}
 
-	// in the future, we could check that it's a proper email formatting,
-	// block known spam providers, etc.
+	// ParseAddress also accepts "Chuck <chuck@norris.com>", but we only want
+	// the bare address, so it has to round trip unchanged.
+	addr, err := mail.ParseAddress(email)
+	if err != nil || addr.Name != "" || addr.Address != email {
+		return errors.New("email must be a valid address")
+	}
+
+	// in the future, we could block known spam providers, etc.
 	return nil
 }
 
@@ -38,7 +48,8 @@ func validatePassword(pw string) error {
 		return fmt.Errorf("max password length is %d", maxPasswordLength)
 	}
 
-	// in the future, we could require passing a certain password strength threshold, etc.
+	// strength is up to the user service's passpolicy check, this is just the
+	// shape of the input
 	return nil
 }
 
@@ -61,3 +72,13 @@ func validateQuery(query string) error {
 	}
 	return nil
 }
+
+func validateMFACode(code string) error {
+	if len(code) == 0 {
+		return errors.New("code is required")
+	}
+	if len(code) > maxMFACodeLength {
+		return fmt.Errorf("max code length is %d", maxMFACodeLength)
+	}
+	return nil
+}
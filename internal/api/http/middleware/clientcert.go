@@ -0,0 +1,106 @@
+package middleware
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/davemolk/chuck/internal/domain"
+)
+
+// ErrUnknownCert is a verified client certificate that isn't mapped to
+// anyone.
+var ErrUnknownCert = errors.New("unknown client certificate")
+
+// CertPrincipal is who a client certificate authenticates as, either the
+// user with Email or the internal Service.
+type CertPrincipal struct {
+	Email   string
+	Service string
+}
+
+// ParseCertPrincipal parses a mapping from a certificate identity to a
+// principal, "identity=user:email" or "identity=service:name". The identity
+// is a URI, DNS or email SAN, or the subject common name.
+func ParseCertPrincipal(s string) (string, CertPrincipal, error) {
+	identity, principal, ok := strings.Cut(s, "=")
+	identity = strings.TrimSpace(identity)
+	if !ok || identity == "" {
+		return "", CertPrincipal{}, fmt.Errorf("invalid client cert principal %q, want identity=user:email or identity=service:name", s)
+	}
+
+	kind, name, _ := strings.Cut(strings.TrimSpace(principal), ":")
+	switch {
+	case name == "":
+		return "", CertPrincipal{}, fmt.Errorf("invalid client cert principal %q, missing the user or service name", s)
+	case kind == "user":
+		return identity, CertPrincipal{Email: name}, nil
+	case kind == "service":
+		return identity, CertPrincipal{Service: name}, nil
+	default:
+		return "", CertPrincipal{}, fmt.Errorf("invalid client cert principal %q, must map to user: or service:", s)
+	}
+}
+
+type userLookup interface {
+	GetUserByEmail(ctx context.Context, email string) (*domain.User, error)
+}
+
+// CertAuthenticator maps verified client certificates to principals.
+type CertAuthenticator struct {
+	users      userLookup
+	principals map[string]CertPrincipal
+}
+
+func NewCertAuthenticator(users userLookup, principals map[string]CertPrincipal) *CertAuthenticator {
+	return &CertAuthenticator{
+		users:      users,
+		principals: principals,
+	}
+}
+
+// authenticate returns the user or service for the connection's client
+// certificate, or neither if there isn't a verified one.
+func (a *CertAuthenticator) authenticate(ctx context.Context, state *tls.ConnectionState) (*domain.User, *domain.Service, error) {
+	// VerifiedChains is only set once the cert checked out against the
+	// client CAs, a cert that was merely presented doesn't count
+	if state == nil || len(state.VerifiedChains) == 0 {
+		return nil, nil, nil
+	}
+
+	for _, identity := range certIdentities(state.VerifiedChains[0][0]) {
+		p, ok := a.principals[identity]
+		if !ok {
+			continue
+		}
+
+		if p.Service != "" {
+			return nil, &domain.Service{Name: p.Service}, nil
+		}
+
+		user, err := a.users.GetUserByEmail(ctx, p.Email)
+		if err != nil {
+			return nil, nil, err
+		}
+		return user, nil, nil
+	}
+
+	return nil, nil, ErrUnknownCert
+}
+
+// certIdentities lists what a cert can be mapped by, most specific first.
+func certIdentities(cert *x509.Certificate) []string {
+	var ids []string
+	for _, u := range cert.URIs {
+		ids = append(ids, u.String())
+	}
+	ids = append(ids, cert.DNSNames...)
+	ids = append(ids, cert.EmailAddresses...)
+	if cert.Subject.CommonName != "" {
+		ids = append(ids, cert.Subject.CommonName)
+	}
+	return ids
+}
@@ -0,0 +1,177 @@
+package middleware
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/davemolk/chuck/internal/domain"
+	"github.com/davemolk/chuck/internal/tests/fixture"
+	"github.com/davemolk/chuck/internal/tests/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseCertPrincipal(t *testing.T) {
+	tests := []struct {
+		in       string
+		identity string
+		want     CertPrincipal
+		err      bool
+	}{
+		{in: "spiffe://internal/billing=service:billing", identity: "spiffe://internal/billing", want: CertPrincipal{Service: "billing"}},
+		{in: "ops.internal = user:ops@chuck.com", identity: "ops.internal", want: CertPrincipal{Email: "ops@chuck.com"}},
+		{in: "billing", err: true},
+		{in: "=service:billing", err: true},
+		{in: "billing=service:", err: true},
+		{in: "billing=admin:billing", err: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			identity, got, err := ParseCertPrincipal(tt.in)
+			if tt.err {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.identity, identity)
+			require.Equal(t, tt.want, got)
+		})
+	}
+}
+
+// whoami answers with who the request was authenticated as.
+func whoami(w http.ResponseWriter, r *http.Request) {
+	if user, err := UserFromCtx(r.Context()); err == nil {
+		_, _ = io.WriteString(w, "user:"+user.Email)
+		return
+	}
+	if service, ok := ServiceFromCtx(r.Context()); ok {
+		_, _ = io.WriteString(w, "service:"+service.Name)
+		return
+	}
+	_, _ = io.WriteString(w, "anonymous")
+}
+
+func TestAuthClientCert(t *testing.T) {
+	ca := fixture.TestCA(t)
+
+	users := &mock.UserService{
+		GetUserByEmailFn: func(ctx context.Context, email string) (*domain.User, error) {
+			if email == "ops@chuck.com" {
+				return &domain.User{ID: 1, Email: email}, nil
+			}
+			return nil, domain.ErrNotFound
+		},
+	}
+	tokens := &mock.AuthService{
+		GetUserIDForTokenFn: func(ctx context.Context, token string) (*domain.User, error) {
+			return &domain.User{ID: 2, Email: "token@chuck.com"}, nil
+		},
+	}
+	certs := NewCertAuthenticator(users, map[string]CertPrincipal{
+		"spiffe://internal/billing": {Service: "billing"},
+		"ops.internal":              {Email: "ops@chuck.com"},
+		"gone.internal":             {Email: "gone@chuck.com"},
+	})
+
+	start := func(t *testing.T, clientAuth tls.ClientAuthType) *httptest.Server {
+		srv := httptest.NewUnstartedServer(Auth(tokens, certs)(http.HandlerFunc(whoami)))
+		srv.TLS = &tls.Config{
+			ClientAuth: clientAuth,
+			ClientCAs:  ca.Pool(),
+		}
+		srv.StartTLS()
+		t.Cleanup(srv.Close)
+		return srv
+	}
+
+	// client for srv presenting certs, if any
+	client := func(srv *httptest.Server, certs ...tls.Certificate) *http.Client {
+		tr := srv.Client().Transport.(*http.Transport).Clone()
+		tr.TLSClientConfig.Certificates = certs
+		return &http.Client{Transport: tr}
+	}
+
+	get := func(t *testing.T, c *http.Client, url, token string) (int, string) {
+		req, err := http.NewRequest(http.MethodGet, url, nil)
+		require.NoError(t, err)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := c.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp.StatusCode, string(body)
+	}
+
+	billing := ca.Issue(t, &x509.Certificate{
+		Subject: pkix.Name{CommonName: "billing"},
+		URIs:    []*url.URL{{Scheme: "spiffe", Host: "internal", Path: "/billing"}},
+	})
+	ops := ca.Issue(t, &x509.Certificate{DNSNames: []string{"ops.internal"}})
+
+	t.Run("request", func(t *testing.T) {
+		srv := start(t, tls.VerifyClientCertIfGiven)
+
+		tests := []struct {
+			name   string
+			certs  []tls.Certificate
+			token  string
+			status int
+			body   string
+		}{
+			{name: "no cert", status: http.StatusOK, body: "anonymous"},
+			{name: "service", certs: []tls.Certificate{billing}, status: http.StatusOK, body: "service:billing"},
+			{name: "user", certs: []tls.Certificate{ops}, status: http.StatusOK, body: "user:ops@chuck.com"},
+			{name: "token wins", certs: []tls.Certificate{ops}, token: "token", status: http.StatusOK, body: "user:token@chuck.com"},
+			{
+				name:   "error: unmapped cert",
+				certs:  []tls.Certificate{ca.Issue(t, &x509.Certificate{Subject: pkix.Name{CommonName: "stranger"}})},
+				status: http.StatusUnauthorized,
+			},
+			{
+				name:   "error: mapped user doesn't exist",
+				certs:  []tls.Certificate{ca.Issue(t, &x509.Certificate{DNSNames: []string{"gone.internal"}})},
+				status: http.StatusUnauthorized,
+			},
+		}
+
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				status, body := get(t, client(srv, tt.certs...), srv.URL, tt.token)
+				require.Equal(t, tt.status, status)
+				if tt.body != "" {
+					require.Equal(t, tt.body, body)
+				}
+			})
+		}
+
+		t.Run("error: cert from another ca", func(t *testing.T) {
+			other := fixture.TestCA(t).Issue(t, &x509.Certificate{DNSNames: []string{"ops.internal"}})
+			_, err := client(srv, other).Get(srv.URL)
+			require.Error(t, err)
+		})
+	})
+
+	t.Run("require", func(t *testing.T) {
+		srv := start(t, tls.RequireAndVerifyClientCert)
+
+		status, body := get(t, client(srv, billing), srv.URL, "")
+		require.Equal(t, http.StatusOK, status)
+		require.Equal(t, "service:billing", body)
+
+		t.Run("error: no cert", func(t *testing.T) {
+			_, err := client(srv).Get(srv.URL)
+			require.Error(t, err)
+		})
+	})
+}
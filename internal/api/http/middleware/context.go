@@ -14,6 +14,10 @@ type contextKey string
 const requestIDKey contextKey = "request_id"
 const requestIDHeader = "X-Request-ID"
 const userKey contextKey = "user"
+const clientIPKey contextKey = "client_ip"
+const tokenKey contextKey = "token"
+const serviceKey contextKey = "service"
+const schemeKey contextKey = "scheme"
 
 func generateRequestID() string {
 	b := make([]byte, 6)
@@ -49,3 +53,57 @@ func UserToCtx(ctx context.Context, user *domain.User) context.Context {
 	ctx = context.WithValue(ctx, userKey, user)
 	return ctx
 }
+
+func ClientIPFromCtx(ctx context.Context) string {
+	if ip, ok := ctx.Value(clientIPKey).(string); ok {
+		return ip
+	}
+
+	return ""
+}
+
+func ClientIPToCtx(ctx context.Context, ip string) context.Context {
+	ctx = context.WithValue(ctx, clientIPKey, ip)
+	return ctx
+}
+
+// SchemeFromCtx returns the scheme the client connected with, which can
+// differ from this server's when a proxy terminates tls.
+func SchemeFromCtx(ctx context.Context) string {
+	if scheme, ok := ctx.Value(schemeKey).(string); ok {
+		return scheme
+	}
+
+	return ""
+}
+
+func SchemeToCtx(ctx context.Context, scheme string) context.Context {
+	ctx = context.WithValue(ctx, schemeKey, scheme)
+	return ctx
+}
+
+// TokenFromCtx returns the bearer token the request was authenticated with.
+func TokenFromCtx(ctx context.Context) string {
+	if token, ok := ctx.Value(tokenKey).(string); ok {
+		return token
+	}
+
+	return ""
+}
+
+func TokenToCtx(ctx context.Context, token string) context.Context {
+	ctx = context.WithValue(ctx, tokenKey, token)
+	return ctx
+}
+
+// ServiceFromCtx returns the internal service a request was authenticated
+// as, if it was by client certificate.
+func ServiceFromCtx(ctx context.Context) (*domain.Service, bool) {
+	service, ok := ctx.Value(serviceKey).(*domain.Service)
+	return service, ok
+}
+
+func ServiceToCtx(ctx context.Context, service *domain.Service) context.Context {
+	ctx = context.WithValue(ctx, serviceKey, service)
+	return ctx
+}
@@ -0,0 +1,29 @@
+package middleware
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/davemolk/chuck/internal/metrics"
+)
+
+// Metrics records each request's status and latency by the route pattern it
+// matched, or "unmatched" when it didn't match any. It should be the
+// outermost middleware so recovered panics and rejected requests count too.
+func Metrics(mux router) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			wrapped := newRespWriter(w)
+
+			next.ServeHTTP(wrapped, r)
+
+			route := "unmatched"
+			if _, pattern := mux.Handler(r); pattern != "" {
+				route = pattern
+			}
+
+			metrics.ObserveHTTP(route, r.Method, wrapped.statusCode, time.Since(start))
+		})
+	}
+}
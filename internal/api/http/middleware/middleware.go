@@ -2,6 +2,7 @@ package middleware
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"net/http"
@@ -10,6 +11,8 @@ import (
 	"time"
 
 	"github.com/davemolk/chuck/internal/domain"
+	sqldb "github.com/davemolk/chuck/internal/sql"
+	"github.com/davemolk/chuck/internal/tracing"
 	"go.uber.org/zap"
 )
 
@@ -44,6 +47,12 @@ func (rw *respWriter) Write(b []byte) (int, error) {
 	return rw.wrapped.Write(b)
 }
 
+// Unwrap lets http.ResponseController reach the underlying writer, to flush
+// or change deadlines while streaming.
+func (rw *respWriter) Unwrap() http.ResponseWriter {
+	return rw.wrapped
+}
+
 func Logger(logger *zap.Logger) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -51,18 +60,25 @@ func Logger(logger *zap.Logger) func(http.Handler) http.Handler {
 			wrapped := newRespWriter(w)
 			reqID := RequestIDFromCtx(r.Context())
 
-			var email string
+			var email, serviceName string
 			user, err := UserFromCtx(r.Context())
 			if err == nil && user != nil {
 				email = user.Email
 			}
+			if service, ok := ServiceFromCtx(r.Context()); ok {
+				serviceName = service.Name
+			}
+			clientIP := ClientIPFromCtx(r.Context())
+
+			// trace ids tie these lines to the request's trace, if there is one
+			logger := logger.With(tracing.LogFields(r.Context())...)
 
-			logger.Info("request started", zap.String("request_id", reqID), zap.String("email", email), zap.String("method", r.Method), zap.String("path", r.URL.Path), zap.String("ua", r.UserAgent()))
+			logger.Info("request started", zap.String("request_id", reqID), zap.String("email", email), zap.String("service", serviceName), zap.String("client_ip", clientIP), zap.String("method", r.Method), zap.String("path", r.URL.Path), zap.String("ua", r.UserAgent()))
 
 			next.ServeHTTP(wrapped, r)
 
 			duration := time.Since(start)
-			logger.Info("request finished", zap.String("request_id", reqID), zap.String("email", email), zap.String("method", r.Method), zap.String("path", r.URL.Path), zap.String("ua", r.UserAgent()), zap.Int("status", wrapped.statusCode), zap.Duration("duration", duration))
+			logger.Info("request finished", zap.String("request_id", reqID), zap.String("email", email), zap.String("service", serviceName), zap.String("client_ip", clientIP), zap.String("method", r.Method), zap.String("path", r.URL.Path), zap.String("ua", r.UserAgent()), zap.Int("status", wrapped.statusCode), zap.Duration("duration", duration))
 		})
 	}
 }
@@ -81,11 +97,25 @@ func RequestID(next http.Handler) http.Handler {
 	})
 }
 
+// ReadYourWrites sends the request's replica reads to the primary once the
+// request has written anything, see sqldb.ReadYourWrites.
+func ReadYourWrites(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r.WithContext(sqldb.ReadYourWrites(r.Context())))
+	})
+}
+
 func RecoverPanic(logger *zap.Logger) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			defer func() {
 				if err := recover(); err != nil {
+					// a handler giving up on a response it already started,
+					// the server drops the connection so the client can tell
+					if err == http.ErrAbortHandler {
+						panic(err)
+					}
+
 					requestID := RequestIDFromCtx(r.Context())
 					logger.Error("panic recovered", zap.String("request_id", requestID), zap.Any("error", err), zap.String("path", r.URL.Path), zap.String("stack", string(debug.Stack())))
 
@@ -104,11 +134,33 @@ type userAuthenticator interface {
 	GetUserIDForToken(ctx context.Context, token string) (*domain.User, error)
 }
 
-func Auth(userAuthenticator userAuthenticator) func(http.Handler) http.Handler {
+// Auth authenticates with the bearer token if there is one, and otherwise
+// with the client certificate when certs is set. Requests with neither carry
+// on anonymously.
+func Auth(userAuthenticator userAuthenticator, certs *CertAuthenticator) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			authHeader := r.Header.Get("Authorization")
 			if authHeader == "" {
+				if certs == nil {
+					next.ServeHTTP(w, r)
+					return
+				}
+
+				user, service, err := certs.authenticate(r.Context(), r.TLS)
+				switch {
+				case errors.Is(err, ErrUnknownCert), errors.Is(err, domain.ErrNotFound):
+					http.Error(w, "unknown client certificate", http.StatusUnauthorized)
+					return
+				case err != nil:
+					http.Error(w, "server is unable to process request", http.StatusInternalServerError)
+					return
+				case user != nil:
+					r = r.WithContext(UserToCtx(r.Context(), user))
+				case service != nil:
+					r = r.WithContext(ServiceToCtx(r.Context(), service))
+				}
+
 				next.ServeHTTP(w, r)
 				return
 			}
@@ -132,6 +184,7 @@ func Auth(userAuthenticator userAuthenticator) func(http.Handler) http.Handler {
 			}
 
 			userCtx := UserToCtx(r.Context(), user)
+			userCtx = TokenToCtx(userCtx, token)
 			r = r.WithContext(userCtx)
 			next.ServeHTTP(w, r)
 		})
@@ -148,3 +201,81 @@ func RequireAuth(next http.HandlerFunc) http.HandlerFunc {
 		next.ServeHTTP(w, r)
 	}
 }
+
+// RequireAdmin is RequireAuth for admin only routes. Everyone else gets a
+// 404, there's no need to advertise the route exists.
+func RequireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, err := UserFromCtx(r.Context())
+		if err != nil {
+			http.Error(w, "authentication required", http.StatusUnauthorized)
+			return
+		}
+
+		if !user.IsAdmin {
+			http.NotFound(w, r)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	}
+}
+
+type router interface {
+	Handler(r *http.Request) (http.Handler, string)
+}
+
+// ErrCodeEmailUnverified is the error code RestrictUnverified responds with,
+// so clients can tell a user to verify their email.
+const ErrCodeEmailUnverified = "email_unverified"
+
+// RestrictUnverified blocks users who haven't verified their email from every
+// route except the allowed patterns, which must match the patterns registered
+// on the router exactly (e.g. "GET /api/v1/jokes/random"). Anonymous requests
+// are left alone, RequireAuth deals with those.
+func RestrictUnverified(mux router, allowed []string) func(http.Handler) http.Handler {
+	allowedSet := make(map[string]struct{}, len(allowed))
+	for _, pattern := range allowed {
+		allowedSet[pattern] = struct{}{}
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			user, err := UserFromCtx(r.Context())
+			if err != nil || user.Verified() {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			if _, pattern := mux.Handler(r); pattern != "" {
+				if _, ok := allowedSet[pattern]; !ok {
+					respondError(w, r, http.StatusForbidden, "email verification required", ErrCodeEmailUnverified)
+					return
+				}
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// respondError writes the same body as handlers.errResponse, which can't be
+// used from here without an import cycle.
+func respondError(w http.ResponseWriter, r *http.Request, status int, msg, code string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	e := json.NewEncoder(w)
+	e.SetIndent("", "    ")
+	_ = e.Encode(struct {
+		Error      string
+		RequestID  string
+		StatusCode int
+		Code       string `json:",omitempty"`
+	}{
+		Error:      msg,
+		RequestID:  RequestIDFromCtx(r.Context()),
+		StatusCode: status,
+		Code:       code,
+	})
+}
@@ -0,0 +1,67 @@
+package middleware
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/davemolk/chuck/internal/domain"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRestrictUnverified(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	mux := http.NewServeMux()
+	mux.Handle("GET /api/v1/jokes/random", ok)
+	mux.Handle("GET /api/v1/users/me", ok)
+	handler := RestrictUnverified(mux, []string{"GET /api/v1/jokes/random"})(mux)
+
+	now := time.Now()
+	tests := []struct {
+		name       string
+		user       *domain.User
+		path       string
+		wantStatus int
+	}{
+		{name: "anonymous", path: "/api/v1/users/me", wantStatus: http.StatusOK},
+		{name: "verified", user: &domain.User{ID: 1, VerifiedAt: &now}, path: "/api/v1/users/me", wantStatus: http.StatusOK},
+		{name: "unverified, allowed", user: &domain.User{ID: 2}, path: "/api/v1/jokes/random", wantStatus: http.StatusOK},
+		{name: "unverified", user: &domain.User{ID: 2}, path: "/api/v1/users/me", wantStatus: http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			ctx := RequestIDToCtx(r.Context(), "abc123")
+			if tt.user != nil {
+				ctx = UserToCtx(ctx, tt.user)
+			}
+
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r.WithContext(ctx))
+			require.Equal(t, tt.wantStatus, w.Code)
+
+			if tt.wantStatus != http.StatusForbidden {
+				return
+			}
+
+			require.Equal(t, "application/json", w.Header().Get("Content-Type"))
+			var body struct {
+				Error      string
+				RequestID  string
+				StatusCode int
+				Code       string
+			}
+			require.NoError(t, json.NewDecoder(w.Body).Decode(&body))
+			require.Equal(t, "email verification required", body.Error)
+			require.Equal(t, "abc123", body.RequestID)
+			require.Equal(t, http.StatusForbidden, body.StatusCode)
+			require.Equal(t, ErrCodeEmailUnverified, body.Code)
+		})
+	}
+}
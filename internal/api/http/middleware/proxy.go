@@ -0,0 +1,167 @@
+package middleware
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// ParseTrustedProxies parses CIDRs, or single addresses, of the proxies
+// allowed to say who the client is.
+func ParseTrustedProxies(cidrs []string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, s := range cidrs {
+		s = strings.TrimSpace(s)
+
+		if prefix, err := netip.ParsePrefix(s); err == nil {
+			prefixes = append(prefixes, prefix.Masked())
+			continue
+		}
+
+		addr, err := netip.ParseAddr(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q, want a cidr or an ip", s)
+		}
+		prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+
+	return prefixes, nil
+}
+
+// ClientIP stores the client's ip and the scheme it connected with in the
+// request context. By default that's the remote end of the connection. When
+// the connection comes from a trusted proxy, the Forwarded header, or else
+// X-Forwarded-For and X-Forwarded-Proto, are used instead. Proxies append to
+// these headers, so they're read right to left, skipping trusted proxies,
+// and the first untrusted address is the client. Anything further left could
+// have been made up by the client.
+func ClientIP(trusted []netip.Prefix) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ip, _, err := net.SplitHostPort(r.RemoteAddr)
+			if err != nil {
+				ip = r.RemoteAddr
+			}
+
+			scheme := "http"
+			if r.TLS != nil {
+				scheme = "https"
+			}
+
+			if isTrusted(trusted, ip) {
+				ip, scheme = forwarded(r, trusted, ip, scheme)
+			}
+
+			trace.SpanFromContext(r.Context()).SetAttributes(
+				attribute.String("client.address", ip),
+				attribute.String("url.scheme", scheme),
+			)
+
+			ctx := ClientIPToCtx(r.Context(), ip)
+			ctx = SchemeToCtx(ctx, scheme)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// hop is one proxy's worth of forwarding info.
+type hop struct {
+	ip    string
+	proto string
+}
+
+// forwarded walks the forwarding headers back to the first untrusted hop.
+func forwarded(r *http.Request, trusted []netip.Prefix, ip, scheme string) (string, string) {
+	hops, proto := forwardedHops(r)
+	if proto == "http" || proto == "https" {
+		scheme = proto
+	}
+
+	for i := len(hops) - 1; i >= 0; i-- {
+		h := hops[i]
+		if _, err := netip.ParseAddr(h.ip); err != nil {
+			// an obfuscated or garbled hop, nothing further left can be trusted
+			break
+		}
+
+		ip = h.ip
+		if h.proto == "http" || h.proto == "https" {
+			scheme = h.proto
+		}
+
+		if !isTrusted(trusted, h.ip) {
+			break
+		}
+	}
+
+	return ip, scheme
+}
+
+// forwardedHops reads the Forwarded header (RFC 7239), or X-Forwarded-For if
+// there isn't one, oldest hop first. X-Forwarded-Proto isn't kept per hop,
+// proxies pass on or overwrite a single value, so it's returned on its own.
+func forwardedHops(r *http.Request) ([]hop, string) {
+	var hops []hop
+
+	if values := r.Header.Values("Forwarded"); len(values) > 0 {
+		for _, element := range strings.Split(strings.Join(values, ","), ",") {
+			var h hop
+			for _, pair := range strings.Split(element, ";") {
+				key, value, _ := strings.Cut(strings.TrimSpace(pair), "=")
+				value = strings.Trim(value, `"`)
+				switch strings.ToLower(key) {
+				case "for":
+					h.ip = forwardedNode(value)
+				case "proto":
+					h.proto = strings.ToLower(value)
+				}
+			}
+			hops = append(hops, h)
+		}
+		return hops, ""
+	}
+
+	for _, ip := range strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",") {
+		if ip = strings.TrimSpace(ip); ip != "" {
+			hops = append(hops, hop{ip: ip})
+		}
+	}
+
+	// the last value is from the proxy in front of us
+	var proto string
+	if values := r.Header.Values("X-Forwarded-Proto"); len(values) > 0 {
+		list := strings.Split(values[len(values)-1], ",")
+		proto = strings.ToLower(strings.TrimSpace(list[len(list)-1]))
+	}
+
+	return hops, proto
+}
+
+// forwardedNode strips the port and brackets from a Forwarded for= value,
+// e.g. "[2001:db8::1]:4711" or "192.0.2.60:8080".
+func forwardedNode(node string) string {
+	if host, _, err := net.SplitHostPort(node); err == nil {
+		return host
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(node, "["), "]")
+}
+
+func isTrusted(trusted []netip.Prefix, ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+
+	for _, prefix := range trusted {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
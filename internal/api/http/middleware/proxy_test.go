@@ -0,0 +1,154 @@
+package middleware
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseTrustedProxies(t *testing.T) {
+	prefixes, err := ParseTrustedProxies([]string{"10.0.0.0/8", " 192.168.1.7 ", "fd00::/8", "10.1.2.3/8"})
+	require.NoError(t, err)
+
+	var got []string
+	for _, p := range prefixes {
+		got = append(got, p.String())
+	}
+	require.Equal(t, []string{"10.0.0.0/8", "192.168.1.7/32", "fd00::/8", "10.0.0.0/8"}, got)
+
+	_, err = ParseTrustedProxies([]string{"proxy.internal"})
+	require.Error(t, err)
+}
+
+func TestClientIP(t *testing.T) {
+	trusted, err := ParseTrustedProxies([]string{"10.0.0.0/8", "fd00::/8"})
+	require.NoError(t, err)
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		tls        bool
+		headers    map[string][]string
+		wantIP     string
+		wantScheme string
+	}{
+		{
+			name:       "direct",
+			remoteAddr: "203.0.113.9:1234",
+			wantIP:     "203.0.113.9",
+			wantScheme: "http",
+		},
+		{
+			name:       "direct tls",
+			remoteAddr: "203.0.113.9:1234",
+			tls:        true,
+			wantIP:     "203.0.113.9",
+			wantScheme: "https",
+		},
+		{
+			name:       "untrusted peer's headers are ignored",
+			remoteAddr: "203.0.113.9:1234",
+			headers: map[string][]string{
+				"X-Forwarded-For":   {"198.51.100.1"},
+				"X-Forwarded-Proto": {"https"},
+			},
+			wantIP:     "203.0.113.9",
+			wantScheme: "http",
+		},
+		{
+			name:       "x-forwarded-for",
+			remoteAddr: "10.0.0.2:1234",
+			headers: map[string][]string{
+				"X-Forwarded-For":   {"198.51.100.1"},
+				"X-Forwarded-Proto": {"https"},
+			},
+			wantIP:     "198.51.100.1",
+			wantScheme: "https",
+		},
+		{
+			name:       "spoofed hops left of the client are ignored",
+			remoteAddr: "10.0.0.2:1234",
+			headers: map[string][]string{
+				"X-Forwarded-For": {"1.2.3.4, 198.51.100.1", "10.0.0.3"},
+			},
+			wantIP:     "198.51.100.1",
+			wantScheme: "http",
+		},
+		{
+			name:       "proto without for",
+			remoteAddr: "10.0.0.2:1234",
+			headers: map[string][]string{
+				"X-Forwarded-Proto": {"HTTPS"},
+			},
+			wantIP:     "10.0.0.2",
+			wantScheme: "https",
+		},
+		{
+			name:       "every hop trusted",
+			remoteAddr: "10.0.0.2:1234",
+			headers: map[string][]string{
+				"X-Forwarded-For": {"10.0.0.4, 10.0.0.3"},
+			},
+			wantIP:     "10.0.0.4",
+			wantScheme: "http",
+		},
+		{
+			name:       "forwarded wins over x-forwarded-for",
+			remoteAddr: "[fd00::2]:1234",
+			headers: map[string][]string{
+				"Forwarded":       {`for=198.51.100.1;proto=https, for="[fd00::3]:8080";proto=http`},
+				"X-Forwarded-For": {"1.2.3.4"},
+			},
+			wantIP:     "198.51.100.1",
+			wantScheme: "https",
+		},
+		{
+			name:       "forwarded ipv6 client",
+			remoteAddr: "10.0.0.2:1234",
+			headers: map[string][]string{
+				"Forwarded": {`for="[2001:db8::1]:4711";proto=https`},
+			},
+			wantIP:     "2001:db8::1",
+			wantScheme: "https",
+		},
+		{
+			name:       "obfuscated hop stops the walk",
+			remoteAddr: "10.0.0.2:1234",
+			headers: map[string][]string{
+				"Forwarded": {`for=198.51.100.1, for=_hidden, for=10.0.0.3`},
+			},
+			wantIP:     "10.0.0.3",
+			wantScheme: "http",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var gotIP, gotScheme string
+			handler := ClientIP(trusted)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				gotIP = ClientIPFromCtx(r.Context())
+				gotScheme = SchemeFromCtx(r.Context())
+			}))
+
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.RemoteAddr = tt.remoteAddr
+			if tt.tls {
+				r.TLS = &tls.ConnectionState{}
+			} else {
+				r.TLS = nil
+			}
+			for k, values := range tt.headers {
+				for _, v := range values {
+					r.Header.Add(k, v)
+				}
+			}
+
+			handler.ServeHTTP(httptest.NewRecorder(), r)
+			require.Equal(t, tt.wantIP, gotIP)
+			require.Equal(t, tt.wantScheme, gotScheme)
+		})
+	}
+}
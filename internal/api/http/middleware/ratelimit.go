@@ -0,0 +1,109 @@
+package middleware
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/davemolk/chuck/internal/ratelimit"
+	"go.uber.org/zap"
+)
+
+// RateLimits are the limits for each route. Routes without their own limit
+// share a single Default bucket per caller.
+type RateLimits struct {
+	Default ratelimit.Limit
+	// Routes maps a route pattern, as registered on the router, to its limit.
+	Routes map[string]ratelimit.Limit
+}
+
+// Limits holds the RateLimits in use, which can be swapped while serving.
+type Limits struct {
+	current atomic.Pointer[RateLimits]
+}
+
+func NewLimits(limits RateLimits) *Limits {
+	l := &Limits{}
+	l.Store(limits)
+	return l
+}
+
+func (l *Limits) Load() RateLimits {
+	return *l.current.Load()
+}
+
+// Store applies limits from the next request on. Buckets are keyed by route,
+// so callers keep their tokens and just refill at the new rate.
+func (l *Limits) Store(limits RateLimits) {
+	l.current.Store(&limits)
+}
+
+// RateLimit limits each caller with a token bucket per route. Callers are
+// identified by user or service when authenticated and by client ip
+// otherwise, so it has to sit inside Auth and ClientIP. Rejected requests
+// get a 429 with a Retry-After header, and every response gets RateLimit-*
+// headers, see
+// https://datatracker.ietf.org/doc/draft-ietf-httpapi-ratelimit-headers/.
+//
+// If the store fails the request is let through, a broken limiter shouldn't
+// take the api down with it.
+func RateLimit(logger *zap.Logger, store ratelimit.Store, mux router, limits *Limits) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, pattern := mux.Handler(r)
+			current := limits.Load()
+
+			bucket, limit := "default", current.Default
+			if l, ok := current.Routes[pattern]; ok {
+				bucket, limit = pattern, l
+			}
+
+			key := bucket + "|" + principal(r)
+
+			res, err := store.Take(r.Context(), key, limit)
+			if err != nil {
+				logger.Error("rate limit store failed", zap.String("request_id", RequestIDFromCtx(r.Context())), zap.String("key", key), zap.Error(err))
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			h := w.Header()
+			h.Set("RateLimit-Policy", fmt.Sprintf("%d;w=%d", limit.Requests, int(limit.Per.Seconds())))
+			h.Set("RateLimit-Limit", strconv.Itoa(res.Limit))
+			h.Set("RateLimit-Remaining", strconv.Itoa(res.Remaining))
+			h.Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(res.ResetAfter)))
+
+			if !res.Allowed {
+				h.Set("Retry-After", strconv.Itoa(ceilSeconds(res.RetryAfter)))
+				logger.Debug("rate limited", zap.String("request_id", RequestIDFromCtx(r.Context())), zap.String("key", key))
+				respondTooManyRequests(w, r)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// principal is who a request is counted against.
+func principal(r *http.Request) string {
+	if user, err := UserFromCtx(r.Context()); err == nil {
+		return "user:" + strconv.FormatInt(user.ID, 10)
+	}
+	if service, ok := ServiceFromCtx(r.Context()); ok {
+		return "service:" + service.Name
+	}
+
+	return "ip:" + ClientIPFromCtx(r.Context())
+}
+
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
+
+func respondTooManyRequests(w http.ResponseWriter, r *http.Request) {
+	respondError(w, r, http.StatusTooManyRequests, "rate limit exceeded", "")
+}
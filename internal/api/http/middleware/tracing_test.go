@@ -0,0 +1,58 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/davemolk/chuck/internal/tracing"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestTracing(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	tp := tracing.Install(exporter, "chuck-test")
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /jokes/{id}", func(w http.ResponseWriter, r *http.Request) {
+		_, span := tracing.Start(r.Context(), "joke.Get")
+		span.End()
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+
+	handler := RequestID(Tracing(mux)(mux))
+
+	// a caller that's already tracing
+	traceID := "4bf92f3577b34da6a3ce929d0e0e4736"
+	r := httptest.NewRequest("GET", "/jokes/42", nil)
+	r.Header.Set("traceparent", "00-"+traceID+"-00f067aa0ba902b7-01")
+	w := httptest.NewRecorder()
+
+	handler.ServeHTTP(w, r)
+	require.NoError(t, tp.ForceFlush(r.Context()))
+
+	spans := exporter.GetSpans()
+	require.Len(t, spans, 2)
+
+	child, root := spans[0], spans[1]
+	require.Equal(t, "joke.Get", child.Name)
+	require.Equal(t, root.SpanContext.SpanID(), child.Parent.SpanID())
+
+	require.Equal(t, "GET /jokes/{id}", root.Name)
+	require.Equal(t, traceID, root.SpanContext.TraceID().String())
+	require.Equal(t, codes.Error, root.Status.Code)
+
+	attrs := make(map[attribute.Key]attribute.Value)
+	for _, kv := range root.Attributes {
+		attrs[kv.Key] = kv.Value
+	}
+	require.Equal(t, w.Header().Get(requestIDHeader), attrs["request_id"].AsString())
+	require.Equal(t, int64(http.StatusInternalServerError), attrs["http.response.status_code"].AsInt64())
+	require.Equal(t, "/jokes/42", attrs["url.path"].AsString())
+}
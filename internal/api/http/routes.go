@@ -2,41 +2,159 @@ package http
 
 import (
 	"net/http"
+	"net/netip"
+	"time"
 
 	"github.com/davemolk/chuck/internal/api/http/handlers"
 	"github.com/davemolk/chuck/internal/api/http/middleware"
+	"github.com/davemolk/chuck/internal/health"
+	"github.com/davemolk/chuck/internal/ratelimit"
 	"github.com/davemolk/chuck/internal/service"
 	"go.uber.org/zap"
 )
 
 type Services struct {
-	JokeService service.JokeService
-	UserService service.UserService
-	AuthService service.AuthService
+	JokeService  service.JokeService
+	UserService  service.UserService
+	AuthService  service.AuthService
+	MFAService   service.MFAService
+	UsageService service.UsageService
 }
 
-func NewRoutes(logger *zap.Logger, services *Services) http.Handler {
+// DefaultUnverifiedRoutes are the routes a user can reach before verifying
+// their email: enough to read jokes, finish verification (or fix a typo in
+// the email), and secure or delete the account.
+var DefaultUnverifiedRoutes = []string{
+	"GET /health",
+	"GET /livez",
+	"GET /readyz",
+	"GET /api/v1/jokes/random",
+	"GET /api/v1/jokes/personalized",
+	"POST /api/v1/users/verify",
+	"POST /api/v1/users/verify/resend",
+	"GET /api/v1/me",
+	"PATCH /api/v1/me",
+	"DELETE /api/v1/me",
+	"GET /api/v1/me/export",
+	"GET /api/v1/me/usage",
+	"PUT /api/v1/me/password",
+	"POST /api/v1/me/mfa/totp",
+	"POST /api/v1/me/mfa/totp/confirm",
+}
+
+// DefaultRateLimits keep search, which costs an upstream api call, and the
+// endpoints that check passwords or send emails well below everything else.
+var DefaultRateLimits = middleware.RateLimits{
+	Default: ratelimit.Limit{Requests: 120, Per: time.Minute},
+	Routes: map[string]ratelimit.Limit{
+		"GET /api/v1/jokes/random":                 {Requests: 60, Per: time.Minute},
+		"GET /api/v1/jokes/personalized":           {Requests: 30, Per: time.Minute},
+		"GET /api/v1/jokes/search":                 {Requests: 10, Per: time.Minute},
+		"POST /api/v1/users":                       {Requests: 10, Per: time.Hour},
+		"POST /api/v1/auth/login":                  {Requests: 10, Per: time.Minute},
+		"POST /api/v1/auth/login/mfa":              {Requests: 10, Per: time.Minute},
+		"POST /api/v1/auth/password-reset":         {Requests: 5, Per: time.Hour},
+		"POST /api/v1/auth/password-reset/confirm": {Requests: 10, Per: time.Minute},
+	},
+}
+
+type RoutesConfig struct {
+	// UnverifiedRoutes are the route patterns unverified users are allowed to
+	// use. Defaults to DefaultUnverifiedRoutes when nil.
+	UnverifiedRoutes []string
+	// RateLimitStore keeps the rate limit buckets. Defaults to an in-process
+	// store, which is only accurate with a single instance.
+	RateLimitStore ratelimit.Store
+	// RateLimits defaults to DefaultRateLimits when nil.
+	RateLimits *middleware.Limits
+	// Health runs the readiness checks. Defaults to a checker with no checks.
+	Health *health.Checker
+	// CertPrincipals maps verified client certificates to users and services,
+	// keyed by identity. Client certificates aren't used for auth when nil.
+	CertPrincipals map[string]middleware.CertPrincipal
+	// TrustedProxies are allowed to set the client ip and scheme with
+	// forwarding headers. None are trusted when empty.
+	TrustedProxies []netip.Prefix
+	// ReadYourWrites has a request's reads go to the primary once it has
+	// written, rather than to a replica that might not have the write yet.
+	ReadYourWrites bool
+}
+
+func NewRoutes(logger *zap.Logger, services *Services, cfg RoutesConfig) http.Handler {
+	if cfg.UnverifiedRoutes == nil {
+		cfg.UnverifiedRoutes = DefaultUnverifiedRoutes
+	}
+	if cfg.RateLimitStore == nil {
+		cfg.RateLimitStore = ratelimit.NewMemory()
+	}
+	if cfg.RateLimits == nil {
+		cfg.RateLimits = middleware.NewLimits(DefaultRateLimits)
+	}
+	if cfg.Health == nil {
+		cfg.Health = health.NewChecker(time.Second)
+	}
+
+	var certs *middleware.CertAuthenticator
+	if cfg.CertPrincipals != nil {
+		certs = middleware.NewCertAuthenticator(services.UserService, cfg.CertPrincipals)
+	}
+
 	mux := http.NewServeMux()
 
-	health := handlers.NewHealthHandlers()
-	jokes := handlers.NewJokeHandlers(logger, services.JokeService)
+	healthz := handlers.NewHealthHandlers(cfg.Health)
+	jokes := handlers.NewJokeHandlers(logger, services.JokeService, services.UsageService)
 	users := handlers.NewUserHandlers(logger, services.UserService)
 	auth := handlers.NewAuthHandlers(logger, services.AuthService)
+	mfa := handlers.NewMFAHandlers(logger, services.MFAService)
+	me := handlers.NewMeHandlers(logger, services.UserService, services.AuthService)
+	usage := handlers.NewUsageHandlers(logger, services.UsageService)
 
-	mux.HandleFunc("GET /health", health.HealthCheck)
+	// /health is the old liveness check, kept for anything still probing it
+	mux.HandleFunc("GET /health", healthz.Livez)
+	mux.HandleFunc("GET /livez", healthz.Livez)
+	mux.HandleFunc("GET /readyz", healthz.Readyz)
 
 	mux.HandleFunc("GET /api/v1/jokes/random", jokes.GetRandomJoke)
 	mux.HandleFunc("GET /api/v1/jokes/search", middleware.RequireAuth(jokes.GetRandomJokeByQuery))
 	mux.HandleFunc("GET /api/v1/jokes/personalized", middleware.RequireAuth(jokes.GetPersonalizedJoke))
 
 	mux.HandleFunc("POST /api/v1/users", users.CreateUser)
+	mux.HandleFunc("POST /api/v1/users/verify", users.VerifyEmail)
+	mux.HandleFunc("POST /api/v1/users/verify/resend", middleware.RequireAuth(users.ResendVerification))
 	mux.HandleFunc("POST /api/v1/auth/login", auth.Login)
+	mux.HandleFunc("POST /api/v1/auth/login/mfa", auth.VerifyMFA)
+	mux.HandleFunc("POST /api/v1/auth/password-reset", auth.RequestPasswordReset)
+	mux.HandleFunc("POST /api/v1/auth/password-reset/confirm", auth.ResetPassword)
+
+	mux.HandleFunc("GET /api/v1/me", middleware.RequireAuth(me.GetMe))
+	mux.HandleFunc("PATCH /api/v1/me", middleware.RequireAuth(me.UpdateMe))
+	mux.HandleFunc("DELETE /api/v1/me", middleware.RequireAuth(me.DeleteMe))
+	mux.HandleFunc("GET /api/v1/me/export", middleware.RequireAuth(me.ExportMe))
+	mux.HandleFunc("GET /api/v1/me/usage", middleware.RequireAuth(usage.GetMyUsage))
+	mux.HandleFunc("PUT /api/v1/me/password", middleware.RequireAuth(auth.ChangePassword))
+
+	mux.HandleFunc("POST /api/v1/me/mfa/totp", middleware.RequireAuth(mfa.EnrollTOTP))
+	mux.HandleFunc("POST /api/v1/me/mfa/totp/confirm", middleware.RequireAuth(mfa.ConfirmTOTP))
+
+	mux.HandleFunc("GET /api/v1/admin/usage", middleware.RequireAdmin(usage.GetReport))
+	mux.HandleFunc("GET /api/v1/admin/jokes/export", middleware.RequireAdmin(jokes.ExportJokes))
+	mux.HandleFunc("POST /api/v1/admin/jokes/import", middleware.RequireAdmin(jokes.ImportJokes))
 
 	var handler http.Handler = mux
+	// innermost, so only the handler's writes count and not, say, the rate
+	// limiter's
+	if cfg.ReadYourWrites {
+		handler = middleware.ReadYourWrites(handler)
+	}
+	handler = middleware.RestrictUnverified(mux, cfg.UnverifiedRoutes)(handler)
+	handler = middleware.RateLimit(logger, cfg.RateLimitStore, mux, cfg.RateLimits)(handler)
 	handler = middleware.Logger(logger)(handler)
-	handler = middleware.Auth(services.AuthService)(handler)
+	handler = middleware.Auth(services.AuthService, certs)(handler)
+	handler = middleware.ClientIP(cfg.TrustedProxies)(handler)
+	handler = middleware.Tracing(mux)(handler)
 	handler = middleware.RequestID(handler)
 	handler = middleware.RecoverPanic(logger)(handler)
+	handler = middleware.Metrics(mux)(handler)
 
 	return handler
 }
@@ -2,26 +2,111 @@ package http
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
+	"net"
 	"net/http"
+	"strconv"
 	"time"
 
+	"github.com/davemolk/chuck/internal/metrics"
 	"go.uber.org/zap"
 )
 
 type Server struct {
 	logger *zap.Logger
+	name   string
 	port   int
 	server *http.Server
 }
 
-func NewServer(logger *zap.Logger, port int, handler http.Handler) *Server {
+// ServerConfig is the api server's listener settings.
+type ServerConfig struct {
+	Port int
+	// TLS serves https when set. Certificates come from its GetCertificate,
+	// so they can be rotated without a restart.
+	TLS *tls.Config
+	// H2C also serves HTTP/2 over plain http, for proxies that speak it to
+	// their backends. It only applies without TLS.
+	H2C               bool
+	ReadHeaderTimeout time.Duration
+	ReadTimeout       time.Duration
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration
+}
+
+func NewServer(logger *zap.Logger, cfg ServerConfig, handler http.Handler) *Server {
+	s := &Server{
+		logger: logger,
+		name:   "api",
+		port:   cfg.Port,
+		server: &http.Server{
+			Addr:              fmt.Sprintf(":%d", cfg.Port),
+			Handler:           handler,
+			TLSConfig:         cfg.TLS,
+			ReadHeaderTimeout: cfg.ReadHeaderTimeout,
+			ReadTimeout:       cfg.ReadTimeout,
+			WriteTimeout:      cfg.WriteTimeout,
+			IdleTimeout:       cfg.IdleTimeout,
+		},
+	}
+
+	if cfg.TLS == nil && cfg.H2C {
+		protocols := new(http.Protocols)
+		protocols.SetHTTP1(true)
+		protocols.SetUnencryptedHTTP2(true)
+		s.server.Protocols = protocols
+	}
+
+	return s
+}
+
+// NewRedirectServer sends plain http requests to the same url over https on
+// httpsPort.
+func NewRedirectServer(logger *zap.Logger, port, httpsPort int) *Server {
 	return &Server{
 		logger: logger,
+		name:   "redirect",
 		port:   port,
 		server: &http.Server{
 			Addr:              fmt.Sprintf(":%d", port),
-			Handler:           handler,
+			Handler:           redirectHandler(httpsPort),
+			ReadHeaderTimeout: 5 * time.Second,
+			ReadTimeout:       10 * time.Second,
+			WriteTimeout:      20 * time.Second,
+			IdleTimeout:       120 * time.Second,
+		},
+	}
+}
+
+func redirectHandler(httpsPort int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host = r.Host
+		}
+		if httpsPort != 443 {
+			host = net.JoinHostPort(host, strconv.Itoa(httpsPort))
+		}
+
+		// 308 rather than 301 so clients keep the method and body
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusPermanentRedirect)
+	})
+}
+
+// NewAdminServer is for operational endpoints like metrics. It's plain http,
+// the port isn't meant to be reachable from outside.
+func NewAdminServer(logger *zap.Logger, port int) *Server {
+	mux := http.NewServeMux()
+	mux.Handle("GET /metrics", metrics.Handler())
+
+	return &Server{
+		logger: logger,
+		name:   "admin",
+		port:   port,
+		server: &http.Server{
+			Addr:              fmt.Sprintf(":%d", port),
+			Handler:           mux,
 			ReadHeaderTimeout: 5 * time.Second,
 			ReadTimeout:       10 * time.Second,
 			WriteTimeout:      20 * time.Second,
@@ -31,11 +116,14 @@ func NewServer(logger *zap.Logger, port int, handler http.Handler) *Server {
 }
 
 func (s *Server) Run() error {
-	s.logger.Info("starting server", zap.Int("port", s.port))
-	return s.server.ListenAndServeTLS("/tls/cert.pem", "/tls/key.pem")
+	s.logger.Info("starting server", zap.String("server", s.name), zap.Int("port", s.port))
+	if s.server.TLSConfig == nil {
+		return s.server.ListenAndServe()
+	}
+	return s.server.ListenAndServeTLS("", "")
 }
 
 func (s *Server) Shutdown(ctx context.Context) error {
-	s.logger.Info("shutting down server")
+	s.logger.Info("shutting down server", zap.String("server", s.name))
 	return s.server.Shutdown(ctx)
 }
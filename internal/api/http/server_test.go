@@ -0,0 +1,65 @@
+package http
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestRedirect(t *testing.T) {
+	tests := []struct {
+		name      string
+		httpsPort int
+		url       string
+		want      string
+	}{
+		{name: "default port", httpsPort: 443, url: "http://chuck.example.com:8081/api/v1/jokes/search?query=kick", want: "https://chuck.example.com/api/v1/jokes/search?query=kick"},
+		{name: "other port", httpsPort: 8443, url: "http://chuck.example.com/livez", want: "https://chuck.example.com:8443/livez"},
+		{name: "ipv6", httpsPort: 8443, url: "http://[::1]:8081/", want: "https://[::1]:8443/"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			redirectHandler(tt.httpsPort).ServeHTTP(w, httptest.NewRequest(http.MethodPost, tt.url, nil))
+
+			require.Equal(t, http.StatusPermanentRedirect, w.Code)
+			require.Equal(t, tt.want, w.Header().Get("Location"))
+		})
+	}
+}
+
+func TestH2C(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(r.Proto))
+	})
+
+	s := NewServer(zap.NewNop(), ServerConfig{H2C: true}, handler)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go func() { _ = s.server.Serve(l) }()
+	t.Cleanup(func() { _ = s.server.Close() })
+
+	get := func(t *testing.T, protocols *http.Protocols) string {
+		client := &http.Client{Transport: &http.Transport{Protocols: protocols}}
+		resp, err := client.Get("http://" + l.Addr().String())
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		return resp.Proto
+	}
+
+	t.Run("http/2 with prior knowledge", func(t *testing.T) {
+		protocols := new(http.Protocols)
+		protocols.SetUnencryptedHTTP2(true)
+		require.Equal(t, "HTTP/2.0", get(t, protocols))
+	})
+
+	t.Run("http/1.1 still works", func(t *testing.T) {
+		require.Equal(t, "HTTP/1.1", get(t, nil))
+	})
+}
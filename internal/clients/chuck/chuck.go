@@ -4,19 +4,26 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
 	"net/url"
 	"strings"
 	"time"
 
 	"github.com/davemolk/chuck/internal/domain"
+	"github.com/davemolk/chuck/internal/metrics"
+	"github.com/davemolk/chuck/internal/tracing"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
 )
 
 const (
-	baseURL            = "https://api.chucknorris.io"
+	DefaultBaseURL     = "https://api.chucknorris.io"
+	DefaultTimeout     = 10 * time.Second
 	responseTimeFormat = "2006-01-02 15:04:05"
-	requestTimeout     = 10 * time.Second
 )
 
 type APIClient struct {
@@ -25,16 +32,53 @@ type APIClient struct {
 	baseURL string
 }
 
-func NewClient(logger *zap.Logger) *APIClient {
+func NewClient(logger *zap.Logger, baseURL string, timeout time.Duration) *APIClient {
 	return &APIClient{
 		logger: logger,
 		client: &http.Client{
-			Timeout: requestTimeout,
+			Timeout: timeout,
 		},
-		baseURL: baseURL,
+		baseURL: strings.TrimSuffix(baseURL, "/"),
 	}
 }
 
+// Ping checks the api is up by fetching the (small) list of categories.
+func (c *APIClient) Ping(ctx context.Context) error {
+	ctx, span := tracing.Start(ctx, "chuck.Ping")
+	defer span.End()
+
+	start := time.Now()
+	err := c.ping(ctx)
+	metrics.ObserveUpstream("ping", time.Since(start), err)
+	tracing.RecordError(span, err)
+
+	return err
+}
+
+func (c *APIClient) ping(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.baseURL+"/jokes/categories", nil)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+
+	req.Header.Set("User-Agent", "https://github.com/davemolk/chuck")
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to make request: %w", err)
+	}
+
+	defer func() { _ = resp.Body.Close() }()
+	_, _ = io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected response status: %s", resp.Status)
+	}
+
+	return nil
+}
+
 type chuckSearchResponse struct {
 	Total  int `json:"total"`
 	Result []struct {
@@ -52,6 +96,18 @@ type chuckSearchResponse struct {
 // to restrict what the caller gets -- the chuck norris endpoint does not support limits and
 // can return large results (e.g. 9667 records for a query of 'chuck').
 func (c *APIClient) Search(ctx context.Context, query string, limit int) ([]*domain.Joke, error) {
+	ctx, span := tracing.Start(ctx, "chuck.Search", attribute.String("chuck.query", query), attribute.Int("chuck.limit", limit))
+	defer span.End()
+
+	start := time.Now()
+	jokes, err := c.search(ctx, query, limit)
+	metrics.ObserveUpstream("search", time.Since(start), err)
+	tracing.RecordError(span, err)
+
+	return jokes, err
+}
+
+func (c *APIClient) search(ctx context.Context, query string, limit int) ([]*domain.Joke, error) {
 	logger := c.logger.With(zap.String("query", query), zap.Int("limit", limit))
 	logger.Info("calling api search")
 
@@ -63,12 +119,16 @@ func (c *APIClient) Search(ctx context.Context, query string, limit int) ([]*dom
 	}
 
 	req.Header.Set("User-Agent", "https://github.com/davemolk/chuck")
+	// pass the trace along in case the api, or anything in between, cares
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
 
 	resp, err := c.client.Do(req)
 	if err != nil {
 		return nil, fmt.Errorf("failed to make request: %w", err)
 	}
 
+	trace.SpanFromContext(ctx).SetAttributes(attribute.Int("http.response.status_code", resp.StatusCode))
+
 	defer func() { _ = resp.Body.Close() }()
 
 	if resp.StatusCode != http.StatusOK {
@@ -6,7 +6,11 @@ import (
 	"net/http/httptest"
 	"testing"
 
+	"github.com/davemolk/chuck/internal/tracing"
 	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
 	"go.uber.org/zap"
 )
 
@@ -20,7 +24,7 @@ func TestSearch(t *testing.T) {
 			}))
 		defer ts.Close()
 
-		c := NewClient(zap.NewNop())
+		c := NewClient(zap.NewNop(), DefaultBaseURL, DefaultTimeout)
 		c.baseURL = ts.URL
 		c.client = ts.Client()
 
@@ -37,7 +41,7 @@ func TestSearch(t *testing.T) {
 			}))
 		defer ts.Close()
 
-		c := NewClient(zap.NewNop())
+		c := NewClient(zap.NewNop(), DefaultBaseURL, DefaultTimeout)
 		c.baseURL = ts.URL
 		c.client = ts.Client()
 
@@ -54,7 +58,7 @@ func TestSearch(t *testing.T) {
 			}))
 		defer ts.Close()
 
-		c := NewClient(zap.NewNop())
+		c := NewClient(zap.NewNop(), DefaultBaseURL, DefaultTimeout)
 		c.baseURL = ts.URL
 		c.client = ts.Client()
 
@@ -63,3 +67,47 @@ func TestSearch(t *testing.T) {
 		require.Len(t, got, 0)
 	})
 }
+
+func TestSearchPropagatesTrace(t *testing.T) {
+	tp := tracing.Install(tracetest.NewInMemoryExporter(), "chuck-test")
+	defer func() { _ = tp.Shutdown(context.Background()) }()
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	var traceparent string
+	ts := httptest.NewTLSServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			traceparent = r.Header.Get("traceparent")
+			http.ServeFile(w, r, "testdata/empty.json")
+		}))
+	defer ts.Close()
+
+	c := NewClient(zap.NewNop(), DefaultBaseURL, DefaultTimeout)
+	c.baseURL = ts.URL
+	c.client = ts.Client()
+
+	ctx, span := tracing.Start(context.Background(), "test")
+	defer span.End()
+
+	_, err := c.Search(ctx, "foo", 10)
+	require.NoError(t, err)
+	require.Contains(t, traceparent, span.SpanContext().TraceID().String())
+}
+
+func TestPing(t *testing.T) {
+	status := http.StatusOK
+	ts := httptest.NewTLSServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			require.Equal(t, "/jokes/categories", r.URL.Path)
+			w.WriteHeader(status)
+		}))
+	defer ts.Close()
+
+	c := NewClient(zap.NewNop(), DefaultBaseURL, DefaultTimeout)
+	c.baseURL = ts.URL
+	c.client = ts.Client()
+
+	require.NoError(t, c.Ping(context.Background()))
+
+	status = http.StatusBadGateway
+	require.Error(t, c.Ping(context.Background()))
+}
@@ -0,0 +1,189 @@
+package mailer
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"mime"
+	"net"
+	"net/smtp"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer sends email. SMTP is the real thing, Log is for local development,
+// and Memory is for tests.
+type Mailer interface {
+	Send(ctx context.Context, msg Message) error
+}
+
+var (
+	_ Mailer = (*SMTP)(nil)
+	_ Mailer = (*Log)(nil)
+	_ Mailer = (*Memory)(nil)
+)
+
+type SMTP struct {
+	logger *zap.Logger
+	host   string
+	port   int
+	auth   smtp.Auth
+	from   string
+}
+
+// NewSMTP returns a mailer that delivers through an smtp server, upgrading to
+// tls when the server supports it. Leave username empty to skip auth.
+func NewSMTP(logger *zap.Logger, host string, port int, username, password, from string) *SMTP {
+	var auth smtp.Auth
+	if username != "" {
+		auth = smtp.PlainAuth("", username, password, host)
+	}
+
+	return &SMTP{
+		logger: logger,
+		host:   host,
+		port:   port,
+		auth:   auth,
+		from:   from,
+	}
+}
+
+func (m *SMTP) Send(ctx context.Context, msg Message) error {
+	logger := m.logger.With(zap.String("to", msg.To), zap.String("subject", msg.Subject))
+
+	// net/smtp doesn't take a context, so we dial ourselves and use the
+	// deadline, if there is one, for the whole conversation
+	addr := net.JoinHostPort(m.host, strconv.Itoa(m.port))
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to dial smtp server: %w", err)
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+
+	c, err := smtp.NewClient(conn, m.host)
+	if err != nil {
+		_ = conn.Close()
+		return fmt.Errorf("failed to create smtp client: %w", err)
+	}
+
+	defer func() { _ = c.Close() }()
+
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err = c.StartTLS(&tls.Config{ServerName: m.host}); err != nil {
+			return fmt.Errorf("failed to start tls: %w", err)
+		}
+	}
+
+	if m.auth != nil {
+		if err = c.Auth(m.auth); err != nil {
+			return fmt.Errorf("failed to authenticate: %w", err)
+		}
+	}
+
+	if err = c.Mail(m.from); err != nil {
+		return fmt.Errorf("failed to set sender: %w", err)
+	}
+
+	if err = c.Rcpt(msg.To); err != nil {
+		return fmt.Errorf("failed to set recipient: %w", err)
+	}
+
+	w, err := c.Data()
+	if err != nil {
+		return fmt.Errorf("failed to start data: %w", err)
+	}
+
+	if _, err = w.Write(buildMessage(m.from, msg, time.Now())); err != nil {
+		return fmt.Errorf("failed to write message: %w", err)
+	}
+
+	if err = w.Close(); err != nil {
+		return fmt.Errorf("failed to send message: %w", err)
+	}
+
+	logger.Info("email sent")
+
+	return c.Quit()
+}
+
+func buildMessage(from string, msg Message, now time.Time) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: %s\r\n", from)
+	fmt.Fprintf(&b, "To: %s\r\n", msg.To)
+	fmt.Fprintf(&b, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", msg.Subject))
+	fmt.Fprintf(&b, "Date: %s\r\n", now.Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	b.WriteString("\r\n")
+	b.WriteString(msg.Body)
+
+	return b.Bytes()
+}
+
+// Log writes emails to the logger instead of sending them, so flows like
+// password reset work locally without a mail server.
+type Log struct {
+	logger *zap.Logger
+}
+
+func NewLog(logger *zap.Logger) *Log {
+	return &Log{logger: logger}
+}
+
+func (m *Log) Send(ctx context.Context, msg Message) error {
+	m.logger.Info("email", zap.String("to", msg.To), zap.String("subject", msg.Subject), zap.String("body", msg.Body))
+	return nil
+}
+
+// Memory keeps sent emails so tests can inspect them.
+type Memory struct {
+	mu       sync.Mutex
+	messages []Message
+}
+
+func NewMemory() *Memory {
+	return &Memory{}
+}
+
+func (m *Memory) Send(ctx context.Context, msg Message) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.messages = append(m.messages, msg)
+	return nil
+}
+
+func (m *Memory) Messages() []Message {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	out := make([]Message, len(m.messages))
+	copy(out, m.messages)
+	return out
+}
+
+// Last returns the most recently sent email, or false if nothing has been sent.
+func (m *Memory) Last() (Message, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if len(m.messages) == 0 {
+		return Message{}, false
+	}
+
+	return m.messages[len(m.messages)-1], true
+}
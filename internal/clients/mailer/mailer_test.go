@@ -0,0 +1,118 @@
+package mailer
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestBuildMessage(t *testing.T) {
+	now := time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC)
+	msg := Message{
+		To:      "walker@ranger.com",
+		Subject: "roundhouse",
+		Body:    "hello",
+	}
+
+	got := string(buildMessage("chuck@norris.com", msg, now))
+	require.Contains(t, got, "From: chuck@norris.com\r\n")
+	require.Contains(t, got, "To: walker@ranger.com\r\n")
+	require.Contains(t, got, "Subject: roundhouse\r\n")
+	require.Contains(t, got, "Date: Thu, 02 Jan 2025 03:04:05 +0000\r\n")
+	require.True(t, strings.HasSuffix(got, "\r\n\r\nhello"))
+}
+
+func TestMemory(t *testing.T) {
+	m := NewMemory()
+
+	_, ok := m.Last()
+	require.False(t, ok)
+
+	err := m.Send(context.Background(), Message{To: "one"})
+	require.NoError(t, err)
+	err = m.Send(context.Background(), Message{To: "two"})
+	require.NoError(t, err)
+
+	require.Len(t, m.Messages(), 2)
+
+	last, ok := m.Last()
+	require.True(t, ok)
+	require.Equal(t, "two", last.To)
+}
+
+func TestSMTP(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer func() { _ = ln.Close() }()
+
+	// a bare-bones smtp server that accepts one message and records the data
+	data := make(chan string, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer func() { _ = conn.Close() }()
+
+		r := bufio.NewReader(conn)
+		write := func(s string) { _, _ = conn.Write([]byte(s + "\r\n")) }
+
+		write("220 localhost ESMTP")
+		var body strings.Builder
+		inData := false
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+
+			if inData {
+				if line == ".\r\n" {
+					inData = false
+					data <- body.String()
+					write("250 OK")
+					continue
+				}
+				body.WriteString(line)
+				continue
+			}
+
+			switch {
+			case strings.HasPrefix(line, "EHLO"), strings.HasPrefix(line, "HELO"):
+				write("250 localhost")
+			case strings.HasPrefix(line, "DATA"):
+				inData = true
+				write("354 go ahead")
+			case strings.HasPrefix(line, "QUIT"):
+				write("221 bye")
+				return
+			default:
+				write("250 OK")
+			}
+		}
+	}()
+
+	_, portStr, err := net.SplitHostPort(ln.Addr().String())
+	require.NoError(t, err)
+	port, err := strconv.Atoi(portStr)
+	require.NoError(t, err)
+
+	m := NewSMTP(zap.NewNop(), "127.0.0.1", port, "", "", "chuck@norris.com")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	err = m.Send(ctx, Message{To: "walker@ranger.com", Subject: "hi", Body: "roundhouse"})
+	require.NoError(t, err)
+
+	got := <-data
+	require.Contains(t, got, "To: walker@ranger.com")
+	require.Contains(t, got, "roundhouse")
+}
@@ -0,0 +1,266 @@
+// Package config loads the server's configuration. Each setting has a
+// default, which is overridden in turn by a YAML file, an env var and a
+// command line flag. Settings are described by struct tags:
+//
+//	yaml:   the key in the file. Flags use the dotted path, e.g. --server.port
+//	env:    the env var
+//	usage:  help text for the flag
+//	secret: "true" to redact the value when printing, or "url" to only
+//	        redact the password in a URL
+//	reload: "true" if a running server picks up changes on SIGHUP, anything
+//	        else needs a restart
+package config
+
+import (
+	"encoding/base64"
+	"net/netip"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/davemolk/chuck/internal/api/http/middleware"
+	"github.com/davemolk/chuck/internal/hasher"
+	"github.com/davemolk/chuck/internal/ratelimit"
+	"github.com/davemolk/chuck/internal/tlscert"
+	"go.uber.org/zap/zapcore"
+)
+
+type Config struct {
+	// Production switches to json logs at info level.
+	Production bool `yaml:"production" env:"PRODUCTION" usage:"json logs at info level"`
+	// LogLevel overrides the level Production picks.
+	LogLevel  string          `yaml:"log_level" env:"LOG_LEVEL" reload:"true" usage:"debug, info, warn or error, empty for debug in development and info in production"`
+	Server    ServerConfig    `yaml:"server"`
+	DB        DBConfig        `yaml:"db"`
+	Chuck     ChuckConfig     `yaml:"chuck"`
+	Auth      AuthConfig      `yaml:"auth"`
+	Password  PasswordConfig  `yaml:"password"`
+	Mail      MailConfig      `yaml:"mail"`
+	RateLimit RateLimitConfig `yaml:"rate_limit"`
+	Tracing   TracingConfig   `yaml:"tracing"`
+}
+
+// Listener modes.
+const (
+	// ModeTLS serves https only.
+	ModeTLS = "tls"
+	// ModePlain serves plain http, for when tls terminates at a proxy.
+	ModePlain = "plain"
+	// ModeBoth serves https, and redirects plain http to it.
+	ModeBoth = "both"
+)
+
+type ServerConfig struct {
+	Port         int    `yaml:"port" env:"PORT" usage:"api port"`
+	Mode         string `yaml:"mode" env:"SERVER_MODE" usage:"tls, plain (tls terminates at a proxy) or both (plain http redirects to https)"`
+	H2C          bool   `yaml:"h2c" env:"SERVER_H2C" usage:"serve http/2 without tls in plain mode"`
+	RedirectPort int    `yaml:"redirect_port" env:"REDIRECT_PORT" usage:"plain http port that redirects to https in both mode"`
+	AdminPort    int    `yaml:"admin_port" env:"ADMIN_PORT" usage:"port for /metrics, served over plain http"`
+	TLSCertFile  string `yaml:"tls_cert_file" env:"TLS_CERT_FILE" usage:"tls certificate (pem)"`
+	TLSKeyFile   string `yaml:"tls_key_file" env:"TLS_KEY_FILE" usage:"tls private key (pem)"`
+	// ClientAuth is none, request or require, see tlscert.
+	ClientAuth        string        `yaml:"client_auth" env:"CLIENT_AUTH" usage:"client certificates: none, request (verified if sent) or require"`
+	ClientCAFile      string        `yaml:"client_ca_file" env:"CLIENT_CA_FILE" usage:"ca bundle (pem) client certificates are verified against"`
+	ReadHeaderTimeout time.Duration `yaml:"read_header_timeout" env:"SERVER_READ_HEADER_TIMEOUT" usage:"time allowed to read request headers"`
+	ReadTimeout       time.Duration `yaml:"read_timeout" env:"SERVER_READ_TIMEOUT" usage:"time allowed to read a whole request"`
+	WriteTimeout      time.Duration `yaml:"write_timeout" env:"SERVER_WRITE_TIMEOUT" usage:"time allowed to write a response"`
+	IdleTimeout       time.Duration `yaml:"idle_timeout" env:"SERVER_IDLE_TIMEOUT" usage:"how long idle keep-alive connections are kept"`
+	ShutdownTimeout   time.Duration `yaml:"shutdown_timeout" env:"SHUTDOWN_TIMEOUT" usage:"time allowed for in-flight requests on shutdown"`
+	DrainDelay        time.Duration `yaml:"drain_delay" env:"SHUTDOWN_DRAIN_DELAY" usage:"how long /readyz fails before shutting down"`
+	// TrustedProxies can set the client ip and scheme with forwarding
+	// headers.
+	TrustedProxies   []string `yaml:"trusted_proxies" env:"TRUSTED_PROXIES" usage:"comma separated cidrs of proxies whose Forwarded and X-Forwarded-* headers are trusted"`
+	UnverifiedRoutes []string `yaml:"unverified_routes" env:"UNVERIFIED_ALLOWED_ROUTES" usage:"comma separated route patterns unverified users can reach, empty for the defaults"`
+}
+
+type DBConfig struct {
+	URL             string        `yaml:"url" env:"DATABASE_URL" secret:"url" usage:"postgres:// url, or sqlite://file to run without postgres"`
+	MaxOpenConns    int           `yaml:"max_open_conns" env:"DB_MAX_OPEN_CONNS" usage:"max open connections"`
+	MaxIdleConns    int           `yaml:"max_idle_conns" env:"DB_MAX_IDLE_CONNS" usage:"max idle connections"`
+	ConnMaxIdleTime time.Duration `yaml:"conn_max_idle_time" env:"DB_CONN_MAX_IDLE_TIME" usage:"how long a connection can sit idle"`
+	ConnMaxLifetime time.Duration `yaml:"conn_max_lifetime" env:"DB_CONN_MAX_LIFETIME" usage:"how long a connection is kept, 0 for forever"`
+	QueryTimeout    time.Duration `yaml:"query_timeout" env:"DB_QUERY_TIMEOUT" usage:"timeout for queries that don't have one, 0 for none"`
+	SlowQuery       time.Duration `yaml:"slow_query" env:"DB_SLOW_QUERY" usage:"log queries that take longer than this, 0 to log none"`
+	StatsInterval   time.Duration `yaml:"stats_interval" env:"DB_STATS_INTERVAL" usage:"how often to log the pool stats, 0 to only have them in /metrics"`
+	// MigrateOnStart runs any pending migrations before serving. Instances
+	// take turns, see migrations.NewMigrator.
+	MigrateOnStart bool `yaml:"migrate_on_start" env:"MIGRATE_ON_START" usage:"run pending migrations at startup"`
+	// ReplicaURLs get the joke reads, each has a pool sized like the
+	// primary's. See sqldb.DB.ReadQueryContext.
+	ReplicaURLs    []string `yaml:"replica_urls" env:"DATABASE_REPLICA_URLS" secret:"url" usage:"comma separated postgres:// urls of read replicas"`
+	ReadYourWrites bool     `yaml:"read_your_writes" env:"DB_READ_YOUR_WRITES" usage:"send a request's reads to the primary once it has written"`
+}
+
+type ChuckConfig struct {
+	BaseURL string        `yaml:"base_url" env:"CHUCK_API_URL" usage:"chuck norris api base url"`
+	Timeout time.Duration `yaml:"timeout" env:"CHUCK_API_TIMEOUT" usage:"chuck norris api request timeout"`
+}
+
+type AuthConfig struct {
+	TokenTTL time.Duration `yaml:"token_ttl" env:"TOKEN_TTL" usage:"how long a login lasts"`
+	// TOTPKey encrypts totp secrets at rest, 32 bytes base64 encoded.
+	TOTPKey string `yaml:"totp_key" env:"TOTP_ENCRYPTION_KEY" secret:"true" usage:"32 bytes, base64 encoded, that encrypt totp secrets"`
+	// CertPrincipals map client certificate identities to who they
+	// authenticate as, see middleware.ParseCertPrincipal.
+	CertPrincipals []string `yaml:"cert_principals" env:"CLIENT_CERT_PRINCIPALS" usage:"comma separated identity=user:email or identity=service:name"`
+}
+
+// TrustedProxyPrefixes parses TrustedProxies, which Load has already checked.
+func (c ServerConfig) TrustedProxyPrefixes() []netip.Prefix {
+	prefixes, _ := middleware.ParseTrustedProxies(c.TrustedProxies)
+	return prefixes
+}
+
+// CertPrincipalMap parses CertPrincipals, which Load has already checked.
+func (c AuthConfig) CertPrincipalMap() map[string]middleware.CertPrincipal {
+	principals := make(map[string]middleware.CertPrincipal, len(c.CertPrincipals))
+	for _, s := range c.CertPrincipals {
+		identity, p, _ := middleware.ParseCertPrincipal(s)
+		principals[identity] = p
+	}
+	return principals
+}
+
+type PasswordConfig struct {
+	// Argon2 params for new hashes. Changing them upgrades existing hashes as
+	// users log in.
+	Argon2MemoryKiB   uint32 `yaml:"argon2_memory_kib" env:"ARGON2_MEMORY_KIB" usage:"argon2id memory in KiB"`
+	Argon2Iterations  uint32 `yaml:"argon2_iterations" env:"ARGON2_ITERATIONS" usage:"argon2id iterations"`
+	Argon2Parallelism uint8  `yaml:"argon2_parallelism" env:"ARGON2_PARALLELISM" usage:"argon2id parallelism"`
+	MinScore          int    `yaml:"min_score" env:"PASSWORD_MIN_SCORE" usage:"minimum strength score, 0-4, for new passwords"`
+	BreachedDir       string `yaml:"breached_dir" env:"BREACHED_PASSWORDS_DIR" usage:"optional dir of breached password sha1 hash ranges"`
+}
+
+type MailConfig struct {
+	// Mailer is either "log" or "smtp".
+	Mailer       string `yaml:"mailer" env:"MAILER" usage:"log or smtp"`
+	SMTPHost     string `yaml:"smtp_host" env:"SMTP_HOST" usage:"smtp host"`
+	SMTPPort     int    `yaml:"smtp_port" env:"SMTP_PORT" usage:"smtp port"`
+	SMTPUsername string `yaml:"smtp_username" env:"SMTP_USERNAME" usage:"smtp username"`
+	SMTPPassword string `yaml:"smtp_password" env:"SMTP_PASSWORD" secret:"true" usage:"smtp password"`
+	From         string `yaml:"from" env:"MAIL_FROM" usage:"from address"`
+}
+
+type RateLimitConfig struct {
+	// Store is either "memory" or "postgres", which shares limits between
+	// instances.
+	Store string `yaml:"store" env:"RATE_LIMIT_STORE" usage:"memory or postgres"`
+	// Default and Routes override the built in limits, as requests/duration,
+	// e.g. "10/1m".
+	Default string   `yaml:"default" env:"RATE_LIMIT_DEFAULT" reload:"true" usage:"limit for routes without their own, e.g. 120/1m, empty for the built in one"`
+	Routes  []string `yaml:"routes" env:"RATE_LIMIT_ROUTES" reload:"true" usage:"comma separated per route limits, e.g. GET /api/v1/jokes/search=10/1m"`
+}
+
+// Limits parses Default and Routes, which Load has already checked. The
+// default is nil unless it's set.
+func (c RateLimitConfig) Limits() (*ratelimit.Limit, map[string]ratelimit.Limit) {
+	var def *ratelimit.Limit
+	if c.Default != "" {
+		l, _ := ratelimit.ParseLimit(c.Default)
+		def = &l
+	}
+
+	routes := make(map[string]ratelimit.Limit, len(c.Routes))
+	for _, route := range c.Routes {
+		pattern, limit, _ := strings.Cut(route, "=")
+		routes[strings.TrimSpace(pattern)], _ = ratelimit.ParseLimit(strings.TrimSpace(limit))
+	}
+
+	return def, routes
+}
+
+type TracingConfig struct {
+	// env names are the otel ones, so the usual setup just works
+	Exporter    string `yaml:"exporter" env:"OTEL_TRACES_EXPORTER" usage:"none, stdout or otlp"`
+	ServiceName string `yaml:"service_name" env:"OTEL_SERVICE_NAME" usage:"service name on spans"`
+}
+
+// Default is the config before anything is loaded. The database url and
+// totp key have no sensible default and have to be set.
+func Default() *Config {
+	return &Config{
+		Server: ServerConfig{
+			Port:              8080,
+			Mode:              ModeTLS,
+			H2C:               true,
+			RedirectPort:      8081,
+			AdminPort:         9090,
+			TLSCertFile:       "/tls/cert.pem",
+			TLSKeyFile:        "/tls/key.pem",
+			ClientAuth:        tlscert.ClientAuthNone,
+			ReadHeaderTimeout: 5 * time.Second,
+			ReadTimeout:       10 * time.Second,
+			WriteTimeout:      20 * time.Second,
+			IdleTimeout:       120 * time.Second,
+			ShutdownTimeout:   30 * time.Second,
+			DrainDelay:        5 * time.Second,
+		},
+		DB: DBConfig{
+			MaxOpenConns:    25,
+			MaxIdleConns:    25,
+			ConnMaxIdleTime: 10 * time.Minute,
+			ConnMaxLifetime: time.Hour,
+			QueryTimeout:    30 * time.Second,
+			SlowQuery:       500 * time.Millisecond,
+		},
+		Chuck: ChuckConfig{
+			BaseURL: "https://api.chucknorris.io",
+			Timeout: 10 * time.Second,
+		},
+		Auth: AuthConfig{
+			TokenTTL: 24 * time.Hour,
+		},
+		Password: PasswordConfig{
+			Argon2MemoryKiB:   hasher.DefaultParams.Memory,
+			Argon2Iterations:  hasher.DefaultParams.Iterations,
+			Argon2Parallelism: hasher.DefaultParams.Parallelism,
+			MinScore:          3,
+		},
+		Mail: MailConfig{
+			Mailer: "log",
+		},
+		RateLimit: RateLimitConfig{
+			Store: "memory",
+		},
+		Tracing: TracingConfig{
+			Exporter:    "none",
+			ServiceName: "chuck",
+		},
+	}
+}
+
+// TOTPKeyBytes decodes TOTPKey, which Load has already checked.
+func (c AuthConfig) TOTPKeyBytes() []byte {
+	key, _ := base64.StdEncoding.DecodeString(c.TOTPKey)
+	return key
+}
+
+// Level is the log level to run at.
+func (c *Config) Level() zapcore.Level {
+	if c.LogLevel != "" {
+		level, _ := zapcore.ParseLevel(c.LogLevel)
+		return level
+	}
+	if c.Production {
+		return zapcore.InfoLevel
+	}
+	return zapcore.DebugLevel
+}
+
+// RestartRequired lists the settings that differ in next but can't be
+// changed without a restart.
+func (c *Config) RestartRequired(next *Config) []string {
+	var paths []string
+
+	nextFields := fieldsOf(next)
+	for i, f := range fieldsOf(c) {
+		if f.reload {
+			continue
+		}
+		if !reflect.DeepEqual(f.value.Interface(), nextFields[i].value.Interface()) {
+			paths = append(paths, f.path)
+		}
+	}
+
+	return paths
+}
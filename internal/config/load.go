@@ -0,0 +1,270 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Options control loading rather than the server, so they aren't part of
+// Config.
+type Options struct {
+	// File is the YAML file to load, from --config or CONFIG_FILE.
+	File string
+	// PrintConfig asks for the effective config to be printed instead of
+	// starting the server.
+	PrintConfig bool
+	// Args are what's left after the flags, e.g. a subcommand.
+	Args []string
+}
+
+// Load builds the config from the defaults, the file named by --config or
+// CONFIG_FILE, env vars and flags, in that order. A *ValidationError lists
+// every bad setting, and the returned config is still filled in as far as
+// possible so it can be printed.
+func Load(args []string, lookupEnv func(string) (string, bool)) (*Config, Options, error) {
+	cfg := Default()
+	fields := fieldsOf(cfg)
+
+	var opts Options
+	flagValues := make(map[string]string)
+
+	fs := flag.NewFlagSet("chuck", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	fs.StringVar(&opts.File, "config", "", "YAML config file")
+	fs.BoolVar(&opts.PrintConfig, "print-config", false, "print the effective config, secrets redacted, and exit")
+	for _, f := range fields {
+		fs.Var(&flagValue{field: f, values: flagValues}, f.path, f.usage)
+		if alias, ok := flagAliases[f.path]; ok {
+			fs.Var(&flagValue{field: f, values: flagValues}, alias, f.usage)
+		}
+	}
+
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return nil, opts, fmt.Errorf("%w\n\n%s", err, Usage())
+		}
+		return nil, opts, err
+	}
+	opts.Args = fs.Args()
+
+	if opts.File == "" {
+		opts.File, _ = lookupEnv("CONFIG_FILE")
+	}
+
+	var verr ValidationError
+
+	if opts.File != "" {
+		if err := loadFile(cfg, opts.File); err != nil {
+			return nil, opts, err
+		}
+	}
+
+	for _, f := range fields {
+		if v, ok := lookupEnv(f.env); ok && f.env != "" {
+			if err := f.set(v); err != nil {
+				verr.add(f.path, fmt.Sprintf("%s (from env %s)", err, f.env))
+			}
+		}
+	}
+
+	for _, f := range fields {
+		if v, ok := flagValues[f.path]; ok {
+			if err := f.set(v); err != nil {
+				verr.add(f.path, fmt.Sprintf("%s (from flag --%s)", err, f.path))
+			}
+		}
+	}
+
+	cfg.validate(&verr)
+	if len(verr.Problems) > 0 {
+		return cfg, opts, &verr
+	}
+
+	return cfg, opts, nil
+}
+
+func loadFile(cfg *Config, path string) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read config file: %w", err)
+	}
+
+	dec := yaml.NewDecoder(bytes.NewReader(b))
+	// a typo in a key would otherwise be silently ignored
+	dec.KnownFields(true)
+
+	if err = dec.Decode(cfg); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("failed to parse config file %s: %w", path, err)
+	}
+
+	// an empty list means the default, same as an empty env var, not an
+	// empty set
+	for _, f := range fieldsOf(cfg) {
+		if f.value.Kind() == reflect.Slice && f.value.Len() == 0 {
+			f.value.SetZero()
+		}
+	}
+
+	return nil
+}
+
+// flagAliases are shorter names for settings that are often passed as flags.
+var flagAliases = map[string]string{
+	"db.migrate_on_start": "migrate-on-start",
+}
+
+// Usage lists every flag and env var.
+func Usage() string {
+	var b strings.Builder
+	b.WriteString("  --config (CONFIG_FILE)\n\tYAML config file\n")
+	b.WriteString("  --print-config\n\tprint the effective config, secrets redacted, and exit\n")
+	for _, f := range fieldsOf(Default()) {
+		name := f.path
+		if alias, ok := flagAliases[f.path]; ok {
+			name += ", --" + alias
+		}
+		fmt.Fprintf(&b, "  --%s (%s)\n\t%s, default %q\n", name, f.env, f.usage, f.String())
+	}
+	return b.String()
+}
+
+// field is a single setting in Config.
+type field struct {
+	path   string
+	env    string
+	usage  string
+	secret string
+	reload bool
+	value  reflect.Value
+}
+
+// fieldsOf lists the settings in cfg, depth first in declaration order. The
+// values point into cfg.
+func fieldsOf(cfg *Config) []field {
+	var fields []field
+
+	var walk func(v reflect.Value, prefix string)
+	walk = func(v reflect.Value, prefix string) {
+		t := v.Type()
+		for i := range t.NumField() {
+			sf := t.Field(i)
+			name, _, _ := strings.Cut(sf.Tag.Get("yaml"), ",")
+			if name == "" || name == "-" {
+				continue
+			}
+
+			if sf.Type.Kind() == reflect.Struct {
+				walk(v.Field(i), prefix+name+".")
+				continue
+			}
+
+			fields = append(fields, field{
+				path:   prefix + name,
+				env:    sf.Tag.Get("env"),
+				usage:  sf.Tag.Get("usage"),
+				secret: sf.Tag.Get("secret"),
+				reload: sf.Tag.Get("reload") == "true",
+				value:  v.Field(i),
+			})
+		}
+	}
+	walk(reflect.ValueOf(cfg).Elem(), "")
+
+	return fields
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// set parses s into the field.
+func (f field) set(s string) error {
+	v := f.value
+
+	switch {
+	case v.Type() == durationType:
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return fmt.Errorf("invalid duration %q", s)
+		}
+		v.SetInt(int64(d))
+	case v.Kind() == reflect.String:
+		v.SetString(s)
+	case v.Kind() == reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return fmt.Errorf("invalid bool %q", s)
+		}
+		v.SetBool(b)
+	case v.CanInt():
+		n, err := strconv.ParseInt(s, 10, v.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("invalid integer %q", s)
+		}
+		v.SetInt(n)
+	case v.CanUint():
+		n, err := strconv.ParseUint(s, 10, v.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("invalid unsigned integer %q", s)
+		}
+		v.SetUint(n)
+	case v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.String:
+		var list []string
+		for _, item := range strings.Split(s, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, item)
+			}
+		}
+		v.Set(reflect.ValueOf(list))
+	default:
+		// only reachable by adding a field of a new type to Config
+		panic(fmt.Sprintf("config: unsupported type %s for %s", v.Type(), f.path))
+	}
+
+	return nil
+}
+
+func (f field) String() string {
+	v := f.value
+
+	switch {
+	case v.Type() == durationType:
+		return time.Duration(v.Int()).String()
+	case v.Kind() == reflect.Slice:
+		return strings.Join(v.Interface().([]string), ",")
+	default:
+		return fmt.Sprint(v.Interface())
+	}
+}
+
+// flagValue only records what was passed, so flags can be applied after the
+// file and env even though they're parsed first.
+type flagValue struct {
+	field  field
+	values map[string]string
+}
+
+func (fv *flagValue) String() string {
+	if fv.values == nil {
+		return ""
+	}
+	return fv.values[fv.field.path]
+}
+
+func (fv *flagValue) Set(s string) error {
+	fv.values[fv.field.path] = s
+	return nil
+}
+
+// IsBoolFlag lets bool settings be passed without a value, e.g. --production.
+func (fv *flagValue) IsBoolFlag() bool {
+	return fv.field.value.Kind() == reflect.Bool
+}
@@ -0,0 +1,78 @@
+package config
+
+import (
+	"net/url"
+	"reflect"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+const redacted = "REDACTED"
+
+// Redacted renders the config as YAML, in the same shape as the config file,
+// with secrets hidden.
+func (c *Config) Redacted() ([]byte, error) {
+	root := &yaml.Node{Kind: yaml.MappingNode}
+
+	for _, f := range fieldsOf(c) {
+		parent := root
+		parts := strings.Split(f.path, ".")
+		for _, section := range parts[:len(parts)-1] {
+			parent = child(parent, section)
+		}
+
+		value := &yaml.Node{Kind: yaml.ScalarNode}
+		if f.value.Kind() == reflect.Slice {
+			value = &yaml.Node{Kind: yaml.SequenceNode}
+			for _, item := range f.value.Interface().([]string) {
+				value.Content = append(value.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: redact(f.secret, item)})
+			}
+		} else {
+			value.Value = redact(f.secret, f.String())
+			if f.value.Kind() == reflect.String {
+				// quote anything that would otherwise read back as another type
+				value.Style = yaml.DoubleQuotedStyle
+			}
+		}
+
+		parent.Content = append(parent.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: parts[len(parts)-1]}, value)
+	}
+
+	return yaml.Marshal(root)
+}
+
+// child finds or adds the mapping for key under parent.
+func child(parent *yaml.Node, key string) *yaml.Node {
+	for i := 0; i < len(parent.Content); i += 2 {
+		if parent.Content[i].Value == key {
+			return parent.Content[i+1]
+		}
+	}
+
+	node := &yaml.Node{Kind: yaml.MappingNode}
+	parent.Content = append(parent.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: key}, node)
+
+	return node
+}
+
+// redact hides v according to a field's secret tag. Lists are redacted item
+// by item.
+func redact(secret, v string) string {
+	if v == "" {
+		return v
+	}
+
+	switch secret {
+	case "true":
+		return redacted
+	case "url":
+		u, err := url.Parse(v)
+		if err != nil {
+			return redacted
+		}
+		return u.Redacted()
+	default:
+		return v
+	}
+}
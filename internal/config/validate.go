@@ -0,0 +1,244 @@
+package config
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/davemolk/chuck/internal/api/http/middleware"
+	"github.com/davemolk/chuck/internal/ratelimit"
+	sqldb "github.com/davemolk/chuck/internal/sql"
+	"github.com/davemolk/chuck/internal/tlscert"
+	"go.uber.org/zap/zapcore"
+)
+
+type Problem struct {
+	Field   string
+	Message string
+}
+
+// ValidationError lists every bad setting, not just the first.
+type ValidationError struct {
+	Problems []Problem
+}
+
+func (e *ValidationError) Error() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "invalid config (%d problems):", len(e.Problems))
+	for _, p := range e.Problems {
+		fmt.Fprintf(&b, "\n  %s: %s", p.Field, p.Message)
+	}
+	return b.String()
+}
+
+// Only narrows the problems down to the settings under prefix, e.g. "db.",
+// for commands that don't need the rest. It's nil if none are left.
+func (e *ValidationError) Only(prefix string) error {
+	var only ValidationError
+	for _, p := range e.Problems {
+		if strings.HasPrefix(p.Field, prefix) {
+			only.Problems = append(only.Problems, p)
+		}
+	}
+
+	if len(only.Problems) == 0 {
+		return nil
+	}
+	return &only
+}
+
+func (e *ValidationError) add(field, message string) {
+	e.Problems = append(e.Problems, Problem{Field: field, Message: message})
+}
+
+func (c *Config) validate(e *ValidationError) {
+	if c.LogLevel != "" {
+		if _, err := zapcore.ParseLevel(c.LogLevel); err != nil {
+			e.add("log_level", fmt.Sprintf("must be debug, info, warn or error, got %q", c.LogLevel))
+		}
+	}
+
+	checkPort(e, "server.port", c.Server.Port)
+	checkPort(e, "server.admin_port", c.Server.AdminPort)
+	if c.Server.Port == c.Server.AdminPort {
+		e.add("server.admin_port", "must differ from server.port")
+	}
+
+	switch c.Server.Mode {
+	case ModeTLS, ModePlain:
+	case ModeBoth:
+		checkPort(e, "server.redirect_port", c.Server.RedirectPort)
+		if c.Server.RedirectPort == c.Server.Port || c.Server.RedirectPort == c.Server.AdminPort {
+			e.add("server.redirect_port", "must differ from server.port and server.admin_port")
+		}
+	default:
+		e.add("server.mode", fmt.Sprintf("must be tls, plain or both, got %q", c.Server.Mode))
+	}
+
+	if c.Server.Mode != ModePlain {
+		if c.Server.TLSCertFile == "" {
+			e.add("server.tls_cert_file", "is required")
+		}
+		if c.Server.TLSKeyFile == "" {
+			e.add("server.tls_key_file", "is required")
+		}
+	}
+	if _, err := tlscert.ClientAuthType(c.Server.ClientAuth); err != nil {
+		e.add("server.client_auth", fmt.Sprintf("must be none, request or require, got %q", c.Server.ClientAuth))
+	} else if c.Server.ClientAuth != tlscert.ClientAuthNone {
+		if c.Server.Mode == ModePlain {
+			e.add("server.client_auth", "needs tls, server.mode is plain")
+		}
+		if c.Server.ClientCAFile == "" {
+			e.add("server.client_ca_file", "is required to verify client certificates")
+		}
+	}
+	if _, err := middleware.ParseTrustedProxies(c.Server.TrustedProxies); err != nil {
+		e.add("server.trusted_proxies", err.Error())
+	}
+	for path, d := range map[string]int64{
+		"server.read_header_timeout": int64(c.Server.ReadHeaderTimeout),
+		"server.read_timeout":        int64(c.Server.ReadTimeout),
+		"server.write_timeout":       int64(c.Server.WriteTimeout),
+		"server.idle_timeout":        int64(c.Server.IdleTimeout),
+		"server.shutdown_timeout":    int64(c.Server.ShutdownTimeout),
+		"db.conn_max_idle_time":      int64(c.DB.ConnMaxIdleTime),
+		"chuck.timeout":              int64(c.Chuck.Timeout),
+		"auth.token_ttl":             int64(c.Auth.TokenTTL),
+	} {
+		if d <= 0 {
+			e.add(path, "must be positive")
+		}
+	}
+	for path, d := range map[string]int64{
+		"server.drain_delay":   int64(c.Server.DrainDelay),
+		"db.conn_max_lifetime": int64(c.DB.ConnMaxLifetime),
+		"db.query_timeout":     int64(c.DB.QueryTimeout),
+		"db.slow_query":        int64(c.DB.SlowQuery),
+		"db.stats_interval":    int64(c.DB.StatsInterval),
+	} {
+		if d < 0 {
+			e.add(path, "can't be negative")
+		}
+	}
+	for _, route := range c.Server.UnverifiedRoutes {
+		if method, path, ok := strings.Cut(route, " "); !ok || method == "" || !strings.HasPrefix(path, "/") {
+			e.add("server.unverified_routes", fmt.Sprintf("%q isn't a route pattern like \"GET /api/v1/jokes/random\"", route))
+		}
+	}
+
+	var driver sqldb.Driver
+	if c.DB.URL == "" {
+		e.add("db.url", "is required")
+	} else if d, err := sqldb.ParseDriver(c.DB.URL); err != nil {
+		e.add("db.url", "must be a postgres:// or sqlite:// url")
+	} else {
+		driver = d
+	}
+	for _, replicaURL := range c.DB.ReplicaURLs {
+		if d, err := sqldb.ParseDriver(replicaURL); err != nil || d != sqldb.Postgres {
+			e.add("db.replica_urls", "must be postgres:// urls")
+			break
+		}
+	}
+	if len(c.DB.ReplicaURLs) > 0 && driver == sqldb.SQLite {
+		e.add("db.replica_urls", "needs a postgres db.url")
+	}
+	if c.DB.MaxOpenConns < 1 {
+		e.add("db.max_open_conns", "must be at least 1")
+	}
+	if c.DB.MaxIdleConns < 0 {
+		e.add("db.max_idle_conns", "can't be negative")
+	} else if c.DB.MaxIdleConns > c.DB.MaxOpenConns {
+		e.add("db.max_idle_conns", "can't be more than db.max_open_conns")
+	}
+
+	if u, err := url.Parse(c.Chuck.BaseURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		e.add("chuck.base_url", "must be an http(s) url")
+	}
+
+	if c.Auth.TOTPKey == "" {
+		e.add("auth.totp_key", "is required, generate one with: openssl rand -base64 32")
+	} else if key, err := base64.StdEncoding.DecodeString(c.Auth.TOTPKey); err != nil {
+		e.add("auth.totp_key", "must be base64")
+	} else if len(key) != 32 {
+		e.add("auth.totp_key", fmt.Sprintf("must be 32 bytes, got %d", len(key)))
+	}
+
+	for _, p := range c.Auth.CertPrincipals {
+		if _, _, err := middleware.ParseCertPrincipal(p); err != nil {
+			e.add("auth.cert_principals", err.Error())
+		}
+	}
+	if len(c.Auth.CertPrincipals) > 0 && c.Server.ClientAuth == tlscert.ClientAuthNone {
+		e.add("auth.cert_principals", "needs server.client_auth set to request or require")
+	}
+
+	if c.Password.Argon2MemoryKiB < 8*uint32(c.Password.Argon2Parallelism) {
+		e.add("password.argon2_memory_kib", "must be at least 8 times password.argon2_parallelism")
+	}
+	if c.Password.Argon2Iterations < 1 {
+		e.add("password.argon2_iterations", "must be at least 1")
+	}
+	if c.Password.Argon2Parallelism < 1 {
+		e.add("password.argon2_parallelism", "must be at least 1")
+	}
+	if c.Password.MinScore < 0 || c.Password.MinScore > 4 {
+		e.add("password.min_score", "must be between 0 and 4")
+	}
+
+	switch c.Mail.Mailer {
+	case "log":
+	case "smtp":
+		if c.Mail.SMTPHost == "" {
+			e.add("mail.smtp_host", "is required for the smtp mailer")
+		}
+		checkPort(e, "mail.smtp_port", c.Mail.SMTPPort)
+		if c.Mail.From == "" {
+			e.add("mail.from", "is required for the smtp mailer")
+		}
+	default:
+		e.add("mail.mailer", fmt.Sprintf("must be log or smtp, got %q", c.Mail.Mailer))
+	}
+
+	switch c.RateLimit.Store {
+	case "memory":
+	case "postgres":
+		if driver == sqldb.SQLite {
+			e.add("rate_limit.store", "postgres needs a postgres db.url")
+		}
+	default:
+		e.add("rate_limit.store", fmt.Sprintf("must be memory or postgres, got %q", c.RateLimit.Store))
+	}
+	if c.RateLimit.Default != "" {
+		if _, err := ratelimit.ParseLimit(c.RateLimit.Default); err != nil {
+			e.add("rate_limit.default", err.Error())
+		}
+	}
+	for _, route := range c.RateLimit.Routes {
+		pattern, limit, ok := strings.Cut(route, "=")
+		if !ok || !strings.Contains(strings.TrimSpace(pattern), " /") {
+			e.add("rate_limit.routes", fmt.Sprintf("%q isn't like \"GET /api/v1/jokes/search=10/1m\"", route))
+			continue
+		}
+		if _, err := ratelimit.ParseLimit(strings.TrimSpace(limit)); err != nil {
+			e.add("rate_limit.routes", err.Error())
+		}
+	}
+
+	switch c.Tracing.Exporter {
+	case "none", "stdout", "otlp":
+	default:
+		e.add("tracing.exporter", fmt.Sprintf("must be none, stdout or otlp, got %q", c.Tracing.Exporter))
+	}
+	if c.Tracing.ServiceName == "" {
+		e.add("tracing.service_name", "is required")
+	}
+}
+
+func checkPort(e *ValidationError, field string, port int) {
+	if port < 1 || port > 65535 {
+		e.add(field, fmt.Sprintf("must be between 1 and 65535, got %d", port))
+	}
+}
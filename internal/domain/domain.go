@@ -7,6 +7,22 @@ import (
 
 var ErrNotFound = errors.New("record not found")
 
+// token scopes. a token is only valid for the scope it was created with, so
+// an mfa challenge can't be used in place of an access token.
+const (
+	ScopeAuthentication = "authentication"
+	ScopeMFA            = "mfa"
+	ScopePasswordReset  = "password-reset"
+	ScopeVerification   = "verification"
+)
+
+// usage events, recorded per user per day. see the usage service.
+const (
+	EventRandomJoke       = "random_joke"
+	EventPersonalizedJoke = "personalized_joke"
+	EventSearch           = "search"
+)
+
 type Joke struct {
 	ID         int64     `json:"id"`
 	ExternalID string    `json:"external_id"`
@@ -20,11 +36,109 @@ type Token struct {
 	Hash      []byte    `json:"-"`
 	UserID    int64     `json:"-"`
 	ExpiresAt time.Time `json:"expires_at"`
+	Scope     string    `json:"-"`
+	CreatedAt time.Time `json:"-"`
 }
 
 type User struct {
-	ID        int64     `json:"id"`
-	HashedPW  []byte    `json:"-"`
+	ID         int64      `json:"id"`
+	HashedPW   []byte     `json:"-"`
+	CreatedAt  time.Time  `json:"created_at"`
+	Email      string     `json:"email"`
+	VerifiedAt *time.Time `json:"verified_at"`
+	Plan       string     `json:"plan"`
+	IsAdmin    bool       `json:"is_admin"`
+}
+
+func (u *User) Verified() bool {
+	return u.VerifiedAt != nil
+}
+
+// Service is an internal caller authenticated by client certificate, rather
+// than as a user.
+type Service struct {
+	Name string `json:"name"`
+}
+
+type TOTPEnrollment struct {
+	Secret string `json:"secret"`
+	URI    string `json:"otpauth_uri"`
+	QRCode []byte `json:"qr_png"`
+}
+
+type UserStats struct {
+	ActiveSessions         int  `json:"active_sessions"`
+	MFAEnabled             bool `json:"mfa_enabled"`
+	RecoveryCodesRemaining int  `json:"recovery_codes_remaining"`
+}
+
+// Session is an access token as the user sees it. The token itself is never
+// stored, so there's nothing secret here.
+type Session struct {
 	CreatedAt time.Time `json:"created_at"`
-	Email     string    `json:"email"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// MFAStatus is the user's totp setup, without the secret.
+type MFAStatus struct {
+	Enabled       bool       `json:"enabled"`
+	ConfirmedAt   *time.Time `json:"confirmed_at"`
+	RecoveryCodes int        `json:"recovery_codes_remaining"`
+}
+
+// UserExport is everything we store about a user. Secrets (password hash,
+// totp secret, recovery codes, token hashes) are left out.
+type UserExport struct {
+	ExportedAt time.Time    `json:"exported_at"`
+	User       *User        `json:"user"`
+	Sessions   []Session    `json:"sessions"`
+	MFA        MFAStatus    `json:"mfa"`
+	Usage      []DailyUsage `json:"usage"`
+}
+
+type EventUsage struct {
+	Event string `json:"event"`
+	Count int    `json:"count"`
+	// Limit and Remaining are nil for events without a quota.
+	Limit     *int `json:"limit"`
+	Remaining *int `json:"remaining"`
+}
+
+// DailyUsage is the count for one event on one (utc) day.
+type DailyUsage struct {
+	Day   string `json:"day"`
+	Event string `json:"event"`
+	Count int    `json:"count"`
+}
+
+type Usage struct {
+	Plan string `json:"plan"`
+	// ResetAt is when today's counts, and so the quotas, start over.
+	ResetAt time.Time    `json:"reset_at"`
+	Today   []EventUsage `json:"today"`
+	History []DailyUsage `json:"history"`
+}
+
+// UsageReportRow is one user's total for an event over the report's range.
+type UsageReportRow struct {
+	UserID int64  `json:"user_id"`
+	Email  string `json:"email"`
+	Plan   string `json:"plan"`
+	Event  string `json:"event"`
+	Count  int64  `json:"count"`
+}
+
+// JokeImport is how a bulk import went. Jokes are upserted by external id,
+// so Imported counts updates too.
+type JokeImport struct {
+	Read     int `json:"read"`
+	Imported int `json:"imported"`
+	Failed   int `json:"failed"`
+	// Errors are the first hundred bad jokes, which were skipped.
+	Errors []ImportError `json:"errors"`
+}
+
+type ImportError struct {
+	Line  int    `json:"line"`
+	Error string `json:"error"`
 }
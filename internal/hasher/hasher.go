@@ -0,0 +1,188 @@
+// Package hasher hashes and verifies passwords.
+//
+// New hashes use argon2id in the PHC string format, e.g.
+//
+//	$argon2id$v=19$m=65536,t=3,p=2$<salt>$<key>
+//
+// so the algorithm and parameters are stored alongside every hash. That lets
+// the parameters change over time, and lets older hashes, including the
+// bcrypt hashes from before argon2id, keep working until they're upgraded.
+package hasher
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// bcrypt only looks at the first 72 bytes of a password.
+const bcryptMaxPasswordLength = 72
+
+var (
+	ErrUnknownAlgorithm = errors.New("unknown password hash algorithm")
+	ErrMalformedHash    = errors.New("malformed password hash")
+)
+
+// Params are the argon2id parameters. See RFC 9106 section 4 for guidance on
+// choosing them.
+type Params struct {
+	// Memory is in KiB.
+	Memory      uint32
+	Iterations  uint32
+	Parallelism uint8
+	SaltLength  uint32
+	KeyLength   uint32
+}
+
+// DefaultParams follow the second recommended option in RFC 9106, adjusted
+// for a small server: 64 MiB and three passes.
+var DefaultParams = Params{
+	Memory:      64 * 1024,
+	Iterations:  3,
+	Parallelism: 2,
+	SaltLength:  16,
+	KeyLength:   32,
+}
+
+func (p Params) validate() error {
+	switch {
+	case p.Iterations < 1:
+		return errors.New("iterations must be at least 1")
+	case p.Parallelism < 1:
+		return errors.New("parallelism must be at least 1")
+	case p.Memory < 8*uint32(p.Parallelism):
+		return fmt.Errorf("memory must be at least %d KiB for parallelism %d", 8*uint32(p.Parallelism), p.Parallelism)
+	case p.SaltLength < 8:
+		return errors.New("salt length must be at least 8 bytes")
+	case p.KeyLength < 16:
+		return errors.New("key length must be at least 16 bytes")
+	}
+
+	return nil
+}
+
+type Hasher struct {
+	params Params
+}
+
+func New(params Params) (*Hasher, error) {
+	if err := params.validate(); err != nil {
+		return nil, fmt.Errorf("invalid argon2id params: %w", err)
+	}
+
+	return &Hasher{params: params}, nil
+}
+
+// Hash returns the argon2id hash of the password using the current params.
+func (h *Hasher) Hash(password string) ([]byte, error) {
+	salt := make([]byte, h.params.SaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, fmt.Errorf("failed to generate salt: %w", err)
+	}
+
+	key := argon2.IDKey([]byte(password), salt, h.params.Iterations, h.params.Memory, h.params.Parallelism, h.params.KeyLength)
+
+	return encode(h.params, salt, key), nil
+}
+
+// Verify checks the password against the hash. When the password matches,
+// rehash reports whether the hash was made with an old algorithm or params
+// and should be replaced with a fresh one from Hash.
+func (h *Hasher) Verify(hash []byte, password string) (ok, rehash bool, err error) {
+	switch {
+	case bytes.HasPrefix(hash, []byte("$argon2id$")):
+		return h.verifyArgon2id(hash, password)
+	case bytes.HasPrefix(hash, []byte("$2a$")), bytes.HasPrefix(hash, []byte("$2b$")), bytes.HasPrefix(hash, []byte("$2y$")):
+		ok, err = verifyBcrypt(hash, password)
+		return ok, ok, err
+	default:
+		return false, false, ErrUnknownAlgorithm
+	}
+}
+
+func (h *Hasher) verifyArgon2id(hash []byte, password string) (bool, bool, error) {
+	params, salt, key, err := decode(hash)
+	if err != nil {
+		return false, false, err
+	}
+
+	other := argon2.IDKey([]byte(password), salt, params.Iterations, params.Memory, params.Parallelism, params.KeyLength)
+	if subtle.ConstantTimeCompare(key, other) != 1 {
+		return false, false, nil
+	}
+
+	return true, params != h.params, nil
+}
+
+func verifyBcrypt(hash []byte, password string) (bool, error) {
+	// bcrypt would silently ignore everything past 72 bytes, and no bcrypt
+	// hash was ever made from a password that long
+	if len(password) > bcryptMaxPasswordLength {
+		return false, nil
+	}
+
+	err := bcrypt.CompareHashAndPassword(hash, []byte(password))
+	if err != nil {
+		if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	return true, nil
+}
+
+var b64 = base64.RawStdEncoding
+
+func encode(p Params, salt, key []byte) []byte {
+	return fmt.Appendf(nil, "$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, p.Memory, p.Iterations, p.Parallelism, b64.EncodeToString(salt), b64.EncodeToString(key))
+}
+
+func decode(hash []byte) (Params, []byte, []byte, error) {
+	// "", "argon2id", "v=19", "m=...,t=...,p=...", salt, key
+	parts := strings.Split(string(hash), "$")
+	if len(parts) != 6 {
+		return Params{}, nil, nil, ErrMalformedHash
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil {
+		return Params{}, nil, nil, ErrMalformedHash
+	}
+	if version != argon2.Version {
+		return Params{}, nil, nil, fmt.Errorf("%w: unsupported argon2 version %d", ErrMalformedHash, version)
+	}
+
+	var p Params
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &p.Memory, &p.Iterations, &p.Parallelism); err != nil {
+		return Params{}, nil, nil, ErrMalformedHash
+	}
+
+	salt, err := b64.DecodeString(parts[4])
+	if err != nil {
+		return Params{}, nil, nil, ErrMalformedHash
+	}
+
+	key, err := b64.DecodeString(parts[5])
+	if err != nil {
+		return Params{}, nil, nil, ErrMalformedHash
+	}
+
+	p.SaltLength = uint32(len(salt))
+	p.KeyLength = uint32(len(key))
+
+	// a tampered or truncated hash shouldn't be able to skip the work
+	if err = p.validate(); err != nil {
+		return Params{}, nil, nil, fmt.Errorf("%w: %w", ErrMalformedHash, err)
+	}
+
+	return p, salt, key, nil
+}
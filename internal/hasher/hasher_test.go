@@ -0,0 +1,137 @@
+package hasher
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// testParams keep the tests fast. Never use these for real.
+var testParams = Params{
+	Memory:      64,
+	Iterations:  1,
+	Parallelism: 1,
+	SaltLength:  16,
+	KeyLength:   32,
+}
+
+func TestNew(t *testing.T) {
+	_, err := New(DefaultParams)
+	require.NoError(t, err)
+
+	bad := testParams
+	bad.Iterations = 0
+	_, err = New(bad)
+	require.Error(t, err)
+
+	bad = testParams
+	bad.Memory = 4
+	_, err = New(bad)
+	require.Error(t, err)
+}
+
+func TestHashAndVerify(t *testing.T) {
+	h, err := New(testParams)
+	require.NoError(t, err)
+
+	hash, err := h.Hash("r0undhou5e")
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(string(hash), "$argon2id$v=19$m=64,t=1,p=1$"))
+
+	t.Run("same password hashes differently", func(t *testing.T) {
+		other, err := h.Hash("r0undhou5e")
+		require.NoError(t, err)
+		require.NotEqual(t, hash, other)
+	})
+
+	t.Run("match", func(t *testing.T) {
+		ok, rehash, err := h.Verify(hash, "r0undhou5e")
+		require.NoError(t, err)
+		require.True(t, ok)
+		require.False(t, rehash)
+	})
+
+	t.Run("mismatch", func(t *testing.T) {
+		ok, _, err := h.Verify(hash, "b34rdp0wer")
+		require.NoError(t, err)
+		require.False(t, ok)
+	})
+
+	t.Run("long passwords aren't truncated", func(t *testing.T) {
+		long := strings.Repeat("a", 100)
+		hash, err := h.Hash(long)
+		require.NoError(t, err)
+
+		ok, _, err := h.Verify(hash, long[:72])
+		require.NoError(t, err)
+		require.False(t, ok)
+
+		ok, _, err = h.Verify(hash, long)
+		require.NoError(t, err)
+		require.True(t, ok)
+	})
+
+	t.Run("outdated params need rehash", func(t *testing.T) {
+		stronger := testParams
+		stronger.Iterations = 2
+		h2, err := New(stronger)
+		require.NoError(t, err)
+
+		ok, rehash, err := h2.Verify(hash, "r0undhou5e")
+		require.NoError(t, err)
+		require.True(t, ok)
+		require.True(t, rehash)
+	})
+}
+
+func TestVerifyBcrypt(t *testing.T) {
+	h, err := New(testParams)
+	require.NoError(t, err)
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("r0undhou5e"), bcrypt.MinCost)
+	require.NoError(t, err)
+
+	ok, rehash, err := h.Verify(hash, "r0undhou5e")
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.True(t, rehash)
+
+	ok, rehash, err = h.Verify(hash, "b34rdp0wer")
+	require.NoError(t, err)
+	require.False(t, ok)
+	require.False(t, rehash)
+
+	// only the first 72 bytes would be compared
+	ok, _, err = h.Verify(hash, "r0undhou5e"+strings.Repeat("a", 72))
+	require.NoError(t, err)
+	require.False(t, ok)
+}
+
+func TestVerifyMalformed(t *testing.T) {
+	h, err := New(testParams)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name string
+		hash string
+		err  error
+	}{
+		{"unknown algorithm", "$scrypt$ln=15,r=8,p=1$c2FsdA$a2V5", ErrUnknownAlgorithm},
+		{"plaintext", "r0undhou5e", ErrUnknownAlgorithm},
+		{"missing key", "$argon2id$v=19$m=64,t=1,p=1$c2FsdHNhbHRzYWx0", ErrMalformedHash},
+		{"bad version", "$argon2id$v=16$m=64,t=1,p=1$c2FsdHNhbHRzYWx0$a2V5a2V5a2V5a2V5a2V5a2V5", ErrMalformedHash},
+		{"no work", "$argon2id$v=19$m=64,t=0,p=1$c2FsdHNhbHRzYWx0$a2V5a2V5a2V5a2V5a2V5a2V5", ErrMalformedHash},
+		{"bad salt", "$argon2id$v=19$m=64,t=1,p=1$!!!$a2V5a2V5a2V5a2V5a2V5a2V5", ErrMalformedHash},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ok, _, err := h.Verify([]byte(tt.hash), "r0undhou5e")
+			require.False(t, ok)
+			require.True(t, errors.Is(err, tt.err), err)
+		})
+	}
+}
@@ -0,0 +1,94 @@
+package health
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/davemolk/chuck/internal/migrations"
+	sqldb "github.com/davemolk/chuck/internal/sql"
+)
+
+// DB checks the database answers.
+func DB(db *sqldb.DB) Check {
+	return Check{
+		Name: "db",
+		Run: func(ctx context.Context) (any, error) {
+			return nil, db.PingContext(ctx)
+		},
+	}
+}
+
+// Migrations checks the database has every embedded migration applied. A
+// newer database is fine, that's an older instance during a deploy.
+func Migrations(db *sqldb.DB) Check {
+	return Check{
+		Name: "migrations",
+		Run: func(ctx context.Context) (any, error) {
+			want, err := migrations.Latest(db.Driver())
+			if err != nil {
+				return nil, err
+			}
+
+			version, dirty, err := migrations.Version(ctx, db)
+			if err != nil {
+				return nil, err
+			}
+
+			detail := map[string]any{"version": version, "want": want, "dirty": dirty}
+
+			switch {
+			case dirty:
+				return detail, fmt.Errorf("migration %d is dirty", version)
+			case version < want:
+				return detail, fmt.Errorf("database is at version %d, want %d", version, want)
+			}
+
+			return detail, nil
+		},
+	}
+}
+
+// Replicas reports each read replica as of its last check, see
+// sqldb.DB.WatchReplicas. It's informational, reads go to the primary while
+// every replica is down.
+func Replicas(db *sqldb.DB) Check {
+	return Check{
+		Name:          "replicas",
+		Informational: true,
+		Run: func(ctx context.Context) (any, error) {
+			status := db.ReplicaStatus()
+
+			down := 0
+			for _, s := range status {
+				if !s.Healthy {
+					down++
+				}
+			}
+			if len(status) > 0 && down == len(status) {
+				return status, errors.New("every replica is down, reading from the primary")
+			}
+
+			return status, nil
+		},
+	}
+}
+
+type pinger interface {
+	Ping(ctx context.Context) error
+}
+
+// Upstream checks the chuck norris api is reachable. It's informational,
+// random jokes and cached searches work without it, and it's cached so
+// probes don't turn into a stream of api calls.
+func Upstream(client pinger) Check {
+	return Check{
+		Name:          "upstream",
+		Informational: true,
+		CacheFor:      time.Minute,
+		Run: func(ctx context.Context) (any, error) {
+			return nil, client.Ping(ctx)
+		},
+	}
+}
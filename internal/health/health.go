@@ -0,0 +1,133 @@
+// Package health runs the dependency checks behind the readiness probe.
+package health
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	StatusOK       = "ok"
+	StatusFailing  = "failing"
+	StatusDraining = "draining"
+)
+
+type Check struct {
+	Name string
+	// Informational checks are reported but never make the service unready,
+	// for dependencies we can limp along without.
+	Informational bool
+	// CacheFor reuses the last result for a while, for checks that are too
+	// slow or too rude to run on every probe.
+	CacheFor time.Duration
+	// Run returns optional details to report along with the status.
+	Run func(ctx context.Context) (detail any, err error)
+}
+
+type Result struct {
+	Status        string  `json:"status"`
+	LatencyMS     float64 `json:"latency_ms"`
+	Error         string  `json:"error,omitempty"`
+	Detail        any     `json:"detail,omitempty"`
+	Informational bool    `json:"informational,omitempty"`
+	// CheckedAt is when the check last ran, which can be a while ago for
+	// cached checks.
+	CheckedAt time.Time `json:"checked_at"`
+}
+
+type Report struct {
+	Status string            `json:"status"`
+	Checks map[string]Result `json:"checks"`
+}
+
+type check struct {
+	Check
+
+	mu     sync.Mutex
+	last   Result
+	hasRun bool
+}
+
+type Checker struct {
+	checks   []*check
+	timeout  time.Duration
+	draining atomic.Bool
+}
+
+// NewChecker runs checks, each limited to timeout.
+func NewChecker(timeout time.Duration, checks ...Check) *Checker {
+	c := &Checker{timeout: timeout}
+	for _, ch := range checks {
+		c.checks = append(c.checks, &check{Check: ch})
+	}
+	return c
+}
+
+// Drain makes the service unready for good, so load balancers stop sending
+// it traffic ahead of shutdown.
+func (c *Checker) Drain() {
+	c.draining.Store(true)
+}
+
+// Ready runs every check concurrently and reports whether the service should
+// get traffic. Checks still run while draining, so the report stays useful.
+func (c *Checker) Ready(ctx context.Context) (Report, bool) {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+
+	results := make([]Result, len(c.checks))
+
+	var wg sync.WaitGroup
+	for i, ch := range c.checks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i] = ch.run(ctx)
+		}()
+	}
+	wg.Wait()
+
+	report := Report{Status: StatusOK, Checks: make(map[string]Result, len(c.checks))}
+	for i, ch := range c.checks {
+		report.Checks[ch.Name] = results[i]
+		if results[i].Status != StatusOK && !ch.Informational {
+			report.Status = StatusFailing
+		}
+	}
+
+	if c.draining.Load() {
+		report.Status = StatusDraining
+	}
+
+	return report, report.Status == StatusOK
+}
+
+func (ch *check) run(ctx context.Context) Result {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+
+	if ch.hasRun && time.Since(ch.last.CheckedAt) < ch.CacheFor {
+		return ch.last
+	}
+
+	start := time.Now()
+	detail, err := ch.Run(ctx)
+
+	res := Result{
+		Status:        StatusOK,
+		LatencyMS:     float64(time.Since(start).Microseconds()) / 1000,
+		Detail:        detail,
+		Informational: ch.Informational,
+		CheckedAt:     start.UTC(),
+	}
+	if err != nil {
+		res.Status = StatusFailing
+		res.Error = err.Error()
+	}
+
+	ch.last, ch.hasRun = res, true
+
+	return res
+}
@@ -0,0 +1,60 @@
+package health
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestReady(t *testing.T) {
+	t.Run("cached checks", func(t *testing.T) {
+		runs := 0
+		c := NewChecker(time.Second, Check{
+			Name:     "slow",
+			CacheFor: time.Hour,
+			Run: func(ctx context.Context) (any, error) {
+				runs++
+				return runs, nil
+			},
+		})
+
+		for range 3 {
+			report, ready := c.Ready(context.Background())
+			require.True(t, ready)
+			require.Equal(t, 1, report.Checks["slow"].Detail)
+		}
+		require.Equal(t, 1, runs)
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		c := NewChecker(10*time.Millisecond, Check{
+			Name: "stuck",
+			Run: func(ctx context.Context) (any, error) {
+				<-ctx.Done()
+				return nil, ctx.Err()
+			},
+		})
+
+		report, ready := c.Ready(context.Background())
+		require.False(t, ready)
+		require.Equal(t, StatusFailing, report.Status)
+		require.Equal(t, context.DeadlineExceeded.Error(), report.Checks["stuck"].Error)
+	})
+
+	t.Run("informational", func(t *testing.T) {
+		c := NewChecker(time.Second, Check{
+			Name:          "upstream",
+			Informational: true,
+			Run: func(ctx context.Context) (any, error) {
+				return nil, errors.New("down")
+			},
+		})
+
+		report, ready := c.Ready(context.Background())
+		require.True(t, ready)
+		require.True(t, report.Checks["upstream"].Informational)
+	})
+}
@@ -0,0 +1,242 @@
+package jokeio
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/davemolk/chuck/internal/domain"
+	"github.com/stretchr/testify/require"
+)
+
+// readAll reads to the end, collecting bad jokes rather than stopping.
+func readAll(t *testing.T, r *Reader) ([]*domain.Joke, []*RecordError, error) {
+	t.Helper()
+
+	var jokes []*domain.Joke
+	var bad []*RecordError
+	for {
+		joke, err := r.Read()
+		if errors.Is(err, io.EOF) {
+			return jokes, bad, nil
+		}
+
+		var recErr *RecordError
+		if errors.As(err, &recErr) {
+			bad = append(bad, recErr)
+			continue
+		}
+		if err != nil {
+			return jokes, bad, err
+		}
+		jokes = append(jokes, joke)
+	}
+}
+
+func TestRead(t *testing.T) {
+	created := time.Date(2020, 1, 5, 13, 42, 19, 0, time.UTC)
+	want := []*domain.Joke{
+		{ExternalID: "a", URL: "https://example.com/a", Content: "Chuck Norris counted to infinity, twice.", CreatedAt: created},
+		{ExternalID: "b", URL: "https://example.com/b", Content: "Chuck Norris can \"unscramble\" an egg."},
+	}
+
+	tests := []struct {
+		name   string
+		format Format
+		input  string
+	}{
+		{
+			name:   "json",
+			format: FormatJSON,
+			input: `[
+				{"external_id": "a", "url": "https://example.com/a", "content": "Chuck Norris counted to infinity, twice.", "created_at": "2020-01-05T13:42:19Z"},
+				{"external_id": "b", "url": "https://example.com/b", "content": "Chuck Norris can \"unscramble\" an egg."}
+			]`,
+		},
+		{
+			name:   "ndjson",
+			format: FormatNDJSON,
+			input: `{"external_id": "a", "url": "https://example.com/a", "content": "Chuck Norris counted to infinity, twice.", "created_at": "2020-01-05T13:42:19Z"}
+
+{"external_id": "b", "url": "https://example.com/b", "content": "Chuck Norris can \"unscramble\" an egg."}
+`,
+		},
+		{
+			name:   "csv, columns in any order",
+			format: FormatCSV,
+			input: `content,external_id,url,created_at
+"Chuck Norris counted to infinity, twice.",a,https://example.com/a,2020-01-05T13:42:19Z
+"Chuck Norris can ""unscramble"" an egg.",b,https://example.com/b,
+`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := NewReader(strings.NewReader(tt.input), tt.format)
+			require.NoError(t, err)
+
+			jokes, bad, err := readAll(t, r)
+			require.NoError(t, err)
+			require.Empty(t, bad)
+			require.Len(t, jokes, len(want))
+
+			require.Equal(t, want[0], jokes[0])
+			// no created_at is now
+			require.WithinDuration(t, time.Now(), jokes[1].CreatedAt, time.Minute)
+			jokes[1].CreatedAt = time.Time{}
+			require.Equal(t, want[1], jokes[1])
+		})
+	}
+}
+
+func TestReadBadJokes(t *testing.T) {
+	tests := []struct {
+		name   string
+		format Format
+		input  string
+		good   int
+		want   []string
+	}{
+		{
+			name:   "json",
+			format: FormatJSON,
+			input: `[
+				{"external_id": "a", "url": "u1", "joke": "c"},
+				{"external_id": 7, "url": "u2", "content": "c"},
+				{"external_id": "c", "url": "u3", "content": "c"}
+			]`,
+			good: 1,
+			want: []string{`line 1: json: unknown field "joke"`, "line 2: json: cannot unmarshal number"},
+		},
+		{
+			name:   "ndjson",
+			format: FormatNDJSON,
+			input: `{"external_id": "a", "url": "u1"}
+{
+{"external_id": "` + strings.Repeat("x", 51) + `", "url": "u3", "content": "c"}
+{"external_id": "d", "url": "u4", "content": "c"}`,
+			good: 1,
+			want: []string{`line 1: content is required for "a"`, "line 2: invalid json", "line 3: external_id", "longer than 50"},
+		},
+		{
+			name:   "csv",
+			format: FormatCSV,
+			input: `external_id,url,content,created_at
+a,u1,c,yesterday
+b,u2
+c,u3,c,
+,u4,c,
+`,
+			good: 1,
+			want: []string{"line 2: created_at must be RFC 3339", "line 3: wrong number of fields", "line 5: external_id is required"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := NewReader(strings.NewReader(tt.input), tt.format)
+			require.NoError(t, err)
+
+			jokes, bad, err := readAll(t, r)
+			require.NoError(t, err)
+			require.Len(t, jokes, tt.good)
+
+			var msgs []string
+			for _, e := range bad {
+				msgs = append(msgs, e.Error())
+			}
+			all := strings.Join(msgs, "\n")
+			for _, want := range tt.want {
+				require.Contains(t, all, want)
+			}
+		})
+	}
+}
+
+func TestReadFatal(t *testing.T) {
+	tests := []struct {
+		name   string
+		format Format
+		input  string
+		want   string
+	}{
+		{name: "json isn't an array", format: FormatJSON, input: `{"external_id": "a"}`, want: "want an array"},
+		{name: "json syntax", format: FormatJSON, input: `[{"external_id": "a", "url": "u", "content": "c"}, {`, want: "invalid json"},
+		{name: "csv missing column", format: FormatCSV, input: "external_id,content\na,c\n", want: "missing url"},
+		{name: "csv unknown column", format: FormatCSV, input: "external_id,url,content,category\na,u,c,dev\n", want: `unknown csv column "category"`},
+		{name: "ndjson line too long", format: FormatNDJSON, input: strings.Repeat("x", maxLineBytes+1), want: "token too long"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := NewReader(strings.NewReader(tt.input), tt.format)
+			require.NoError(t, err)
+
+			_, _, err = readAll(t, r)
+			require.ErrorContains(t, err, tt.want)
+
+			// and it stays stopped
+			_, again := r.Read()
+			require.Equal(t, err, again)
+		})
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	jokes := []*domain.Joke{
+		{ExternalID: "a", URL: "https://example.com/a?x=1&y=2", Content: "Chuck Norris <3 \"quotes\", commas\nand newlines.", CreatedAt: time.Date(2020, 1, 5, 13, 42, 19, 123456000, time.UTC)},
+		{ExternalID: "b", URL: "https://example.com/b", Content: "Chuck Norris can unscramble an egg.", CreatedAt: time.Date(2021, 6, 1, 0, 0, 0, 0, time.UTC)},
+	}
+
+	for _, format := range []Format{FormatJSON, FormatNDJSON, FormatCSV} {
+		t.Run(string(format), func(t *testing.T) {
+			var buf bytes.Buffer
+			w, err := NewWriter(&buf, format)
+			require.NoError(t, err)
+			for _, j := range jokes {
+				require.NoError(t, w.Write(j))
+			}
+			require.NoError(t, w.Close())
+			require.Equal(t, 2, w.Count())
+
+			r, err := NewReader(&buf, format)
+			require.NoError(t, err)
+			got, bad, err := readAll(t, r)
+			require.NoError(t, err)
+			require.Empty(t, bad)
+			require.Equal(t, jokes, got)
+		})
+	}
+
+	t.Run("empty", func(t *testing.T) {
+		for _, format := range []Format{FormatJSON, FormatNDJSON, FormatCSV} {
+			var buf bytes.Buffer
+			w, err := NewWriter(&buf, format)
+			require.NoError(t, err)
+			require.NoError(t, w.Close())
+
+			r, err := NewReader(&buf, format)
+			require.NoError(t, err)
+			got, _, err := readAll(t, r)
+			require.NoError(t, err)
+			require.Empty(t, got)
+		}
+	})
+}
+
+func TestFormatOf(t *testing.T) {
+	for name, want := range map[string]Format{"a.json": FormatJSON, "a.ndjson": FormatNDJSON, "a.JSONL": FormatNDJSON, "dir.v2/a.csv": FormatCSV} {
+		got, err := FormatOf(name)
+		require.NoError(t, err)
+		require.Equal(t, want, got)
+	}
+
+	_, err := FormatOf("jokes")
+	require.Error(t, err)
+	_, err = FormatOf("jokes.xml")
+	require.Error(t, err)
+}
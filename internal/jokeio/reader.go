@@ -0,0 +1,335 @@
+// Package jokeio reads and writes jokes as JSON, NDJSON or CSV, a joke at a
+// time, so files of any size can be streamed.
+package jokeio
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/davemolk/chuck/internal/domain"
+)
+
+// Format is a file format for jokes.
+type Format string
+
+const (
+	// FormatJSON is an array of jokes.
+	FormatJSON Format = "json"
+	// FormatNDJSON is a joke per line.
+	FormatNDJSON Format = "ndjson"
+	// FormatCSV has a header row naming the columns, in any order.
+	FormatCSV Format = "csv"
+)
+
+// maxExternalIDLen matches jokes.external_id.
+const maxExternalIDLen = 50
+
+// maxLineBytes bounds a single NDJSON line.
+const maxLineBytes = 1024 * 1024
+
+// columns are the CSV columns, and the JSON fields, in the order they're
+// written.
+var columns = []string{"external_id", "url", "content", "created_at"}
+
+// record is a joke as it appears in a file.
+type record struct {
+	ExternalID string `json:"external_id"`
+	URL        string `json:"url"`
+	Content    string `json:"content"`
+	// CreatedAt is optional on read, see Reader.
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// ParseFormat parses a format name, e.g. from a query param. jsonl is
+// another name for ndjson.
+func ParseFormat(s string) (Format, error) {
+	switch strings.ToLower(s) {
+	case "json":
+		return FormatJSON, nil
+	case "ndjson", "jsonl":
+		return FormatNDJSON, nil
+	case "csv":
+		return FormatCSV, nil
+	default:
+		return "", fmt.Errorf("unknown format %q, want json, ndjson or csv", s)
+	}
+}
+
+// FormatOf picks the format from a file's extension.
+func FormatOf(name string) (Format, error) {
+	ext := strings.TrimPrefix(filepath.Ext(name), ".")
+	if ext == "" {
+		return "", fmt.Errorf("%s has no extension to tell the format from", name)
+	}
+	return ParseFormat(ext)
+}
+
+// ContentType is the media type to serve the format as.
+func (f Format) ContentType() string {
+	switch f {
+	case FormatNDJSON:
+		return "application/x-ndjson"
+	case FormatCSV:
+		return "text/csv; charset=utf-8"
+	default:
+		return "application/json"
+	}
+}
+
+// RecordError is a bad joke. The rest of the file can still be read.
+type RecordError struct {
+	// Line is where the joke starts, or for a JSON array its position in
+	// the array, counting from 1.
+	Line int
+	Err  error
+}
+
+func (e *RecordError) Error() string {
+	return fmt.Sprintf("line %d: %v", e.Line, e.Err)
+}
+
+func (e *RecordError) Unwrap() error {
+	return e.Err
+}
+
+// Reader reads jokes one at a time. Each one needs an external id, url and
+// content. A missing created_at defaults to when the Reader was made.
+type Reader struct {
+	format Format
+	now    time.Time
+
+	// ndjson
+	scanner *bufio.Scanner
+	// json
+	dec     *json.Decoder
+	started bool
+	// csv
+	csv    *csv.Reader
+	header []string
+
+	line int
+	// err stops reading after the first error that isn't a bad joke
+	err error
+}
+
+func NewReader(r io.Reader, format Format) (*Reader, error) {
+	jr := &Reader{
+		format: format,
+		now:    time.Now().UTC(),
+	}
+
+	switch format {
+	case FormatJSON:
+		jr.dec = json.NewDecoder(r)
+		// a misspelled field would otherwise load as an empty one
+		jr.dec.DisallowUnknownFields()
+	case FormatNDJSON:
+		jr.scanner = bufio.NewScanner(r)
+		jr.scanner.Buffer(make([]byte, 0, 64*1024), maxLineBytes)
+	case FormatCSV:
+		jr.csv = csv.NewReader(r)
+		jr.csv.ReuseRecord = true
+	default:
+		return nil, fmt.Errorf("unknown format %q", format)
+	}
+
+	return jr, nil
+}
+
+// Read returns the next joke, or io.EOF after the last. A *RecordError is a
+// bad joke that's been skipped, any other error means the file can't be
+// read any further.
+func (r *Reader) Read() (*domain.Joke, error) {
+	if r.err != nil {
+		return nil, r.err
+	}
+
+	var rec record
+	var err error
+
+	switch r.format {
+	case FormatJSON:
+		rec, err = r.readJSON()
+	case FormatNDJSON:
+		rec, err = r.readNDJSON()
+	case FormatCSV:
+		rec, err = r.readCSV()
+	}
+	if err != nil {
+		var recErr *RecordError
+		if !errors.As(err, &recErr) {
+			r.err = err
+		}
+		return nil, err
+	}
+
+	if err = rec.check(); err != nil {
+		return nil, &RecordError{Line: r.line, Err: err}
+	}
+
+	if rec.CreatedAt.IsZero() {
+		rec.CreatedAt = r.now
+	}
+
+	return &domain.Joke{
+		ExternalID: rec.ExternalID,
+		URL:        rec.URL,
+		Content:    rec.Content,
+		CreatedAt:  rec.CreatedAt,
+	}, nil
+}
+
+func (rec *record) check() error {
+	rec.ExternalID = strings.TrimSpace(rec.ExternalID)
+	rec.URL = strings.TrimSpace(rec.URL)
+	rec.Content = strings.TrimSpace(rec.Content)
+
+	switch {
+	case rec.ExternalID == "":
+		return errors.New("external_id is required")
+	case len(rec.ExternalID) > maxExternalIDLen:
+		return fmt.Errorf("external_id %q is longer than %d characters", rec.ExternalID, maxExternalIDLen)
+	case rec.URL == "":
+		return fmt.Errorf("url is required for %q", rec.ExternalID)
+	case rec.Content == "":
+		return fmt.Errorf("content is required for %q", rec.ExternalID)
+	}
+	return nil
+}
+
+func (r *Reader) readJSON() (record, error) {
+	if !r.started {
+		r.started = true
+		tok, err := r.dec.Token()
+		if err != nil {
+			return record{}, fmt.Errorf("invalid json: %w", err)
+		}
+		if tok != json.Delim('[') {
+			return record{}, errors.New("invalid json: want an array of jokes")
+		}
+	}
+
+	if !r.dec.More() {
+		if _, err := r.dec.Token(); err != nil {
+			return record{}, fmt.Errorf("invalid json: %w", err)
+		}
+		return record{}, io.EOF
+	}
+
+	r.line++
+	var rec record
+	if err := r.dec.Decode(&rec); err != nil {
+		// the decoder skips past a value of the wrong type or with an
+		// unknown field, but can't get past a syntax error or the end
+		var syntaxErr *json.SyntaxError
+		if errors.As(err, &syntaxErr) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return record{}, fmt.Errorf("invalid json: %w", err)
+		}
+		return record{}, &RecordError{Line: r.line, Err: err}
+	}
+
+	return rec, nil
+}
+
+func (r *Reader) readNDJSON() (record, error) {
+	for r.scanner.Scan() {
+		r.line++
+		text := r.scanner.Bytes()
+		if len(bytes.TrimSpace(text)) == 0 {
+			continue
+		}
+
+		dec := json.NewDecoder(bytes.NewReader(text))
+		dec.DisallowUnknownFields()
+
+		var rec record
+		if err := dec.Decode(&rec); err != nil {
+			return record{}, &RecordError{Line: r.line, Err: fmt.Errorf("invalid json: %w", err)}
+		}
+		return rec, nil
+	}
+
+	if err := r.scanner.Err(); err != nil {
+		return record{}, fmt.Errorf("failed to read ndjson after line %d: %w", r.line, err)
+	}
+	return record{}, io.EOF
+}
+
+func (r *Reader) readCSV() (record, error) {
+	if r.header == nil {
+		if err := r.readHeader(); err != nil {
+			return record{}, err
+		}
+	}
+
+	row, err := r.csv.Read()
+	if errors.Is(err, io.EOF) {
+		return record{}, io.EOF
+	}
+	if err != nil {
+		var parseErr *csv.ParseError
+		if errors.As(err, &parseErr) {
+			r.line = parseErr.StartLine
+			return record{}, &RecordError{Line: parseErr.StartLine, Err: parseErr.Err}
+		}
+		return record{}, fmt.Errorf("failed to read csv: %w", err)
+	}
+	line, _ := r.csv.FieldPos(0)
+	r.line = line
+
+	var rec record
+	for i, name := range r.header {
+		value := row[i]
+		switch name {
+		case "external_id":
+			rec.ExternalID = value
+		case "url":
+			rec.URL = value
+		case "content":
+			rec.Content = value
+		case "created_at":
+			if strings.TrimSpace(value) == "" {
+				continue
+			}
+			if rec.CreatedAt, err = time.Parse(time.RFC3339Nano, strings.TrimSpace(value)); err != nil {
+				return record{}, &RecordError{Line: line, Err: fmt.Errorf("created_at must be RFC 3339, got %q", value)}
+			}
+		}
+	}
+
+	return rec, nil
+}
+
+func (r *Reader) readHeader() error {
+	// the csv reader holds every row to the header's number of fields
+	header, err := r.csv.Read()
+	if err != nil {
+		return fmt.Errorf("failed to read csv header: %w", err)
+	}
+	r.line = 1
+
+	r.header = make([]string, len(header))
+	for i, h := range header {
+		h = strings.ToLower(strings.TrimSpace(h))
+		if !slices.Contains(columns, h) {
+			return fmt.Errorf("unknown csv column %q", h)
+		}
+		r.header[i] = h
+	}
+	for _, required := range columns[:3] {
+		if !slices.Contains(r.header, required) {
+			return fmt.Errorf("csv header is missing %s", required)
+		}
+	}
+
+	return nil
+}
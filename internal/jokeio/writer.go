@@ -0,0 +1,107 @@
+package jokeio
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/davemolk/chuck/internal/domain"
+)
+
+// Writer writes jokes one at a time, in a form Reader reads back. Close
+// finishes the file, it doesn't close the underlying writer.
+type Writer struct {
+	format Format
+	buf    *bufio.Writer
+	enc    *json.Encoder
+	csv    *csv.Writer
+	count  int
+}
+
+func NewWriter(w io.Writer, format Format) (*Writer, error) {
+	jw := &Writer{
+		format: format,
+		buf:    bufio.NewWriter(w),
+	}
+
+	switch format {
+	case FormatJSON, FormatNDJSON:
+		jw.enc = json.NewEncoder(jw.buf)
+		jw.enc.SetEscapeHTML(false)
+	case FormatCSV:
+		jw.csv = csv.NewWriter(jw.buf)
+		// a write error turns up on Flush, in Write or Close
+		_ = jw.csv.Write(columns)
+	default:
+		return nil, fmt.Errorf("unknown format %q", format)
+	}
+
+	return jw, nil
+}
+
+func (w *Writer) Write(joke *domain.Joke) error {
+	rec := record{
+		ExternalID: joke.ExternalID,
+		URL:        joke.URL,
+		Content:    joke.Content,
+		CreatedAt:  joke.CreatedAt.UTC(),
+	}
+
+	var err error
+	switch w.format {
+	case FormatJSON:
+		prefix := ",\n"
+		if w.count == 0 {
+			prefix = "[\n"
+		}
+		if _, err = w.buf.WriteString(prefix); err == nil {
+			err = w.enc.Encode(rec)
+		}
+	case FormatNDJSON:
+		err = w.enc.Encode(rec)
+	case FormatCSV:
+		err = w.csv.Write([]string{rec.ExternalID, rec.URL, rec.Content, rec.CreatedAt.Format(time.RFC3339Nano)})
+		if err == nil {
+			err = w.csv.Error()
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write joke: %w", err)
+	}
+
+	w.count++
+	return nil
+}
+
+// Flush sends what's buffered on to the underlying writer.
+func (w *Writer) Flush() error {
+	if w.csv != nil {
+		w.csv.Flush()
+		if err := w.csv.Error(); err != nil {
+			return err
+		}
+	}
+	return w.buf.Flush()
+}
+
+// Close writes whatever ends the file and flushes.
+func (w *Writer) Close() error {
+	if w.format == FormatJSON {
+		end := "]\n"
+		if w.count == 0 {
+			end = "[]\n"
+		}
+		if _, err := w.buf.WriteString(end); err != nil {
+			return err
+		}
+	}
+	return w.Flush()
+}
+
+// Count is how many jokes have been written.
+func (w *Writer) Count() int {
+	return w.count
+}
@@ -0,0 +1,142 @@
+// Package metrics holds the app's prometheus metrics. They're registered on
+// Registry rather than the global default registry so only what's defined
+// here, plus the go and process collectors, is exposed by Handler.
+package metrics
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "chuck"
+
+// token validation outcomes
+const (
+	TokenValid   = "valid"
+	TokenInvalid = "invalid"
+	TokenError   = "error"
+)
+
+// outbox delivery outcomes
+const (
+	OutboxDelivered = "delivered"
+	OutboxRetried   = "retried"
+	OutboxDead      = "dead"
+)
+
+var Registry = prometheus.NewRegistry()
+
+var (
+	httpRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "http_requests_total",
+		Help:      "HTTP requests by route pattern, method and status code.",
+	}, []string{"route", "method", "code"})
+
+	httpDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "HTTP request latency by route pattern, method and status code.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"route", "method", "code"})
+
+	upstreamDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "upstream_request_duration_seconds",
+		Help:      "Chuck Norris API call latency by operation, failed calls included.",
+		// the client times out after 10s
+		Buckets: []float64{.05, .1, .25, .5, 1, 2.5, 5, 10},
+	}, []string{"operation"})
+
+	upstreamErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "upstream_errors_total",
+		Help:      "Failed Chuck Norris API calls by operation.",
+	}, []string{"operation"})
+
+	jokeSearchCache = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "joke_search_cache_total",
+		Help:      "Joke searches answered from the database (hit) or the Chuck Norris API (miss).",
+	}, []string{"result"})
+
+	tokenValidations = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "token_validations_total",
+		Help:      "Token validations by scope and outcome.",
+	}, []string{"scope", "outcome"})
+
+	outboxDeliveries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "outbox_deliveries_total",
+		Help:      "Outbox event deliveries by event type and outcome.",
+	}, []string{"type", "outcome"})
+)
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		httpRequests,
+		httpDuration,
+		upstreamDuration,
+		upstreamErrors,
+		jokeSearchCache,
+		tokenValidations,
+		outboxDeliveries,
+	)
+}
+
+// Handler serves Registry in the prometheus text format.
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{})
+}
+
+// RegisterDB adds gauges and counters for the connection pool, from
+// db.Stats(), labelled with name.
+func RegisterDB(name string, db *sql.DB) error {
+	return Registry.Register(collectors.NewDBStatsCollector(db, name))
+}
+
+// ObserveHTTP records a finished request. route should be the pattern it was
+// routed by, not the path, to keep the number of series bounded.
+func ObserveHTTP(route, method string, code int, d time.Duration) {
+	c := strconv.Itoa(code)
+	httpRequests.WithLabelValues(route, method, c).Inc()
+	httpDuration.WithLabelValues(route, method, c).Observe(d.Seconds())
+}
+
+// ObserveUpstream records a call to the Chuck Norris API.
+func ObserveUpstream(operation string, d time.Duration, err error) {
+	upstreamDuration.WithLabelValues(operation).Observe(d.Seconds())
+	if err != nil {
+		upstreamErrors.WithLabelValues(operation).Inc()
+	}
+}
+
+// ObserveJokeSearch records whether a search was answered from the database.
+func ObserveJokeSearch(hit bool) {
+	result := "miss"
+	if hit {
+		result = "hit"
+	}
+	jokeSearchCache.WithLabelValues(result).Inc()
+}
+
+// ObserveTokenValidation records the outcome of validating a token, one of
+// TokenValid, TokenInvalid or TokenError.
+func ObserveTokenValidation(scope, outcome string) {
+	tokenValidations.WithLabelValues(scope, outcome).Inc()
+}
+
+// ObserveOutboxDelivery records an attempt to deliver an outbox event, one of
+// OutboxDelivered, OutboxRetried or OutboxDead.
+func ObserveOutboxDelivery(eventType, outcome string) {
+	outboxDeliveries.WithLabelValues(eventType, outcome).Inc()
+}
@@ -0,0 +1,40 @@
+package metrics
+
+import (
+	"errors"
+	"io"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandler(t *testing.T) {
+	ObserveHTTP("GET /api/v1/jokes/random", "GET", 200, 50*time.Millisecond)
+	ObserveUpstream("search", time.Second, errors.New("nope"))
+	ObserveJokeSearch(true)
+	ObserveJokeSearch(false)
+	ObserveJokeSearch(false)
+	ObserveTokenValidation("authentication", TokenInvalid)
+
+	w := httptest.NewRecorder()
+	Handler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	require.Equal(t, 200, w.Code)
+
+	body, err := io.ReadAll(w.Body)
+	require.NoError(t, err)
+
+	for _, want := range []string{
+		`chuck_http_requests_total{code="200",method="GET",route="GET /api/v1/jokes/random"} 1`,
+		`chuck_http_request_duration_seconds_bucket{code="200",method="GET",route="GET /api/v1/jokes/random",le="0.05"} 1`,
+		`chuck_upstream_errors_total{operation="search"} 1`,
+		`chuck_upstream_request_duration_seconds_count{operation="search"} 1`,
+		`chuck_joke_search_cache_total{result="hit"} 1`,
+		`chuck_joke_search_cache_total{result="miss"} 2`,
+		`chuck_token_validations_total{outcome="invalid",scope="authentication"} 1`,
+		`go_goroutines`,
+	} {
+		require.Contains(t, string(body), want)
+	}
+}
@@ -0,0 +1,18 @@
+ALTER TABLE tokens ADD COLUMN IF NOT EXISTS scope varchar(32) not null default 'authentication';
+
+CREATE TABLE IF NOT EXISTS user_totp (
+    user_id bigint primary key references users on delete cascade,
+    -- aes-gcm encrypted, see internal/service/mfa
+    secret bytea not null,
+    confirmed_at timestamp,
+    last_used_step bigint not null default 0,
+    created_at timestamp not null default current_timestamp
+);
+
+CREATE TABLE IF NOT EXISTS recovery_codes (
+    id bigserial primary key,
+    user_id bigint not null references users on delete cascade,
+    hash bytea unique not null,
+    used_at timestamp
+);
+CREATE INDEX idx_recovery_codes_user_id ON recovery_codes (user_id);
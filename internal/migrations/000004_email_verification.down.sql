@@ -0,0 +1,2 @@
+ALTER TABLE tokens DROP COLUMN IF EXISTS created_at;
+ALTER TABLE users DROP COLUMN IF EXISTS verified_at;
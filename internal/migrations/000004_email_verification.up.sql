@@ -0,0 +1,7 @@
+ALTER TABLE users ADD COLUMN IF NOT EXISTS verified_at timestamp;
+
+-- accounts created before verification existed are grandfathered in
+UPDATE users SET verified_at = created_at WHERE verified_at IS NULL;
+
+-- used to rate limit resending verification emails
+ALTER TABLE tokens ADD COLUMN IF NOT EXISTS created_at timestamp not null default current_timestamp;
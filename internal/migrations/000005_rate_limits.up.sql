@@ -0,0 +1,8 @@
+CREATE UNLOGGED TABLE IF NOT EXISTS rate_limits (
+    key varchar(512) primary key,
+    tokens double precision not null,
+    updated_at timestamptz not null,
+    -- when the bucket will be full again, after which the row can go
+    full_at timestamptz not null
+);
+CREATE INDEX IF NOT EXISTS idx_rate_limits_full_at ON rate_limits (full_at);
@@ -0,0 +1,15 @@
+-- events written in the same transaction as the change they describe, and
+-- delivered by outbox.Dispatcher. delivered ones are deleted, ones that ran
+-- out of attempts stay as status 'dead'.
+CREATE TABLE IF NOT EXISTS outbox (
+    id bigserial primary key,
+    type varchar(100) not null,
+    payload jsonb not null,
+    status varchar(20) not null default 'pending',
+    attempts integer not null default 0,
+    next_attempt_at timestamptz not null default current_timestamp,
+    locked_until timestamptz,
+    last_error text,
+    created_at timestamptz not null default current_timestamp
+);
+CREATE INDEX IF NOT EXISTS idx_outbox_pending ON outbox (next_attempt_at) WHERE status = 'pending';
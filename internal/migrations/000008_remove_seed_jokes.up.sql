@@ -0,0 +1,11 @@
+-- the seed jokes moved from 000001 to the seed command. deleting them here,
+-- rather than editing 000001, leaves every database at the same point
+-- whenever it was created. jokes the api returns are cached again on the
+-- next search that finds them.
+DELETE FROM jokes
+WHERE external_id IN (
+    'c-3yrrglr0ouxifeo2rzsw',
+    '7w5sd_KSTgGwsVCQc3U8KA',
+    'KzX7anzHQMKJuViPUmBMVg',
+    '-jMF0mF7Rcu6tUiIZ49pkw'
+);
@@ -1,6 +1,25 @@
 package migrations
 
-import "embed"
+import (
+	"embed"
+	"io/fs"
+
+	sqldb "github.com/davemolk/chuck/internal/sql"
+)
 
 //go:embed *.sql
 var MigrationFiles embed.FS
+
+// sqliteFiles follow MigrationFiles version for version, with the same names.
+//
+//go:embed sqlite/*.sql
+var sqliteFiles embed.FS
+
+// migrationFS holds the migrations for the driver.
+func migrationFS(driver sqldb.Driver) fs.FS {
+	if driver == sqldb.SQLite {
+		sub, _ := fs.Sub(sqliteFiles, "sqlite")
+		return sub
+	}
+	return MigrationFiles
+}
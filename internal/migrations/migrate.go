@@ -0,0 +1,285 @@
+package migrations
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	sqldb "github.com/davemolk/chuck/internal/sql"
+	"github.com/golang-migrate/migrate/v4"
+	"github.com/golang-migrate/migrate/v4/database"
+	"github.com/golang-migrate/migrate/v4/database/postgres"
+	"github.com/golang-migrate/migrate/v4/database/sqlite"
+	"github.com/golang-migrate/migrate/v4/source/iofs"
+	"go.uber.org/zap"
+)
+
+// lockID is the advisory lock held while migrating. It's arbitrary, just
+// distinct from the lock golang-migrate takes around each run.
+const lockID int64 = 7_341_008_271
+
+// Migrator applies the embedded migrations for the database's driver. On
+// postgres it holds an advisory lock from NewMigrator until Close, so
+// replicas starting at the same time take turns and each report describes a
+// single, consistent change. A sqlite database belongs to a single instance,
+// so there's nobody to take turns with.
+type Migrator struct {
+	logger *zap.Logger
+	driver sqldb.Driver
+	// conn holds the lock, it's nil for sqlite
+	conn *sql.Conn
+	m    *migrate.Migrate
+}
+
+// Migration is a single migration that ran.
+type Migration struct {
+	Version uint
+	Name    string
+	// Direction is "up" or "down".
+	Direction string
+}
+
+// Report is what a migrate command changed.
+type Report struct {
+	From    uint
+	To      uint
+	Applied []Migration
+}
+
+func (r Report) String() string {
+	if len(r.Applied) == 0 {
+		return fmt.Sprintf("database is at version %d, no migrations to run", r.To)
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "migrated from version %d to %d:", r.From, r.To)
+	for _, m := range r.Applied {
+		fmt.Fprintf(&b, "\n  %-4s %d %s", m.Direction, m.Version, m.Name)
+	}
+	return b.String()
+}
+
+// NewMigrator waits for the migration lock, so it can block for as long as
+// another instance is migrating, or until ctx is done.
+func NewMigrator(ctx context.Context, logger *zap.Logger, db *sqldb.DB) (*Migrator, error) {
+	if db.Driver() == sqldb.SQLite {
+		return newSQLiteMigrator(logger, db)
+	}
+
+	// a dedicated connection, the session holds the lock and golang-migrate
+	// only closes this connection rather than the whole pool when done
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get connection: %w", err)
+	}
+
+	var locked bool
+	if err = conn.QueryRowContext(ctx, `select pg_try_advisory_lock($1)`, lockID).Scan(&locked); err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("failed to take migration lock: %w", err)
+	}
+	if !locked {
+		logger.Info("another instance is migrating, waiting for it to finish")
+		if _, err = conn.ExecContext(ctx, `select pg_advisory_lock($1)`, lockID); err != nil {
+			_ = conn.Close()
+			return nil, fmt.Errorf("failed to take migration lock: %w", err)
+		}
+	}
+
+	driver, err := postgres.WithConnection(ctx, conn, &postgres.Config{})
+	if err != nil {
+		// closing the connection releases the lock
+		_ = conn.Close()
+		return nil, fmt.Errorf("failed to get db driver for migration: %w", err)
+	}
+
+	m, err := newMigrate(logger, sqldb.Postgres, driver)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+
+	return &Migrator{
+		logger: logger,
+		driver: sqldb.Postgres,
+		conn:   conn,
+		m:      m,
+	}, nil
+}
+
+func newSQLiteMigrator(logger *zap.Logger, db *sqldb.DB) (*Migrator, error) {
+	// golang-migrate closes the whole *sql.DB when it's done with it, so it
+	// gets one of its own
+	sqlDB, err := db.Separate()
+	if err != nil {
+		return nil, err
+	}
+
+	driver, err := sqlite.WithInstance(sqlDB, &sqlite.Config{})
+	if err != nil {
+		_ = sqlDB.Close()
+		return nil, fmt.Errorf("failed to get db driver for migration: %w", err)
+	}
+
+	m, err := newMigrate(logger, sqldb.SQLite, driver)
+	if err != nil {
+		_ = sqlDB.Close()
+		return nil, err
+	}
+
+	return &Migrator{
+		logger: logger,
+		driver: sqldb.SQLite,
+		m:      m,
+	}, nil
+}
+
+func newMigrate(logger *zap.Logger, driver sqldb.Driver, instance database.Driver) (*migrate.Migrate, error) {
+	source, err := iofs.New(migrationFS(driver), ".")
+	if err != nil {
+		return nil, fmt.Errorf("failed to get driver from fs: %w", err)
+	}
+
+	m, err := migrate.NewWithInstance("iofs", source, string(driver), instance)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get migrator: %w", err)
+	}
+	m.Log = migrateLogger{logger}
+
+	return m, nil
+}
+
+// Close releases the lock.
+func (m *Migrator) Close() error {
+	// unlock explicitly rather than relying on the connection closing, a
+	// pooled driver could keep the session alive
+	var unlockErr error
+	if m.conn != nil {
+		_, unlockErr = m.conn.ExecContext(context.Background(), `select pg_advisory_unlock($1)`, lockID)
+	}
+	sourceErr, dbErr := m.m.Close()
+
+	return errors.Join(unlockErr, sourceErr, dbErr)
+}
+
+// Up runs every migration that hasn't been.
+func (m *Migrator) Up() (Report, error) {
+	return m.run(m.m.Up)
+}
+
+// Down rolls back the last steps migrations.
+func (m *Migrator) Down(steps int) (Report, error) {
+	if steps < 1 {
+		return Report{}, fmt.Errorf("steps must be at least 1, got %d", steps)
+	}
+	return m.run(func() error { return m.m.Steps(-steps) })
+}
+
+// Goto migrates up or down to version.
+func (m *Migrator) Goto(version uint) (Report, error) {
+	return m.run(func() error { return m.m.Migrate(version) })
+}
+
+// Force records version as the current one, and clears the dirty flag,
+// without running anything. It's for recovering from a failed migration
+// after fixing the database by hand. -1 means no version.
+func (m *Migrator) Force(version int) error {
+	if err := m.m.Force(version); err != nil {
+		return fmt.Errorf("failed to force version: %w", err)
+	}
+	return nil
+}
+
+// Latest is the version Up would take the database to.
+func (m *Migrator) Latest() (uint, error) {
+	return Latest(m.driver)
+}
+
+// Version is the current version, see migrations.Version.
+func (m *Migrator) Version() (uint, bool, error) {
+	version, dirty, err := m.m.Version()
+	if errors.Is(err, migrate.ErrNilVersion) {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, fmt.Errorf("failed to get migration version: %w", err)
+	}
+	return version, dirty, nil
+}
+
+func (m *Migrator) run(migrateFn func() error) (Report, error) {
+	from, dirty, err := m.Version()
+	if err != nil {
+		return Report{}, err
+	}
+	if dirty {
+		return Report{From: from, To: from}, fmt.Errorf("database is dirty at version %d, a migration failed partway: fix it by hand, then run migrate force %d", from, from)
+	}
+
+	runErr := migrateFn()
+	if errors.Is(runErr, migrate.ErrNoChange) {
+		runErr = nil
+	}
+
+	// report whatever got applied, even if a later migration failed
+	to, _, err := m.Version()
+	if err != nil {
+		return Report{}, errors.Join(runErr, err)
+	}
+
+	report := Report{From: from, To: to}
+	report.Applied, err = between(m.driver, from, to)
+	if err != nil {
+		return report, errors.Join(runErr, err)
+	}
+
+	if runErr != nil {
+		return report, fmt.Errorf("migration failed: %w", runErr)
+	}
+
+	return report, nil
+}
+
+// between lists the migrations that take a database from one version to
+// another, in the order they run.
+func between(driver sqldb.Driver, from, to uint) ([]Migration, error) {
+	files, err := embedded(driver)
+	if err != nil {
+		return nil, err
+	}
+
+	var applied []Migration
+	for _, f := range files {
+		switch {
+		case from < to && f.Version > from && f.Version <= to:
+			f.Direction = "up"
+			applied = append(applied, f)
+		case from > to && f.Version > to && f.Version <= from:
+			f.Direction = "down"
+			applied = append(applied, f)
+		}
+	}
+
+	// downs run newest first
+	if from > to {
+		slices.Reverse(applied)
+	}
+
+	return applied, nil
+}
+
+// migrateLogger sends golang-migrate's progress lines to zap.
+type migrateLogger struct {
+	logger *zap.Logger
+}
+
+func (l migrateLogger) Printf(format string, v ...any) {
+	l.logger.Debug(strings.TrimSpace(fmt.Sprintf(format, v...)))
+}
+
+func (l migrateLogger) Verbose() bool {
+	return false
+}
@@ -0,0 +1,52 @@
+package migrations
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	sqldb "github.com/davemolk/chuck/internal/sql"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+// TestSQLite runs every sqlite migration up, all the way down and up again.
+// The postgres ones get run by every test using dbtest.
+func TestSQLite(t *testing.T) {
+	ctx := context.Background()
+
+	db, err := sqldb.New(zap.NewNop(), "sqlite://"+filepath.Join(t.TempDir(), "chuck.db"), nil, sqldb.DefaultPoolConfig)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = db.Close() })
+
+	m, err := NewMigrator(ctx, zap.NewNop(), db)
+	require.NoError(t, err)
+	t.Cleanup(func() { require.NoError(t, m.Close()) })
+
+	latest, err := m.Latest()
+	require.NoError(t, err)
+
+	report, err := m.Up()
+	require.NoError(t, err)
+	require.Equal(t, uint(0), report.From)
+	require.Equal(t, latest, report.To)
+	require.Len(t, report.Applied, int(latest))
+
+	_, err = db.ExecContext(ctx, `insert into users (email, hashed_pw) values ('chuck@norris.com', x'00')`)
+	require.NoError(t, err)
+	_, err = db.ExecContext(ctx, `insert into tokens (hash, user_id, expires_at) values (x'01', 1, current_timestamp)`)
+	require.NoError(t, err)
+
+	version, dirty, err := Version(ctx, db)
+	require.NoError(t, err)
+	require.False(t, dirty)
+	require.Equal(t, latest, version)
+
+	report, err = m.Down(int(latest))
+	require.NoError(t, err)
+	require.Equal(t, uint(0), report.To)
+
+	report, err = m.Up()
+	require.NoError(t, err)
+	require.Equal(t, latest, report.To)
+}
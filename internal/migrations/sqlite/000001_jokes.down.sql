@@ -0,0 +1,4 @@
+DROP TABLE IF EXISTS tokens;
+DROP TABLE IF EXISTS users;
+DROP TABLE IF EXISTS jokes_fts;
+DROP TABLE IF EXISTS jokes;
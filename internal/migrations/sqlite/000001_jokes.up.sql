@@ -0,0 +1,46 @@
+-- the sqlite schema follows the postgres one a version at a time, so a
+-- version means the same tables on either. timestamps are stored as text the
+-- driver reads back as time.Time.
+CREATE TABLE IF NOT EXISTS jokes (
+    id integer primary key autoincrement,
+    external_id varchar(50) unique not null,
+    joke_url varchar unique not null,
+    content text not null,
+    created_at timestamp not null default current_timestamp
+);
+
+-- stands in for the to_tsvector index. unicode61 lowercases and splits on
+-- anything that isn't a letter or digit, like postgres' simple config, and
+-- keeping diacritics matches that too. the triggers keep it in step.
+CREATE VIRTUAL TABLE IF NOT EXISTS jokes_fts USING fts5(
+    content,
+    content = 'jokes',
+    content_rowid = 'id',
+    tokenize = 'unicode61 remove_diacritics 0'
+);
+CREATE TRIGGER IF NOT EXISTS jokes_fts_insert AFTER INSERT ON jokes BEGIN
+    INSERT INTO jokes_fts (rowid, content) VALUES (new.id, new.content);
+END;
+CREATE TRIGGER IF NOT EXISTS jokes_fts_delete AFTER DELETE ON jokes BEGIN
+    INSERT INTO jokes_fts (jokes_fts, rowid, content) VALUES ('delete', old.id, old.content);
+END;
+CREATE TRIGGER IF NOT EXISTS jokes_fts_update AFTER UPDATE OF content ON jokes BEGIN
+    INSERT INTO jokes_fts (jokes_fts, rowid, content) VALUES ('delete', old.id, old.content);
+    INSERT INTO jokes_fts (rowid, content) VALUES (new.id, new.content);
+END;
+
+CREATE TABLE IF NOT EXISTS users (
+    id integer primary key autoincrement,
+    hashed_pw blob not null,
+    created_at timestamp not null default current_timestamp,
+    -- nocase stands in for citext, though it only folds ascii letters
+    email text collate nocase unique not null
+);
+
+CREATE TABLE IF NOT EXISTS tokens (
+    hash blob primary key,
+    user_id integer not null references users on delete cascade,
+    expires_at timestamp not null
+);
+CREATE INDEX IF NOT EXISTS idx_tokens_user_id ON tokens (user_id);
+CREATE INDEX IF NOT EXISTS idx_tokens_expires_at ON tokens (expires_at);
@@ -0,0 +1,18 @@
+ALTER TABLE tokens ADD COLUMN scope varchar(32) not null default 'authentication';
+
+CREATE TABLE IF NOT EXISTS user_totp (
+    user_id integer primary key references users on delete cascade,
+    -- aes-gcm encrypted, see internal/service/mfa
+    secret blob not null,
+    confirmed_at timestamp,
+    last_used_step integer not null default 0,
+    created_at timestamp not null default current_timestamp
+);
+
+CREATE TABLE IF NOT EXISTS recovery_codes (
+    id integer primary key autoincrement,
+    user_id integer not null references users on delete cascade,
+    hash blob unique not null,
+    used_at timestamp
+);
+CREATE INDEX IF NOT EXISTS idx_recovery_codes_user_id ON recovery_codes (user_id);
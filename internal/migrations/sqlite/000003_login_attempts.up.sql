@@ -0,0 +1,8 @@
+-- failed login tracking, keyed by account (email) and by client ip. see
+-- internal/service/auth/throttle.go
+CREATE TABLE IF NOT EXISTS login_attempts (
+    key varchar(320) primary key,
+    failures integer not null default 0,
+    last_failure_at timestamp not null,
+    locked_until timestamp
+);
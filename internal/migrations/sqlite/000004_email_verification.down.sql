@@ -0,0 +1,2 @@
+ALTER TABLE tokens DROP COLUMN created_at;
+ALTER TABLE users DROP COLUMN verified_at;
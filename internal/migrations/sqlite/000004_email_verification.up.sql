@@ -0,0 +1,20 @@
+ALTER TABLE users ADD COLUMN verified_at timestamp;
+
+-- accounts created before verification existed are grandfathered in
+UPDATE users SET verified_at = created_at WHERE verified_at IS NULL;
+
+-- used to rate limit resending verification emails. sqlite can't add a
+-- column with a default like current_timestamp, so the table is rebuilt.
+CREATE TABLE tokens_new (
+    hash blob primary key,
+    user_id integer not null references users on delete cascade,
+    expires_at timestamp not null,
+    scope varchar(32) not null default 'authentication',
+    created_at timestamp not null default current_timestamp
+);
+INSERT INTO tokens_new (hash, user_id, expires_at, scope)
+SELECT hash, user_id, expires_at, scope FROM tokens;
+DROP TABLE tokens;
+ALTER TABLE tokens_new RENAME TO tokens;
+CREATE INDEX IF NOT EXISTS idx_tokens_user_id ON tokens (user_id);
+CREATE INDEX IF NOT EXISTS idx_tokens_expires_at ON tokens (expires_at);
@@ -0,0 +1,3 @@
+-- rate limits are only kept in postgres, with sqlite they're in memory, see
+-- internal/ratelimit. this keeps the versions in step.
+SELECT 1;
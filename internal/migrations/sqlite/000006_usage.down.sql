@@ -0,0 +1,4 @@
+DROP TABLE IF EXISTS usage_daily;
+
+ALTER TABLE users DROP COLUMN is_admin;
+ALTER TABLE users DROP COLUMN plan;
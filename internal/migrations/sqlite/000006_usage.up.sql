@@ -0,0 +1,12 @@
+ALTER TABLE users ADD COLUMN plan varchar(50) not null default 'free';
+ALTER TABLE users ADD COLUMN is_admin boolean not null default false;
+
+-- usage is rolled up as it's recorded, one row per user, day and event
+CREATE TABLE IF NOT EXISTS usage_daily (
+    user_id integer not null references users on delete cascade,
+    day date not null,
+    event varchar(50) not null,
+    count integer not null default 0,
+    primary key (user_id, day, event)
+);
+CREATE INDEX IF NOT EXISTS idx_usage_daily_day ON usage_daily (day);
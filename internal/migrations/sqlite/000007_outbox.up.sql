@@ -0,0 +1,14 @@
+-- see the postgres migration. the times always come from the outbox
+-- package, in utc, so they compare as text.
+CREATE TABLE IF NOT EXISTS outbox (
+    id integer primary key,
+    type varchar(100) not null,
+    payload text not null,
+    status varchar(20) not null default 'pending',
+    attempts integer not null default 0,
+    next_attempt_at timestamp not null,
+    locked_until timestamp,
+    last_error text,
+    created_at timestamp not null
+);
+CREATE INDEX IF NOT EXISTS idx_outbox_pending ON outbox (next_attempt_at) WHERE status = 'pending';
@@ -0,0 +1,3 @@
+-- see the postgres migration. sqlite migrations never had the seed, so
+-- there's nothing to delete, this only keeps the versions in step.
+SELECT 1;
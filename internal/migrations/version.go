@@ -0,0 +1,74 @@
+package migrations
+
+import (
+	"cmp"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io/fs"
+	"slices"
+	"strconv"
+	"strings"
+
+	sqldb "github.com/davemolk/chuck/internal/sql"
+)
+
+// Latest is the highest version among the driver's embedded migrations, the
+// one a fully migrated database should be at.
+func Latest(driver sqldb.Driver) (uint, error) {
+	files, err := embedded(driver)
+	if err != nil {
+		return 0, err
+	}
+
+	var latest uint
+	for _, f := range files {
+		latest = max(latest, f.Version)
+	}
+
+	return latest, nil
+}
+
+// embedded lists the driver's embedded migrations in version order.
+func embedded(driver sqldb.Driver) ([]Migration, error) {
+	names, err := fs.Glob(migrationFS(driver), "*.up.sql")
+	if err != nil {
+		return nil, err
+	}
+
+	files := make([]Migration, 0, len(names))
+	for _, name := range names {
+		prefix, rest, ok := strings.Cut(strings.TrimSuffix(name, ".up.sql"), "_")
+		if !ok {
+			return nil, fmt.Errorf("migration %s has no version", name)
+		}
+
+		v, err := strconv.ParseUint(prefix, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("migration %s has a bad version: %w", name, err)
+		}
+		files = append(files, Migration{Version: uint(v), Name: rest})
+	}
+
+	slices.SortFunc(files, func(a, b Migration) int { return cmp.Compare(a.Version, b.Version) })
+
+	return files, nil
+}
+
+// Version reads the version golang-migrate recorded in the database. dirty
+// means a migration failed partway and needs fixing by hand. A database that
+// was never migrated is at version 0.
+func Version(ctx context.Context, db *sqldb.DB) (version uint, dirty bool, err error) {
+	query := `select version, dirty from schema_migrations limit 1`
+
+	err = db.QueryRowContext(ctx, query).Scan(&version, &dirty)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, false, nil
+		}
+		return 0, false, fmt.Errorf("failed to get migration version: %w", err)
+	}
+
+	return version, dirty, nil
+}
@@ -0,0 +1,55 @@
+package migrations
+
+import (
+	"testing"
+
+	sqldb "github.com/davemolk/chuck/internal/sql"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLatest(t *testing.T) {
+	latest, err := Latest(sqldb.Postgres)
+	require.NoError(t, err)
+	require.GreaterOrEqual(t, latest, uint(6))
+}
+
+// TestDriversInStep keeps a version meaning the same schema on postgres and
+// sqlite.
+func TestDriversInStep(t *testing.T) {
+	pg, err := embedded(sqldb.Postgres)
+	require.NoError(t, err)
+	sqlite, err := embedded(sqldb.SQLite)
+	require.NoError(t, err)
+
+	require.Equal(t, pg, sqlite)
+}
+
+func TestBetween(t *testing.T) {
+	up, err := between(sqldb.Postgres, 3, 5)
+	require.NoError(t, err)
+	require.Equal(t, []Migration{
+		{Version: 4, Name: "email_verification", Direction: "up"},
+		{Version: 5, Name: "rate_limits", Direction: "up"},
+	}, up)
+
+	down, err := between(sqldb.Postgres, 5, 3)
+	require.NoError(t, err)
+	require.Equal(t, []Migration{
+		{Version: 5, Name: "rate_limits", Direction: "down"},
+		{Version: 4, Name: "email_verification", Direction: "down"},
+	}, down)
+
+	none, err := between(sqldb.Postgres, 6, 6)
+	require.NoError(t, err)
+	require.Empty(t, none)
+}
+
+func TestReportString(t *testing.T) {
+	require.Equal(t, "database is at version 6, no migrations to run", Report{From: 6, To: 6}.String())
+
+	report := Report{From: 0, To: 2, Applied: []Migration{
+		{Version: 1, Name: "jokes", Direction: "up"},
+		{Version: 2, Name: "mfa", Direction: "up"},
+	}}
+	require.Equal(t, "migrated from version 0 to 2:\n  up   1 jokes\n  up   2 mfa", report.String())
+}
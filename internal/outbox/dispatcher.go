@@ -0,0 +1,220 @@
+package outbox
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/davemolk/chuck/internal/metrics"
+	sqldb "github.com/davemolk/chuck/internal/sql"
+	"github.com/davemolk/chuck/internal/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.uber.org/zap"
+)
+
+const (
+	// MaxAttempts is how many times an event is tried before it's left as
+	// dead.
+	MaxAttempts = 10
+
+	// retryBackoff is the wait after the first failed attempt, it doubles
+	// after each one after that, up to maxBackoff. Ten attempts take about
+	// 45 minutes.
+	retryBackoff = 5 * time.Second
+	maxBackoff   = time.Hour
+
+	// handlerTimeout bounds each subscriber's handling of an event.
+	handlerTimeout = 30 * time.Second
+
+	// lease is how long a claimed event is left alone by other dispatchers,
+	// so if this one dies mid delivery the event is tried again after it.
+	lease = 5 * time.Minute
+)
+
+// Handler reacts to an event. An error has the event tried again later, see
+// MaxAttempts.
+type Handler func(ctx context.Context, event Event) error
+
+type subscriber struct {
+	name string
+	fn   Handler
+}
+
+// Dispatcher delivers events from the outbox to the subscribers for their
+// type, oldest first. Delivered events are deleted. Events no one subscribes
+// to count as delivered.
+//
+// Any number of dispatchers can share an outbox, each event is claimed by
+// one at a time.
+type Dispatcher struct {
+	logger      *zap.Logger
+	db          *sqldb.DB
+	subscribers map[string][]subscriber
+	now         func() time.Time
+}
+
+func NewDispatcher(logger *zap.Logger, db *sqldb.DB) *Dispatcher {
+	return &Dispatcher{
+		logger:      logger,
+		db:          db,
+		subscribers: make(map[string][]subscriber),
+		now:         time.Now,
+	}
+}
+
+// Subscribe has fn called with every event of eventType, name is for logs.
+// Subscribers are called in the order they subscribed. It's not safe to call
+// once Run has started.
+func (d *Dispatcher) Subscribe(eventType, name string, fn Handler) {
+	d.subscribers[eventType] = append(d.subscribers[eventType], subscriber{name: name, fn: fn})
+}
+
+// Run dispatches whatever's due every interval until ctx is done.
+func (d *Dispatcher) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := d.Dispatch(ctx); err != nil && ctx.Err() == nil {
+				d.logger.Error("failed to dispatch outbox events", zap.Error(err))
+			}
+		}
+	}
+}
+
+// Dispatch delivers events until none are due, returning how many it tried.
+// A subscriber failing isn't an error, the event is retried or left dead.
+func (d *Dispatcher) Dispatch(ctx context.Context) (int, error) {
+	n := 0
+	for {
+		event, err := d.claim(ctx)
+		if errors.Is(err, sql.ErrNoRows) {
+			return n, nil
+		}
+		if err != nil {
+			return n, err
+		}
+		n++
+
+		if err = d.deliver(ctx, event); err != nil {
+			return n, err
+		}
+	}
+}
+
+// claim takes the oldest due event and holds it for the lease. The update
+// checks the event is still unclaimed, so if two dispatchers pick the same
+// one only the first gets it.
+func (d *Dispatcher) claim(ctx context.Context) (Event, error) {
+	now := d.now().UTC()
+
+	query := `
+		update outbox
+		set attempts = attempts + 1, locked_until = $2
+		where id = (
+			select id from outbox
+			where status = 'pending' and next_attempt_at <= $1 and (locked_until is null or locked_until <= $1)
+			order by id
+			limit 1` + d.db.SkipLocked() + `
+		)
+		and status = 'pending' and (locked_until is null or locked_until <= $1)
+		returning id, type, payload, attempts, created_at
+	`
+
+	var event Event
+	var payload string
+	err := d.db.QueryRowContext(ctx, query, now, now.Add(lease)).Scan(&event.ID, &event.Type, &payload, &event.Attempts, &event.CreatedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return Event{}, err
+		}
+		return Event{}, fmt.Errorf("failed to claim event: %w", err)
+	}
+	event.Payload = []byte(payload)
+
+	return event, nil
+}
+
+// deliver hands the event to its subscribers and records how that went. The
+// error is only for failing to record it.
+func (d *Dispatcher) deliver(ctx context.Context, event Event) error {
+	ctx, span := tracing.Start(ctx, "outbox.deliver",
+		attribute.String("event.type", event.Type),
+		attribute.Int64("event.id", event.ID),
+		attribute.Int("event.attempt", event.Attempts),
+	)
+	defer span.End()
+
+	logger := d.logger.With(zap.Int64("event_id", event.ID), zap.String("type", event.Type), zap.Int("attempt", event.Attempts))
+
+	var failed error
+	for _, s := range d.subscribers[event.Type] {
+		if failed = call(ctx, s, event); failed != nil {
+			break
+		}
+	}
+	tracing.RecordError(span, failed)
+
+	switch {
+	case failed == nil:
+		if _, err := d.db.ExecContext(ctx, `delete from outbox where id = $1`, event.ID); err != nil {
+			return fmt.Errorf("failed to delete delivered event %d: %w", event.ID, err)
+		}
+		metrics.ObserveOutboxDelivery(event.Type, metrics.OutboxDelivered)
+
+	case event.Attempts >= MaxAttempts:
+		query := `update outbox set status = 'dead', locked_until = null, last_error = $2 where id = $1`
+		if _, err := d.db.ExecContext(ctx, query, event.ID, failed.Error()); err != nil {
+			return fmt.Errorf("failed to mark event %d dead: %w", event.ID, err)
+		}
+		metrics.ObserveOutboxDelivery(event.Type, metrics.OutboxDead)
+		logger.Error("giving up on event", zap.Error(failed))
+
+	default:
+		wait := backoff(event.Attempts)
+		query := `update outbox set locked_until = null, next_attempt_at = $2, last_error = $3 where id = $1`
+		if _, err := d.db.ExecContext(ctx, query, event.ID, d.now().UTC().Add(wait), failed.Error()); err != nil {
+			return fmt.Errorf("failed to reschedule event %d: %w", event.ID, err)
+		}
+		metrics.ObserveOutboxDelivery(event.Type, metrics.OutboxRetried)
+		logger.Warn("failed to deliver event, will retry", zap.Duration("wait", wait), zap.Error(failed))
+	}
+
+	return nil
+}
+
+// call runs one subscriber, with a panic counting as a failure.
+func call(ctx context.Context, s subscriber, event Event) (err error) {
+	ctx, cancel := context.WithTimeout(ctx, handlerTimeout)
+	defer cancel()
+
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%s panicked: %v", s.name, r)
+		}
+	}()
+
+	if err = s.fn(ctx, event); err != nil {
+		return fmt.Errorf("%s: %w", s.name, err)
+	}
+
+	return nil
+}
+
+// backoff is how long to wait after the attempt'th try.
+func backoff(attempt int) time.Duration {
+	d := retryBackoff
+	for range attempt - 1 {
+		d *= 2
+		if d >= maxBackoff {
+			return maxBackoff
+		}
+	}
+	return d
+}
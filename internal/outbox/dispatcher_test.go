@@ -0,0 +1,178 @@
+package outbox
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"testing"
+	"time"
+
+	sqldb "github.com/davemolk/chuck/internal/sql"
+	"github.com/davemolk/chuck/internal/sql/dbtest"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+// newTestDispatcher is a dispatcher with a clock the test moves. It starts a
+// minute ahead of the real time Add uses, so events are due as soon as
+// they're added.
+func newTestDispatcher(db *sqldb.DB) (*Dispatcher, *time.Time) {
+	now := time.Now().Add(time.Minute)
+	d := NewDispatcher(zap.NewNop(), db)
+	d.now = func() time.Time { return now }
+	return d, &now
+}
+
+func add(t *testing.T, db *sqldb.DB, eventType string, payload any) {
+	t.Helper()
+	err := db.RunInTx(context.Background(), nil, func(ctx context.Context, tx *sql.Tx) error {
+		return Add(ctx, tx, eventType, payload)
+	})
+	require.NoError(t, err)
+}
+
+func pending(t *testing.T, db *sqldb.DB) int {
+	t.Helper()
+	var n int
+	require.NoError(t, db.QueryRowContext(context.Background(), `select count(*) from outbox`).Scan(&n))
+	return n
+}
+
+func TestDispatcher(t *testing.T) {
+	dbtest.Run(t, func(t *testing.T, db *sqldb.DB) {
+		ctx := context.Background()
+
+		t.Run("delivers in order", func(t *testing.T) {
+			d, _ := newTestDispatcher(db)
+
+			var got []string
+			d.Subscribe(UserRegistered, "first", func(ctx context.Context, e Event) error {
+				var p UserRegisteredPayload
+				require.NoError(t, e.Decode(&p))
+				require.Equal(t, 1, e.Attempts)
+				got = append(got, "first", string(rune('0'+p.UserID)))
+				return nil
+			})
+			d.Subscribe(UserRegistered, "second", func(ctx context.Context, e Event) error {
+				got = append(got, "second")
+				return nil
+			})
+
+			add(t, db, UserRegistered, UserRegisteredPayload{UserID: 1})
+			add(t, db, UserRegistered, UserRegisteredPayload{UserID: 2})
+			// no one subscribes, it just goes
+			add(t, db, JokeIngested, JokeIngestedPayload{JokeID: 1, ExternalID: "a"})
+
+			n, err := d.Dispatch(ctx)
+			require.NoError(t, err)
+			require.Equal(t, 3, n)
+			require.Equal(t, []string{"first", "1", "second", "first", "2", "second"}, got)
+			require.Zero(t, pending(t, db))
+		})
+
+		t.Run("rolled back events are never delivered", func(t *testing.T) {
+			errBoom := errors.New("boom")
+			err := db.RunInTx(ctx, nil, func(ctx context.Context, tx *sql.Tx) error {
+				require.NoError(t, Add(ctx, tx, UserRegistered, UserRegisteredPayload{UserID: 3}))
+				return errBoom
+			})
+			require.ErrorIs(t, err, errBoom)
+			require.Zero(t, pending(t, db))
+		})
+
+		t.Run("retries with backoff", func(t *testing.T) {
+			d, now := newTestDispatcher(db)
+
+			calls := 0
+			d.Subscribe(UserRegistered, "flaky", func(ctx context.Context, e Event) error {
+				calls++
+				require.Equal(t, calls, e.Attempts)
+				if calls == 1 {
+					return errors.New("not yet")
+				}
+				if calls == 2 {
+					panic("still not yet")
+				}
+				return nil
+			})
+			add(t, db, UserRegistered, UserRegisteredPayload{UserID: 4})
+
+			_, err := d.Dispatch(ctx)
+			require.NoError(t, err)
+			require.Equal(t, 1, calls)
+
+			var lastError string
+			require.NoError(t, db.QueryRowContext(ctx, `select last_error from outbox`).Scan(&lastError))
+			require.Equal(t, "flaky: not yet", lastError)
+
+			// not due until the backoff is up
+			n, err := d.Dispatch(ctx)
+			require.NoError(t, err)
+			require.Zero(t, n)
+
+			*now = now.Add(retryBackoff)
+			_, err = d.Dispatch(ctx)
+			require.NoError(t, err)
+			require.Equal(t, 2, calls)
+
+			*now = now.Add(2 * retryBackoff)
+			_, err = d.Dispatch(ctx)
+			require.NoError(t, err)
+			require.Equal(t, 3, calls)
+			require.Zero(t, pending(t, db))
+		})
+
+		t.Run("dead letters", func(t *testing.T) {
+			d, now := newTestDispatcher(db)
+
+			calls := 0
+			d.Subscribe(UserRegistered, "broken", func(ctx context.Context, e Event) error {
+				calls++
+				return errors.New("nope")
+			})
+			add(t, db, UserRegistered, UserRegisteredPayload{UserID: 5})
+
+			for range MaxAttempts + 2 {
+				_, err := d.Dispatch(ctx)
+				require.NoError(t, err)
+				*now = now.Add(maxBackoff)
+			}
+			require.Equal(t, MaxAttempts, calls)
+
+			var status string
+			var attempts int
+			require.NoError(t, db.QueryRowContext(ctx, `select status, attempts from outbox`).Scan(&status, &attempts))
+			require.Equal(t, "dead", status)
+			require.Equal(t, MaxAttempts, attempts)
+
+			_, err := db.ExecContext(ctx, `delete from outbox`)
+			require.NoError(t, err)
+		})
+
+		t.Run("claims are leased", func(t *testing.T) {
+			d, now := newTestDispatcher(db)
+			other, otherNow := newTestDispatcher(db)
+			add(t, db, UserRegistered, UserRegisteredPayload{UserID: 6})
+
+			// d claims it and dies before delivering
+			_, err := d.claim(ctx)
+			require.NoError(t, err)
+
+			n, err := other.Dispatch(ctx)
+			require.NoError(t, err)
+			require.Zero(t, n)
+
+			*otherNow = now.Add(lease)
+			n, err = other.Dispatch(ctx)
+			require.NoError(t, err)
+			require.Equal(t, 1, n)
+			require.Zero(t, pending(t, db))
+		})
+	})
+}
+
+func TestBackoff(t *testing.T) {
+	require.Equal(t, retryBackoff, backoff(1))
+	require.Equal(t, 4*retryBackoff, backoff(3))
+	require.Equal(t, maxBackoff, backoff(20))
+}
@@ -0,0 +1,73 @@
+// Package outbox records events in the same transaction as the change they
+// describe, so an event exists exactly when its change was committed, and
+// delivers them to subscribers in process afterwards, see Dispatcher.
+//
+// Delivery is at least once. A subscriber can see an event again after a
+// crash, or after another subscriber to the same event failed, so it has to
+// be fine with repeats.
+package outbox
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Event types, each with a payload below.
+const (
+	UserRegistered = "user.registered"
+	JokeIngested   = "joke.ingested"
+)
+
+// UserRegisteredPayload is a new account.
+type UserRegisteredPayload struct {
+	UserID int64 `json:"user_id"`
+}
+
+// JokeIngestedPayload is a joke saved from the chuck norris api, an import
+// or a seed. It's saved again when it's seen again, so the same joke can be
+// ingested more than once.
+type JokeIngestedPayload struct {
+	JokeID     int64  `json:"joke_id"`
+	ExternalID string `json:"external_id"`
+}
+
+// Event is an event being delivered.
+type Event struct {
+	ID      int64
+	Type    string
+	Payload json.RawMessage
+	// Attempts counts this delivery
+	Attempts  int
+	CreatedAt time.Time
+}
+
+// Decode unmarshals the payload into v, e.g. a *UserRegisteredPayload.
+func (e Event) Decode(v any) error {
+	if err := json.Unmarshal(e.Payload, v); err != nil {
+		return fmt.Errorf("failed to decode %s event %d: %w", e.Type, e.ID, err)
+	}
+	return nil
+}
+
+// Add writes an event to the outbox in tx. It's delivered once tx commits,
+// and never if it rolls back.
+func Add(ctx context.Context, tx *sql.Tx, eventType string, payload any) error {
+	b, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("failed to encode %s event: %w", eventType, err)
+	}
+
+	query := `
+		insert into outbox (type, payload, next_attempt_at, created_at)
+		values ($1, $2, $3, $3)
+	`
+
+	if _, err = tx.ExecContext(ctx, query, eventType, string(b), time.Now().UTC()); err != nil {
+		return fmt.Errorf("failed to add %s event: %w", eventType, err)
+	}
+
+	return nil
+}
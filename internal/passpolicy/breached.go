@@ -0,0 +1,92 @@
+package passpolicy
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// BreachedList knows about passwords that have shown up in data breaches.
+type BreachedList interface {
+	Contains(password string) (bool, error)
+}
+
+const (
+	// prefixLen and suffixLen split a hex SHA-1 hash the way the Pwned
+	// Passwords range files do.
+	prefixLen = 5
+	suffixLen = 2*sha1.Size - prefixLen
+)
+
+// RangeDir is a BreachedList on disk in the k-anonymity layout of the Pwned
+// Passwords downloads: a file per 5 character hash prefix, e.g. 5BAA6.txt,
+// holding a "suffix:count" line for each hash starting with it. Only the one
+// file for a password's prefix is read to check it, so the whole corpus never
+// has to fit in memory.
+type RangeDir struct {
+	dir string
+}
+
+// OpenRangeDir checks dir is a directory. A missing prefix file means no
+// breached hashes start with it, so a partial corpus works too.
+func OpenRangeDir(dir string) (*RangeDir, error) {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open breached password dir: %w", err)
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("breached password dir %s is not a directory", dir)
+	}
+
+	return &RangeDir{dir: dir}, nil
+}
+
+func (d *RangeDir) Contains(password string) (bool, error) {
+	sum := sha1.Sum([]byte(password))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+	prefix, suffix := hash[:prefixLen], hash[prefixLen:]
+
+	path := filepath.Join(d.dir, prefix+".txt")
+	f, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to open breached password range: %w", err)
+	}
+
+	defer func() { _ = f.Close() }()
+
+	scanner := bufio.NewScanner(f)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+
+		s, count, _ := strings.Cut(text, ":")
+		if len(s) != suffixLen {
+			return false, fmt.Errorf("%s line %d: expected a %d character hash suffix", path, line, suffixLen)
+		}
+
+		// the range api pads responses with zero count suffixes that were
+		// never in a breach
+		if strings.EqualFold(s, suffix) && count != "0" {
+			return true, nil
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return false, fmt.Errorf("failed to read breached password range: %w", err)
+	}
+
+	return false, nil
+}
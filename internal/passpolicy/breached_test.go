@@ -0,0 +1,75 @@
+package passpolicy
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+// writeRanges lays out range files the way the Pwned Passwords downloader
+// does, one per prefix with crlf line endings.
+func writeRanges(t *testing.T, ranges map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for prefix, lines := range ranges {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, prefix+".txt"), []byte(lines), 0o600))
+	}
+	return dir
+}
+
+func TestRangeDir(t *testing.T) {
+	// sha1("password") is 5BAA6 1E4C9..., sha1("123456") is 7C4A8 D09CA...,
+	// the second in lower case
+	dir := writeRanges(t, map[string]string{
+		"5BAA6": "003D68EB55068C33ACE09247EE4C639306B:3\r\n1E4C9B93F3F0682250B6CF8331B7EE68FD8:9545824\r\n",
+		"7C4A8": "d09ca3762af61e59520943dc26494f8941b:37359195\r\n",
+		// padding from the range api, never breached
+		"8BE3C": "943B1609FFFBFC51AAD666D0A04ADF83C9D:0\r\n",
+	})
+
+	list, err := OpenRangeDir(dir)
+	require.NoError(t, err)
+
+	for password, want := range map[string]bool{
+		"password": true,
+		"123456":   true,
+		"Password": false,
+		// no range file for its prefix
+		"roundhouse kick to the face": false,
+	} {
+		got, err := list.Contains(password)
+		require.NoError(t, err)
+		require.Equal(t, want, got, password)
+	}
+}
+
+func TestRangeDirErrors(t *testing.T) {
+	_, err := OpenRangeDir(filepath.Join(t.TempDir(), "missing"))
+	require.Error(t, err)
+
+	file := filepath.Join(t.TempDir(), "pwned.txt")
+	require.NoError(t, os.WriteFile(file, nil, 0o600))
+	_, err = OpenRangeDir(file)
+	require.ErrorContains(t, err, "not a directory")
+
+	// a full hash where a suffix should be
+	list, err := OpenRangeDir(writeRanges(t, map[string]string{
+		"5BAA6": "5BAA61E4C9B93F3F0682250B6CF8331B7EE68FD8:12\r\n",
+	}))
+	require.NoError(t, err)
+	_, err = list.Contains("password")
+	require.ErrorContains(t, err, "line 1")
+}
+
+type brokenList struct{}
+
+func (brokenList) Contains(string) (bool, error) {
+	return false, os.ErrPermission
+}
+
+func TestNotBreachedFailsOpen(t *testing.T) {
+	require.Nil(t, NotBreached(zap.NewNop(), brokenList{}).Check(Input{Password: "password"}))
+}
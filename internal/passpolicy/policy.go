@@ -0,0 +1,180 @@
+// Package passpolicy decides whether a password is good enough to use. A
+// Policy is a list of rules, and a rejected password comes back as an *Error
+// with every reason it failed, so the user can fix them all at once.
+package passpolicy
+
+import (
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// Reason is why a rule rejected a password. Code is stable and meant for
+// clients, Message is meant for people.
+type Reason struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+type Error struct {
+	Reasons []Reason
+}
+
+func (e *Error) Error() string {
+	msgs := make([]string, len(e.Reasons))
+	for i, r := range e.Reasons {
+		msgs[i] = r.Message
+	}
+	return "password rejected: " + strings.Join(msgs, "; ")
+}
+
+// Input is what the rules get to look at. Email is empty when it isn't known.
+type Input struct {
+	Password string
+	Email    string
+}
+
+// Rule checks one thing about a password, returning nil if it's happy.
+type Rule interface {
+	Check(in Input) *Reason
+}
+
+// RuleFunc lets a plain function be used as a Rule.
+type RuleFunc func(in Input) *Reason
+
+func (f RuleFunc) Check(in Input) *Reason {
+	return f(in)
+}
+
+type Policy struct {
+	rules []Rule
+}
+
+// New returns a policy that applies the rules in order. A policy with no
+// rules accepts everything.
+func New(rules ...Rule) *Policy {
+	return &Policy{rules: rules}
+}
+
+// Check runs every rule and returns an *Error listing all the reasons the
+// password was rejected, or nil if it passed.
+func (p *Policy) Check(in Input) error {
+	var reasons []Reason
+	for _, rule := range p.rules {
+		if reason := rule.Check(in); reason != nil {
+			reasons = append(reasons, *reason)
+		}
+	}
+
+	if len(reasons) > 0 {
+		return &Error{Reasons: reasons}
+	}
+
+	return nil
+}
+
+// MinScore rejects passwords that score below min on the 0-4 scale from
+// Score.
+func MinScore(min int) Rule {
+	return RuleFunc(func(in Input) *Reason {
+		if Score(in.Password) >= min {
+			return nil
+		}
+		return &Reason{
+			Code:    "too_weak",
+			Message: "password is too easy to guess, try a longer phrase or fewer common words and patterns",
+		}
+	})
+}
+
+// ForbiddenWords rejects passwords containing any of the words, ignoring
+// case, common character substitutions, and anything that isn't a letter or
+// digit, so "Chuck_N0rr1s!" counts as "chucknorris".
+func ForbiddenWords(words ...string) Rule {
+	normalized := make([]string, 0, len(words))
+	for _, w := range words {
+		if w = normalize(w); w != "" {
+			normalized = append(normalized, w)
+		}
+	}
+
+	return RuleFunc(func(in Input) *Reason {
+		pw := normalize(in.Password)
+		for _, w := range normalized {
+			if strings.Contains(pw, w) {
+				return &Reason{
+					Code:    "forbidden_word",
+					Message: "password can't contain " + w,
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// NoEmail rejects passwords containing the user's email or the part of it
+// before the @.
+func NoEmail() Rule {
+	return RuleFunc(func(in Input) *Reason {
+		if in.Email == "" {
+			return nil
+		}
+
+		local, _, _ := strings.Cut(in.Email, "@")
+		pw := normalize(in.Password)
+
+		// very short local parts would match too much by accident
+		if local = normalize(local); len(local) >= 3 && strings.Contains(pw, local) {
+			return &Reason{
+				Code:    "contains_email",
+				Message: "password can't contain your email",
+			}
+		}
+		return nil
+	})
+}
+
+// NotBreached rejects passwords that appear in the list. A password the list
+// can't be checked for is let through and the error logged, so a bad disk
+// doesn't stop everyone from signing up.
+func NotBreached(logger *zap.Logger, list BreachedList) Rule {
+	return RuleFunc(func(in Input) *Reason {
+		breached, err := list.Contains(in.Password)
+		if err != nil {
+			logger.Error("failed to check breached passwords", zap.Error(err))
+			return nil
+		}
+		if !breached {
+			return nil
+		}
+		return &Reason{
+			Code:    "breached",
+			Message: "password has appeared in a data breach, please choose another",
+		}
+	})
+}
+
+var leet = strings.NewReplacer(
+	"@", "a", "4", "a",
+	"8", "b",
+	"(", "c",
+	"3", "e",
+	"6", "g", "9", "g",
+	"1", "i", "!", "i", "|", "i",
+	"0", "o",
+	"$", "s", "5", "s",
+	"7", "t", "+", "t",
+	"2", "z",
+)
+
+// normalize lowercases, undoes common substitutions, and drops everything
+// but letters and digits.
+func normalize(s string) string {
+	s = leet.Replace(strings.ToLower(s))
+	return strings.Map(func(r rune) rune {
+		if ('a' <= r && r <= 'z') || ('0' <= r && r <= '9') {
+			return r
+		}
+		return -1
+	}, s)
+}
@@ -0,0 +1,67 @@
+package passpolicy
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestPolicy(t *testing.T) {
+	breached, err := OpenRangeDir(writeRanges(t, map[string]string{
+		// sha1("correct horse battery staple")
+		"ABF7A": "AD6438836DBE526AA231ABDE2D0EEF74D42:3\r\n",
+	}))
+	require.NoError(t, err)
+
+	p := New(
+		MinScore(3),
+		ForbiddenWords("chucknorris"),
+		NoEmail(),
+		NotBreached(zap.NewNop(), breached),
+	)
+
+	tests := []struct {
+		name    string
+		in      Input
+		reasons []string
+	}{
+		{"strong", Input{Password: "roundhouse kick to the face", Email: "walker@ranger.com"}, nil},
+		{"weak", Input{Password: "password1"}, []string{"too_weak"}},
+		{"forbidden word", Input{Password: "I am Chuck_N0rr1s, fear me!"}, []string{"forbidden_word"}},
+		{"email", Input{Password: "cordell walker texas ranger 88", Email: "Walker@ranger.com"}, []string{"contains_email"}},
+		{"short local part is ignored", Input{Password: "bo knows roundhouse kicks", Email: "bo@ranger.com"}, nil},
+		{"breached", Input{Password: "correct horse battery staple"}, []string{"breached"}},
+		{"everything at once", Input{Password: "chucknorris", Email: "chuck@norris.com"}, []string{"too_weak", "forbidden_word", "contains_email"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := p.Check(tt.in)
+			if tt.reasons == nil {
+				require.NoError(t, err)
+				return
+			}
+
+			var perr *Error
+			require.True(t, errors.As(err, &perr))
+
+			var codes []string
+			for _, r := range perr.Reasons {
+				codes = append(codes, r.Code)
+				require.NotEmpty(t, r.Message)
+			}
+			require.Equal(t, tt.reasons, codes)
+		})
+	}
+
+	t.Run("empty policy accepts anything", func(t *testing.T) {
+		require.NoError(t, New().Check(Input{Password: "pw"}))
+	})
+}
+
+func TestNormalize(t *testing.T) {
+	require.Equal(t, "chucknorris", normalize("Chuck_N0rr1$"))
+	require.Equal(t, "walker", normalize("w@lk3r"))
+}
@@ -0,0 +1,313 @@
+package passpolicy
+
+import (
+	_ "embed"
+	"math"
+	"strings"
+	"unicode"
+)
+
+// The estimator below follows the approach of Dropbox's zxcvbn, cut down to
+// the parts that matter most: a password is split into the cheapest sequence
+// of known patterns (common words, keyboard rows, sequences, repeats, years)
+// and bruteforced characters, and the guesses needed for each piece are
+// multiplied together. See https://github.com/dropbox/zxcvbn for the full
+// version.
+
+//go:embed common.txt
+var commonList string
+
+// common maps a word or password to its rank, 1 being the most common.
+var common = func() map[string]int {
+	m := make(map[string]int)
+	rank := 1
+	for _, line := range strings.Split(commonList, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if _, ok := m[line]; !ok {
+			m[line] = rank
+			rank++
+		}
+	}
+	return m
+}()
+
+var keyboardRows = []string{
+	"1234567890",
+	"qwertyuiop",
+	"asdfghjkl",
+	"zxcvbnm",
+}
+
+const (
+	minMatchLength = 3
+	// guesses for a year are roughly the range of years people pick from.
+	yearGuesses = 120
+)
+
+type match struct {
+	start, end int // end is exclusive
+	// log2 of the guesses needed for this piece
+	bits float64
+}
+
+// Entropy estimates the bits of entropy in the password, i.e. log2 of the
+// number of guesses an attacker who knows common patterns would need.
+func Entropy(password string) float64 {
+	runes := []rune(password)
+	if len(runes) == 0 {
+		return 0
+	}
+
+	matches := findMatches(runes)
+	charBits := math.Log2(float64(cardinality(runes)))
+
+	// best[k] is the fewest bits needed to cover the first k runes
+	best := make([]float64, len(runes)+1)
+	for k := 1; k <= len(runes); k++ {
+		best[k] = best[k-1] + charBits
+		for _, m := range matches {
+			if m.end == k {
+				best[k] = math.Min(best[k], best[m.start]+m.bits)
+			}
+		}
+	}
+
+	return best[len(runes)]
+}
+
+// Score buckets the estimated guesses the same way zxcvbn does:
+//
+//	0: < 10^3 guesses, 1: < 10^6, 2: < 10^8, 3: < 10^10, 4: more
+func Score(password string) int {
+	guesses := math.Pow(2, Entropy(password))
+	switch {
+	case guesses < 1e3:
+		return 0
+	case guesses < 1e6:
+		return 1
+	case guesses < 1e8:
+		return 2
+	case guesses < 1e10:
+		return 3
+	default:
+		return 4
+	}
+}
+
+func findMatches(runes []rune) []match {
+	var matches []match
+
+	lower := []rune(strings.ToLower(string(runes)))
+	unleeted := []rune(leet.Replace(string(lower)))
+	// the leet replacer only swaps single characters, so positions line up
+	if len(unleeted) != len(lower) {
+		unleeted = lower
+	}
+
+	for i := range runes {
+		for j := i + minMatchLength; j <= len(runes); j++ {
+			word := string(lower[i:j])
+
+			if rank, ok := common[word]; ok {
+				matches = append(matches, match{i, j, math.Log2(float64(rank)) + caseBits(runes[i:j])})
+			}
+			if rank, ok := common[reverse(word)]; ok {
+				matches = append(matches, match{i, j, math.Log2(float64(rank)) + caseBits(runes[i:j]) + 1})
+			}
+			if sub := string(unleeted[i:j]); sub != word {
+				if rank, ok := common[sub]; ok {
+					matches = append(matches, match{i, j, math.Log2(float64(rank)) + caseBits(runes[i:j]) + 1})
+				}
+			}
+
+			if j-i == 4 && isYear(word) {
+				matches = append(matches, match{i, j, math.Log2(yearGuesses)})
+			}
+		}
+	}
+
+	matches = append(matches, sequenceMatches(lower)...)
+	matches = append(matches, repeatMatches(lower)...)
+	matches = append(matches, keyboardMatches(lower)...)
+
+	return matches
+}
+
+// sequenceMatches finds runs like "abcd", "9876", or "aceg" where every step
+// is the same small distance.
+func sequenceMatches(runes []rune) []match {
+	var matches []match
+
+	for i := 0; i < len(runes)-1; {
+		delta := runes[i+1] - runes[i]
+		j := i + 1
+		for j < len(runes) && runes[j]-runes[j-1] == delta {
+			j++
+		}
+
+		if j-i >= minMatchLength && delta != 0 && abs(delta) <= 5 {
+			// sequences starting somewhere obvious are guessed first
+			base := 26.0
+			switch {
+			case strings.ContainsRune("az019", runes[i]):
+				base = 4
+			case unicode.IsDigit(runes[i]):
+				base = 10
+			}
+			if delta < 0 {
+				base *= 2
+			}
+			matches = append(matches, match{i, j, math.Log2(base * float64(j-i))})
+		}
+
+		i = j - 1
+		if j == len(runes) {
+			break
+		}
+	}
+
+	return matches
+}
+
+// repeatMatches finds the same character over and over, like "aaaa".
+func repeatMatches(runes []rune) []match {
+	var matches []match
+
+	for i := 0; i < len(runes); {
+		j := i + 1
+		for j < len(runes) && runes[j] == runes[i] {
+			j++
+		}
+
+		if j-i >= minMatchLength {
+			matches = append(matches, match{i, j, math.Log2(float64(cardinality(runes[i:i+1]) * (j - i)))})
+		}
+
+		i = j
+	}
+
+	return matches
+}
+
+// keyboardMatches finds straight runs along a keyboard row, like "asdf" or
+// "poiuy".
+func keyboardMatches(runes []rune) []match {
+	var matches []match
+
+	for _, row := range keyboardRows {
+		rev := reverse(row)
+		for i := range runes {
+			for j := i + minMatchLength + 1; j <= len(runes); j++ {
+				sub := string(runes[i:j])
+				if !strings.Contains(row, sub) && !strings.Contains(rev, sub) {
+					break
+				}
+				// a start key, a direction, and a length
+				matches = append(matches, match{i, j, math.Log2(float64(len(row) * 2 * (j - i)))})
+			}
+		}
+	}
+
+	return matches
+}
+
+// caseBits is the extra work for guessing where the capitals go, which is
+// nothing for all lower case and one bit for the usual first or all caps.
+func caseBits(runes []rune) float64 {
+	var upper, lower int
+	for _, r := range runes {
+		switch {
+		case unicode.IsUpper(r):
+			upper++
+		case unicode.IsLower(r):
+			lower++
+		}
+	}
+
+	switch {
+	case upper == 0:
+		return 0
+	case lower == 0, upper == 1 && unicode.IsUpper(runes[0]):
+		return 1
+	default:
+		// any upper and lower case arrangement, log2(n choose upper)
+		n := upper + lower
+		return math.Log2(binomial(n, min(upper, lower)))
+	}
+}
+
+// cardinality is the size of the character set the runes are drawn from.
+func cardinality(runes []rune) int {
+	var lower, upper, digit, symbol, other bool
+	for _, r := range runes {
+		switch {
+		case 'a' <= r && r <= 'z':
+			lower = true
+		case 'A' <= r && r <= 'Z':
+			upper = true
+		case '0' <= r && r <= '9':
+			digit = true
+		case r < unicode.MaxASCII:
+			symbol = true
+		default:
+			other = true
+		}
+	}
+
+	var n int
+	if lower {
+		n += 26
+	}
+	if upper {
+		n += 26
+	}
+	if digit {
+		n += 10
+	}
+	if symbol {
+		n += 33
+	}
+	if other {
+		n += 100
+	}
+
+	return n
+}
+
+func isYear(s string) bool {
+	if len(s) != 4 || (s[:2] != "19" && s[:2] != "20") {
+		return false
+	}
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+func binomial(n, k int) float64 {
+	r := 1.0
+	for i := 1; i <= k; i++ {
+		r *= float64(n-k+i) / float64(i)
+	}
+	return r
+}
+
+func reverse(s string) string {
+	r := []rune(s)
+	for i, j := 0, len(r)-1; i < j; i, j = i+1, j-1 {
+		r[i], r[j] = r[j], r[i]
+	}
+	return string(r)
+}
+
+func abs(r rune) rune {
+	if r < 0 {
+		return -r
+	}
+	return r
+}
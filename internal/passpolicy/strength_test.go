@@ -0,0 +1,45 @@
+package passpolicy
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestScore(t *testing.T) {
+	tests := []struct {
+		password string
+		score    int
+	}{
+		{"", 0},
+		{"password", 0},
+		{"P@ssw0rd", 0},
+		{"drowssap", 0},
+		{"qwertyuiop", 0},
+		{"abcdefgh", 0},
+		{"98765432", 0},
+		{"aaaaaaaaaaaa", 0},
+		{"walker1987", 1},
+		{"roundhouse kick to the face", 4},
+		{"9fK#2mQ!xz", 4},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.password, func(t *testing.T) {
+			require.Equal(t, tt.score, Score(tt.password))
+		})
+	}
+}
+
+func TestEntropyPatternsBeatBruteforce(t *testing.T) {
+	// same length and character set, but one is made of patterns
+	require.Less(t, Entropy("qwerty123456"), Entropy("q8w1e5r2t7y0"))
+	require.Less(t, Entropy("monkeydragon"), Entropy("mkoyndgeraon"))
+}
+
+func TestCaseBits(t *testing.T) {
+	require.Equal(t, 0.0, caseBits([]rune("chuck")))
+	require.Equal(t, 1.0, caseBits([]rune("Chuck")))
+	require.Equal(t, 1.0, caseBits([]rune("CHUCK")))
+	require.Greater(t, caseBits([]rune("cHuCk")), 1.0)
+}
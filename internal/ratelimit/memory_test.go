@@ -0,0 +1,74 @@
+package ratelimit
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemoryTake(t *testing.T) {
+	m := NewMemory()
+	now := time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC)
+	m.now = func() time.Time { return now }
+	ctx := context.Background()
+
+	limit := Limit{Requests: 3, Per: 3 * time.Second}
+
+	for i := range 3 {
+		r, err := m.Take(ctx, "key", limit)
+		require.NoError(t, err)
+		require.True(t, r.Allowed)
+		require.Equal(t, 3, r.Limit)
+		require.Equal(t, 2-i, r.Remaining)
+	}
+
+	t.Run("empty bucket is denied", func(t *testing.T) {
+		r, err := m.Take(ctx, "key", limit)
+		require.NoError(t, err)
+		require.False(t, r.Allowed)
+		require.Equal(t, 0, r.Remaining)
+		require.Equal(t, time.Second, r.RetryAfter)
+		require.Equal(t, 3*time.Second, r.ResetAfter)
+	})
+
+	t.Run("other keys have their own bucket", func(t *testing.T) {
+		r, err := m.Take(ctx, "other", limit)
+		require.NoError(t, err)
+		require.True(t, r.Allowed)
+	})
+
+	t.Run("refills over time", func(t *testing.T) {
+		now = now.Add(1500 * time.Millisecond)
+		r, err := m.Take(ctx, "key", limit)
+		require.NoError(t, err)
+		require.True(t, r.Allowed)
+		require.Equal(t, 0, r.Remaining)
+		require.Equal(t, 500*time.Millisecond, r.RetryAfter)
+	})
+
+	t.Run("never more than the limit", func(t *testing.T) {
+		now = now.Add(time.Hour)
+		r, err := m.Take(ctx, "key", limit)
+		require.NoError(t, err)
+		require.Equal(t, 2, r.Remaining)
+	})
+}
+
+func TestMemorySweep(t *testing.T) {
+	m := NewMemory()
+	now := time.Now()
+	m.now = func() time.Time { return now }
+	ctx := context.Background()
+
+	_, err := m.Take(ctx, "fast", Limit{Requests: 10, Per: time.Second})
+	require.NoError(t, err)
+	_, err = m.Take(ctx, "slow", Limit{Requests: 10, Per: time.Hour})
+	require.NoError(t, err)
+
+	now = now.Add(time.Minute)
+	err = m.Sweep(ctx)
+	require.NoError(t, err)
+	require.Equal(t, 1, m.len())
+}
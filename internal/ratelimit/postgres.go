@@ -0,0 +1,73 @@
+package ratelimit
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	sqldb "github.com/davemolk/chuck/internal/sql"
+)
+
+// Postgres keeps buckets in the rate_limits table so every replica shares
+// them. It uses the database clock rather than each replica's.
+type Postgres struct {
+	db *sqldb.DB
+}
+
+var _ Store = (*Postgres)(nil)
+
+func NewPostgres(db *sqldb.DB) *Postgres {
+	return &Postgres{db: db}
+}
+
+func (p *Postgres) Take(ctx context.Context, key string, limit Limit) (Result, error) {
+	var tokens float64
+	var allowed bool
+
+	err := p.db.RunInTx(ctx, nil, func(ctx context.Context, tx *sql.Tx) error {
+		// a new key starts with a full bucket. The no-op update locks the row
+		// when it's already there, so concurrent requests for the same key
+		// queue up behind this one whether it's their first or not, and a
+		// sweep can't delete the row before the take below.
+		if _, err := tx.ExecContext(ctx, `
+			insert into rate_limits (key, tokens, updated_at, full_at)
+			values ($1, $2::float8, clock_timestamp(), clock_timestamp())
+			on conflict (key) do update set updated_at = rate_limits.updated_at`,
+			key, float64(limit.Requests)); err != nil {
+			return fmt.Errorf("failed to lock rate limit bucket: %w", err)
+		}
+
+		// $2 is the capacity and $3 the refill rate in tokens per second
+		query := `
+			with refilled as (
+				select least($2::float8, tokens + extract(epoch from (clock_timestamp() - updated_at)) * $3::float8) as tokens
+				from rate_limits where key = $1
+			)
+			update rate_limits
+			set
+				tokens = case when refilled.tokens >= 1 then refilled.tokens - 1 else refilled.tokens end,
+				updated_at = clock_timestamp(),
+				full_at = clock_timestamp() + make_interval(secs => ($2::float8 - case when refilled.tokens >= 1 then refilled.tokens - 1 else refilled.tokens end) / $3::float8)
+			from refilled
+			where key = $1
+			returning rate_limits.tokens, refilled.tokens >= 1`
+
+		if err := tx.QueryRowContext(ctx, query, key, float64(limit.Requests), limit.rate()).Scan(&tokens, &allowed); err != nil {
+			return fmt.Errorf("failed to take rate limit token: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return Result{}, err
+	}
+
+	return result(limit, allowed, tokens), nil
+}
+
+func (p *Postgres) Sweep(ctx context.Context) error {
+	if _, err := p.db.ExecContext(ctx, `delete from rate_limits where full_at <= clock_timestamp()`); err != nil {
+		return fmt.Errorf("failed to sweep rate limits: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,69 @@
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/davemolk/chuck/internal/sql/dbtest"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPostgresTake(t *testing.T) {
+	db := dbtest.SetupTestDB(t)
+	p := NewPostgres(db)
+	ctx := context.Background()
+
+	limit := Limit{Requests: 2, Per: time.Hour}
+
+	for i := range 2 {
+		r, err := p.Take(ctx, "key", limit)
+		require.NoError(t, err)
+		require.True(t, r.Allowed)
+		require.Equal(t, 1-i, r.Remaining)
+	}
+
+	r, err := p.Take(ctx, "key", limit)
+	require.NoError(t, err)
+	require.False(t, r.Allowed)
+	require.Greater(t, r.RetryAfter, 29*time.Minute)
+
+	r, err = p.Take(ctx, "other", limit)
+	require.NoError(t, err)
+	require.True(t, r.Allowed)
+
+	t.Run("sweep keeps buckets that aren't full", func(t *testing.T) {
+		err := p.Sweep(ctx)
+		require.NoError(t, err)
+
+		r, err := p.Take(ctx, "key", limit)
+		require.NoError(t, err)
+		require.False(t, r.Allowed)
+	})
+
+	t.Run("concurrent first requests share a bucket", func(t *testing.T) {
+		limit := Limit{Requests: 1, Per: time.Hour}
+
+		var wg sync.WaitGroup
+		var allowed atomic.Int32
+		for range 10 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				r, err := p.Take(ctx, "new", limit)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if r.Allowed {
+					allowed.Add(1)
+				}
+			}()
+		}
+		wg.Wait()
+
+		require.Equal(t, int32(1), allowed.Load())
+	})
+}
@@ -0,0 +1,113 @@
+// Package ratelimit implements token bucket rate limiting over a pluggable
+// store. Each key gets a bucket holding up to Limit.Requests tokens, refilled
+// evenly over Limit.Per. A request takes one token, and is denied if the
+// bucket is empty.
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+type Limit struct {
+	Requests int
+	Per      time.Duration
+}
+
+func (l Limit) String() string {
+	return fmt.Sprintf("%d/%s", l.Requests, l.Per)
+}
+
+// ParseLimit parses a limit in the form String produces, e.g. "10/1m0s" or
+// "10/1m".
+func ParseLimit(s string) (Limit, error) {
+	requests, per, ok := strings.Cut(s, "/")
+	if !ok {
+		return Limit{}, fmt.Errorf("invalid limit %q, want requests/duration", s)
+	}
+
+	n, err := strconv.Atoi(requests)
+	if err != nil || n < 1 {
+		return Limit{}, fmt.Errorf("invalid limit %q, requests must be a positive integer", s)
+	}
+
+	d, err := time.ParseDuration(per)
+	if err != nil || d <= 0 {
+		return Limit{}, fmt.Errorf("invalid limit %q, per must be a positive duration", s)
+	}
+
+	return Limit{Requests: n, Per: d}, nil
+}
+
+// rate is how many tokens are added back per second.
+func (l Limit) rate() float64 {
+	return float64(l.Requests) / l.Per.Seconds()
+}
+
+type Result struct {
+	Allowed   bool
+	Limit     int
+	Remaining int
+	// RetryAfter is how long until the next request would be allowed, zero
+	// if it already would be.
+	RetryAfter time.Duration
+	// ResetAfter is how long until the bucket is full again.
+	ResetAfter time.Duration
+}
+
+// Store keeps buckets. Implementations must be safe for concurrent use, and
+// Take must be atomic per key.
+type Store interface {
+	// Take tries to take a token from the key's bucket.
+	Take(ctx context.Context, key string, limit Limit) (Result, error)
+	// Sweep drops buckets that have refilled completely, since a full bucket
+	// is the same as no bucket.
+	Sweep(ctx context.Context) error
+}
+
+// result works out the Result once the bucket has been refilled and, if
+// allowed, a token taken.
+func result(limit Limit, allowed bool, tokens float64) Result {
+	r := Result{
+		Allowed:    allowed,
+		Limit:      limit.Requests,
+		Remaining:  int(math.Floor(tokens)),
+		ResetAfter: tokensToDuration(float64(limit.Requests)-tokens, limit),
+	}
+
+	if tokens < 1 {
+		r.RetryAfter = tokensToDuration(1-tokens, limit)
+	}
+
+	return r
+}
+
+func tokensToDuration(tokens float64, limit Limit) time.Duration {
+	if tokens <= 0 {
+		return 0
+	}
+	return time.Duration(math.Ceil(tokens / limit.rate() * float64(time.Second)))
+}
+
+// SweepEvery calls store.Sweep on an interval until ctx is done.
+func SweepEvery(ctx context.Context, logger *zap.Logger, store Store, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := store.Sweep(ctx); err != nil {
+				logger.Error("failed to sweep rate limit buckets", zap.Error(err))
+			}
+		}
+	}
+}
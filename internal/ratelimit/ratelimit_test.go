@@ -0,0 +1,41 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseLimit(t *testing.T) {
+	tests := []struct {
+		in   string
+		want Limit
+		err  bool
+	}{
+		{in: "10/1m", want: Limit{Requests: 10, Per: time.Minute}},
+		{in: "5/1h0m0s", want: Limit{Requests: 5, Per: time.Hour}},
+		{in: "10", err: true},
+		{in: "0/1m", err: true},
+		{in: "ten/1m", err: true},
+		{in: "10/soon", err: true},
+		{in: "10/-1m", err: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := ParseLimit(tt.in)
+			if tt.err {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.want, got)
+
+			// String round trips
+			again, err := ParseLimit(got.String())
+			require.NoError(t, err)
+			require.Equal(t, got, again)
+		})
+	}
+}
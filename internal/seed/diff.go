@@ -0,0 +1,103 @@
+package seed
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/davemolk/chuck/internal/domain"
+)
+
+// Store is where jokes are seeded, joke.Service in practice, so seeded jokes
+// are saved the same way as ones from the api.
+type Store interface {
+	GetJokesByExternalID(ctx context.Context, externalIDs []string) (map[string]*domain.Joke, error)
+	SaveJokes(ctx context.Context, jokes []*domain.Joke) error
+}
+
+// Diff is what seeding a dataset would change.
+type Diff struct {
+	Add       []*domain.Joke
+	Change    []Change
+	Unchanged int
+}
+
+// Change is a joke that's already in the database with a different url or
+// content.
+type Change struct {
+	From *domain.Joke
+	To   *domain.Joke
+}
+
+// Plan compares jokes with what's in the store, without changing anything.
+func Plan(ctx context.Context, store Store, jokes []*domain.Joke) (*Diff, error) {
+	ids := make([]string, 0, len(jokes))
+	for _, j := range jokes {
+		ids = append(ids, j.ExternalID)
+	}
+
+	existing, err := store.GetJokesByExternalID(ctx, ids)
+	if err != nil {
+		return nil, err
+	}
+
+	var diff Diff
+	for _, j := range jokes {
+		current, ok := existing[j.ExternalID]
+		switch {
+		case !ok:
+			diff.Add = append(diff.Add, j)
+		case current.URL != j.URL || current.Content != j.Content:
+			diff.Change = append(diff.Change, Change{From: current, To: j})
+		default:
+			diff.Unchanged++
+		}
+	}
+
+	return &diff, nil
+}
+
+// Apply saves the jokes that are new or changed.
+func Apply(ctx context.Context, store Store, diff *Diff) error {
+	jokes := append([]*domain.Joke(nil), diff.Add...)
+	for _, c := range diff.Change {
+		jokes = append(jokes, c.To)
+	}
+
+	if err := store.SaveJokes(ctx, jokes); err != nil {
+		return fmt.Errorf("failed to save jokes: %w", err)
+	}
+	return nil
+}
+
+// String lists each added and changed joke, then the totals.
+func (d *Diff) String() string {
+	var b strings.Builder
+
+	for _, j := range d.Add {
+		fmt.Fprintf(&b, "+ %s %s\n", j.ExternalID, abbreviate(j.Content))
+	}
+	for _, c := range d.Change {
+		fmt.Fprintf(&b, "~ %s\n", c.To.ExternalID)
+		if c.From.URL != c.To.URL {
+			fmt.Fprintf(&b, "    url:     %s\n          -> %s\n", c.From.URL, c.To.URL)
+		}
+		if c.From.Content != c.To.Content {
+			fmt.Fprintf(&b, "    content: %s\n          -> %s\n", abbreviate(c.From.Content), abbreviate(c.To.Content))
+		}
+	}
+	fmt.Fprintf(&b, "%d to add, %d to change, %d unchanged", len(d.Add), len(d.Change), d.Unchanged)
+
+	return b.String()
+}
+
+// abbreviate keeps the diff to a line per joke.
+func abbreviate(s string) string {
+	const limit = 60
+
+	r := []rune(s)
+	if len(r) <= limit {
+		return s
+	}
+	return string(r[:limit-3]) + "..."
+}
@@ -0,0 +1,115 @@
+// Package seed loads jokes into the database from datasets, either the ones
+// built in or files in any format jokeio reads.
+package seed
+
+import (
+	"embed"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/davemolk/chuck/internal/domain"
+	"github.com/davemolk/chuck/internal/jokeio"
+)
+
+//go:embed datasets
+var datasets embed.FS
+
+// Datasets lists the built in datasets.
+func Datasets() []string {
+	entries, _ := fs.ReadDir(datasets, "datasets")
+
+	var names []string
+	for _, e := range entries {
+		names = append(names, strings.TrimSuffix(e.Name(), path.Ext(e.Name())))
+	}
+	return names
+}
+
+// Open loads a built in dataset by name, e.g. "dev", or a file by path. A
+// name with an extension is a file.
+func Open(name string) ([]*domain.Joke, error) {
+	if filepath.Ext(name) != "" {
+		return ReadFile(name)
+	}
+
+	for _, format := range []jokeio.Format{jokeio.FormatJSON, jokeio.FormatNDJSON, jokeio.FormatCSV} {
+		f, err := datasets.Open("datasets/" + name + "." + string(format))
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+
+		jokes, err := Parse(f, format)
+		if err != nil {
+			return nil, fmt.Errorf("dataset %s: %w", name, err)
+		}
+		return jokes, nil
+	}
+
+	return nil, fmt.Errorf("unknown dataset %q, want a file or one of %s", name, strings.Join(Datasets(), ", "))
+}
+
+// ReadFile loads a dataset file, the format comes from the extension.
+func ReadFile(name string) ([]*domain.Joke, error) {
+	format, err := jokeio.FormatOf(name)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open dataset: %w", err)
+	}
+	defer f.Close()
+
+	jokes, err := Parse(f, format)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	return jokes, nil
+}
+
+// Parse reads a whole dataset, which has to be free of errors, see
+// jokeio.Reader. No external id or url can appear twice either.
+func Parse(r io.Reader, format jokeio.Format) ([]*domain.Joke, error) {
+	jr, err := jokeio.NewReader(r, format)
+	if err != nil {
+		return nil, err
+	}
+
+	seenIDs := make(map[string]bool)
+	seenURLs := make(map[string]bool)
+
+	var jokes []*domain.Joke
+	for {
+		joke, err := jr.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if seenIDs[joke.ExternalID] {
+			return nil, fmt.Errorf("joke %d: duplicate external_id %q", len(jokes)+1, joke.ExternalID)
+		}
+		if seenURLs[joke.URL] {
+			return nil, fmt.Errorf("joke %d: duplicate url %q", len(jokes)+1, joke.URL)
+		}
+		seenIDs[joke.ExternalID] = true
+		seenURLs[joke.URL] = true
+
+		jokes = append(jokes, joke)
+	}
+
+	return jokes, nil
+}
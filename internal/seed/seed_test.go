@@ -0,0 +1,110 @@
+package seed
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/davemolk/chuck/internal/domain"
+	"github.com/davemolk/chuck/internal/jokeio"
+	"github.com/davemolk/chuck/internal/tests/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDatasets(t *testing.T) {
+	require.Equal(t, []string{"demo", "dev", "test"}, Datasets())
+
+	for _, name := range Datasets() {
+		t.Run(name, func(t *testing.T) {
+			jokes, err := Open(name)
+			require.NoError(t, err)
+			require.NotEmpty(t, jokes)
+		})
+	}
+
+	_, err := Open("prod")
+	require.ErrorContains(t, err, "demo, dev, test")
+}
+
+func TestParse(t *testing.T) {
+	jokes, err := Parse(strings.NewReader(`[
+		{"external_id": "a", "url": "https://example.com/a", "content": "Chuck Norris counted to infinity, twice."},
+		{"external_id": "b", "url": "https://example.com/b", "content": "Chuck Norris can unscramble an egg."}
+	]`), jokeio.FormatJSON)
+	require.NoError(t, err)
+	require.Len(t, jokes, 2)
+
+	tests := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{name: "bad joke", input: "{\"external_id\": \"a\", \"url\": \"u\"}", want: `line 1: content is required for "a"`},
+		{name: "duplicate id", input: "{\"external_id\": \"a\", \"url\": \"u1\", \"content\": \"c\"}\n{\"external_id\": \"a\", \"url\": \"u2\", \"content\": \"c\"}", want: `joke 2: duplicate external_id "a"`},
+		{name: "duplicate url", input: "{\"external_id\": \"a\", \"url\": \"u\", \"content\": \"c\"}\n{\"external_id\": \"b\", \"url\": \"u\", \"content\": \"c\"}", want: `joke 2: duplicate url "u"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Parse(strings.NewReader(tt.input), jokeio.FormatNDJSON)
+			require.ErrorContains(t, err, tt.want)
+		})
+	}
+}
+
+func TestReadFile(t *testing.T) {
+	dir := t.TempDir()
+
+	path := filepath.Join(dir, "jokes.jsonl")
+	require.NoError(t, os.WriteFile(path, []byte(`{"external_id": "a", "url": "u", "content": "c"}`), 0o600))
+	jokes, err := Open(path)
+	require.NoError(t, err)
+	require.Len(t, jokes, 1)
+
+	_, err = Open(filepath.Join(dir, "jokes.xml"))
+	require.ErrorContains(t, err, `unknown format "xml"`)
+}
+
+func TestPlanAndApply(t *testing.T) {
+	ctx := context.Background()
+
+	existing := map[string]*domain.Joke{
+		"same":    {ID: 1, ExternalID: "same", URL: "u1", Content: "Chuck Norris doesn't read books."},
+		"changed": {ID: 2, ExternalID: "changed", URL: "u2", Content: "Chuck Norris can slam a revolving door."},
+	}
+	jokes := []*domain.Joke{
+		{ExternalID: "same", URL: "u1", Content: "Chuck Norris doesn't read books."},
+		{ExternalID: "changed", URL: "u2", Content: "Chuck Norris can slam a revolving door. Twice."},
+		{ExternalID: "new", URL: "u3", Content: "Chuck Norris can win a game of Connect Four in only three moves."},
+	}
+
+	var saved []*domain.Joke
+	store := &mock.JokeStore{
+		GetJokesByExternalIDFn: func(ctx context.Context, externalIDs []string) (map[string]*domain.Joke, error) {
+			require.Equal(t, []string{"same", "changed", "new"}, externalIDs)
+			return existing, nil
+		},
+		SaveJokesFn: func(ctx context.Context, jokes []*domain.Joke) error {
+			saved = jokes
+			return nil
+		},
+	}
+
+	diff, err := Plan(ctx, store, jokes)
+	require.NoError(t, err)
+	require.False(t, store.SaveJokesCalled)
+	require.Equal(t, []*domain.Joke{jokes[2]}, diff.Add)
+	require.Equal(t, []Change{{From: existing["changed"], To: jokes[1]}}, diff.Change)
+	require.Equal(t, 1, diff.Unchanged)
+
+	require.Equal(t, `+ new Chuck Norris can win a game of Connect Four in only three...
+~ changed
+    content: Chuck Norris can slam a revolving door.
+          -> Chuck Norris can slam a revolving door. Twice.
+1 to add, 1 to change, 1 unchanged`, diff.String())
+
+	require.NoError(t, Apply(ctx, store, diff))
+	require.Equal(t, []*domain.Joke{jokes[2], jokes[1]}, saved)
+}
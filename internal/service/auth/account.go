@@ -0,0 +1,68 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/davemolk/chuck/internal/tracing"
+	"go.uber.org/zap"
+)
+
+// ChangeEmail moves the account to a new email after checking the password.
+// The new address has to be verified again.
+func (s *Service) ChangeEmail(ctx context.Context, userID int64, password, email string) error {
+	ctx, span := tracing.Start(ctx, "auth.ChangeEmail")
+	defer span.End()
+
+	user, err := s.userService.GetUserByID(ctx, userID)
+	if err != nil {
+		return fmt.Errorf("failed to get user: %w", err)
+	}
+
+	if err = s.confirmPassword(ctx, user, password, "change_email_mismatch"); err != nil {
+		return err
+	}
+
+	// emails are case insensitive, so there's nothing to change or verify
+	if strings.EqualFold(user.Email, email) {
+		return nil
+	}
+
+	if err = s.userService.UpdateEmail(ctx, userID, email); err != nil {
+		return err
+	}
+
+	s.logger.Info("email changed", zap.Int64("user_id", userID), zap.String("old_email", user.Email), zap.String("email", email))
+
+	return nil
+}
+
+// DeleteAccount permanently deletes the user after checking the password.
+// Every token goes with them, so all sessions end immediately.
+func (s *Service) DeleteAccount(ctx context.Context, userID int64, password string) error {
+	ctx, span := tracing.Start(ctx, "auth.DeleteAccount")
+	defer span.End()
+
+	user, err := s.userService.GetUserByID(ctx, userID)
+	if err != nil {
+		return fmt.Errorf("failed to get user: %w", err)
+	}
+
+	if err = s.confirmPassword(ctx, user, password, "delete_account_mismatch"); err != nil {
+		return err
+	}
+
+	if err = s.userService.DeleteUser(ctx, userID); err != nil {
+		return err
+	}
+
+	// don't leave a lockout behind for whoever signs up with the email next
+	if err = s.resetFailures(ctx, accountKey(user.Email)); err != nil {
+		s.logger.Error("failed to reset login attempts", zap.Int64("user_id", userID), zap.Error(err))
+	}
+
+	s.logger.Info("account deleted", zap.Int64("user_id", userID), zap.String("email", user.Email))
+
+	return nil
+}
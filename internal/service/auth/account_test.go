@@ -0,0 +1,81 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/davemolk/chuck/internal/clients/mailer"
+	"github.com/davemolk/chuck/internal/domain"
+	"github.com/davemolk/chuck/internal/passpolicy"
+	"github.com/davemolk/chuck/internal/service/token"
+	"github.com/davemolk/chuck/internal/service/user"
+	sqldb "github.com/davemolk/chuck/internal/sql"
+	"github.com/davemolk/chuck/internal/sql/dbtest"
+	"github.com/davemolk/chuck/internal/store"
+	"github.com/davemolk/chuck/internal/tests/fixture"
+	"github.com/davemolk/chuck/internal/tests/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestChangeEmail(t *testing.T) {
+	dbtest.Run(t, func(t *testing.T, db *sqldb.DB) {
+		ctx := context.Background()
+
+		tokenService := token.NewService(fixture.TestLogger(t), store.New(db))
+		userService := user.NewService(fixture.TestLogger(t), store.New(db), fixture.TestHasher(t), passpolicy.New(), tokenService, &mock.MFAService{}, &mock.UsageService{}, mailer.NewMemory())
+		userID, err := userService.CreateUser(ctx, "roundhouse@kick.com", "password")
+		require.NoError(t, err)
+
+		s := NewService(fixture.TestLogger(t), db, fixture.TestHasher(t), userService, tokenService, &mock.MFAService{}, mailer.NewMemory(), DefaultTokenTTL)
+
+		t.Run("error: wrong password", func(t *testing.T) {
+			err := s.ChangeEmail(ctx, userID, "nope", "walker@ranger.com")
+			require.True(t, errors.Is(err, ErrInvalidCredentials))
+		})
+
+		t.Run("success", func(t *testing.T) {
+			err := s.ChangeEmail(ctx, userID, "password", "walker@ranger.com")
+			require.NoError(t, err)
+
+			u, err := userService.GetUserByID(ctx, userID)
+			require.NoError(t, err)
+			require.Equal(t, "walker@ranger.com", u.Email)
+		})
+	})
+}
+
+func TestDeleteAccount(t *testing.T) {
+	dbtest.Run(t, func(t *testing.T, db *sqldb.DB) {
+		ctx := context.Background()
+
+		tokenService := token.NewService(fixture.TestLogger(t), store.New(db))
+		userService := user.NewService(fixture.TestLogger(t), store.New(db), fixture.TestHasher(t), passpolicy.New(), tokenService, &mock.MFAService{}, &mock.UsageService{}, mailer.NewMemory())
+		userID, err := userService.CreateUser(ctx, "roundhouse@kick.com", "password")
+		require.NoError(t, err)
+
+		s := NewService(fixture.TestLogger(t), db, fixture.TestHasher(t), userService, tokenService, &mock.MFAService{}, mailer.NewMemory(), DefaultTokenTTL)
+
+		t.Run("error: wrong password", func(t *testing.T) {
+			err := s.DeleteAccount(ctx, userID, "nope")
+			require.True(t, errors.Is(err, ErrInvalidCredentials))
+
+			_, err = userService.GetUserByID(ctx, userID)
+			require.NoError(t, err)
+		})
+
+		t.Run("success", func(t *testing.T) {
+			err := s.DeleteAccount(ctx, userID, "password")
+			require.NoError(t, err)
+
+			_, err = userService.GetUserByID(ctx, userID)
+			require.True(t, errors.Is(err, domain.ErrNotFound))
+
+			// the failed attempt above shouldn't follow the email around
+			var attempts int
+			err = db.QueryRowContext(ctx, `select count(*) from login_attempts where key = $1`, accountKey("roundhouse@kick.com").key).Scan(&attempts)
+			require.NoError(t, err)
+			require.Zero(t, attempts)
+		})
+	})
+}
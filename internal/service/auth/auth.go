@@ -4,38 +4,72 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"sync"
 	"time"
 
+	"github.com/davemolk/chuck/internal/clients/mailer"
 	"github.com/davemolk/chuck/internal/domain"
+	"github.com/davemolk/chuck/internal/hasher"
 	"github.com/davemolk/chuck/internal/service"
+	"github.com/davemolk/chuck/internal/service/mfa"
 	sqldb "github.com/davemolk/chuck/internal/sql"
+	"github.com/davemolk/chuck/internal/tracing"
 	"go.uber.org/zap"
-	"golang.org/x/crypto/bcrypt"
 )
 
 var _ service.AuthService = (*Service)(nil)
 
+// DefaultTokenTTL is how long a login lasts unless configured otherwise.
+const DefaultTokenTTL = 24 * time.Hour
+
+const (
+	// mfaChallengeTTL only needs to be long enough for the user to open their
+	// authenticator app.
+	mfaChallengeTTL = 5 * time.Minute
+)
+
 var ErrInvalidCredentials = errors.New("invalid credentials")
 
 type Service struct {
 	logger       *zap.Logger
 	db           *sqldb.DB
+	hasher       *hasher.Hasher
 	userService  service.UserService
 	tokenService service.TokenService
+	mfaService   service.MFAService
+	mailer       mailer.Mailer
+	tokenTTL     time.Duration
+	// dummyHash is compared against when a login is for an unknown email. It
+	// uses the same hasher as real users so the timing matches.
+	dummyHash func() []byte
 }
 
-func NewService(logger *zap.Logger, db *sqldb.DB, userService service.UserService, tokenService service.TokenService) *Service {
+func NewService(logger *zap.Logger, db *sqldb.DB, hasher *hasher.Hasher, userService service.UserService, tokenService service.TokenService, mfaService service.MFAService, mailer mailer.Mailer, tokenTTL time.Duration) *Service {
 	return &Service{
 		logger:       logger,
 		db:           db,
+		hasher:       hasher,
 		userService:  userService,
 		tokenService: tokenService,
+		mfaService:   mfaService,
+		mailer:       mailer,
+		tokenTTL:     tokenTTL,
+		dummyHash: sync.OnceValue(func() []byte {
+			hash, err := hasher.Hash("the dummy password")
+			if err != nil {
+				panic(err)
+			}
+			return hash
+		}),
 	}
 }
 
 func (s *Service) GetUserIDForToken(ctx context.Context, token string) (*domain.User, error) {
+	ctx, span := tracing.Start(ctx, "auth.GetUserIDForToken")
+	defer span.End()
+
 	s.logger.Info("validating token")
-	userID, err := s.tokenService.ValidateToken(ctx, token)
+	userID, err := s.tokenService.ValidateToken(ctx, token, domain.ScopeAuthentication)
 	if err != nil {
 		return nil, err
 	}
@@ -53,28 +87,75 @@ func (s *Service) GetUserIDForToken(ctx context.Context, token string) (*domain.
 	return user, nil
 }
 
-func (s *Service) Login(ctx context.Context, email, password string) (*domain.Token, error) {
+// Login checks the user's credentials, returning an access token, or an mfa
+// challenge if the user has a second factor enabled. Failed attempts are
+// tracked per account and per ip, see throttle.go.
+func (s *Service) Login(ctx context.Context, email, password, ip string) (*domain.Token, error) {
+	ctx, span := tracing.Start(ctx, "auth.Login")
+	defer span.End()
+
+	keys := []throttleKey{accountKey(email), ipKey(ip)}
+
+	if err := s.checkThrottle(ctx, keys...); err != nil {
+		s.logger.Debug("auth_throttled", zap.String("email", email), zap.String("ip", ip), zap.Error(err))
+		return nil, err
+	}
+
 	user, err := s.userService.GetUserByEmail(ctx, email)
 	if err != nil {
 		if errors.Is(err, domain.ErrNotFound) {
+			// do the same work as for a real user so response times don't
+			// reveal which emails have accounts
+			_, _, _ = s.hasher.Verify(s.dummyHash(), password)
 			s.logger.Debug("auth_failed", zap.String("email", email), zap.String("reason", "user_not_found"))
+			s.recordFailures(ctx, email, ip, keys...)
 			return nil, ErrInvalidCredentials
 		}
 		return nil, fmt.Errorf("failed to get user: %w", err)
 	}
 
-	valid, err := s.validatePasswordHash(user.HashedPW, password)
+	valid, rehash, err := s.hasher.Verify(user.HashedPW, password)
 	if err != nil {
-		s.logger.Debug("auth_failed", zap.String("email", email), zap.String("reason", "bcrypt_error"))
+		s.logger.Error("auth_failed", zap.String("email", email), zap.String("reason", "hash_error"), zap.Error(err))
+		s.recordFailures(ctx, email, ip, keys...)
 		return nil, ErrInvalidCredentials
 	}
 
 	if !valid {
 		s.logger.Debug("auth_failed", zap.String("email", email), zap.String("reason", "password_mismatch"))
+		s.recordFailures(ctx, email, ip, keys...)
 		return nil, ErrInvalidCredentials
 	}
 
-	token, err := s.tokenService.CreateToken(ctx, user.ID, 24*time.Hour)
+	// the password is only available in the clear right now, so this is our
+	// chance to move the user to the current algorithm and params
+	if rehash {
+		if err = s.userService.RehashPassword(ctx, user.ID, password); err != nil {
+			s.logger.Error("failed to rehash password", zap.Int64("user_id", user.ID), zap.Error(err))
+		} else {
+			s.logger.Info("password_rehashed", zap.Int64("user_id", user.ID))
+		}
+	}
+
+	// only the account is cleared. the ip is left to age out, otherwise an
+	// attacker with one valid account could reset it between guesses.
+	if err = s.resetFailures(ctx, accountKey(email)); err != nil {
+		return nil, err
+	}
+
+	mfaEnabled, err := s.mfaService.IsEnabled(ctx, user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	// users with a second factor get a short-lived challenge instead, which
+	// they exchange for an access token in VerifyMFA
+	if mfaEnabled {
+		s.logger.Debug("mfa_required", zap.String("email", email))
+		return s.tokenService.CreateToken(ctx, user.ID, mfaChallengeTTL, domain.ScopeMFA)
+	}
+
+	token, err := s.tokenService.CreateToken(ctx, user.ID, s.tokenTTL, domain.ScopeAuthentication)
 	if err != nil {
 		return nil, err
 	}
@@ -82,14 +163,42 @@ func (s *Service) Login(ctx context.Context, email, password string) (*domain.To
 	return token, nil
 }
 
-func (s *Service) validatePasswordHash(hash []byte, password string) (bool, error) {
-	err := bcrypt.CompareHashAndPassword(hash, []byte(password))
+// VerifyMFA exchanges a challenge from Login plus a totp or recovery code for
+// an access token. The challenge can be retried until it expires, but is
+// deleted once it's been used successfully.
+func (s *Service) VerifyMFA(ctx context.Context, challenge, code, ip string) (*domain.Token, error) {
+	ctx, span := tracing.Start(ctx, "auth.VerifyMFA")
+	defer span.End()
+
+	userID, err := s.tokenService.ValidateToken(ctx, challenge, domain.ScopeMFA)
 	if err != nil {
-		if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
-			return false, nil
+		return nil, err
+	}
+
+	// codes are only 6 digits, so guessing gets the same treatment as passwords
+	keys := []throttleKey{mfaKey(userID), ipKey(ip)}
+
+	if err = s.checkThrottle(ctx, keys...); err != nil {
+		s.logger.Debug("auth_throttled", zap.Int64("user_id", userID), zap.String("ip", ip), zap.Error(err))
+		return nil, err
+	}
+
+	if err = s.mfaService.Verify(ctx, userID, code); err != nil {
+		if errors.Is(err, mfa.ErrInvalidCode) || errors.Is(err, mfa.ErrNotEnrolled) {
+			s.logger.Debug("auth_failed", zap.Int64("user_id", userID), zap.String("reason", "mfa_invalid_code"))
+			s.recordFailures(ctx, "", ip, keys...)
+			return nil, ErrInvalidCredentials
 		}
-		return false, err
+		return nil, fmt.Errorf("failed to verify code: %w", err)
+	}
+
+	if err = s.resetFailures(ctx, mfaKey(userID)); err != nil {
+		return nil, err
+	}
+
+	if err = s.tokenService.DeleteToken(ctx, challenge); err != nil {
+		return nil, err
 	}
 
-	return true, nil
+	return s.tokenService.CreateToken(ctx, userID, s.tokenTTL, domain.ScopeAuthentication)
 }
@@ -3,100 +3,292 @@ package auth
 import (
 	"context"
 	"errors"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/davemolk/chuck/internal/clients/mailer"
 	"github.com/davemolk/chuck/internal/domain"
+	"github.com/davemolk/chuck/internal/passpolicy"
+	"github.com/davemolk/chuck/internal/service/mfa"
 	"github.com/davemolk/chuck/internal/service/token"
 	"github.com/davemolk/chuck/internal/service/user"
+	sqldb "github.com/davemolk/chuck/internal/sql"
 	"github.com/davemolk/chuck/internal/sql/dbtest"
+	"github.com/davemolk/chuck/internal/store"
 	"github.com/davemolk/chuck/internal/tests/fixture"
 	"github.com/davemolk/chuck/internal/tests/mock"
 	"github.com/stretchr/testify/require"
 )
 
 func TestGetUserForToken(t *testing.T) {
-	db := dbtest.SetupTestDB(t)
-	email := "roundhouse@kick.com"
-	userService := &mock.UserService{
-		GetUserByIDFn: func(ctx context.Context, id int64) (*domain.User, error) {
-			return &domain.User{
-				Email: email,
-			}, nil
-		},
-	}
-	tokenService := &mock.TokenService{
-		ValidateTokenFn: func(ctx context.Context, token string) (int64, error) {
-			return 1, nil
-		},
-	}
-
-	s := NewService(fixture.TestLogger(t), db, userService, tokenService)
-	ctx := context.Background()
-
-	t.Run("success", func(t *testing.T) {
-		user, err := s.GetUserIDForToken(ctx, "my token")
+	dbtest.Run(t, func(t *testing.T, db *sqldb.DB) {
+		email := "roundhouse@kick.com"
+		userService := &mock.UserService{
+			GetUserByIDFn: func(ctx context.Context, id int64) (*domain.User, error) {
+				return &domain.User{
+					Email: email,
+				}, nil
+			},
+		}
+		tokenService := &mock.TokenService{
+			ValidateTokenFn: func(ctx context.Context, token, scope string) (int64, error) {
+				return 1, nil
+			},
+		}
+
+		s := NewService(fixture.TestLogger(t), db, fixture.TestHasher(t), userService, tokenService, &mock.MFAService{}, mailer.NewMemory(), DefaultTokenTTL)
+		ctx := context.Background()
+
+		t.Run("success", func(t *testing.T) {
+			user, err := s.GetUserIDForToken(ctx, "my token")
+			require.NoError(t, err)
+			require.Equal(t, email, user.Email)
+		})
+
+		t.Run("error: invalid token", func(t *testing.T) {
+			invalidTokenService := &mock.TokenService{
+				ValidateTokenFn: func(ctx context.Context, tokenStr, scope string) (int64, error) {
+					return 0, token.ErrInvalidToken
+				},
+			}
+			s.tokenService = invalidTokenService
+			_, err := s.GetUserIDForToken(ctx, "my token")
+			require.Error(t, err)
+			require.True(t, errors.Is(err, token.ErrInvalidToken))
+			s.tokenService = tokenService
+		})
+
+		t.Run("error: invalid user", func(t *testing.T) {
+			invalidUserService := &mock.UserService{
+				GetUserByIDFn: func(ctx context.Context, id int64) (*domain.User, error) {
+					return nil, errors.New("nope")
+				},
+			}
+			s.userService = invalidUserService
+			_, err := s.GetUserIDForToken(ctx, "my token")
+			require.Error(t, err)
+		})
+	})
+}
+
+func TestLogin(t *testing.T) {
+	dbtest.Run(t, func(t *testing.T, db *sqldb.DB) {
+		email := "roundhouse@kick.com"
+		pw := "pw"
+		ip := "127.0.0.1"
+		ctx := context.Background()
+
+		// use real service so we get proper hashed password
+		userService := user.NewService(fixture.TestLogger(t), store.New(db), fixture.TestHasher(t), passpolicy.New(), token.NewService(fixture.TestLogger(t), store.New(db)), &mock.MFAService{}, &mock.UsageService{}, mailer.NewMemory())
+		userID, err := userService.CreateUser(ctx, email, pw)
 		require.NoError(t, err)
-		require.Equal(t, email, user.Email)
+
+		tokenService := &mock.TokenService{
+			CreateTokenFn: func(ctx context.Context, userID int64, ttl time.Duration, scope string) (*domain.Token, error) {
+				return &domain.Token{
+					UserID:    userID,
+					Plaintext: "roundhouse",
+					Scope:     scope,
+				}, nil
+			},
+		}
+		mfaService := &mock.MFAService{
+			IsEnabledFn: func(ctx context.Context, userID int64) (bool, error) {
+				return false, nil
+			},
+		}
+
+		s := NewService(fixture.TestLogger(t), db, fixture.TestHasher(t), userService, tokenService, mfaService, mailer.NewMemory(), DefaultTokenTTL)
+
+		t.Run("success", func(t *testing.T) {
+			token, err := s.Login(ctx, email, pw, ip)
+			require.NoError(t, err)
+			require.Equal(t, "roundhouse", token.Plaintext)
+			require.Equal(t, userID, token.UserID)
+			require.Equal(t, domain.ScopeAuthentication, token.Scope)
+		})
+
+		t.Run("success, mfa enabled returns challenge", func(t *testing.T) {
+			s.mfaService = &mock.MFAService{
+				IsEnabledFn: func(ctx context.Context, userID int64) (bool, error) {
+					return true, nil
+				},
+			}
+			token, err := s.Login(ctx, email, pw, ip)
+			require.NoError(t, err)
+			require.Equal(t, domain.ScopeMFA, token.Scope)
+			s.mfaService = mfaService
+		})
+
+		t.Run("error: no user", func(t *testing.T) {
+			_, err := s.Login(ctx, "no@email.com", pw, ip)
+			require.Error(t, err)
+			require.True(t, errors.Is(err, ErrInvalidCredentials))
+		})
 	})
+}
 
-	t.Run("error: invalid token", func(t *testing.T) {
-		invalidTokenService := &mock.TokenService{
-			ValidateTokenFn: func(ctx context.Context, tokenStr string) (int64, error) {
-				return 0, token.ErrInvalidToken
+func TestLoginRehash(t *testing.T) {
+	dbtest.Run(t, func(t *testing.T, db *sqldb.DB) {
+		ctx := context.Background()
+
+		// fixture users have a bcrypt hash, like everyone from before argon2id
+		email := "legacy@kick.com"
+		userID := fixture.AddUser(t, store.New(db), email)
+
+		userService := user.NewService(fixture.TestLogger(t), store.New(db), fixture.TestHasher(t), passpolicy.New(), token.NewService(fixture.TestLogger(t), store.New(db)), &mock.MFAService{}, &mock.UsageService{}, mailer.NewMemory())
+		mfaService := &mock.MFAService{
+			IsEnabledFn: func(ctx context.Context, userID int64) (bool, error) {
+				return false, nil
 			},
 		}
-		s.tokenService = invalidTokenService
-		_, err := s.GetUserIDForToken(ctx, "my token")
-		require.Error(t, err)
-		require.True(t, errors.Is(err, token.ErrInvalidToken))
-		s.tokenService = tokenService
+		s := NewService(fixture.TestLogger(t), db, fixture.TestHasher(t), userService, token.NewService(fixture.TestLogger(t), store.New(db)), mfaService, mailer.NewMemory(), DefaultTokenTTL)
+
+		_, err := s.Login(ctx, email, "password", "127.0.0.1")
+		require.NoError(t, err)
+
+		u, err := userService.GetUserByID(ctx, userID)
+		require.NoError(t, err)
+		require.True(t, strings.HasPrefix(string(u.HashedPW), "$argon2id$"))
+
+		// and the new hash still works
+		_, err = s.Login(ctx, email, "password", "127.0.0.1")
+		require.NoError(t, err)
 	})
+}
 
-	t.Run("error: invalid user", func(t *testing.T) {
-		invalidUserService := &mock.UserService{
-			GetUserByIDFn: func(ctx context.Context, id int64) (*domain.User, error) {
-				return nil, errors.New("nope")
+func TestVerifyMFA(t *testing.T) {
+	dbtest.Run(t, func(t *testing.T, db *sqldb.DB) {
+		ctx := context.Background()
+
+		var gotScope string
+		tokenService := &mock.TokenService{
+			ValidateTokenFn: func(ctx context.Context, token, scope string) (int64, error) {
+				gotScope = scope
+				return 1, nil
+			},
+			DeleteTokenFn: func(ctx context.Context, token string) error {
+				return nil
+			},
+			CreateTokenFn: func(ctx context.Context, userID int64, ttl time.Duration, scope string) (*domain.Token, error) {
+				return &domain.Token{
+					UserID:    userID,
+					Plaintext: "roundhouse",
+					Scope:     scope,
+				}, nil
+			},
+		}
+		mfaService := &mock.MFAService{
+			VerifyFn: func(ctx context.Context, userID int64, code string) error {
+				return nil
 			},
 		}
-		s.userService = invalidUserService
-		_, err := s.GetUserIDForToken(ctx, "my token")
-		require.Error(t, err)
+
+		s := NewService(fixture.TestLogger(t), db, fixture.TestHasher(t), &mock.UserService{}, tokenService, mfaService, mailer.NewMemory(), DefaultTokenTTL)
+
+		t.Run("success", func(t *testing.T) {
+			token, err := s.VerifyMFA(ctx, "challenge", "123456", "127.0.0.1")
+			require.NoError(t, err)
+			require.Equal(t, domain.ScopeMFA, gotScope)
+			require.Equal(t, domain.ScopeAuthentication, token.Scope)
+			require.True(t, tokenService.DeleteTokenCalled)
+		})
+
+		t.Run("error: invalid code", func(t *testing.T) {
+			tokenService.DeleteTokenCalled = false
+			s.mfaService = &mock.MFAService{
+				VerifyFn: func(ctx context.Context, userID int64, code string) error {
+					return mfa.ErrInvalidCode
+				},
+			}
+			_, err := s.VerifyMFA(ctx, "challenge", "123456", "127.0.0.1")
+			require.Error(t, err)
+			require.True(t, errors.Is(err, ErrInvalidCredentials))
+			require.False(t, tokenService.DeleteTokenCalled)
+		})
 	})
 }
 
-func TestLogin(t *testing.T) {
-	db := dbtest.SetupTestDB(t)
-	email := "roundhouse@kick.com"
-	pw := "pw"
-	ctx := context.Background()
-
-	// use real service so we get proper hashed password
-	userService := user.NewService(fixture.TestLogger(t), db)
-	userID, err := userService.CreateUser(ctx, email, pw)
-	require.NoError(t, err)
-
-	tokenService := &mock.TokenService{
-		CreateTokenFn: func(ctx context.Context, userID int64, ttl time.Duration) (*domain.Token, error) {
-			return &domain.Token{
-				UserID:    userID,
-				Plaintext: "roundhouse",
-			}, nil
-		},
-	}
-
-	s := NewService(fixture.TestLogger(t), db, userService, tokenService)
-
-	t.Run("success", func(t *testing.T) {
-		token, err := s.Login(ctx, email, pw)
+func TestLoginThrottle(t *testing.T) {
+	dbtest.Run(t, func(t *testing.T, db *sqldb.DB) {
+		email := "roundhouse@kick.com"
+		pw := "password"
+		ctx := context.Background()
+
+		userService := user.NewService(fixture.TestLogger(t), store.New(db), fixture.TestHasher(t), passpolicy.New(), token.NewService(fixture.TestLogger(t), store.New(db)), &mock.MFAService{}, &mock.UsageService{}, mailer.NewMemory())
+		_, err := userService.CreateUser(ctx, email, pw)
 		require.NoError(t, err)
-		require.Equal(t, "roundhouse", token.Plaintext)
-		require.Equal(t, userID, token.UserID)
-	})
 
-	t.Run("error: no user", func(t *testing.T) {
-		_, err := s.Login(ctx, "no@email.com", pw)
-		require.Error(t, err)
-		require.True(t, errors.Is(err, ErrInvalidCredentials))
+		tokenService := &mock.TokenService{
+			CreateTokenFn: func(ctx context.Context, userID int64, ttl time.Duration, scope string) (*domain.Token, error) {
+				return &domain.Token{UserID: userID, Scope: scope}, nil
+			},
+		}
+		mfaService := &mock.MFAService{
+			IsEnabledFn: func(ctx context.Context, userID int64) (bool, error) {
+				return false, nil
+			},
+		}
+
+		s := NewService(fixture.TestLogger(t), db, fixture.TestHasher(t), userService, tokenService, mfaService, mailer.NewMemory(), DefaultTokenTTL)
+
+		t.Run("free attempts aren't throttled", func(t *testing.T) {
+			for range accountPolicy.freeAttempts {
+				_, err := s.Login(ctx, email, "wrong password", "10.0.0.1")
+				require.True(t, errors.Is(err, ErrInvalidCredentials))
+			}
+		})
+
+		t.Run("next failure adds a delay", func(t *testing.T) {
+			_, err := s.Login(ctx, email, "wrong password", "10.0.0.2")
+			require.True(t, errors.Is(err, ErrInvalidCredentials))
+
+			// the correct password doesn't help while the delay is in effect
+			_, err = s.Login(ctx, email, pw, "10.0.0.3")
+			var throttled *ThrottledError
+			require.True(t, errors.As(err, &throttled))
+			require.True(t, errors.Is(err, ErrTooManyAttempts))
+			require.Greater(t, throttled.RetryAfter, time.Duration(0))
+		})
+
+		t.Run("lockout", func(t *testing.T) {
+			for range accountPolicy.lockoutThreshold {
+				_, err := s.recordFailure(ctx, accountKey(email))
+				require.NoError(t, err)
+			}
+
+			err := s.checkThrottle(ctx, accountKey(email))
+			var throttled *ThrottledError
+			require.True(t, errors.As(err, &throttled))
+			require.Greater(t, throttled.RetryAfter, accountPolicy.lockoutDuration-time.Minute)
+		})
+
+		t.Run("unknown emails are tracked too", func(t *testing.T) {
+			for range accountPolicy.freeAttempts + 1 {
+				_, err := s.Login(ctx, "no@email.com", pw, "10.0.0.4")
+				require.True(t, errors.Is(err, ErrInvalidCredentials))
+			}
+
+			_, err := s.Login(ctx, "no@email.com", pw, "10.0.0.4")
+			require.True(t, errors.Is(err, ErrTooManyAttempts))
+		})
+
+		t.Run("success resets account", func(t *testing.T) {
+			other := "walker@ranger.com"
+			_, err := userService.CreateUser(ctx, other, pw)
+			require.NoError(t, err)
+
+			_, err = s.Login(ctx, other, "wrong password", "10.0.0.5")
+			require.True(t, errors.Is(err, ErrInvalidCredentials))
+
+			_, err = s.Login(ctx, other, pw, "10.0.0.5")
+			require.NoError(t, err)
+
+			var count int
+			err = db.QueryRowContext(ctx, `select count(*) from login_attempts where key = $1`, accountKey(other).key).Scan(&count)
+			require.NoError(t, err)
+			require.Equal(t, 0, count)
+		})
 	})
 }
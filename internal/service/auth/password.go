@@ -0,0 +1,158 @@
+package auth
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/davemolk/chuck/internal/clients/mailer"
+	"github.com/davemolk/chuck/internal/domain"
+	"github.com/davemolk/chuck/internal/tracing"
+	"go.uber.org/zap"
+)
+
+const passwordResetTTL = 30 * time.Minute
+
+// ChangePassword updates the password for a logged in user after checking
+// their current one. Every other session is signed out, but the one making
+// the request is kept.
+func (s *Service) ChangePassword(ctx context.Context, userID int64, oldPassword, newPassword, currentToken string) error {
+	ctx, span := tracing.Start(ctx, "auth.ChangePassword")
+	defer span.End()
+
+	user, err := s.userService.GetUserByID(ctx, userID)
+	if err != nil {
+		return fmt.Errorf("failed to get user: %w", err)
+	}
+
+	if err = s.confirmPassword(ctx, user, oldPassword, "change_password_mismatch"); err != nil {
+		return err
+	}
+
+	if err = s.userService.UpdatePassword(ctx, userID, newPassword); err != nil {
+		return err
+	}
+
+	return s.revokeSessions(ctx, userID, currentToken)
+}
+
+// RequestPasswordReset emails a single-use reset token to the user. Unknown
+// emails aren't an error so the endpoint can't be used to find accounts.
+func (s *Service) RequestPasswordReset(ctx context.Context, email string) error {
+	ctx, span := tracing.Start(ctx, "auth.RequestPasswordReset")
+	defer span.End()
+
+	user, err := s.userService.GetUserByEmail(ctx, email)
+	if err != nil {
+		if errors.Is(err, domain.ErrNotFound) {
+			s.logger.Debug("password_reset_skipped", zap.String("email", email), zap.String("reason", "user_not_found"))
+			return nil
+		}
+		return fmt.Errorf("failed to get user: %w", err)
+	}
+
+	// only the latest reset email should work
+	if err = s.tokenService.RevokeTokens(ctx, user.ID, domain.ScopePasswordReset, ""); err != nil {
+		return err
+	}
+
+	token, err := s.tokenService.CreateToken(ctx, user.ID, passwordResetTTL, domain.ScopePasswordReset)
+	if err != nil {
+		return err
+	}
+
+	msg := mailer.Message{
+		To:      user.Email,
+		Subject: "Reset your chuck password",
+		Body: fmt.Sprintf(
+			"Someone (hopefully you) asked to reset the password for this account.\n\n"+
+				"Send the token below along with your new password to POST /api/v1/auth/password-reset/confirm. "+
+				"It expires in %d minutes and can only be used once.\n\n%s\n\n"+
+				"If you didn't ask for this, you can ignore this email.\n",
+			int(passwordResetTTL.Minutes()), token.Plaintext),
+	}
+
+	if err = s.mailer.Send(ctx, msg); err != nil {
+		return fmt.Errorf("failed to send reset email: %w", err)
+	}
+
+	s.logger.Info("password reset requested", zap.Int64("user_id", user.ID))
+
+	return nil
+}
+
+// ResetPassword sets a new password using a token from RequestPasswordReset.
+// Since the user might be recovering from a compromised account, every
+// session is signed out and any login lockout is cleared.
+func (s *Service) ResetPassword(ctx context.Context, token, password string) error {
+	ctx, span := tracing.Start(ctx, "auth.ResetPassword")
+	defer span.End()
+
+	var user *domain.User
+	err := s.db.RunInTx(ctx, nil, func(ctx context.Context, tx *sql.Tx) error {
+		// the token goes first, so a concurrent reset with it waits and then
+		// finds it gone. A password the policy rejects rolls back and leaves
+		// the token to try again.
+		userID, err := s.tokenService.ConsumeToken(ctx, token, domain.ScopePasswordReset)
+		if err != nil {
+			return err
+		}
+
+		if user, err = s.userService.GetUserByID(ctx, userID); err != nil {
+			return fmt.Errorf("failed to get user: %w", err)
+		}
+
+		if err = s.userService.UpdatePassword(ctx, userID, password); err != nil {
+			return err
+		}
+
+		if err = s.tokenService.RevokeTokens(ctx, userID, domain.ScopePasswordReset, ""); err != nil {
+			return err
+		}
+
+		return s.revokeSessions(ctx, userID, "")
+	})
+	if err != nil {
+		return err
+	}
+
+	if err = s.resetFailures(ctx, accountKey(user.Email)); err != nil {
+		return err
+	}
+
+	s.logger.Info("password reset", zap.Int64("user_id", user.ID))
+
+	return nil
+}
+
+// revokeSessions signs the user out everywhere except keep, including any
+// logins that are part way through mfa.
+func (s *Service) revokeSessions(ctx context.Context, userID int64, keep string) error {
+	if err := s.tokenService.RevokeTokens(ctx, userID, domain.ScopeAuthentication, keep); err != nil {
+		return err
+	}
+
+	return s.tokenService.RevokeTokens(ctx, userID, domain.ScopeMFA, "")
+}
+
+// confirmPassword re-checks the password of a logged in user before a
+// sensitive change. It shares the login throttle, since a stolen session
+// shouldn't be a way around it.
+func (s *Service) confirmPassword(ctx context.Context, user *domain.User, password, reason string) error {
+	key := accountKey(user.Email)
+	if err := s.checkThrottle(ctx, key); err != nil {
+		s.logger.Debug("auth_throttled", zap.String("email", user.Email), zap.Error(err))
+		return err
+	}
+
+	valid, _, err := s.hasher.Verify(user.HashedPW, password)
+	if err != nil || !valid {
+		s.logger.Debug("auth_failed", zap.String("email", user.Email), zap.String("reason", reason))
+		s.recordFailures(ctx, user.Email, "", key)
+		return ErrInvalidCredentials
+	}
+
+	return nil
+}
@@ -0,0 +1,174 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"regexp"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/davemolk/chuck/internal/clients/mailer"
+	"github.com/davemolk/chuck/internal/domain"
+	"github.com/davemolk/chuck/internal/passpolicy"
+	"github.com/davemolk/chuck/internal/service/token"
+	"github.com/davemolk/chuck/internal/service/user"
+	sqldb "github.com/davemolk/chuck/internal/sql"
+	"github.com/davemolk/chuck/internal/sql/dbtest"
+	"github.com/davemolk/chuck/internal/store"
+	"github.com/davemolk/chuck/internal/tests/fixture"
+	"github.com/davemolk/chuck/internal/tests/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestChangePassword(t *testing.T) {
+	dbtest.Run(t, func(t *testing.T, db *sqldb.DB) {
+		email := "roundhouse@kick.com"
+		pw := "password"
+		ctx := context.Background()
+
+		userService := user.NewService(fixture.TestLogger(t), store.New(db), fixture.TestHasher(t), passpolicy.New(), token.NewService(fixture.TestLogger(t), store.New(db)), &mock.MFAService{}, &mock.UsageService{}, mailer.NewMemory())
+		userID, err := userService.CreateUser(ctx, email, pw)
+		require.NoError(t, err)
+
+		tokenService := token.NewService(fixture.TestLogger(t), store.New(db))
+		current, err := tokenService.CreateToken(ctx, userID, time.Hour, domain.ScopeAuthentication)
+		require.NoError(t, err)
+		other, err := tokenService.CreateToken(ctx, userID, time.Hour, domain.ScopeAuthentication)
+		require.NoError(t, err)
+
+		s := NewService(fixture.TestLogger(t), db, fixture.TestHasher(t), userService, tokenService, &mock.MFAService{}, mailer.NewMemory(), DefaultTokenTTL)
+
+		t.Run("error: wrong old password", func(t *testing.T) {
+			err := s.ChangePassword(ctx, userID, "nope", "new password", current.Plaintext)
+			require.True(t, errors.Is(err, ErrInvalidCredentials))
+		})
+
+		t.Run("success", func(t *testing.T) {
+			err := s.ChangePassword(ctx, userID, pw, "new password", current.Plaintext)
+			require.NoError(t, err)
+
+			u, err := userService.GetUserByEmail(ctx, email)
+			require.NoError(t, err)
+			valid, _, err := s.hasher.Verify(u.HashedPW, "new password")
+			require.NoError(t, err)
+			require.True(t, valid)
+
+			// current session survives, the other one doesn't
+			_, err = tokenService.ValidateToken(ctx, current.Plaintext, domain.ScopeAuthentication)
+			require.NoError(t, err)
+			_, err = tokenService.ValidateToken(ctx, other.Plaintext, domain.ScopeAuthentication)
+			require.True(t, errors.Is(err, token.ErrInvalidToken))
+		})
+	})
+}
+
+func TestPasswordReset(t *testing.T) {
+	dbtest.Run(t, func(t *testing.T, db *sqldb.DB) {
+		email := "roundhouse@kick.com"
+		pw := "password"
+		ctx := context.Background()
+
+		userService := user.NewService(fixture.TestLogger(t), store.New(db), fixture.TestHasher(t), passpolicy.New(passpolicy.NoEmail()), token.NewService(fixture.TestLogger(t), store.New(db)), &mock.MFAService{}, &mock.UsageService{}, mailer.NewMemory())
+		userID, err := userService.CreateUser(ctx, email, pw)
+		require.NoError(t, err)
+
+		tokenService := token.NewService(fixture.TestLogger(t), store.New(db))
+		session, err := tokenService.CreateToken(ctx, userID, time.Hour, domain.ScopeAuthentication)
+		require.NoError(t, err)
+
+		mail := mailer.NewMemory()
+		s := NewService(fixture.TestLogger(t), db, fixture.TestHasher(t), userService, tokenService, &mock.MFAService{}, mail, DefaultTokenTTL)
+
+		tokenRE := regexp.MustCompile(`\n\n([A-Z2-7]{26})\n\n`)
+
+		t.Run("unknown email sends nothing", func(t *testing.T) {
+			err := s.RequestPasswordReset(ctx, "no@email.com")
+			require.NoError(t, err)
+			require.Empty(t, mail.Messages())
+		})
+
+		err = s.RequestPasswordReset(ctx, email)
+		require.NoError(t, err)
+		first, ok := mail.Last()
+		require.True(t, ok)
+		require.Equal(t, email, first.To)
+
+		err = s.RequestPasswordReset(ctx, email)
+		require.NoError(t, err)
+		second, _ := mail.Last()
+
+		firstToken := tokenRE.FindStringSubmatch(first.Body)[1]
+		secondToken := tokenRE.FindStringSubmatch(second.Body)[1]
+
+		t.Run("error: superseded token", func(t *testing.T) {
+			err := s.ResetPassword(ctx, firstToken, "new password")
+			require.True(t, errors.Is(err, token.ErrInvalidToken))
+		})
+
+		t.Run("error: reset token isn't an access token", func(t *testing.T) {
+			_, err := s.GetUserIDForToken(ctx, secondToken)
+			require.True(t, errors.Is(err, token.ErrInvalidToken))
+		})
+
+		t.Run("rejected password keeps the token", func(t *testing.T) {
+			err := s.ResetPassword(ctx, secondToken, "roundhouse123")
+			var policyErr *passpolicy.Error
+			require.True(t, errors.As(err, &policyErr))
+
+			_, err = tokenService.ValidateToken(ctx, secondToken, domain.ScopePasswordReset)
+			require.NoError(t, err)
+		})
+
+		t.Run("success", func(t *testing.T) {
+			err := s.ResetPassword(ctx, secondToken, "new password")
+			require.NoError(t, err)
+
+			_, err = tokenService.ValidateToken(ctx, session.Plaintext, domain.ScopeAuthentication)
+			require.True(t, errors.Is(err, token.ErrInvalidToken))
+		})
+
+		t.Run("error: single use", func(t *testing.T) {
+			err := s.ResetPassword(ctx, secondToken, "another password")
+			require.True(t, errors.Is(err, token.ErrInvalidToken))
+		})
+
+		t.Run("concurrent resets with one token", func(t *testing.T) {
+			err := s.RequestPasswordReset(ctx, email)
+			require.NoError(t, err)
+			msg, _ := mail.Last()
+			resetToken := tokenRE.FindStringSubmatch(msg.Body)[1]
+
+			passwords := []string{"first password", "second password"}
+			errs := make([]error, len(passwords))
+
+			var wg sync.WaitGroup
+			for i, password := range passwords {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					errs[i] = s.ResetPassword(ctx, resetToken, password)
+				}()
+			}
+			wg.Wait()
+
+			// exactly one wins, and the password is the winner's
+			var won string
+			for i, err := range errs {
+				if err == nil {
+					require.Empty(t, won)
+					won = passwords[i]
+					continue
+				}
+				require.True(t, errors.Is(err, token.ErrInvalidToken))
+			}
+			require.NotEmpty(t, won)
+
+			u, err := userService.GetUserByID(ctx, userID)
+			require.NoError(t, err)
+			valid, _, err := s.hasher.Verify(u.HashedPW, won)
+			require.NoError(t, err)
+			require.True(t, valid)
+		})
+	})
+}
@@ -0,0 +1,203 @@
+package auth
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+var ErrTooManyAttempts = errors.New("too many failed attempts")
+
+// ThrottledError is returned when a login is rejected before checking the
+// password, either because of a lockout or because the caller is retrying
+// faster than the progressive delay allows.
+type ThrottledError struct {
+	RetryAfter time.Duration
+}
+
+func (e *ThrottledError) Error() string {
+	return fmt.Sprintf("%s, try again in %s", ErrTooManyAttempts, e.RetryAfter.Round(time.Second))
+}
+
+func (e *ThrottledError) Unwrap() error {
+	return ErrTooManyAttempts
+}
+
+// throttlePolicy controls how failures for a single key are punished. The
+// first few failures are free, after which each failure doubles the time the
+// caller has to wait before trying again, until the lockout threshold is hit.
+type throttlePolicy struct {
+	name             string
+	freeAttempts     int
+	baseDelay        time.Duration
+	maxDelay         time.Duration
+	lockoutThreshold int
+	lockoutDuration  time.Duration
+	// window is how long a failure is remembered. A key that hasn't failed
+	// within the window starts over.
+	window time.Duration
+}
+
+var (
+	accountPolicy = throttlePolicy{
+		name:             "account",
+		freeAttempts:     3,
+		baseDelay:        time.Second,
+		maxDelay:         30 * time.Second,
+		lockoutThreshold: 10,
+		lockoutDuration:  15 * time.Minute,
+		window:           15 * time.Minute,
+	}
+	// ips are more generous since many users can share one behind a nat
+	ipPolicy = throttlePolicy{
+		name:             "ip",
+		freeAttempts:     20,
+		baseDelay:        time.Second,
+		maxDelay:         30 * time.Second,
+		lockoutThreshold: 100,
+		lockoutDuration:  15 * time.Minute,
+		window:           15 * time.Minute,
+	}
+)
+
+type attemptState struct {
+	failures      int
+	lastFailureAt time.Time
+	lockedUntil   sql.NullTime
+}
+
+// retryAfter returns how long the caller has to wait before another attempt
+// is allowed, or zero if they can go ahead.
+func (p throttlePolicy) retryAfter(state attemptState, now time.Time) time.Duration {
+	if state.lockedUntil.Valid && now.Before(state.lockedUntil.Time) {
+		return state.lockedUntil.Time.Sub(now)
+	}
+
+	if now.Sub(state.lastFailureAt) > p.window {
+		return 0
+	}
+
+	return max(p.delay(state.failures)-now.Sub(state.lastFailureAt), 0)
+}
+
+func (p throttlePolicy) delay(failures int) time.Duration {
+	if failures <= p.freeAttempts {
+		return 0
+	}
+
+	// cap before converting back, large failure counts overflow a duration
+	exp := float64(failures - p.freeAttempts - 1)
+	delay := math.Min(float64(p.baseDelay)*math.Pow(2, exp), float64(p.maxDelay))
+	return time.Duration(delay)
+}
+
+type throttleKey struct {
+	key    string
+	policy throttlePolicy
+}
+
+func accountKey(email string) throttleKey {
+	return throttleKey{key: "account:" + strings.ToLower(email), policy: accountPolicy}
+}
+
+func mfaKey(userID int64) throttleKey {
+	return throttleKey{key: fmt.Sprintf("mfa:%d", userID), policy: accountPolicy}
+}
+
+func ipKey(ip string) throttleKey {
+	return throttleKey{key: "ip:" + ip, policy: ipPolicy}
+}
+
+// checkThrottle returns a *ThrottledError if any of the keys are locked out or
+// still waiting out a delay.
+func (s *Service) checkThrottle(ctx context.Context, keys ...throttleKey) error {
+	query := `select failures, last_failure_at, locked_until from login_attempts where key = $1`
+
+	// login_attempts uses timestamp without time zone, so stick to utc
+	now := time.Now().UTC()
+	var wait time.Duration
+	for _, k := range keys {
+		var state attemptState
+		err := s.db.QueryRowContext(ctx, query, k.key).Scan(&state.failures, &state.lastFailureAt, &state.lockedUntil)
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				continue
+			}
+			return fmt.Errorf("failed to check login attempts: %w", err)
+		}
+
+		wait = max(wait, k.policy.retryAfter(state, now))
+	}
+
+	if wait > 0 {
+		return &ThrottledError{RetryAfter: wait}
+	}
+
+	return nil
+}
+
+// recordFailure bumps the failure count for the key, locking it once the
+// threshold is reached. It returns when the lock expires, if one was applied.
+func (s *Service) recordFailure(ctx context.Context, k throttleKey) (time.Time, error) {
+	now := time.Now().UTC()
+
+	query := `
+		insert into login_attempts (key, failures, last_failure_at)
+		values ($1, 1, $2)
+		on conflict (key) do update
+		set failures = case
+				when login_attempts.last_failure_at < $3 then 1
+				else login_attempts.failures + 1
+			end,
+			last_failure_at = excluded.last_failure_at
+		returning failures`
+
+	var failures int
+	if err := s.db.QueryRowContext(ctx, query, k.key, now, now.Add(-k.policy.window)).Scan(&failures); err != nil {
+		return time.Time{}, fmt.Errorf("failed to record login failure: %w", err)
+	}
+
+	if failures < k.policy.lockoutThreshold {
+		return time.Time{}, nil
+	}
+
+	// start counting again once the lock is in place so the key gets a fresh
+	// set of attempts when it expires
+	lockedUntil := now.Add(k.policy.lockoutDuration)
+	query = `update login_attempts set failures = 0, locked_until = $2 where key = $1`
+	if _, err := s.db.ExecContext(ctx, query, k.key, lockedUntil); err != nil {
+		return time.Time{}, fmt.Errorf("failed to lock key: %w", err)
+	}
+
+	return lockedUntil, nil
+}
+
+func (s *Service) resetFailures(ctx context.Context, k throttleKey) error {
+	if _, err := s.db.ExecContext(ctx, `delete from login_attempts where key = $1`, k.key); err != nil {
+		return fmt.Errorf("failed to reset login attempts: %w", err)
+	}
+
+	return nil
+}
+
+// recordFailures records a failure against every key. Errors are logged
+// rather than returned since the caller is already failing the login.
+func (s *Service) recordFailures(ctx context.Context, email, ip string, keys ...throttleKey) {
+	for _, k := range keys {
+		lockedUntil, err := s.recordFailure(ctx, k)
+		if err != nil {
+			s.logger.Error("failed to record login failure", zap.String("key", k.key), zap.Error(err))
+			continue
+		}
+
+		if !lockedUntil.IsZero() {
+			s.logger.Warn("auth_locked", zap.String("email", email), zap.String("ip", ip), zap.String("reason", k.policy.name+"_failures"), zap.Time("locked_until", lockedUntil))
+		}
+	}
+}
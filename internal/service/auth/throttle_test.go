@@ -0,0 +1,85 @@
+package auth
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestThrottleDelay(t *testing.T) {
+	p := throttlePolicy{
+		freeAttempts: 3,
+		baseDelay:    time.Second,
+		maxDelay:     10 * time.Second,
+	}
+
+	tests := []struct {
+		failures int
+		expected time.Duration
+	}{
+		{failures: 0, expected: 0},
+		{failures: 3, expected: 0},
+		{failures: 4, expected: time.Second},
+		{failures: 5, expected: 2 * time.Second},
+		{failures: 6, expected: 4 * time.Second},
+		{failures: 7, expected: 8 * time.Second},
+		{failures: 8, expected: 10 * time.Second},
+		{failures: 50, expected: 10 * time.Second},
+	}
+
+	for _, tt := range tests {
+		require.Equal(t, tt.expected, p.delay(tt.failures), "failures: %d", tt.failures)
+	}
+}
+
+func TestThrottleRetryAfter(t *testing.T) {
+	p := throttlePolicy{
+		freeAttempts: 3,
+		baseDelay:    time.Second,
+		maxDelay:     10 * time.Second,
+		window:       15 * time.Minute,
+	}
+	now := time.Now()
+
+	t.Run("locked", func(t *testing.T) {
+		state := attemptState{
+			lastFailureAt: now,
+			lockedUntil:   sql.NullTime{Time: now.Add(time.Minute), Valid: true},
+		}
+		require.Equal(t, time.Minute, p.retryAfter(state, now))
+	})
+
+	t.Run("expired lock", func(t *testing.T) {
+		state := attemptState{
+			lastFailureAt: now.Add(-time.Hour),
+			lockedUntil:   sql.NullTime{Time: now.Add(-time.Minute), Valid: true},
+		}
+		require.Zero(t, p.retryAfter(state, now))
+	})
+
+	t.Run("waiting out delay", func(t *testing.T) {
+		state := attemptState{
+			failures:      5,
+			lastFailureAt: now.Add(-500 * time.Millisecond),
+		}
+		require.Equal(t, 1500*time.Millisecond, p.retryAfter(state, now))
+	})
+
+	t.Run("delay has passed", func(t *testing.T) {
+		state := attemptState{
+			failures:      5,
+			lastFailureAt: now.Add(-3 * time.Second),
+		}
+		require.Zero(t, p.retryAfter(state, now))
+	})
+
+	t.Run("outside window", func(t *testing.T) {
+		state := attemptState{
+			failures:      50,
+			lastFailureAt: now.Add(-time.Hour),
+		}
+		require.Zero(t, p.retryAfter(state, now))
+	})
+}
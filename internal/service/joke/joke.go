@@ -2,43 +2,76 @@ package joke
 
 import (
 	"context"
-	"database/sql"
 	"errors"
 	"fmt"
+	"io"
 	"math/rand/v2"
 	"strings"
 
 	"github.com/davemolk/chuck/internal/domain"
+	"github.com/davemolk/chuck/internal/jokeio"
+	"github.com/davemolk/chuck/internal/metrics"
+	"github.com/davemolk/chuck/internal/seed"
 	"github.com/davemolk/chuck/internal/service"
-	sqldb "github.com/davemolk/chuck/internal/sql"
+	"github.com/davemolk/chuck/internal/store"
+	"github.com/davemolk/chuck/internal/tracing"
 	"go.uber.org/zap"
 )
 
 const maxJokesFromAPI = 100
 
-var _ service.JokeService = (*Service)(nil)
+const (
+	// importBatchSize is how many jokes go in each import transaction.
+	importBatchSize = 500
+	// maxImportErrors caps the bad jokes an import reports, the rest are
+	// only counted.
+	maxImportErrors = 100
+)
+
+var (
+	_ service.JokeService = (*Service)(nil)
+	_ seed.Store          = (*Service)(nil)
+)
 
 var ErrNoJokes = errors.New("no jokes found")
 
+// ErrBadImport is an import file that couldn't be read to the end, as
+// opposed to a bad joke in it, which is skipped.
+var ErrBadImport = errors.New("bad import file")
+
 type chuckGetter interface {
 	Search(ctx context.Context, query string, limit int) ([]*domain.Joke, error)
 }
 
+// meter counts searches that go to the chuck norris api against the user's
+// quota, see the usage service.
+type meter interface {
+	Record(ctx context.Context, user *domain.User, event string) error
+	Refund(ctx context.Context, user *domain.User, event string) error
+}
+
 type Service struct {
 	logger *zap.Logger
-	db     *sqldb.DB
+	jokes  store.JokeStore
 	client chuckGetter
+	usage  meter
 }
 
-func NewService(logger *zap.Logger, db *sqldb.DB, client chuckGetter) *Service {
+// NewService returns a joke service. usage can be nil when nothing calls
+// GetRandomJokeByQuery for a user, e.g. in commands.
+func NewService(logger *zap.Logger, jokes store.JokeStore, client chuckGetter, usage meter) *Service {
 	return &Service{
 		logger: logger,
-		db:     db,
+		jokes:  jokes,
 		client: client,
+		usage:  usage,
 	}
 }
 
 func (s *Service) GetPersonalizedJoke(ctx context.Context, name string) (*domain.Joke, error) {
+	ctx, span := tracing.Start(ctx, "joke.GetPersonalizedJoke")
+	defer span.End()
+
 	joke, err := s.GetRandomJoke(ctx)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get joke for personalization: %w", err)
@@ -50,27 +83,13 @@ func (s *Service) GetPersonalizedJoke(ctx context.Context, name string) (*domain
 	return joke, nil
 }
 
-// GetRandomJoke selects a joke at random from the database. Since we seed in
-// the initial migration, we will always have a result.
+// GetRandomJoke selects a joke at random from the database. It's
+// domain.ErrNotFound until the database is seeded, see the seed package.
 func (s *Service) GetRandomJoke(ctx context.Context) (*domain.Joke, error) {
-	query := `
-		select id, external_id, joke_url, content, created_at
-		from jokes
-		order by random()
-		limit 1
-	`
-
-	var joke domain.Joke
-	err := s.db.QueryRowContext(ctx, query).Scan(
-		&joke.ID, &joke.ExternalID, &joke.URL, &joke.Content, &joke.CreatedAt)
-	if err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			return nil, domain.ErrNotFound
-		}
-		return nil, fmt.Errorf("failed to get joke: %w", err)
-	}
+	ctx, span := tracing.Start(ctx, "joke.GetRandomJoke")
+	defer span.End()
 
-	return &joke, nil
+	return s.jokes.GetRandomJoke(ctx)
 }
 
 // personalize is a quick and dirty (but readable) substitution of
@@ -91,14 +110,21 @@ func (s *Service) personalize(joke, name string) string {
 // GetRandomJokeByQuery searches the database for a joke whose content matches the
 // query. If this fails, GetRandomJokeByQuery calls the search endpoint of the Chuck
 // Norris API, saving any results to the database and returning one to user.
-func (s *Service) GetRandomJokeByQuery(ctx context.Context, query string) (*domain.Joke, error) {
+//
+// Only the api call counts against the user's search quota, and only when it
+// finds something. user is nil for anonymous searches, which aren't metered.
+func (s *Service) GetRandomJokeByQuery(ctx context.Context, user *domain.User, query string) (*domain.Joke, error) {
+	ctx, span := tracing.Start(ctx, "joke.GetRandomJokeByQuery")
+	defer span.End()
+
 	// first, check database for a match
-	joke, err := s.getRandomDBJokeByQuery(ctx, query)
+	joke, err := s.jokes.SearchJoke(ctx, query)
 	if err != nil && !errors.Is(err, domain.ErrNotFound) {
 		return nil, err
 	}
 
 	// exit early if we found our match
+	metrics.ObserveJokeSearch(joke != nil)
 	if joke != nil {
 		return joke, nil
 	}
@@ -107,19 +133,27 @@ func (s *Service) GetRandomJokeByQuery(ctx context.Context, query string) (*doma
 	logger := s.logger.With(zap.String("query", query))
 	logger.Info("no cached matches, calling api...")
 
+	// the quota is taken before the call, so concurrent searches can't go
+	// over it, and given back if the call comes up empty
+	if err = s.recordSearch(ctx, user); err != nil {
+		return nil, err
+	}
+
 	jokes, err := s.client.Search(ctx, query, maxJokesFromAPI)
 	if err != nil {
+		s.refundSearch(ctx, user)
 		return nil, fmt.Errorf("failed to search api: %w", err)
 	}
 
 	if len(jokes) == 0 {
+		s.refundSearch(ctx, user)
 		return nil, ErrNoJokes
 	}
 
 	logger.Info("found", zap.Int("count", len(jokes)))
 
 	// populate db. as we insert, we will scan the id to the slice we're passing in
-	if err = s.saveJokes(ctx, jokes); err != nil {
+	if err = s.SaveJokes(ctx, jokes); err != nil {
 		// user should still get a joke if we can't save them
 		logger.Error("failed to save jokes", zap.Error(err))
 	}
@@ -129,55 +163,106 @@ func (s *Service) GetRandomJokeByQuery(ctx context.Context, query string) (*doma
 	return jokes[rand.IntN(len(jokes))], nil
 }
 
-func (s *Service) getRandomDBJokeByQuery(ctx context.Context, query string) (*domain.Joke, error) {
-	q := `
-		select id, external_id, joke_url, content, created_at
-		from jokes
-		where to_tsvector('simple', content) @@ to_tsquery('simple', $1)
-		order by random()
-		limit 1
-	`
-
-	var joke domain.Joke
-	err := s.db.QueryRowContext(ctx, q, query).Scan(
-		&joke.ID, &joke.ExternalID, &joke.URL, &joke.Content, &joke.CreatedAt)
-	if err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			return nil, domain.ErrNotFound
-		}
-		return nil, fmt.Errorf("failed to get joke by content: %w", err)
+func (s *Service) recordSearch(ctx context.Context, user *domain.User) error {
+	if user == nil || s.usage == nil {
+		return nil
 	}
+	return s.usage.Record(ctx, user, domain.EventSearch)
+}
 
-	return &joke, nil
+// refundSearch is best effort, a failed refund only costs the user a search.
+func (s *Service) refundSearch(ctx context.Context, user *domain.User) {
+	if user == nil || s.usage == nil {
+		return
+	}
+	if err := s.usage.Refund(ctx, user, domain.EventSearch); err != nil {
+		s.logger.Error("failed to refund search", zap.Int64("user_id", user.ID), zap.Error(err))
+	}
 }
 
-func (s *Service) saveJokes(ctx context.Context, jokes []*domain.Joke) error {
-	// sanity check
-	if len(jokes) == 0 {
+// SaveJokes upserts jokes by external id, filling in each one's id. Both
+// api results and seed datasets are saved through here.
+func (s *Service) SaveJokes(ctx context.Context, jokes []*domain.Joke) error {
+	ctx, span := tracing.Start(ctx, "joke.SaveJokes")
+	defer span.End()
+
+	return s.jokes.SaveJokes(ctx, jokes)
+}
+
+// GetJokesByExternalID returns the jokes that exist, keyed by external id.
+func (s *Service) GetJokesByExternalID(ctx context.Context, externalIDs []string) (map[string]*domain.Joke, error) {
+	ctx, span := tracing.Start(ctx, "joke.GetJokesByExternalID")
+	defer span.End()
+
+	return s.jokes.GetJokesByExternalID(ctx, externalIDs)
+}
+
+// ExportJokes writes every joke, oldest first, and closes w. Jokes are
+// written as the store hands them over rather than gathered up first.
+func (s *Service) ExportJokes(ctx context.Context, w *jokeio.Writer) error {
+	ctx, span := tracing.Start(ctx, "joke.ExportJokes")
+	defer span.End()
+
+	if err := s.jokes.EachJoke(ctx, w.Write); err != nil {
+		return fmt.Errorf("failed to export jokes: %w", err)
+	}
+
+	return w.Close()
+}
+
+// ImportJokes upserts jokes in batches, each in its own transaction. Bad
+// jokes are skipped and reported. Anything else stops the import, but
+// batches already saved stay saved, and since it's an upsert the same file
+// can be imported again.
+func (s *Service) ImportJokes(ctx context.Context, r *jokeio.Reader) (*domain.JokeImport, error) {
+	ctx, span := tracing.Start(ctx, "joke.ImportJokes")
+	defer span.End()
+
+	report := &domain.JokeImport{Errors: []domain.ImportError{}}
+	batch := make([]*domain.Joke, 0, importBatchSize)
+
+	save := func() error {
+		if err := s.SaveJokes(ctx, batch); err != nil {
+			return fmt.Errorf("failed to save jokes after %d imported: %w", report.Imported, err)
+		}
+		report.Imported += len(batch)
+		batch = batch[:0]
 		return nil
 	}
 
-	// this presupposes that external id is a unique identifier, and it certainly
-	// appears to be, but there's no statement to that effect in the chuck norris
-	// api docs.
-	//
-	// since we need to scan an id and we might have conflicts, we could either check
-	// for sql.ErrNoRows and handle, or do a no-op update which will return the id.
-	query := `
-		insert into jokes (external_id, joke_url, content, created_at)
-		values ($1, $2, $3, $4)
-		on conflict (external_id) do update
-		set external_id = jokes.external_id
-		returning id
-	`
-
-	return s.db.RunInTx(ctx, func(tx *sql.Tx) error {
-		for _, joke := range jokes {
-			if err := tx.QueryRowContext(ctx, query, joke.ExternalID, joke.URL, joke.Content, joke.CreatedAt).Scan(&joke.ID); err != nil {
-				return err
+	for {
+		joke, err := r.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+
+		var recErr *jokeio.RecordError
+		if errors.As(err, &recErr) {
+			report.Read++
+			report.Failed++
+			if len(report.Errors) < maxImportErrors {
+				report.Errors = append(report.Errors, domain.ImportError{Line: recErr.Line, Error: recErr.Err.Error()})
 			}
+			continue
+		}
+		if err != nil {
+			return report, fmt.Errorf("%w, stopped after %d imported: %w", ErrBadImport, report.Imported, err)
 		}
 
-		return nil
-	})
+		report.Read++
+		batch = append(batch, joke)
+		if len(batch) == importBatchSize {
+			if err = save(); err != nil {
+				return report, err
+			}
+		}
+	}
+
+	if err := save(); err != nil {
+		return report, err
+	}
+
+	s.logger.Info("imported jokes", zap.Int("read", report.Read), zap.Int("imported", report.Imported), zap.Int("failed", report.Failed))
+
+	return report, nil
 }
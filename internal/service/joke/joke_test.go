@@ -1,18 +1,33 @@
 package joke
 
 import (
+	"bytes"
 	"context"
 	"errors"
+	"fmt"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/davemolk/chuck/internal/domain"
-	"github.com/davemolk/chuck/internal/sql/dbtest"
+	"github.com/davemolk/chuck/internal/jokeio"
+	"github.com/davemolk/chuck/internal/seed"
+	"github.com/davemolk/chuck/internal/store"
 	"github.com/davemolk/chuck/internal/tests/fixture"
 	"github.com/davemolk/chuck/internal/tests/mock"
 	"github.com/stretchr/testify/require"
 )
 
+// seedJokes loads the test dataset, the tests below rely on its order for
+// ids.
+func seedJokes(t *testing.T, s *Service) {
+	t.Helper()
+
+	jokes, err := seed.Open("test")
+	require.NoError(t, err)
+	require.NoError(t, s.SaveJokes(context.Background(), jokes))
+}
+
 func TestPersonalize(t *testing.T) {
 	s := &Service{}
 
@@ -81,9 +96,9 @@ func TestPersonalize(t *testing.T) {
 }
 
 func TestGetRandomDBJoke(t *testing.T) {
-	db := dbtest.SetupTestDB(t)
-	s := NewService(fixture.TestLogger(t), db, nil)
+	s := NewService(fixture.TestLogger(t), store.NewMemory(), nil, nil)
 	ctx := context.Background()
+	seedJokes(t, s)
 
 	joke, err := s.GetRandomJoke(ctx)
 	require.NoError(t, err)
@@ -91,9 +106,9 @@ func TestGetRandomDBJoke(t *testing.T) {
 }
 
 func TestGetPersonalizedJoke(t *testing.T) {
-	db := dbtest.SetupTestDB(t)
-	s := NewService(fixture.TestLogger(t), db, nil)
+	s := NewService(fixture.TestLogger(t), store.NewMemory(), nil, nil)
 	ctx := context.Background()
+	seedJokes(t, s)
 
 	name := "dave molk"
 	joke, err := s.GetPersonalizedJoke(ctx, name)
@@ -102,12 +117,12 @@ func TestGetPersonalizedJoke(t *testing.T) {
 }
 
 func TestGetRandomDBJokeByQuery(t *testing.T) {
-	db := dbtest.SetupTestDB(t)
-	s := NewService(fixture.TestLogger(t), db, nil)
+	s := NewService(fixture.TestLogger(t), store.NewMemory(), nil, nil)
 	ctx := context.Background()
+	seedJokes(t, s)
 
 	t.Run("success, joke in db", func(t *testing.T) {
-		joke, err := s.getRandomDBJokeByQuery(ctx, "horse")
+		joke, err := s.jokes.SearchJoke(ctx, "horse")
 		require.NoError(t, err)
 		require.Equal(t, int64(4), joke.ID)
 	})
@@ -126,7 +141,7 @@ func TestGetRandomDBJokeByQuery(t *testing.T) {
 			},
 		}
 		s.client = client
-		joke, err := s.GetRandomJokeByQuery(ctx, "school")
+		joke, err := s.GetRandomJokeByQuery(ctx, nil, "school")
 		require.NoError(t, err)
 		require.Equal(t, int64(5), joke.ID)
 	})
@@ -165,7 +180,7 @@ func TestGetRandomDBJokeByQuery(t *testing.T) {
 			},
 		}
 		s.client = client
-		joke, err := s.GetRandomJokeByQuery(ctx, "ninja")
+		joke, err := s.GetRandomJokeByQuery(ctx, nil, "ninja")
 		require.NoError(t, err)
 		externalIDs := []string{"h0VbNVqJQcWQvpxtimWJ7Q", "z_VZSvW5SWud7-Vb0oZgIw", "Yf3aq8BRSQmL9NBwWPoFqA", "wIkJ7EssS6GUs-ACNUbzuw"}
 		// make sure joke is from one of the ones returned by api
@@ -179,8 +194,65 @@ func TestGetRandomDBJokeByQuery(t *testing.T) {
 			},
 		}
 		s.client = client
-		_, err := s.GetRandomJokeByQuery(ctx, "kale")
+		_, err := s.GetRandomJokeByQuery(ctx, nil, "kale")
 		require.Error(t, err)
 		require.True(t, errors.Is(err, ErrNoJokes))
 	})
 }
+
+func TestExportImportJokes(t *testing.T) {
+	s := NewService(fixture.TestLogger(t), store.NewMemory(), nil, nil)
+	ctx := context.Background()
+	seedJokes(t, s)
+
+	t.Run("export", func(t *testing.T) {
+		var buf bytes.Buffer
+		w, err := jokeio.NewWriter(&buf, jokeio.FormatNDJSON)
+		require.NoError(t, err)
+
+		require.NoError(t, s.ExportJokes(ctx, w))
+		require.Equal(t, 4, w.Count())
+		require.Equal(t, 4, strings.Count(buf.String(), "\n"))
+		require.True(t, strings.HasPrefix(buf.String(), `{"external_id":"c-3yrrglr0ouxifeo2rzsw"`))
+	})
+
+	t.Run("import", func(t *testing.T) {
+		input := `external_id,url,content
+c-3yrrglr0ouxifeo2rzsw,https://api.chucknorris.io/jokes/c-3yrrglr0ouxifeo2rzsw,Chuck Norris is the Matrix.
+,https://example.com/nope,no id
+new-joke,https://example.com/new,Chuck Norris can slam a revolving door.
+`
+		r, err := jokeio.NewReader(strings.NewReader(input), jokeio.FormatCSV)
+		require.NoError(t, err)
+
+		report, err := s.ImportJokes(ctx, r)
+		require.NoError(t, err)
+		require.Equal(t, &domain.JokeImport{
+			Read:     3,
+			Imported: 2,
+			Failed:   1,
+			Errors:   []domain.ImportError{{Line: 3, Error: "external_id is required"}},
+		}, report)
+
+		jokes, err := s.GetJokesByExternalID(ctx, []string{"c-3yrrglr0ouxifeo2rzsw", "new-joke"})
+		require.NoError(t, err)
+		require.Equal(t, "Chuck Norris is the Matrix.", jokes["c-3yrrglr0ouxifeo2rzsw"].Content)
+		require.Equal(t, int64(1), jokes["c-3yrrglr0ouxifeo2rzsw"].ID)
+		require.Equal(t, "https://example.com/new", jokes["new-joke"].URL)
+	})
+
+	t.Run("import in batches", func(t *testing.T) {
+		var input strings.Builder
+		for i := range importBatchSize + 10 {
+			fmt.Fprintf(&input, `{"external_id": "batch-%d", "url": "https://example.com/batch/%d", "content": "Chuck Norris %d"}`+"\n", i, i, i)
+		}
+
+		r, err := jokeio.NewReader(strings.NewReader(input.String()), jokeio.FormatNDJSON)
+		require.NoError(t, err)
+
+		report, err := s.ImportJokes(ctx, r)
+		require.NoError(t, err)
+		require.Equal(t, importBatchSize+10, report.Imported)
+		require.Empty(t, report.Errors)
+	})
+}
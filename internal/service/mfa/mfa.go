@@ -0,0 +1,339 @@
+package mfa
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/davemolk/chuck/internal/domain"
+	"github.com/davemolk/chuck/internal/service"
+	sqldb "github.com/davemolk/chuck/internal/sql"
+	"github.com/davemolk/chuck/internal/tracing"
+	"github.com/skip2/go-qrcode"
+	"go.uber.org/zap"
+)
+
+const (
+	issuer            = "chuck"
+	qrCodeSize        = 256
+	recoveryCodeCount = 10
+	// recoveryCodeBytes gives us 16 base32 characters, which we split in half
+	// with a dash so they're easier to copy down.
+	recoveryCodeBytes = 10
+)
+
+var _ service.MFAService = (*Service)(nil)
+
+var (
+	ErrAlreadyEnrolled = errors.New("totp is already enabled")
+	ErrNotEnrolled     = errors.New("totp enrollment not started")
+	ErrInvalidCode     = errors.New("invalid code")
+)
+
+type Service struct {
+	logger *zap.Logger
+	db     *sqldb.DB
+	aead   cipher.AEAD
+}
+
+// NewService returns an mfa service. key is used to encrypt totp secrets at
+// rest and must be 32 bytes (AES-256).
+func NewService(logger *zap.Logger, db *sqldb.DB, key []byte) (*Service, error) {
+	if len(key) != 32 {
+		return nil, fmt.Errorf("encryption key must be 32 bytes, got %d", len(key))
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %w", err)
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create gcm: %w", err)
+	}
+
+	return &Service{
+		logger: logger,
+		db:     db,
+		aead:   aead,
+	}, nil
+}
+
+// EnrollTOTP generates a new secret for the user. The secret isn't active until
+// it's confirmed with a code, so calling this again before confirming simply
+// replaces the pending secret.
+func (s *Service) EnrollTOTP(ctx context.Context, user *domain.User) (*domain.TOTPEnrollment, error) {
+	ctx, span := tracing.Start(ctx, "mfa.EnrollTOTP")
+	defer span.End()
+
+	logger := s.logger.With(zap.Int64("user_id", user.ID))
+	logger.Info("starting totp enrollment")
+
+	secret, err := generateSecret()
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate secret: %w", err)
+	}
+
+	encrypted, err := s.encrypt(user.ID, secret)
+	if err != nil {
+		return nil, err
+	}
+
+	// the where clause means a confirmed enrollment is left alone, in which
+	// case there's nothing to return and we know the user is already enrolled.
+	query := `
+		insert into user_totp (user_id, secret)
+		values ($1, $2)
+		on conflict (user_id) do update
+		set secret = excluded.secret, created_at = current_timestamp
+		where user_totp.confirmed_at is null
+		returning user_id`
+
+	var id int64
+	if err = s.db.QueryRowContext(ctx, query, user.ID, encrypted).Scan(&id); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrAlreadyEnrolled
+		}
+		return nil, fmt.Errorf("failed to save totp secret: %w", err)
+	}
+
+	uri := otpauthURI(issuer, user.Email, secret)
+
+	png, err := qrcode.Encode(uri, qrcode.Medium, qrCodeSize)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate qr code: %w", err)
+	}
+
+	return &domain.TOTPEnrollment{
+		Secret: b32.EncodeToString(secret),
+		URI:    uri,
+		QRCode: png,
+	}, nil
+}
+
+// ConfirmTOTP activates a pending enrollment once the user proves their
+// authenticator works, returning a fresh set of one-time recovery codes.
+func (s *Service) ConfirmTOTP(ctx context.Context, userID int64, code string) ([]string, error) {
+	ctx, span := tracing.Start(ctx, "mfa.ConfirmTOTP")
+	defer span.End()
+
+	logger := s.logger.With(zap.Int64("user_id", userID))
+
+	var codes []string
+	err := s.db.RunInTx(ctx, nil, func(ctx context.Context, tx *sql.Tx) error {
+		var encrypted []byte
+		var confirmedAt sql.NullTime
+		var lastStep int64
+
+		query := `select secret, confirmed_at, last_used_step from user_totp where user_id = $1` + s.db.ForUpdate()
+		if err := tx.QueryRowContext(ctx, query, userID).Scan(&encrypted, &confirmedAt, &lastStep); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return ErrNotEnrolled
+			}
+			return fmt.Errorf("failed to get totp secret: %w", err)
+		}
+
+		if confirmedAt.Valid {
+			return ErrAlreadyEnrolled
+		}
+
+		secret, err := s.decrypt(userID, encrypted)
+		if err != nil {
+			return err
+		}
+
+		step, ok := validateTOTP(secret, code, time.Now(), lastStep)
+		if !ok {
+			return ErrInvalidCode
+		}
+
+		query = `update user_totp set confirmed_at = current_timestamp, last_used_step = $2 where user_id = $1`
+		if _, err = tx.ExecContext(ctx, query, userID, step); err != nil {
+			return fmt.Errorf("failed to confirm totp: %w", err)
+		}
+
+		codes, err = s.replaceRecoveryCodes(ctx, tx, userID)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	logger.Info("totp enabled")
+
+	return codes, nil
+}
+
+func (s *Service) IsEnabled(ctx context.Context, userID int64) (bool, error) {
+	ctx, span := tracing.Start(ctx, "mfa.IsEnabled")
+	defer span.End()
+
+	query := `select exists(select 1 from user_totp where user_id = $1 and confirmed_at is not null)`
+
+	var enabled bool
+	if err := s.db.QueryRowContext(ctx, query, userID).Scan(&enabled); err != nil {
+		return false, fmt.Errorf("failed to check totp status: %w", err)
+	}
+
+	return enabled, nil
+}
+
+// GetStatus reports whether totp is on and how many recovery codes are left.
+func (s *Service) GetStatus(ctx context.Context, userID int64) (*domain.MFAStatus, error) {
+	ctx, span := tracing.Start(ctx, "mfa.GetStatus")
+	defer span.End()
+
+	query := `
+		select
+			(select confirmed_at from user_totp where user_id = $1),
+			(select count(*) from recovery_codes where user_id = $1 and used_at is null)`
+
+	var status domain.MFAStatus
+	if err := s.db.QueryRowContext(ctx, query, userID).Scan(&status.ConfirmedAt, &status.RecoveryCodes); err != nil {
+		return nil, fmt.Errorf("failed to get mfa status: %w", err)
+	}
+	status.Enabled = status.ConfirmedAt != nil
+
+	return &status, nil
+}
+
+// Verify accepts either a current totp code or one of the user's unused
+// recovery codes. Recovery codes are burned on use.
+func (s *Service) Verify(ctx context.Context, userID int64, code string) error {
+	ctx, span := tracing.Start(ctx, "mfa.Verify")
+	defer span.End()
+
+	code = strings.TrimSpace(code)
+
+	if len(code) == totpDigits {
+		return s.verifyTOTP(ctx, userID, code)
+	}
+
+	return s.useRecoveryCode(ctx, userID, code)
+}
+
+func (s *Service) verifyTOTP(ctx context.Context, userID int64, code string) error {
+	return s.db.RunInTx(ctx, nil, func(ctx context.Context, tx *sql.Tx) error {
+		var encrypted []byte
+		var lastStep int64
+
+		// lock the row so two concurrent requests can't both use the same code
+		query := `select secret, last_used_step from user_totp where user_id = $1 and confirmed_at is not null` + s.db.ForUpdate()
+		if err := tx.QueryRowContext(ctx, query, userID).Scan(&encrypted, &lastStep); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return ErrNotEnrolled
+			}
+			return fmt.Errorf("failed to get totp secret: %w", err)
+		}
+
+		secret, err := s.decrypt(userID, encrypted)
+		if err != nil {
+			return err
+		}
+
+		step, ok := validateTOTP(secret, code, time.Now(), lastStep)
+		if !ok {
+			return ErrInvalidCode
+		}
+
+		query = `update user_totp set last_used_step = $2 where user_id = $1`
+		if _, err = tx.ExecContext(ctx, query, userID, step); err != nil {
+			return fmt.Errorf("failed to update totp step: %w", err)
+		}
+
+		return nil
+	})
+}
+
+func (s *Service) useRecoveryCode(ctx context.Context, userID int64, code string) error {
+	query := `
+		update recovery_codes
+		set used_at = current_timestamp
+		where user_id = $1 and hash = $2 and used_at is null`
+
+	res, err := s.db.ExecContext(ctx, query, userID, hashRecoveryCode(code))
+	if err != nil {
+		return fmt.Errorf("failed to use recovery code: %w", err)
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to use recovery code: %w", err)
+	}
+	if n == 0 {
+		return ErrInvalidCode
+	}
+
+	s.logger.Info("recovery code used", zap.Int64("user_id", userID))
+
+	return nil
+}
+
+func (s *Service) replaceRecoveryCodes(ctx context.Context, tx *sql.Tx, userID int64) ([]string, error) {
+	if _, err := tx.ExecContext(ctx, `delete from recovery_codes where user_id = $1`, userID); err != nil {
+		return nil, fmt.Errorf("failed to delete recovery codes: %w", err)
+	}
+
+	query := `insert into recovery_codes (user_id, hash) values ($1, $2)`
+
+	codes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		b := make([]byte, recoveryCodeBytes)
+		if _, err := rand.Read(b); err != nil {
+			return nil, fmt.Errorf("failed to generate recovery code: %w", err)
+		}
+
+		code := strings.ToLower(b32.EncodeToString(b))
+		codes[i] = code[:8] + "-" + code[8:]
+
+		if _, err := tx.ExecContext(ctx, query, userID, hashRecoveryCode(codes[i])); err != nil {
+			return nil, fmt.Errorf("failed to insert recovery code: %w", err)
+		}
+	}
+
+	return codes, nil
+}
+
+// hashRecoveryCode normalizes the code before hashing so users can enter it
+// with or without the dash and in any case. The codes are random, so a plain
+// sha256 is fine, same as with tokens.
+func hashRecoveryCode(code string) []byte {
+	code = strings.ToLower(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+	hash := sha256.Sum256([]byte(code))
+	return hash[:]
+}
+
+// encrypt seals the secret with the user id as additional data, so a secret
+// copied to another user's row won't decrypt.
+func (s *Service) encrypt(userID int64, plaintext []byte) ([]byte, error) {
+	nonce := make([]byte, s.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+
+	return s.aead.Seal(nonce, nonce, plaintext, []byte(strconv.FormatInt(userID, 10))), nil
+}
+
+func (s *Service) decrypt(userID int64, ciphertext []byte) ([]byte, error) {
+	size := s.aead.NonceSize()
+	if len(ciphertext) < size {
+		return nil, errors.New("malformed totp secret")
+	}
+
+	nonce, sealed := ciphertext[:size], ciphertext[size:]
+	plaintext, err := s.aead.Open(nil, nonce, sealed, []byte(strconv.FormatInt(userID, 10)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt totp secret: %w", err)
+	}
+
+	return plaintext, nil
+}
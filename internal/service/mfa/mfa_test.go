@@ -0,0 +1,124 @@
+package mfa
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/davemolk/chuck/internal/domain"
+	sqldb "github.com/davemolk/chuck/internal/sql"
+	"github.com/davemolk/chuck/internal/sql/dbtest"
+	"github.com/davemolk/chuck/internal/store"
+	"github.com/davemolk/chuck/internal/tests/fixture"
+	"github.com/stretchr/testify/require"
+)
+
+var testKey = []byte("0123456789abcdef0123456789abcdef")
+
+func TestNewService(t *testing.T) {
+	_, err := NewService(fixture.TestLogger(t), nil, []byte("too short"))
+	require.Error(t, err)
+}
+
+func TestEncrypt(t *testing.T) {
+	s, err := NewService(fixture.TestLogger(t), nil, testKey)
+	require.NoError(t, err)
+
+	secret := []byte("roundhouse")
+	encrypted, err := s.encrypt(1, secret)
+	require.NoError(t, err)
+	require.NotContains(t, string(encrypted), string(secret))
+
+	t.Run("success", func(t *testing.T) {
+		got, err := s.decrypt(1, encrypted)
+		require.NoError(t, err)
+		require.Equal(t, secret, got)
+	})
+
+	t.Run("error: bound to user", func(t *testing.T) {
+		_, err := s.decrypt(2, encrypted)
+		require.Error(t, err)
+	})
+}
+
+func TestEnrollAndVerify(t *testing.T) {
+	dbtest.Run(t, func(t *testing.T, db *sqldb.DB) {
+		s, err := NewService(fixture.TestLogger(t), db, testKey)
+		require.NoError(t, err)
+		ctx := context.Background()
+
+		userID := fixture.AddUser(t, store.New(db), "chuck@norris.com")
+		user := &domain.User{ID: userID, Email: "chuck@norris.com"}
+
+		t.Run("not enabled before enrollment", func(t *testing.T) {
+			enabled, err := s.IsEnabled(ctx, userID)
+			require.NoError(t, err)
+			require.False(t, enabled)
+
+			_, err = s.ConfirmTOTP(ctx, userID, "123456")
+			require.True(t, errors.Is(err, ErrNotEnrolled))
+
+			status, err := s.GetStatus(ctx, userID)
+			require.NoError(t, err)
+			require.Equal(t, &domain.MFAStatus{}, status)
+		})
+
+		enrollment, err := s.EnrollTOTP(ctx, user)
+		require.NoError(t, err)
+		require.Contains(t, enrollment.URI, "otpauth://totp/")
+		require.NotEmpty(t, enrollment.QRCode)
+
+		secret, err := b32.DecodeString(enrollment.Secret)
+		require.NoError(t, err)
+
+		t.Run("error: wrong code", func(t *testing.T) {
+			_, err := s.ConfirmTOTP(ctx, userID, "000000")
+			require.True(t, errors.Is(err, ErrInvalidCode))
+
+			enabled, err := s.IsEnabled(ctx, userID)
+			require.NoError(t, err)
+			require.False(t, enabled)
+		})
+
+		// confirm with the previous step so we have a fresh one to verify with below
+		step := timeStep(time.Now())
+		codes, err := s.ConfirmTOTP(ctx, userID, hotp(secret, uint64(step-1), totpDigits))
+		require.NoError(t, err)
+		require.Len(t, codes, recoveryCodeCount)
+
+		t.Run("enabled", func(t *testing.T) {
+			enabled, err := s.IsEnabled(ctx, userID)
+			require.NoError(t, err)
+			require.True(t, enabled)
+
+			_, err = s.EnrollTOTP(ctx, user)
+			require.True(t, errors.Is(err, ErrAlreadyEnrolled))
+		})
+
+		t.Run("verify totp, no replay", func(t *testing.T) {
+			code := hotp(secret, uint64(step), totpDigits)
+			err := s.Verify(ctx, userID, code)
+			require.NoError(t, err)
+
+			err = s.Verify(ctx, userID, code)
+			require.True(t, errors.Is(err, ErrInvalidCode))
+		})
+
+		t.Run("recovery codes are single use", func(t *testing.T) {
+			err := s.Verify(ctx, userID, codes[0])
+			require.NoError(t, err)
+
+			err = s.Verify(ctx, userID, codes[0])
+			require.True(t, errors.Is(err, ErrInvalidCode))
+		})
+
+		t.Run("status", func(t *testing.T) {
+			status, err := s.GetStatus(ctx, userID)
+			require.NoError(t, err)
+			require.True(t, status.Enabled)
+			require.NotNil(t, status.ConfirmedAt)
+			require.Equal(t, recoveryCodeCount-1, status.RecoveryCodes)
+		})
+	})
+}
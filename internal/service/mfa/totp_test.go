@@ -0,0 +1,71 @@
+package mfa
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestHOTP(t *testing.T) {
+	// test vectors from RFC 6238 appendix B (SHA1)
+	secret := []byte("12345678901234567890")
+
+	tests := []struct {
+		unix     int64
+		expected string
+	}{
+		{unix: 59, expected: "94287082"},
+		{unix: 1111111109, expected: "07081804"},
+		{unix: 1111111111, expected: "14050471"},
+		{unix: 1234567890, expected: "89005924"},
+		{unix: 2000000000, expected: "69279037"},
+		{unix: 20000000000, expected: "65353130"},
+	}
+
+	for _, tt := range tests {
+		step := timeStep(time.Unix(tt.unix, 0))
+		require.Equal(t, tt.expected, hotp(secret, uint64(step), 8))
+		require.Equal(t, tt.expected[2:], hotp(secret, uint64(step), 6))
+	}
+}
+
+func TestValidateTOTP(t *testing.T) {
+	secret := []byte("12345678901234567890")
+	now := time.Unix(1111111111, 0)
+	step := timeStep(now)
+
+	t.Run("success", func(t *testing.T) {
+		got, ok := validateTOTP(secret, "050471", now, 0)
+		require.True(t, ok)
+		require.Equal(t, step, got)
+	})
+
+	t.Run("allows clock skew", func(t *testing.T) {
+		code := hotp(secret, uint64(step-1), totpDigits)
+		got, ok := validateTOTP(secret, code, now, 0)
+		require.True(t, ok)
+		require.Equal(t, step-1, got)
+	})
+
+	t.Run("rejects codes outside skew", func(t *testing.T) {
+		code := hotp(secret, uint64(step-2), totpDigits)
+		_, ok := validateTOTP(secret, code, now, 0)
+		require.False(t, ok)
+	})
+
+	t.Run("rejects replay", func(t *testing.T) {
+		_, ok := validateTOTP(secret, "050471", now, step)
+		require.False(t, ok)
+	})
+
+	t.Run("rejects wrong length", func(t *testing.T) {
+		_, ok := validateTOTP(secret, "14050471", now, 0)
+		require.False(t, ok)
+	})
+}
+
+func TestOtpauthURI(t *testing.T) {
+	uri := otpauthURI("chuck", "walker@ranger.com", []byte("12345678901234567890"))
+	require.Equal(t, "otpauth://totp/chuck:walker@ranger.com?algorithm=SHA1&digits=6&issuer=chuck&period=30&secret=GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ", uri)
+}
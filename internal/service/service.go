@@ -5,26 +5,63 @@ import (
 	"time"
 
 	"github.com/davemolk/chuck/internal/domain"
+	"github.com/davemolk/chuck/internal/jokeio"
 )
 
 type JokeService interface {
 	GetPersonalizedJoke(ctx context.Context, name string) (*domain.Joke, error)
 	GetRandomJoke(ctx context.Context) (*domain.Joke, error)
-	GetRandomJokeByQuery(ctx context.Context, query string) (*domain.Joke, error)
+	GetRandomJokeByQuery(ctx context.Context, user *domain.User, query string) (*domain.Joke, error)
+	ExportJokes(ctx context.Context, w *jokeio.Writer) error
+	ImportJokes(ctx context.Context, r *jokeio.Reader) (*domain.JokeImport, error)
 }
 
 type TokenService interface {
-	CreateToken(ctx context.Context, userID int64, ttl time.Duration) (*domain.Token, error)
-	ValidateToken(ctx context.Context, token string) (int64, error)
+	CreateToken(ctx context.Context, userID int64, ttl time.Duration, scope string) (*domain.Token, error)
+	ValidateToken(ctx context.Context, token, scope string) (int64, error)
+	ConsumeToken(ctx context.Context, token, scope string) (int64, error)
+	DeleteToken(ctx context.Context, token string) error
+	RevokeTokens(ctx context.Context, userID int64, scope, keep string) error
+	ListTokens(ctx context.Context, userID int64, scope string) ([]*domain.Token, error)
 }
 
 type UserService interface {
 	CreateUser(ctx context.Context, email, password string) (int64, error)
 	GetUserByEmail(ctx context.Context, email string) (*domain.User, error)
 	GetUserByID(ctx context.Context, id int64) (*domain.User, error)
+	UpdatePassword(ctx context.Context, userID int64, password string) error
+	RehashPassword(ctx context.Context, userID int64, password string) error
+	VerifyEmail(ctx context.Context, token string) error
+	ResendVerification(ctx context.Context, userID int64) error
+	GetUserStats(ctx context.Context, userID int64) (*domain.UserStats, error)
+	ExportUser(ctx context.Context, userID int64) (*domain.UserExport, error)
+	UpdateEmail(ctx context.Context, userID int64, email string) error
+	DeleteUser(ctx context.Context, userID int64) error
 }
 
 type AuthService interface {
-	Login(ctx context.Context, email, password string) (*domain.Token, error)
+	Login(ctx context.Context, email, password, ip string) (*domain.Token, error)
+	VerifyMFA(ctx context.Context, challenge, code, ip string) (*domain.Token, error)
 	GetUserIDForToken(ctx context.Context, token string) (*domain.User, error)
+	ChangePassword(ctx context.Context, userID int64, oldPassword, newPassword, currentToken string) error
+	RequestPasswordReset(ctx context.Context, email string) error
+	ResetPassword(ctx context.Context, token, password string) error
+	ChangeEmail(ctx context.Context, userID int64, password, email string) error
+	DeleteAccount(ctx context.Context, userID int64, password string) error
+}
+
+type MFAService interface {
+	EnrollTOTP(ctx context.Context, user *domain.User) (*domain.TOTPEnrollment, error)
+	ConfirmTOTP(ctx context.Context, userID int64, code string) ([]string, error)
+	IsEnabled(ctx context.Context, userID int64) (bool, error)
+	Verify(ctx context.Context, userID int64, code string) error
+	GetStatus(ctx context.Context, userID int64) (*domain.MFAStatus, error)
+}
+
+type UsageService interface {
+	Record(ctx context.Context, user *domain.User, event string) error
+	Refund(ctx context.Context, user *domain.User, event string) error
+	GetUsage(ctx context.Context, user *domain.User, days int) (*domain.Usage, error)
+	Report(ctx context.Context, from, to time.Time) ([]domain.UsageReportRow, error)
+	GetDailyUsage(ctx context.Context, userID int64) ([]domain.DailyUsage, error)
 }
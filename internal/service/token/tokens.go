@@ -4,15 +4,16 @@ import (
 	"context"
 	"crypto/rand"
 	"crypto/sha256"
-	"database/sql"
 	"encoding/base32"
 	"errors"
 	"fmt"
 	"time"
 
 	"github.com/davemolk/chuck/internal/domain"
+	"github.com/davemolk/chuck/internal/metrics"
 	"github.com/davemolk/chuck/internal/service"
-	sqldb "github.com/davemolk/chuck/internal/sql"
+	"github.com/davemolk/chuck/internal/store"
+	"github.com/davemolk/chuck/internal/tracing"
 	"go.uber.org/zap"
 )
 
@@ -22,20 +23,21 @@ var _ service.TokenService = (*Service)(nil)
 
 type Service struct {
 	logger *zap.Logger
-	db     *sqldb.DB
+	tokens store.TokenStore
 }
 
-func NewService(logger *zap.Logger, db *sqldb.DB) *Service {
+func NewService(logger *zap.Logger, tokens store.TokenStore) *Service {
 	return &Service{
 		logger: logger,
-		db:     db,
+		tokens: tokens,
 	}
 }
 
-func (s *Service) generateToken(userID int64, ttl time.Duration) (*domain.Token, error) {
+func (s *Service) generateToken(userID int64, ttl time.Duration, scope string) (*domain.Token, error) {
 	token := &domain.Token{
 		UserID:    userID,
 		ExpiresAt: time.Now().Add(ttl),
+		Scope:     scope,
 	}
 
 	randomBytes := make([]byte, 16)
@@ -53,40 +55,98 @@ func (s *Service) generateToken(userID int64, ttl time.Duration) (*domain.Token,
 	return token, nil
 }
 
-func (s *Service) CreateToken(ctx context.Context, userID int64, ttl time.Duration) (*domain.Token, error) {
-	token, err := s.generateToken(userID, ttl)
+func (s *Service) CreateToken(ctx context.Context, userID int64, ttl time.Duration, scope string) (*domain.Token, error) {
+	ctx, span := tracing.Start(ctx, "token.CreateToken")
+	defer span.End()
+
+	token, err := s.generateToken(userID, ttl, scope)
 	if err != nil {
 		return nil, fmt.Errorf("failed to generate token: %w", err)
 	}
 
-	query := `
-	insert into tokens (hash, user_id, expires_at)
-	values ($1, $2, $3)
-	`
-
-	args := []any{token.Hash, token.UserID, token.ExpiresAt}
-
-	if _, err = s.db.ExecContext(ctx, query, args...); err != nil {
+	if err = s.tokens.CreateToken(ctx, token); err != nil {
 		return nil, fmt.Errorf("failed to insert token: %w", err)
 	}
 
 	return token, nil
 }
 
-func (s *Service) ValidateToken(ctx context.Context, token string) (int64, error) {
+func (s *Service) ValidateToken(ctx context.Context, token, scope string) (int64, error) {
+	ctx, span := tracing.Start(ctx, "token.ValidateToken")
+	defer span.End()
+
 	hash := sha256.Sum256([]byte(token))
 
-	query := `select user_id from tokens where hash = $1 and expires_at > $2`
+	id, err := s.tokens.GetTokenUserID(ctx, hash[:], scope)
+	if err != nil {
+		if errors.Is(err, domain.ErrNotFound) {
+			metrics.ObserveTokenValidation(scope, metrics.TokenInvalid)
+			return 0, ErrInvalidToken
+		}
+		metrics.ObserveTokenValidation(scope, metrics.TokenError)
+		return 0, fmt.Errorf("failed to validate token: %w", err)
+	}
+
+	metrics.ObserveTokenValidation(scope, metrics.TokenValid)
+
+	return id, nil
+}
+
+// ConsumeToken validates a single-use token and deletes it, so of any
+// concurrent calls with the same token only one gets the user id.
+func (s *Service) ConsumeToken(ctx context.Context, token, scope string) (int64, error) {
+	ctx, span := tracing.Start(ctx, "token.ConsumeToken")
+	defer span.End()
 
-	args := []any{hash[:], time.Now()}
+	hash := sha256.Sum256([]byte(token))
 
-	var id int64
-	if err := s.db.QueryRowContext(ctx, query, args...).Scan(&id); err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
+	id, err := s.tokens.ConsumeToken(ctx, hash[:], scope)
+	if err != nil {
+		if errors.Is(err, domain.ErrNotFound) {
+			metrics.ObserveTokenValidation(scope, metrics.TokenInvalid)
 			return 0, ErrInvalidToken
 		}
-		return 0, fmt.Errorf("failed to validate token: %w", err)
+		metrics.ObserveTokenValidation(scope, metrics.TokenError)
+		return 0, fmt.Errorf("failed to consume token: %w", err)
 	}
 
+	metrics.ObserveTokenValidation(scope, metrics.TokenValid)
+
 	return id, nil
 }
+
+// DeleteToken removes a token regardless of scope. Deleting a token that
+// doesn't exist is not an error.
+func (s *Service) DeleteToken(ctx context.Context, token string) error {
+	ctx, span := tracing.Start(ctx, "token.DeleteToken")
+	defer span.End()
+
+	hash := sha256.Sum256([]byte(token))
+
+	return s.tokens.DeleteToken(ctx, hash[:])
+}
+
+// RevokeTokens deletes all of the user's tokens with the given scope, except
+// for keep, which is the plaintext of a token to leave alone. Pass an empty
+// keep to revoke everything.
+func (s *Service) RevokeTokens(ctx context.Context, userID int64, scope, keep string) error {
+	ctx, span := tracing.Start(ctx, "token.RevokeTokens")
+	defer span.End()
+
+	hash := sha256.Sum256([]byte(keep))
+
+	if err := s.tokens.DeleteTokens(ctx, userID, scope, hash[:]); err != nil {
+		return fmt.Errorf("failed to revoke tokens: %w", err)
+	}
+
+	return nil
+}
+
+// ListTokens returns the user's unexpired tokens with the given scope, oldest
+// first. Only the hashes are stored, so the tokens have no plaintext.
+func (s *Service) ListTokens(ctx context.Context, userID int64, scope string) ([]*domain.Token, error) {
+	ctx, span := tracing.Start(ctx, "token.ListTokens")
+	defer span.End()
+
+	return s.tokens.ListTokens(ctx, userID, scope)
+}
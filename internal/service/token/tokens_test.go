@@ -6,29 +6,30 @@ import (
 	"testing"
 	"time"
 
-	"github.com/davemolk/chuck/internal/sql/dbtest"
+	"github.com/davemolk/chuck/internal/domain"
+	"github.com/davemolk/chuck/internal/store"
 	"github.com/davemolk/chuck/internal/tests/fixture"
 	"github.com/stretchr/testify/require"
 )
 
 func TestCreateToken(t *testing.T) {
-	db := dbtest.SetupTestDB(t)
-	s := NewService(fixture.TestLogger(t), db)
+	st := store.NewMemory()
+	s := NewService(fixture.TestLogger(t), st)
 	ctx := context.Background()
 	ttl := 5 * time.Minute
 	t.Run("error: no user", func(t *testing.T) {
-		_, err := s.CreateToken(ctx, 20, ttl)
+		_, err := s.CreateToken(ctx, 20, ttl, domain.ScopeAuthentication)
 		require.Error(t, err)
 	})
 
-	user1ID := fixture.AddUser(t, db, "email1")
-	user2ID := fixture.AddUser(t, db, "email2")
+	user1ID := fixture.AddUser(t, st, "email1")
+	user2ID := fixture.AddUser(t, st, "email2")
 	t.Run("create two tokens", func(t *testing.T) {
 		now := time.Now()
-		token1, err := s.CreateToken(ctx, user1ID, ttl)
+		token1, err := s.CreateToken(ctx, user1ID, ttl, domain.ScopeAuthentication)
 		require.NoError(t, err)
 
-		token2, err := s.CreateToken(ctx, user2ID, ttl)
+		token2, err := s.CreateToken(ctx, user2ID, ttl, domain.ScopeAuthentication)
 		require.NoError(t, err)
 
 		require.NotEqual(t, token1.Plaintext, token2.Plaintext)
@@ -44,33 +45,140 @@ func TestCreateToken(t *testing.T) {
 }
 
 func TestValidateToken(t *testing.T) {
-	db := dbtest.SetupTestDB(t)
-	s := NewService(fixture.TestLogger(t), db)
+	st := store.NewMemory()
+	s := NewService(fixture.TestLogger(t), st)
 	ctx := context.Background()
 	ttl := 5 * time.Minute
 
 	t.Run("error: no user", func(t *testing.T) {
-		_, err := s.ValidateToken(ctx, "foobar")
+		_, err := s.ValidateToken(ctx, "foobar", domain.ScopeAuthentication)
 		require.Error(t, err)
 		require.True(t, errors.Is(err, ErrInvalidToken))
 	})
 
-	user1ID := fixture.AddUser(t, db, "email1")
-	user2ID := fixture.AddUser(t, db, "email2")
-	token1, err := s.CreateToken(ctx, user1ID, ttl)
+	user1ID := fixture.AddUser(t, st, "email1")
+	user2ID := fixture.AddUser(t, st, "email2")
+	token1, err := s.CreateToken(ctx, user1ID, ttl, domain.ScopeAuthentication)
 	require.NoError(t, err)
 
-	token2, err := s.CreateToken(ctx, user2ID, ttl)
+	token2, err := s.CreateToken(ctx, user2ID, ttl, domain.ScopeAuthentication)
 	require.NoError(t, err)
 
 	t.Run("success", func(t *testing.T) {
-		id, err := s.ValidateToken(ctx, token1.Plaintext)
+		id, err := s.ValidateToken(ctx, token1.Plaintext, domain.ScopeAuthentication)
 		require.NoError(t, err)
 		require.Equal(t, user1ID, id)
 
 		// confirm other
-		id2, err := s.ValidateToken(ctx, token2.Plaintext)
+		id2, err := s.ValidateToken(ctx, token2.Plaintext, domain.ScopeAuthentication)
 		require.NoError(t, err)
 		require.Equal(t, user2ID, id2)
 	})
+
+	t.Run("error: wrong scope", func(t *testing.T) {
+		_, err := s.ValidateToken(ctx, token1.Plaintext, domain.ScopeMFA)
+		require.Error(t, err)
+		require.True(t, errors.Is(err, ErrInvalidToken))
+	})
+}
+
+func TestConsumeToken(t *testing.T) {
+	st := store.NewMemory()
+	s := NewService(fixture.TestLogger(t), st)
+	ctx := context.Background()
+
+	userID := fixture.AddUser(t, st, "email1")
+	token, err := s.CreateToken(ctx, userID, 5*time.Minute, domain.ScopePasswordReset)
+	require.NoError(t, err)
+
+	_, err = s.ConsumeToken(ctx, token.Plaintext, domain.ScopeVerification)
+	require.True(t, errors.Is(err, ErrInvalidToken))
+
+	id, err := s.ConsumeToken(ctx, token.Plaintext, domain.ScopePasswordReset)
+	require.NoError(t, err)
+	require.Equal(t, userID, id)
+
+	_, err = s.ConsumeToken(ctx, token.Plaintext, domain.ScopePasswordReset)
+	require.True(t, errors.Is(err, ErrInvalidToken))
+}
+
+func TestDeleteToken(t *testing.T) {
+	st := store.NewMemory()
+	s := NewService(fixture.TestLogger(t), st)
+	ctx := context.Background()
+
+	userID := fixture.AddUser(t, st, "email1")
+	token, err := s.CreateToken(ctx, userID, 5*time.Minute, domain.ScopeMFA)
+	require.NoError(t, err)
+
+	err = s.DeleteToken(ctx, token.Plaintext)
+	require.NoError(t, err)
+
+	_, err = s.ValidateToken(ctx, token.Plaintext, domain.ScopeMFA)
+	require.True(t, errors.Is(err, ErrInvalidToken))
+
+	t.Run("deleting missing token is fine", func(t *testing.T) {
+		err := s.DeleteToken(ctx, token.Plaintext)
+		require.NoError(t, err)
+	})
+}
+
+func TestRevokeTokens(t *testing.T) {
+	st := store.NewMemory()
+	s := NewService(fixture.TestLogger(t), st)
+	ctx := context.Background()
+	ttl := 5 * time.Minute
+
+	userID := fixture.AddUser(t, st, "email1")
+	otherID := fixture.AddUser(t, st, "email2")
+
+	keep, err := s.CreateToken(ctx, userID, ttl, domain.ScopeAuthentication)
+	require.NoError(t, err)
+	revoke, err := s.CreateToken(ctx, userID, ttl, domain.ScopeAuthentication)
+	require.NoError(t, err)
+	otherScope, err := s.CreateToken(ctx, userID, ttl, domain.ScopePasswordReset)
+	require.NoError(t, err)
+	otherUser, err := s.CreateToken(ctx, otherID, ttl, domain.ScopeAuthentication)
+	require.NoError(t, err)
+
+	err = s.RevokeTokens(ctx, userID, domain.ScopeAuthentication, keep.Plaintext)
+	require.NoError(t, err)
+
+	_, err = s.ValidateToken(ctx, keep.Plaintext, domain.ScopeAuthentication)
+	require.NoError(t, err)
+	_, err = s.ValidateToken(ctx, revoke.Plaintext, domain.ScopeAuthentication)
+	require.True(t, errors.Is(err, ErrInvalidToken))
+	_, err = s.ValidateToken(ctx, otherScope.Plaintext, domain.ScopePasswordReset)
+	require.NoError(t, err)
+	_, err = s.ValidateToken(ctx, otherUser.Plaintext, domain.ScopeAuthentication)
+	require.NoError(t, err)
+
+	t.Run("revoke all", func(t *testing.T) {
+		err := s.RevokeTokens(ctx, userID, domain.ScopeAuthentication, "")
+		require.NoError(t, err)
+
+		_, err = s.ValidateToken(ctx, keep.Plaintext, domain.ScopeAuthentication)
+		require.True(t, errors.Is(err, ErrInvalidToken))
+	})
+}
+
+func TestListTokens(t *testing.T) {
+	st := store.NewMemory()
+	s := NewService(fixture.TestLogger(t), st)
+	ctx := context.Background()
+
+	userID := fixture.AddUser(t, st, "email1")
+	first, err := s.CreateToken(ctx, userID, time.Hour, domain.ScopeAuthentication)
+	require.NoError(t, err)
+	second, err := s.CreateToken(ctx, userID, time.Hour, domain.ScopeAuthentication)
+	require.NoError(t, err)
+	_, err = s.CreateToken(ctx, userID, time.Hour, domain.ScopeVerification)
+	require.NoError(t, err)
+
+	tokens, err := s.ListTokens(ctx, userID, domain.ScopeAuthentication)
+	require.NoError(t, err)
+	require.Len(t, tokens, 2)
+	require.Equal(t, first.Hash, tokens[0].Hash)
+	require.Equal(t, second.Hash, tokens[1].Hash)
+	require.Empty(t, tokens[0].Plaintext)
 }
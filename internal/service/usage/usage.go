@@ -0,0 +1,305 @@
+package usage
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/davemolk/chuck/internal/domain"
+	"github.com/davemolk/chuck/internal/service"
+	sqldb "github.com/davemolk/chuck/internal/sql"
+	"github.com/davemolk/chuck/internal/tracing"
+	"go.uber.org/zap"
+)
+
+const (
+	// DefaultPlan is used for users whose plan isn't configured.
+	DefaultPlan = "free"
+	// maxHistoryDays caps how far back GetUsage and Report will look.
+	maxHistoryDays = 366
+)
+
+var ErrQuotaExceeded = errors.New("daily quota exceeded")
+
+// QuotaExceededError is returned by Record once a user has used up their
+// plan's quota for an event.
+type QuotaExceededError struct {
+	Event   string
+	Limit   int
+	ResetAt time.Time
+}
+
+func (e *QuotaExceededError) Error() string {
+	return fmt.Sprintf("%s, your plan allows %d %s requests per day", ErrQuotaExceeded, e.Limit, e.Event)
+}
+
+func (e *QuotaExceededError) Unwrap() error {
+	return ErrQuotaExceeded
+}
+
+// Plan holds daily quotas by event. Events without a quota are only counted.
+type Plan struct {
+	Quotas map[string]int
+}
+
+// DefaultPlans only limit search, the one event that can end in a call to the
+// chuck norris api.
+var DefaultPlans = map[string]Plan{
+	"free": {Quotas: map[string]int{domain.EventSearch: 50}},
+	"pro":  {Quotas: map[string]int{domain.EventSearch: 1000}},
+}
+
+var _ service.UsageService = (*Service)(nil)
+
+type Service struct {
+	logger *zap.Logger
+	db     *sqldb.DB
+	plans  map[string]Plan
+	now    func() time.Time
+}
+
+func NewService(logger *zap.Logger, db *sqldb.DB, plans map[string]Plan) *Service {
+	return &Service{
+		logger: logger,
+		db:     db,
+		plans:  plans,
+		now:    time.Now,
+	}
+}
+
+func (s *Service) plan(name string) Plan {
+	if p, ok := s.plans[name]; ok {
+		return p
+	}
+	s.logger.Warn("unknown plan, using default", zap.String("plan", name))
+	return s.plans[DefaultPlan]
+}
+
+// Record counts an event for the user, returning a *QuotaExceededError
+// instead if the user's plan doesn't allow any more today. Days are utc.
+func (s *Service) Record(ctx context.Context, user *domain.User, event string) error {
+	ctx, span := tracing.Start(ctx, "usage.Record")
+	defer span.End()
+
+	now := s.now().UTC()
+	day := now.Format(time.DateOnly)
+
+	// a nil limit means no quota
+	var limit *int
+	if l, ok := s.plan(user.Plan).Quotas[event]; ok {
+		if l <= 0 {
+			return &QuotaExceededError{Event: event, Limit: l, ResetAt: nextDay(now)}
+		}
+		limit = &l
+	}
+
+	// the count is only bumped while under the limit, so when the quota is
+	// used up the update is skipped and there's nothing to return
+	query := `
+		insert into usage_daily (user_id, day, event, count)
+		values ($1, $2, $3, 1)
+		on conflict (user_id, day, event) do update
+		set count = usage_daily.count + 1
+		where cast($4 as bigint) is null or usage_daily.count < $4
+		returning count`
+
+	var count int
+	err := s.db.QueryRowContext(ctx, query, user.ID, day, event, limit).Scan(&count)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			s.logger.Debug("quota exceeded", zap.Int64("user_id", user.ID), zap.String("event", event))
+			return &QuotaExceededError{Event: event, Limit: *limit, ResetAt: nextDay(now)}
+		}
+		return fmt.Errorf("failed to record usage: %w", err)
+	}
+
+	return nil
+}
+
+// Refund takes back an event Record counted today, e.g. when the work it
+// paid for failed. It never takes the count below zero.
+func (s *Service) Refund(ctx context.Context, user *domain.User, event string) error {
+	ctx, span := tracing.Start(ctx, "usage.Refund")
+	defer span.End()
+
+	day := s.now().UTC().Format(time.DateOnly)
+
+	query := `
+		update usage_daily
+		set count = count - 1
+		where user_id = $1 and day = $2 and event = $3 and count > 0`
+
+	if _, err := s.db.ExecContext(ctx, query, user.ID, day, event); err != nil {
+		return fmt.Errorf("failed to refund usage: %w", err)
+	}
+
+	return nil
+}
+
+// GetUsage returns today's counts against the user's quotas along with the
+// daily counts for the past days, most recent first.
+func (s *Service) GetUsage(ctx context.Context, user *domain.User, days int) (*domain.Usage, error) {
+	ctx, span := tracing.Start(ctx, "usage.GetUsage")
+	defer span.End()
+
+	days = min(max(days, 1), maxHistoryDays)
+
+	now := s.now().UTC()
+	today := now.Format(time.DateOnly)
+	from := now.AddDate(0, 0, -(days - 1)).Format(time.DateOnly)
+
+	query := `
+		select day, event, count
+		from usage_daily
+		where user_id = $1 and day >= $2
+		order by day desc, event`
+
+	rows, err := s.db.QueryContext(ctx, query, user.ID, from)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get usage: %w", err)
+	}
+
+	defer func() { _ = rows.Close() }()
+
+	plan := s.plan(user.Plan)
+	usage := &domain.Usage{
+		Plan:    user.Plan,
+		ResetAt: nextDay(now),
+		Today:   []domain.EventUsage{},
+		History: []domain.DailyUsage{},
+	}
+
+	counted := make(map[string]bool)
+	for rows.Next() {
+		d, err := scanDailyUsage(rows)
+		if err != nil {
+			return nil, err
+		}
+		usage.History = append(usage.History, d)
+
+		if d.Day == today {
+			counted[d.Event] = true
+			usage.Today = append(usage.Today, eventUsage(d.Event, d.Count, plan))
+		}
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to get usage: %w", err)
+	}
+
+	// limited events show up even before they're used
+	for event := range plan.Quotas {
+		if !counted[event] {
+			usage.Today = append(usage.Today, eventUsage(event, 0, plan))
+		}
+	}
+
+	return usage, nil
+}
+
+// GetDailyUsage returns every daily count the user has, oldest first.
+func (s *Service) GetDailyUsage(ctx context.Context, userID int64) ([]domain.DailyUsage, error) {
+	ctx, span := tracing.Start(ctx, "usage.GetDailyUsage")
+	defer span.End()
+
+	query := `
+		select day, event, count
+		from usage_daily
+		where user_id = $1
+		order by day, event`
+
+	rows, err := s.db.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get usage: %w", err)
+	}
+
+	defer func() { _ = rows.Close() }()
+
+	usage := []domain.DailyUsage{}
+	for rows.Next() {
+		d, err := scanDailyUsage(rows)
+		if err != nil {
+			return nil, err
+		}
+		usage = append(usage, d)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to get usage: %w", err)
+	}
+
+	return usage, nil
+}
+
+// Report totals usage per user and event between from and to, inclusive.
+func (s *Service) Report(ctx context.Context, from, to time.Time) ([]domain.UsageReportRow, error) {
+	ctx, span := tracing.Start(ctx, "usage.Report")
+	defer span.End()
+
+	if to.Before(from) {
+		return nil, errors.New("report can't end before it starts")
+	}
+	if to.Sub(from) >= maxHistoryDays*24*time.Hour {
+		return nil, fmt.Errorf("report can't cover more than %d days", maxHistoryDays)
+	}
+
+	query := `
+		select u.id, u.email, u.plan, d.event, sum(d.count)
+		from usage_daily d
+		join users u on u.id = d.user_id
+		where d.day between $1 and $2
+		group by u.id, u.email, u.plan, d.event
+		order by u.id, d.event`
+
+	rows, err := s.db.QueryContext(ctx, query, from.Format(time.DateOnly), to.Format(time.DateOnly))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get usage report: %w", err)
+	}
+
+	defer func() { _ = rows.Close() }()
+
+	report := []domain.UsageReportRow{}
+	for rows.Next() {
+		var row domain.UsageReportRow
+		if err = rows.Scan(&row.UserID, &row.Email, &row.Plan, &row.Event, &row.Count); err != nil {
+			return nil, fmt.Errorf("failed to scan usage report: %w", err)
+		}
+		report = append(report, row)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to get usage report: %w", err)
+	}
+
+	return report, nil
+}
+
+// scanDailyUsage reads a day, event and count. The day comes back as a
+// time.Time from both postgres and sqlite, it's formatted here rather than in
+// sql since they don't share a function for it.
+func scanDailyUsage(rows *sqldb.Rows) (domain.DailyUsage, error) {
+	var d domain.DailyUsage
+	var day time.Time
+	if err := rows.Scan(&day, &d.Event, &d.Count); err != nil {
+		return d, fmt.Errorf("failed to scan usage: %w", err)
+	}
+	d.Day = day.Format(time.DateOnly)
+	return d, nil
+}
+
+func eventUsage(event string, count int, plan Plan) domain.EventUsage {
+	u := domain.EventUsage{Event: event, Count: count}
+	if limit, ok := plan.Quotas[event]; ok {
+		remaining := max(limit-count, 0)
+		u.Limit = &limit
+		u.Remaining = &remaining
+	}
+	return u
+}
+
+func nextDay(t time.Time) time.Time {
+	y, m, d := t.UTC().Date()
+	return time.Date(y, m, d+1, 0, 0, 0, 0, time.UTC)
+}
@@ -0,0 +1,108 @@
+package usage
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/davemolk/chuck/internal/domain"
+	sqldb "github.com/davemolk/chuck/internal/sql"
+	"github.com/davemolk/chuck/internal/sql/dbtest"
+	"github.com/davemolk/chuck/internal/store"
+	"github.com/davemolk/chuck/internal/tests/fixture"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRecord(t *testing.T) {
+	dbtest.Run(t, func(t *testing.T, db *sqldb.DB) {
+		ctx := context.Background()
+
+		s := NewService(fixture.TestLogger(t), db, map[string]Plan{
+			"free": {Quotas: map[string]int{domain.EventSearch: 2}},
+		})
+		now := time.Date(2025, 3, 10, 23, 30, 0, 0, time.UTC)
+		s.now = func() time.Time { return now }
+
+		user := &domain.User{ID: fixture.AddUser(t, store.New(db), "chuck@norris.com"), Plan: "free"}
+		other := &domain.User{ID: fixture.AddUser(t, store.New(db), "walker@texas.com"), Plan: "enterprise"}
+
+		for range 2 {
+			require.NoError(t, s.Record(ctx, user, domain.EventSearch))
+		}
+
+		err := s.Record(ctx, user, domain.EventSearch)
+		var quotaErr *QuotaExceededError
+		require.True(t, errors.As(err, &quotaErr))
+		require.True(t, errors.Is(err, ErrQuotaExceeded))
+		require.Equal(t, 2, quotaErr.Limit)
+		require.Equal(t, time.Date(2025, 3, 11, 0, 0, 0, 0, time.UTC), quotaErr.ResetAt)
+
+		t.Run("refund", func(t *testing.T) {
+			require.NoError(t, s.Refund(ctx, user, domain.EventSearch))
+			require.NoError(t, s.Record(ctx, user, domain.EventSearch))
+			require.True(t, errors.Is(s.Record(ctx, user, domain.EventSearch), ErrQuotaExceeded))
+
+			// nothing to refund
+			require.NoError(t, s.Refund(ctx, user, domain.EventPersonalizedJoke))
+		})
+
+		t.Run("events without a quota are only counted", func(t *testing.T) {
+			for range 5 {
+				require.NoError(t, s.Record(ctx, user, domain.EventRandomJoke))
+			}
+		})
+
+		t.Run("unknown plans get the default plan", func(t *testing.T) {
+			for range 2 {
+				require.NoError(t, s.Record(ctx, other, domain.EventSearch))
+			}
+			require.True(t, errors.Is(s.Record(ctx, other, domain.EventSearch), ErrQuotaExceeded))
+		})
+
+		t.Run("quota resets the next day", func(t *testing.T) {
+			now = now.Add(time.Hour)
+			require.NoError(t, s.Record(ctx, user, domain.EventSearch))
+		})
+
+		t.Run("usage", func(t *testing.T) {
+			usage, err := s.GetUsage(ctx, user, 7)
+			require.NoError(t, err)
+			require.Equal(t, "free", usage.Plan)
+			require.Equal(t, time.Date(2025, 3, 12, 0, 0, 0, 0, time.UTC), usage.ResetAt)
+
+			require.Len(t, usage.Today, 1)
+			require.Equal(t, domain.EventSearch, usage.Today[0].Event)
+			require.Equal(t, 1, usage.Today[0].Count)
+			require.Equal(t, 2, *usage.Today[0].Limit)
+			require.Equal(t, 1, *usage.Today[0].Remaining)
+
+			require.Equal(t, []domain.DailyUsage{
+				{Day: "2025-03-11", Event: domain.EventSearch, Count: 1},
+				{Day: "2025-03-10", Event: domain.EventRandomJoke, Count: 5},
+				{Day: "2025-03-10", Event: domain.EventSearch, Count: 2},
+			}, usage.History)
+		})
+
+		t.Run("daily usage", func(t *testing.T) {
+			usage, err := s.GetDailyUsage(ctx, user.ID)
+			require.NoError(t, err)
+			require.Equal(t, []domain.DailyUsage{
+				{Day: "2025-03-10", Event: domain.EventRandomJoke, Count: 5},
+				{Day: "2025-03-10", Event: domain.EventSearch, Count: 2},
+				{Day: "2025-03-11", Event: domain.EventSearch, Count: 1},
+			}, usage)
+		})
+
+		t.Run("report", func(t *testing.T) {
+			// the report reads plans from the db, where everyone is on free
+			report, err := s.Report(ctx, time.Date(2025, 3, 1, 0, 0, 0, 0, time.UTC), time.Date(2025, 3, 31, 0, 0, 0, 0, time.UTC))
+			require.NoError(t, err)
+			require.Equal(t, []domain.UsageReportRow{
+				{UserID: user.ID, Email: "chuck@norris.com", Plan: "free", Event: domain.EventRandomJoke, Count: 5},
+				{UserID: user.ID, Email: "chuck@norris.com", Plan: "free", Event: domain.EventSearch, Count: 3},
+				{UserID: other.ID, Email: "walker@texas.com", Plan: "free", Event: domain.EventSearch, Count: 2},
+			}, report)
+		})
+	})
+}
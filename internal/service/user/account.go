@@ -0,0 +1,114 @@
+package user
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/davemolk/chuck/internal/domain"
+	"github.com/davemolk/chuck/internal/store"
+	"github.com/davemolk/chuck/internal/tracing"
+	"go.uber.org/zap"
+)
+
+func (s *Service) GetUserStats(ctx context.Context, userID int64) (*domain.UserStats, error) {
+	ctx, span := tracing.Start(ctx, "user.GetUserStats")
+	defer span.End()
+
+	sessions, err := s.tokenService.ListTokens(ctx, userID, domain.ScopeAuthentication)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get user stats: %w", err)
+	}
+
+	mfa, err := s.mfaService.GetStatus(ctx, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get user stats: %w", err)
+	}
+
+	return &domain.UserStats{
+		ActiveSessions:         len(sessions),
+		MFAEnabled:             mfa.Enabled,
+		RecoveryCodesRemaining: mfa.RecoveryCodes,
+	}, nil
+}
+
+// ExportUser gathers everything we store about the user into one document.
+func (s *Service) ExportUser(ctx context.Context, userID int64) (*domain.UserExport, error) {
+	ctx, span := tracing.Start(ctx, "user.ExportUser")
+	defer span.End()
+
+	user, err := s.GetUserByID(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	export := &domain.UserExport{
+		ExportedAt: s.now().UTC(),
+		User:       user,
+		Sessions:   []domain.Session{},
+	}
+
+	tokens, err := s.tokenService.ListTokens(ctx, userID, domain.ScopeAuthentication)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get sessions: %w", err)
+	}
+	for _, t := range tokens {
+		export.Sessions = append(export.Sessions, domain.Session{CreatedAt: t.CreatedAt, ExpiresAt: t.ExpiresAt})
+	}
+
+	mfa, err := s.mfaService.GetStatus(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	export.MFA = *mfa
+
+	if export.Usage, err = s.usageService.GetDailyUsage(ctx, userID); err != nil {
+		return nil, err
+	}
+
+	return export, nil
+}
+
+// UpdateEmail changes the user's email and marks it unverified, sending a
+// verification email to the new address.
+func (s *Service) UpdateEmail(ctx context.Context, userID int64, email string) error {
+	ctx, span := tracing.Start(ctx, "user.UpdateEmail")
+	defer span.End()
+
+	logger := s.logger.With(zap.Int64("user_id", userID))
+
+	err := s.users.UpdateEmail(ctx, userID, email)
+	if errors.Is(err, store.ErrDuplicate) {
+		return ErrDuplicateEmail
+	}
+	if err != nil {
+		return err
+	}
+
+	logger.Info("email updated")
+
+	// links sent to the old address shouldn't verify the new one
+	if err = s.tokenService.RevokeTokens(ctx, userID, domain.ScopeVerification, ""); err != nil {
+		return err
+	}
+
+	if err = s.sendVerification(ctx, userID, email); err != nil {
+		logger.Error("failed to send verification email", zap.Error(err))
+	}
+
+	return nil
+}
+
+// DeleteUser removes the user along with everything that references them.
+func (s *Service) DeleteUser(ctx context.Context, userID int64) error {
+	ctx, span := tracing.Start(ctx, "user.DeleteUser")
+	defer span.End()
+
+	if err := s.users.DeleteUser(ctx, userID); err != nil {
+		return err
+	}
+
+	s.logger.Info("user deleted", zap.Int64("user_id", userID))
+
+	return nil
+}
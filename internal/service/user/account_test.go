@@ -0,0 +1,149 @@
+package user
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/davemolk/chuck/internal/clients/mailer"
+	"github.com/davemolk/chuck/internal/domain"
+	"github.com/davemolk/chuck/internal/service/token"
+	"github.com/davemolk/chuck/internal/store"
+	"github.com/davemolk/chuck/internal/tests/fixture"
+	"github.com/davemolk/chuck/internal/tests/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetUserStats(t *testing.T) {
+	st := store.NewMemory()
+	s := newTestService(t, st, mailer.NewMemory())
+	s.mfaService = &mock.MFAService{
+		GetStatusFn: func(ctx context.Context, userID int64) (*domain.MFAStatus, error) {
+			return &domain.MFAStatus{Enabled: true, RecoveryCodes: 7}, nil
+		},
+	}
+	ctx := context.Background()
+
+	id, err := s.CreateUser(ctx, "chuck@norris.com", "r0undhou5e")
+	require.NoError(t, err)
+
+	tokenService := token.NewService(fixture.TestLogger(t), st)
+	for range 2 {
+		_, err = tokenService.CreateToken(ctx, id, time.Hour, domain.ScopeAuthentication)
+		require.NoError(t, err)
+	}
+	// neither of these is a session
+	_, err = tokenService.CreateToken(ctx, id, -time.Hour, domain.ScopeAuthentication)
+	require.NoError(t, err)
+	_, err = tokenService.CreateToken(ctx, id, time.Hour, domain.ScopeMFA)
+	require.NoError(t, err)
+
+	stats, err := s.GetUserStats(ctx, id)
+	require.NoError(t, err)
+	require.Equal(t, 2, stats.ActiveSessions)
+	require.True(t, stats.MFAEnabled)
+	require.Equal(t, 7, stats.RecoveryCodesRemaining)
+}
+
+func TestExportUser(t *testing.T) {
+	st := store.NewMemory()
+	s := newTestService(t, st, mailer.NewMemory())
+	s.mfaService = &mock.MFAService{
+		GetStatusFn: func(ctx context.Context, userID int64) (*domain.MFAStatus, error) {
+			return &domain.MFAStatus{}, nil
+		},
+	}
+	usage := []domain.DailyUsage{{Day: "2025-03-10", Event: domain.EventSearch, Count: 2}}
+	s.usageService = &mock.UsageService{
+		GetDailyUsageFn: func(ctx context.Context, userID int64) ([]domain.DailyUsage, error) {
+			return usage, nil
+		},
+	}
+	ctx := context.Background()
+
+	t.Run("error: user not exist", func(t *testing.T) {
+		_, err := s.ExportUser(ctx, 1)
+		require.True(t, errors.Is(err, domain.ErrNotFound))
+	})
+
+	id, err := s.CreateUser(ctx, "chuck@norris.com", "r0undhou5e")
+	require.NoError(t, err)
+
+	tokenService := token.NewService(fixture.TestLogger(t), st)
+	session, err := tokenService.CreateToken(ctx, id, time.Hour, domain.ScopeAuthentication)
+	require.NoError(t, err)
+
+	export, err := s.ExportUser(ctx, id)
+	require.NoError(t, err)
+	require.Equal(t, id, export.User.ID)
+	require.Len(t, export.Sessions, 1)
+	require.Equal(t, session.ExpiresAt, export.Sessions[0].ExpiresAt)
+	require.False(t, export.MFA.Enabled)
+	require.Equal(t, usage, export.Usage)
+}
+
+func TestUpdateEmail(t *testing.T) {
+	st := store.NewMemory()
+	mail := mailer.NewMemory()
+	s := newTestService(t, st, mail)
+	ctx := context.Background()
+
+	id, err := s.CreateUser(ctx, "chuck@norris.com", "r0undhou5e")
+	require.NoError(t, err)
+	_, err = s.CreateUser(ctx, "walker@ranger.com", "r0undhou5e")
+	require.NoError(t, err)
+
+	require.NoError(t, st.MarkVerified(ctx, id))
+
+	t.Run("error: duplicate email", func(t *testing.T) {
+		err := s.UpdateEmail(ctx, id, "WALKER@ranger.com")
+		require.True(t, errors.Is(err, ErrDuplicateEmail))
+	})
+
+	t.Run("error: user not exist", func(t *testing.T) {
+		err := s.UpdateEmail(ctx, 1000, "cordell@ranger.com")
+		require.True(t, errors.Is(err, domain.ErrNotFound))
+	})
+
+	t.Run("success", func(t *testing.T) {
+		err := s.UpdateEmail(ctx, id, "cordell@ranger.com")
+		require.NoError(t, err)
+
+		user, err := s.GetUserByID(ctx, id)
+		require.NoError(t, err)
+		require.Equal(t, "cordell@ranger.com", user.Email)
+		require.False(t, user.Verified())
+
+		msg, ok := mail.Last()
+		require.True(t, ok)
+		require.Equal(t, "cordell@ranger.com", msg.To)
+	})
+}
+
+func TestDeleteUser(t *testing.T) {
+	st := store.NewMemory()
+	s := newTestService(t, st, mailer.NewMemory())
+	ctx := context.Background()
+
+	t.Run("error: user not exist", func(t *testing.T) {
+		err := s.DeleteUser(ctx, 1)
+		require.True(t, errors.Is(err, domain.ErrNotFound))
+	})
+
+	id, err := s.CreateUser(ctx, "chuck@norris.com", "r0undhou5e")
+	require.NoError(t, err)
+
+	tokenService := token.NewService(fixture.TestLogger(t), st)
+	session, err := tokenService.CreateToken(ctx, id, time.Hour, domain.ScopeAuthentication)
+	require.NoError(t, err)
+
+	err = s.DeleteUser(ctx, id)
+	require.NoError(t, err)
+
+	_, err = s.GetUserByID(ctx, id)
+	require.True(t, errors.Is(err, domain.ErrNotFound))
+
+	_, err = tokenService.ValidateToken(ctx, session.Plaintext, domain.ScopeAuthentication)
+	require.True(t, errors.Is(err, token.ErrInvalidToken))
+}
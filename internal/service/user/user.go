@@ -2,104 +2,244 @@ package user
 
 import (
 	"context"
-	"database/sql"
 	"errors"
 	"fmt"
+	"time"
 
+	"github.com/davemolk/chuck/internal/clients/mailer"
 	"github.com/davemolk/chuck/internal/domain"
-	sqldb "github.com/davemolk/chuck/internal/sql"
-	"golang.org/x/crypto/bcrypt"
+	"github.com/davemolk/chuck/internal/hasher"
+	"github.com/davemolk/chuck/internal/passpolicy"
+	"github.com/davemolk/chuck/internal/store"
+	"github.com/davemolk/chuck/internal/tracing"
 
 	"github.com/davemolk/chuck/internal/service"
 	"go.uber.org/zap"
 )
 
-var ErrDuplicateEmail = errors.New("duplicate email")
+const (
+	verificationTTL = 24 * time.Hour
+	// resending is limited to one email per resendInterval and at most
+	// maxResendsPerHour in any hour.
+	resendInterval    = time.Minute
+	maxResendsPerHour = 5
+)
+
+var (
+	ErrDuplicateEmail    = errors.New("duplicate email")
+	ErrAlreadyVerified   = errors.New("email already verified")
+	ErrResendRateLimited = errors.New("verification email sent too recently, try again later")
+)
 
 type Service struct {
-	logger *zap.Logger
-	db     *sqldb.DB
+	logger       *zap.Logger
+	users        store.UserStore
+	hasher       *hasher.Hasher
+	policy       *passpolicy.Policy
+	tokenService service.TokenService
+	mfaService   service.MFAService
+	usageService service.UsageService
+	mailer       mailer.Mailer
+	now          func() time.Time
 }
 
 var _ service.UserService = (*Service)(nil)
 
-func NewService(logger *zap.Logger, db *sqldb.DB) *Service {
+func NewService(logger *zap.Logger, users store.UserStore, hasher *hasher.Hasher, policy *passpolicy.Policy, tokenService service.TokenService, mfaService service.MFAService, usageService service.UsageService, mailer mailer.Mailer) *Service {
 	return &Service{
-		logger: logger,
-		db:     db,
+		logger:       logger,
+		users:        users,
+		hasher:       hasher,
+		policy:       policy,
+		tokenService: tokenService,
+		mfaService:   mfaService,
+		usageService: usageService,
+		mailer:       mailer,
+		now:          time.Now,
 	}
 }
 
 func (s *Service) CreateUser(ctx context.Context, email, password string) (int64, error) {
+	ctx, span := tracing.Start(ctx, "user.CreateUser")
+	defer span.End()
+
 	logger := s.logger.With(zap.String("email", email))
 	logger.Info("creating user")
 
-	hash, err := bcrypt.GenerateFromPassword([]byte(password), 12)
+	if err := s.policy.Check(passpolicy.Input{Password: password, Email: email}); err != nil {
+		return 0, err
+	}
+
+	hash, err := s.hasher.Hash(password)
 	if err != nil {
 		return 0, fmt.Errorf("failed to hash: %w", err)
 	}
 
-	args := []any{email, hash}
-
-	query := `
-		insert into users (email, hashed_pw)
-		values ($1, $2)
-		on conflict (email) do nothing
-		returning id`
-
-	var id int64
-	err = s.db.QueryRowContext(ctx, query, args...).Scan(&id)
+	id, err := s.users.CreateUser(ctx, email, hash)
 	if err != nil {
-		// this would happen if the email is already stored, so
-		// we do nothing and consequently can't scan the id
-		if errors.Is(err, sql.ErrNoRows) {
+		if errors.Is(err, store.ErrDuplicate) {
 			logger.Debug("email already exists")
 			return 0, ErrDuplicateEmail
 		}
-		return 0, fmt.Errorf("failed to insert user: %w", err)
+		return 0, err
 	}
 
 	logger.Info("user created")
 
+	// the account exists at this point, so a failed email shouldn't fail the
+	// signup. the user can always ask for another one.
+	if err = s.sendVerification(ctx, id, email); err != nil {
+		logger.Error("failed to send verification email", zap.Error(err))
+	}
+
 	return id, nil
 }
 
 func (s *Service) GetUserByEmail(ctx context.Context, email string) (*domain.User, error) {
-	query := `select id, email, hashed_pw, created_at from users where email = $1`
-
-	var u domain.User
-	err := s.db.QueryRowContext(ctx, query, email).Scan(
-		&u.ID,
-		&u.Email,
-		&u.HashedPW,
-		&u.CreatedAt,
-	)
+	ctx, span := tracing.Start(ctx, "user.GetUserByEmail")
+	defer span.End()
+
+	return s.users.GetUserByEmail(ctx, email)
+}
+
+func (s *Service) GetUserByID(ctx context.Context, id int64) (*domain.User, error) {
+	ctx, span := tracing.Start(ctx, "user.GetUserByID")
+	defer span.End()
+
+	return s.users.GetUserByID(ctx, id)
+}
+
+// UpdatePassword sets a new password chosen by the user, which has to pass
+// the password policy.
+func (s *Service) UpdatePassword(ctx context.Context, userID int64, password string) error {
+	ctx, span := tracing.Start(ctx, "user.UpdatePassword")
+	defer span.End()
+
+	user, err := s.GetUserByID(ctx, userID)
 	if err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			return nil, domain.ErrNotFound
-		}
-		return nil, fmt.Errorf("failed to get user: %w", err)
+		return err
+	}
+
+	if err = s.policy.Check(passpolicy.Input{Password: password, Email: user.Email}); err != nil {
+		return err
 	}
 
-	return &u, nil
+	if err = s.setPassword(ctx, userID, password); err != nil {
+		return err
+	}
+
+	s.logger.Info("password updated", zap.Int64("user_id", userID))
+
+	return nil
 }
 
-func (s *Service) GetUserByID(ctx context.Context, id int64) (*domain.User, error) {
-	query := `select id, email, hashed_pw, created_at from users where id = $1`
-
-	var u domain.User
-	err := s.db.QueryRowContext(ctx, query, id).Scan(
-		&u.ID,
-		&u.Email,
-		&u.HashedPW,
-		&u.CreatedAt,
-	)
+// RehashPassword stores a fresh hash of the user's existing password, moving
+// them to the current hashing params. The policy isn't applied, the user
+// didn't choose anything new.
+func (s *Service) RehashPassword(ctx context.Context, userID int64, password string) error {
+	ctx, span := tracing.Start(ctx, "user.RehashPassword")
+	defer span.End()
+
+	return s.setPassword(ctx, userID, password)
+}
+
+func (s *Service) setPassword(ctx context.Context, userID int64, password string) error {
+	hash, err := s.hasher.Hash(password)
 	if err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			return nil, domain.ErrNotFound
+		return fmt.Errorf("failed to hash: %w", err)
+	}
+
+	return s.users.UpdatePassword(ctx, userID, hash)
+}
+
+// VerifyEmail marks the user's email as verified using a token from their
+// verification email.
+func (s *Service) VerifyEmail(ctx context.Context, token string) error {
+	ctx, span := tracing.Start(ctx, "user.VerifyEmail")
+	defer span.End()
+
+	userID, err := s.tokenService.ValidateToken(ctx, token, domain.ScopeVerification)
+	if err != nil {
+		return err
+	}
+
+	if err = s.users.MarkVerified(ctx, userID); err != nil {
+		return err
+	}
+
+	// any other outstanding verification emails are now pointless
+	if err = s.tokenService.RevokeTokens(ctx, userID, domain.ScopeVerification, ""); err != nil {
+		return err
+	}
+
+	s.logger.Info("email verified", zap.Int64("user_id", userID))
+
+	return nil
+}
+
+// ResendVerification sends a new verification email. Earlier emails stay
+// valid until they expire.
+func (s *Service) ResendVerification(ctx context.Context, userID int64) error {
+	ctx, span := tracing.Start(ctx, "user.ResendVerification")
+	defer span.End()
+
+	user, err := s.GetUserByID(ctx, userID)
+	if err != nil {
+		return err
+	}
+
+	if user.Verified() {
+		return ErrAlreadyVerified
+	}
+
+	// verification tokens outlive the hour, so every email sent in it is
+	// still listed
+	tokens, err := s.tokenService.ListTokens(ctx, userID, domain.ScopeVerification)
+	if err != nil {
+		return fmt.Errorf("failed to check verification emails: %w", err)
+	}
+
+	now := s.now()
+	var sent int
+	var lastSent time.Time
+	for _, t := range tokens {
+		if now.Sub(t.CreatedAt) < time.Hour {
+			sent++
+		}
+		if t.CreatedAt.After(lastSent) {
+			lastSent = t.CreatedAt
 		}
-		return nil, fmt.Errorf("failed to get user: %w", err)
 	}
 
-	return &u, nil
+	if sent >= maxResendsPerHour || now.Sub(lastSent) < resendInterval {
+		s.logger.Debug("verification resend rate limited", zap.Int64("user_id", userID), zap.Int("sent_last_hour", sent))
+		return ErrResendRateLimited
+	}
+
+	return s.sendVerification(ctx, user.ID, user.Email)
+}
+
+func (s *Service) sendVerification(ctx context.Context, userID int64, email string) error {
+	token, err := s.tokenService.CreateToken(ctx, userID, verificationTTL, domain.ScopeVerification)
+	if err != nil {
+		return err
+	}
+
+	msg := mailer.Message{
+		To:      email,
+		Subject: "Verify your chuck email",
+		Body: fmt.Sprintf(
+			"Thanks for signing up! Chuck Norris doesn't need to verify his email, but you do.\n\n"+
+				"Send the token below to POST /api/v1/users/verify to finish setting up your account. "+
+				"It expires in %d hours.\n\n%s\n",
+			int(verificationTTL.Hours()), token.Plaintext),
+	}
+
+	if err = s.mailer.Send(ctx, msg); err != nil {
+		return fmt.Errorf("failed to send verification email: %w", err)
+	}
+
+	s.logger.Info("verification email sent", zap.Int64("user_id", userID))
+
+	return nil
 }
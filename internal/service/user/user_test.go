@@ -3,17 +3,28 @@ package user
 import (
 	"context"
 	"errors"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/davemolk/chuck/internal/clients/mailer"
 	"github.com/davemolk/chuck/internal/domain"
-	"github.com/davemolk/chuck/internal/sql/dbtest"
+	"github.com/davemolk/chuck/internal/passpolicy"
+	"github.com/davemolk/chuck/internal/service/token"
+	"github.com/davemolk/chuck/internal/store"
 	"github.com/davemolk/chuck/internal/tests/fixture"
+	"github.com/davemolk/chuck/internal/tests/mock"
 	"github.com/stretchr/testify/require"
 )
 
+func newTestService(t *testing.T, st store.Store, mail mailer.Mailer) *Service {
+	t.Helper()
+	return NewService(fixture.TestLogger(t), st, fixture.TestHasher(t), passpolicy.New(), token.NewService(fixture.TestLogger(t), st), &mock.MFAService{}, &mock.UsageService{}, mail)
+}
+
 func TestCreateUser(t *testing.T) {
-	db := dbtest.SetupTestDB(t)
-	s := NewService(fixture.TestLogger(t), db)
+	st := store.NewMemory()
+	s := newTestService(t, st, mailer.NewMemory())
 	ctx := context.Background()
 
 	email := "chuck@norris.com"
@@ -32,9 +43,27 @@ func TestCreateUser(t *testing.T) {
 	})
 }
 
+func TestCreateUserPolicy(t *testing.T) {
+	st := store.NewMemory()
+	policy := passpolicy.New(passpolicy.MinScore(3), passpolicy.NoEmail())
+	s := NewService(fixture.TestLogger(t), st, fixture.TestHasher(t), policy, token.NewService(fixture.TestLogger(t), st), &mock.MFAService{}, &mock.UsageService{}, mailer.NewMemory())
+	ctx := context.Background()
+
+	_, err := s.CreateUser(ctx, "walker@ranger.com", "walker123")
+	var perr *passpolicy.Error
+	require.True(t, errors.As(err, &perr))
+	require.Len(t, perr.Reasons, 2)
+
+	_, err = s.GetUserByEmail(ctx, "walker@ranger.com")
+	require.True(t, errors.Is(err, domain.ErrNotFound))
+
+	_, err = s.CreateUser(ctx, "walker@ranger.com", "roundhouse kick to the face")
+	require.NoError(t, err)
+}
+
 func TestGetUserByEmail(t *testing.T) {
-	db := dbtest.SetupTestDB(t)
-	s := NewService(fixture.TestLogger(t), db)
+	st := store.NewMemory()
+	s := newTestService(t, st, mailer.NewMemory())
 	ctx := context.Background()
 
 	email := "chuck@norris.com"
@@ -56,8 +85,8 @@ func TestGetUserByEmail(t *testing.T) {
 }
 
 func TestGetUserByID(t *testing.T) {
-	db := dbtest.SetupTestDB(t)
-	s := NewService(fixture.TestLogger(t), db)
+	st := store.NewMemory()
+	s := newTestService(t, st, mailer.NewMemory())
 	ctx := context.Background()
 
 	t.Run("error: user not exist", func(t *testing.T) {
@@ -83,3 +112,103 @@ func TestGetUserByID(t *testing.T) {
 		require.Equal(t, id2, user2.ID)
 	})
 }
+
+func TestUpdatePassword(t *testing.T) {
+	st := store.NewMemory()
+	s := newTestService(t, st, mailer.NewMemory())
+	ctx := context.Background()
+
+	t.Run("error: user not exist", func(t *testing.T) {
+		err := s.UpdatePassword(ctx, 1, "r0undhou5e")
+		require.True(t, errors.Is(err, domain.ErrNotFound))
+	})
+
+	id, err := s.CreateUser(ctx, "chuck@norris.com", "r0undhou5e")
+	require.NoError(t, err)
+
+	before, err := s.GetUserByID(ctx, id)
+	require.NoError(t, err)
+
+	t.Run("success", func(t *testing.T) {
+		err := s.UpdatePassword(ctx, id, "b34rdp0wer")
+		require.NoError(t, err)
+
+		after, err := s.GetUserByID(ctx, id)
+		require.NoError(t, err)
+		require.NotEqual(t, before.HashedPW, after.HashedPW)
+	})
+}
+
+func TestVerifyEmail(t *testing.T) {
+	st := store.NewMemory()
+	mail := mailer.NewMemory()
+	s := newTestService(t, st, mail)
+	ctx := context.Background()
+
+	id, err := s.CreateUser(ctx, "chuck@norris.com", "r0undhou5e")
+	require.NoError(t, err)
+
+	msg, ok := mail.Last()
+	require.True(t, ok)
+	require.Equal(t, "chuck@norris.com", msg.To)
+
+	user, err := s.GetUserByID(ctx, id)
+	require.NoError(t, err)
+	require.False(t, user.Verified())
+
+	// the token is the last line of the body
+	lines := strings.Split(strings.TrimSpace(msg.Body), "\n")
+	plaintext := lines[len(lines)-1]
+
+	t.Run("error: bad token", func(t *testing.T) {
+		err := s.VerifyEmail(ctx, "foobar")
+		require.True(t, errors.Is(err, token.ErrInvalidToken))
+	})
+
+	t.Run("success", func(t *testing.T) {
+		err := s.VerifyEmail(ctx, plaintext)
+		require.NoError(t, err)
+
+		user, err := s.GetUserByID(ctx, id)
+		require.NoError(t, err)
+		require.True(t, user.Verified())
+	})
+
+	t.Run("error: token is single use", func(t *testing.T) {
+		err := s.VerifyEmail(ctx, plaintext)
+		require.True(t, errors.Is(err, token.ErrInvalidToken))
+	})
+}
+
+func TestResendVerification(t *testing.T) {
+	st := store.NewMemory()
+	mail := mailer.NewMemory()
+	s := newTestService(t, st, mail)
+	ctx := context.Background()
+
+	id, err := s.CreateUser(ctx, "chuck@norris.com", "r0undhou5e")
+	require.NoError(t, err)
+	require.Len(t, mail.Messages(), 1)
+
+	t.Run("error: too soon", func(t *testing.T) {
+		err := s.ResendVerification(ctx, id)
+		require.True(t, errors.Is(err, ErrResendRateLimited))
+		require.Len(t, mail.Messages(), 1)
+	})
+
+	t.Run("success", func(t *testing.T) {
+		// pretend the signup email went out a while ago
+		s.now = func() time.Time { return time.Now().Add(2 * time.Minute) }
+
+		err := s.ResendVerification(ctx, id)
+		require.NoError(t, err)
+		require.Len(t, mail.Messages(), 2)
+	})
+
+	t.Run("error: already verified", func(t *testing.T) {
+		require.NoError(t, st.MarkVerified(ctx, id))
+
+		err := s.ResendVerification(ctx, id)
+		require.True(t, errors.Is(err, ErrAlreadyVerified))
+	})
+}
@@ -3,33 +3,219 @@ package sql
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"fmt"
+	"strings"
+	"sync/atomic"
 	"time"
 
+	"github.com/davemolk/chuck/internal/tracing"
 	_ "github.com/lib/pq"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
+	_ "modernc.org/sqlite"
 )
 
+// Driver is the database behind a DB.
+type Driver string
+
+const (
+	Postgres Driver = "postgres"
+	// SQLite is for running as a single binary, see New.
+	SQLite Driver = "sqlite"
+)
+
+// ParseDriver picks the driver from a database url's scheme, postgres:// or
+// postgresql:// for postgres and sqlite:// for sqlite.
+func ParseDriver(dbURL string) (Driver, error) {
+	scheme, _, ok := strings.Cut(dbURL, "://")
+	if !ok {
+		return "", errors.New("database url has no scheme, want postgres:// or sqlite://")
+	}
+
+	switch strings.ToLower(scheme) {
+	case "postgres", "postgresql":
+		return Postgres, nil
+	case "sqlite":
+		return SQLite, nil
+	default:
+		return "", fmt.Errorf("unknown database url scheme %q, want postgres:// or sqlite://", scheme)
+	}
+}
+
+// sqliteDSN turns sqlite://path into what the driver wants. Everything after
+// the scheme is the file, so sqlite://chuck.db is relative to the working
+// directory and sqlite:///var/lib/chuck/chuck.db is absolute.
+//
+// Foreign keys are off in sqlite unless asked for, and the cascades rely on
+// them. Transactions take the write lock when they begin rather than on
+// their first write, so two of them can't both read a row and then fail to
+// upgrade, which is what select ... for update prevents in postgres. The
+// busy timeout has writers queue for the lock rather than fail.
+func sqliteDSN(dbURL string) (string, error) {
+	_, path, _ := strings.Cut(dbURL, "://")
+	if path == "" {
+		return "", errors.New("sqlite url needs a file, e.g. sqlite://chuck.db")
+	}
+	if strings.Contains(path, "?") {
+		return "", errors.New("sqlite url takes no options, just a file")
+	}
+
+	return "file:" + path +
+		"?_pragma=foreign_keys(1)" +
+		"&_pragma=busy_timeout(5000)" +
+		"&_pragma=journal_mode(WAL)" +
+		"&_txlock=immediate" +
+		"&_time_format=sqlite", nil
+}
+
+// DB is the primary pool, plus any replica pools that the Read methods can
+// send selects to. Everything else goes to the primary.
 type DB struct {
 	logger *zap.Logger
+	driver Driver
+	// dsn is what sql.Open got, see Separate
+	dsn string
 	*sql.DB
+
+	replicas []*replica
+	// next is where the Read methods start looking for a healthy replica
+	next atomic.Uint64
+
+	queryTimeout time.Duration
+	slowQuery    time.Duration
+	requestID    func(context.Context) string
+}
+
+// PoolConfig sizes the connection pools, and bounds and logs the queries run
+// on them.
+type PoolConfig struct {
+	MaxOpenConns    int
+	MaxIdleConns    int
+	ConnMaxIdleTime time.Duration
+	// ConnMaxLifetime closes connections this old, so they get spread over
+	// new replicas and pick up dns changes. Zero keeps them forever.
+	ConnMaxLifetime time.Duration
+	// QueryTimeout bounds queries whose context has no deadline, see
+	// NoQueryTimeout. Zero leaves them unbounded.
+	QueryTimeout time.Duration
+	// SlowQuery is how long a query can take before it's logged. Zero logs
+	// none.
+	SlowQuery time.Duration
+	// RequestID labels slow query logs with the request the query ran for.
+	RequestID func(context.Context) string
+}
+
+var DefaultPoolConfig = PoolConfig{
+	MaxOpenConns:    25,
+	MaxIdleConns:    25,
+	ConnMaxIdleTime: 10 * time.Minute,
+	ConnMaxLifetime: time.Hour,
+	QueryTimeout:    30 * time.Second,
+	SlowQuery:       500 * time.Millisecond,
+}
+
+// New opens the database the url's scheme names, see ParseDriver, and a pool
+// for each replica url. Replicas are only for postgres. They're assumed
+// healthy until a check says otherwise, see WatchReplicas.
+func New(logger *zap.Logger, dbURL string, replicaURLs []string, pool PoolConfig) (*DB, error) {
+	driver, err := ParseDriver(dbURL)
+	if err != nil {
+		return nil, err
+	}
+
+	dsn := dbURL
+	if driver == SQLite {
+		if len(replicaURLs) > 0 {
+			return nil, errors.New("sqlite can't have replicas")
+		}
+		if dsn, err = sqliteDSN(dbURL); err != nil {
+			return nil, err
+		}
+	}
+
+	sqlDB, err := open(driver, dsn, pool)
+	if err != nil {
+		return nil, err
+	}
+
+	db := &DB{
+		logger:       logger,
+		driver:       driver,
+		dsn:          dsn,
+		DB:           sqlDB,
+		queryTimeout: pool.QueryTimeout,
+		slowQuery:    pool.SlowQuery,
+		requestID:    pool.RequestID,
+	}
+
+	for i, replicaURL := range replicaURLs {
+		name := replicaName(replicaURL, i)
+
+		if d, err := ParseDriver(replicaURL); err != nil || d != Postgres {
+			_ = db.Close()
+			return nil, fmt.Errorf("replica %s: must be a postgres:// url", name)
+		}
+
+		replicaDB, err := open(Postgres, replicaURL, pool)
+		if err != nil {
+			_ = db.Close()
+			return nil, fmt.Errorf("replica %s: %w", name, err)
+		}
+
+		db.replicas = append(db.replicas, newReplica(name, replicaDB))
+	}
+
+	return db, nil
 }
 
-func New(logger *zap.Logger, dbURL string) (*DB, error) {
-	sqlDB, err := sql.Open("postgres", dbURL)
+func open(driver Driver, dsn string, pool PoolConfig) (*sql.DB, error) {
+	sqlDB, err := sql.Open(string(driver), dsn)
 	if err != nil {
 		return nil, fmt.Errorf("failed to open db: %w", err)
 	}
 
-	// Note, with more time, would expose these to caller for more control
-	sqlDB.SetMaxOpenConns(25)
-	sqlDB.SetMaxIdleConns(25)
-	sqlDB.SetConnMaxIdleTime(10 * time.Minute)
+	sqlDB.SetMaxOpenConns(pool.MaxOpenConns)
+	sqlDB.SetMaxIdleConns(pool.MaxIdleConns)
+	sqlDB.SetConnMaxIdleTime(pool.ConnMaxIdleTime)
+	sqlDB.SetConnMaxLifetime(pool.ConnMaxLifetime)
 
-	return &DB{
-		logger: logger,
-		DB:     sqlDB,
-	}, nil
+	return sqlDB, nil
+}
+
+func (db *DB) Driver() Driver {
+	return db.driver
+}
+
+// Separate opens another pool on the same database, for code that closes the
+// *sql.DB it's handed when it's done.
+func (db *DB) Separate() (*sql.DB, error) {
+	sqlDB, err := sql.Open(string(db.driver), db.dsn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open db: %w", err)
+	}
+	return sqlDB, nil
+}
+
+// ForUpdate ends a select that locks the rows it reads until the transaction
+// is done. sqlite has no row locks and doesn't need them, its transactions
+// hold the write lock from the start, see sqliteDSN.
+func (db *DB) ForUpdate() string {
+	if db.driver == SQLite {
+		return ""
+	}
+	return " for update"
+}
+
+// SkipLocked ends a select in a statement that claims rows, so rows another
+// claim has locked are passed over rather than waited for. sqlite only has
+// one writer at a time, so there's nothing to skip.
+func (db *DB) SkipLocked() string {
+	if db.driver == SQLite {
+		return ""
+	}
+	return " for update skip locked"
 }
 
 func (db *DB) Ping(ctx context.Context) error {
@@ -43,35 +229,96 @@ func (db *DB) Ping(ctx context.Context) error {
 
 func (db *DB) Close() error {
 	db.logger.Info("closing database")
-	return db.DB.Close()
+
+	errs := []error{db.DB.Close()}
+	for _, r := range db.replicas {
+		errs = append(errs, r.db.Close())
+	}
+
+	return errors.Join(errs...)
 }
 
-// note: while it's true we only have one insert statement for mvp on this
-// project, this is helpful to have.
-func (db *DB) RunInTx(ctx context.Context, fn func(*sql.Tx) error) error {
-	tx, err := db.BeginTx(ctx, nil)
-	if err != nil {
-		return fmt.Errorf("failed to begin tx: %w", err)
+// QueryContext, QueryRowContext and ExecContext shadow the *sql.DB methods
+// to trace each query, give it the default timeout and log it when it's
+// slow. The timeout ends with the query, or for rows when they're closed
+// and for a row when it's scanned. Queries run on a *sql.Tx aren't traced
+// individually, they're covered by the RunInTx span. They always run on the
+// primary, and anything but a select counts as a write for ReadYourWrites.
+// Called with a ctx from a RunInTx callback, they run in that transaction,
+// so store methods can be part of one.
+
+func (db *DB) QueryContext(ctx context.Context, query string, args ...any) (*Rows, error) {
+	ctx, span := db.startQuery(ctx, "db.query", query, primaryPool)
+	defer span.End()
+
+	if !isSelect(query) {
+		markWrite(ctx)
 	}
 
-	defer func() {
-		if r := recover(); r != nil {
-			// rollback and panic again
-			_ = tx.Rollback()
-			panic(r)
-		} else if err != nil {
-			// just rollback
-			_ = tx.Rollback()
-		}
-	}()
+	// the rows are read with ctx after this returns, so the timeout ends
+	// when they're closed
+	ctx, cancel := db.withTimeout(ctx)
+	defer db.logSlow(ctx, query, primaryPool, time.Now())
 
-	if err = fn(tx); err != nil {
-		return err
+	rows, err := db.primary(ctx).QueryContext(ctx, query, args...)
+	tracing.RecordError(span, err)
+	if err != nil {
+		cancel()
+		return nil, err
 	}
 
-	if err = tx.Commit(); err != nil {
-		return fmt.Errorf("failed to commit tx: %w", err)
+	return &Rows{Rows: rows, cancel: cancel}, nil
+}
+
+func (db *DB) QueryRowContext(ctx context.Context, query string, args ...any) *Row {
+	ctx, span := db.startQuery(ctx, "db.query_row", query, primaryPool)
+	defer span.End()
+
+	if !isSelect(query) {
+		markWrite(ctx)
 	}
 
-	return nil
+	// see QueryContext, Scan reads with ctx too
+	ctx, cancel := db.withTimeout(ctx)
+	defer db.logSlow(ctx, query, primaryPool, time.Now())
+
+	// a missing row only shows up at Scan, so it doesn't count as an error here
+	row := db.primary(ctx).QueryRowContext(ctx, query, args...)
+	tracing.RecordError(span, row.Err())
+
+	return &Row{Row: row, cancel: cancel}
+}
+
+func (db *DB) ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error) {
+	ctx, span := db.startQuery(ctx, "db.exec", query, primaryPool)
+	defer span.End()
+
+	markWrite(ctx)
+
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+	defer db.logSlow(ctx, query, primaryPool, time.Now())
+
+	res, err := db.primary(ctx).ExecContext(ctx, query, args...)
+	tracing.RecordError(span, err)
+
+	return res, err
+}
+
+// startQuery records the statement but never the args, which can hold
+// password hashes and tokens.
+func (db *DB) startQuery(ctx context.Context, name, query, pool string) (context.Context, trace.Span) {
+	return tracing.Start(ctx, name,
+		db.system(),
+		attribute.String("db.statement", query),
+		attribute.String("db.pool", pool),
+	)
+}
+
+// system is the opentelemetry name for the database.
+func (db *DB) system() attribute.KeyValue {
+	if db.driver == SQLite {
+		return attribute.String("db.system", "sqlite")
+	}
+	return attribute.String("db.system", "postgresql")
 }
@@ -2,16 +2,12 @@ package dbtest
 
 import (
 	"context"
-	"errors"
-	"fmt"
+	"path/filepath"
 	"testing"
 
 	"github.com/davemolk/chuck/internal/sql"
 
 	"github.com/davemolk/chuck/internal/migrations"
-	"github.com/golang-migrate/migrate/v4"
-	"github.com/golang-migrate/migrate/v4/database/postgres"
-	"github.com/golang-migrate/migrate/v4/source/iofs"
 	"github.com/stretchr/testify/require"
 	postgresTest "github.com/testcontainers/testcontainers-go/modules/postgres"
 	"go.uber.org/zap"
@@ -38,42 +34,56 @@ func SetupTestDB(t *testing.T) *sql.DB {
 	dbURL, err := pgContainer.ConnectionString(ctx, "sslmode=disable")
 	require.NoError(t, err)
 
-	database, err := sql.New(zap.Must(zap.NewDevelopment()), dbURL)
+	return open(t, dbURL)
+}
+
+// SetupSQLite is a migrated sqlite database in a temp dir. It doesn't need
+// docker.
+func SetupSQLite(t *testing.T) *sql.DB {
+	t.Helper()
+	return open(t, "sqlite://"+filepath.Join(t.TempDir(), "chuck.db"))
+}
+
+// Run runs the test against each database, as subtests named for the
+// driver.
+func Run(t *testing.T, test func(t *testing.T, db *sql.DB)) {
+	t.Helper()
+
+	t.Run("postgres", func(t *testing.T) {
+		test(t, SetupTestDB(t))
+	})
+	t.Run("sqlite", func(t *testing.T) {
+		test(t, SetupSQLite(t))
+	})
+}
+
+func open(t *testing.T, dbURL string) *sql.DB {
+	t.Helper()
+	ctx := context.Background()
+
+	database, err := sql.New(zap.Must(zap.NewDevelopment()), dbURL, nil, sql.DefaultPoolConfig)
 	require.NoError(t, err)
 
+	t.Cleanup(func() {
+		_ = database.DB.Close()
+	})
+
 	err = database.PingContext(ctx)
 	require.NoError(t, err)
 
-	err = runMigrations(database)
+	err = runMigrations(ctx, database)
 	require.NoError(t, err)
 
 	return database
 }
 
-func runMigrations(db *sql.DB) error {
-	source, err := iofs.New(migrations.MigrationFiles, ".")
-	if err != nil {
-		return fmt.Errorf("failed to get driver from fs: %w", err)
-	}
-
-	driver, err := postgres.WithInstance(db.DB, &postgres.Config{})
+func runMigrations(ctx context.Context, db *sql.DB) error {
+	m, err := migrations.NewMigrator(ctx, zap.NewNop(), db)
 	if err != nil {
-		return fmt.Errorf("failed to get db driver for migration: %w", err)
-	}
-
-	m, err := migrate.NewWithInstance(
-		"iofs",
-		source,
-		"postgres",
-		driver,
-	)
-	if err != nil {
-		return fmt.Errorf("failed to get migrator: %w", err)
-	}
-
-	if err := m.Up(); err != nil && !errors.Is(err, migrate.ErrNoChange) {
-		return fmt.Errorf("migration failed: %w", err)
+		return err
 	}
+	defer m.Close()
 
-	return nil
+	_, err = m.Up()
+	return err
 }
@@ -0,0 +1,164 @@
+package sql
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"time"
+	"unicode"
+
+	"go.uber.org/zap"
+)
+
+type noTimeoutKey struct{}
+
+// NoQueryTimeout has queries run with ctx skip the default timeout, for the
+// ones that are meant to run long, like streaming every joke out.
+func NoQueryTimeout(ctx context.Context) context.Context {
+	return context.WithValue(ctx, noTimeoutKey{}, true)
+}
+
+// withTimeout gives ctx the default query timeout, unless it already has a
+// deadline or opted out with NoQueryTimeout.
+func (db *DB) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if db.queryTimeout <= 0 || ctx.Value(noTimeoutKey{}) != nil {
+		return ctx, func() {}
+	}
+	if _, ok := ctx.Deadline(); ok {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, db.queryTimeout)
+}
+
+// Rows is *sql.Rows from QueryContext or ReadQueryContext. Close also ends
+// the query's timeout, so it doesn't outlive the rows.
+type Rows struct {
+	*sql.Rows
+	cancel context.CancelFunc
+}
+
+func (r *Rows) Close() error {
+	defer r.cancel()
+	return r.Rows.Close()
+}
+
+// Row is *sql.Row from QueryRowContext or ReadQueryRowContext. Scan also
+// ends the query's timeout, the row is done with once it's scanned.
+type Row struct {
+	*sql.Row
+	cancel context.CancelFunc
+}
+
+func (r *Row) Scan(dest ...any) error {
+	defer r.cancel()
+	return r.Row.Scan(dest...)
+}
+
+// logSlow logs the query if it's been running since start for longer than
+// the slow query threshold. It's meant to be deferred.
+func (db *DB) logSlow(ctx context.Context, query, pool string, start time.Time) {
+	duration := time.Since(start)
+	if db.slowQuery <= 0 || duration < db.slowQuery {
+		return
+	}
+
+	var requestID string
+	if db.requestID != nil {
+		requestID = db.requestID(ctx)
+	}
+
+	db.logger.Warn("slow query",
+		zap.String("request_id", requestID),
+		zap.String("fingerprint", fingerprint(query)),
+		zap.String("pool", pool),
+		zap.Duration("duration", duration),
+	)
+}
+
+// fingerprint is query on one line with its literals swapped for ?, so the
+// same statement logs the same way whatever it was run with, and a literal
+// can't leak anything into the logs. Placeholders like $1 are kept.
+func fingerprint(query string) string {
+	var b strings.Builder
+	b.Grow(len(query))
+
+	// prev is the last rune written, to tell 1 from t1 or $1
+	var prev rune
+	write := func(r rune) {
+		b.WriteRune(r)
+		prev = r
+	}
+
+	rs := []rune(query)
+	for i := 0; i < len(rs); i++ {
+		r := rs[i]
+		switch {
+		case unicode.IsSpace(r):
+			for i+1 < len(rs) && unicode.IsSpace(rs[i+1]) {
+				i++
+			}
+			if prev != 0 && i+1 < len(rs) {
+				write(' ')
+			}
+		case r == '\'':
+			// '' inside a string is a quote, not its end
+			for i++; i < len(rs); i++ {
+				if rs[i] == '\'' {
+					if i+1 < len(rs) && rs[i+1] == '\'' {
+						i++
+						continue
+					}
+					break
+				}
+			}
+			write('?')
+		case unicode.IsDigit(r) && !isWordRune(prev) && prev != '$':
+			for i+1 < len(rs) && (unicode.IsDigit(rs[i+1]) || rs[i+1] == '.') {
+				i++
+			}
+			write('?')
+		default:
+			write(unicode.ToLower(r))
+		}
+	}
+
+	return b.String()
+}
+
+func isWordRune(r rune) bool {
+	return r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+// LogStatsEvery logs every pool's connection stats each interval until ctx
+// is done. They're also in the go_sql_* metrics, see metrics.RegisterDB,
+// this is for when nothing scrapes those.
+func (db *DB) LogStatsEvery(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			db.logStats(primaryPool, db.Stats())
+			for _, r := range db.replicas {
+				db.logStats(r.name, r.db.Stats())
+			}
+		}
+	}
+}
+
+func (db *DB) logStats(pool string, stats sql.DBStats) {
+	db.logger.Info("db pool stats",
+		zap.String("pool", pool),
+		zap.Int("open", stats.OpenConnections),
+		zap.Int("in_use", stats.InUse),
+		zap.Int("idle", stats.Idle),
+		zap.Int64("wait_count", stats.WaitCount),
+		zap.Duration("wait_duration", stats.WaitDuration),
+		zap.Int64("max_idle_closed", stats.MaxIdleClosed),
+		zap.Int64("max_idle_time_closed", stats.MaxIdleTimeClosed),
+		zap.Int64("max_lifetime_closed", stats.MaxLifetimeClosed),
+	)
+}
@@ -0,0 +1,136 @@
+package sql
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestQueryTimeout(t *testing.T) {
+	pool := DefaultPoolConfig
+	pool.QueryTimeout = time.Nanosecond
+
+	db, err := New(zap.NewNop(), "sqlite://"+filepath.Join(t.TempDir(), "chuck.db"), nil, pool)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = db.Close() })
+
+	ctx := context.Background()
+
+	_, err = db.ExecContext(ctx, `create table t (n integer)`)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+
+	t.Run("opted out", func(t *testing.T) {
+		_, err := db.ExecContext(NoQueryTimeout(ctx), `create table t (n integer)`)
+		require.NoError(t, err)
+
+		var n int
+		require.NoError(t, db.QueryRowContext(NoQueryTimeout(ctx), `select count(*) from t`).Scan(&n))
+	})
+
+	t.Run("caller's deadline wins", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(ctx, time.Minute)
+		defer cancel()
+
+		err := db.RunInTx(ctx, nil, func(ctx context.Context, tx *sql.Tx) error {
+			_, err := tx.ExecContext(ctx, `insert into t values (1)`)
+			return err
+		})
+		require.NoError(t, err)
+	})
+}
+
+// TestQueryTimeoutEnds checks the default timeout is over once a query is
+// done with, rather than running out later. The slow query log's request id
+// hook gets the query's context, which is how the test sees it.
+func TestQueryTimeoutEnds(t *testing.T) {
+	var queryCtx context.Context
+
+	pool := DefaultPoolConfig
+	pool.SlowQuery = time.Nanosecond
+	pool.RequestID = func(ctx context.Context) string {
+		queryCtx = ctx
+		return ""
+	}
+
+	db, err := New(zap.NewNop(), "sqlite://"+filepath.Join(t.TempDir(), "chuck.db"), nil, pool)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = db.Close() })
+
+	ctx := context.Background()
+
+	for name, query := range map[string]func(ctx context.Context, query string, args ...any) (*Rows, error){
+		"query":      db.QueryContext,
+		"read query": db.ReadQueryContext,
+	} {
+		t.Run(name, func(t *testing.T) {
+			rows, err := query(ctx, `select 1`)
+			require.NoError(t, err)
+			require.NoError(t, queryCtx.Err())
+
+			require.True(t, rows.Next())
+			require.NoError(t, rows.Close())
+			require.ErrorIs(t, queryCtx.Err(), context.Canceled)
+		})
+	}
+
+	for name, queryRow := range map[string]func(ctx context.Context, query string, args ...any) *Row{
+		"query row":      db.QueryRowContext,
+		"read query row": db.ReadQueryRowContext,
+	} {
+		t.Run(name, func(t *testing.T) {
+			row := queryRow(ctx, `select 1`)
+			require.NoError(t, queryCtx.Err())
+
+			var n int
+			require.NoError(t, row.Scan(&n))
+			require.ErrorIs(t, queryCtx.Err(), context.Canceled)
+		})
+	}
+
+	t.Run("failed query", func(t *testing.T) {
+		_, err := db.QueryContext(ctx, `select nope`)
+		require.Error(t, err)
+		require.ErrorIs(t, queryCtx.Err(), context.Canceled)
+	})
+}
+
+func TestSlowQuery(t *testing.T) {
+	core, logs := observer.New(zap.WarnLevel)
+
+	pool := DefaultPoolConfig
+	pool.SlowQuery = time.Nanosecond
+	pool.RequestID = func(ctx context.Context) string { return "abc123" }
+
+	db, err := New(zap.New(core), "sqlite://"+filepath.Join(t.TempDir(), "chuck.db"), nil, pool)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = db.Close() })
+
+	var n int
+	require.NoError(t, db.QueryRowContext(context.Background(), "select 1 +\n\t$1", 2).Scan(&n))
+
+	slow := logs.FilterMessage("slow query").All()
+	require.Len(t, slow, 1)
+	fields := slow[0].ContextMap()
+	require.Equal(t, "abc123", fields["request_id"])
+	require.Equal(t, "select ? + $1", fields["fingerprint"])
+	require.Equal(t, "primary", fields["pool"])
+	require.Contains(t, fields, "duration")
+}
+
+func TestFingerprint(t *testing.T) {
+	for query, want := range map[string]string{
+		"select 1":                       "select ?",
+		"\n\t\tSELECT id\n\t\tFROM t1\n": "select id from t1",
+		"select * from users where email = 'it''s@example.com' and id = $1": "select * from users where email = ? and id = $1",
+		"update t set n = n + 1.5 where id in (1, 2, 3)":                    "update t set n = n + ? where id in (?, ?, ?)",
+		"select col_2 from t where x = -12":                                 "select col_2 from t where x = -?",
+	} {
+		require.Equal(t, want, fingerprint(query), query)
+	}
+}
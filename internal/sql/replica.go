@@ -0,0 +1,225 @@
+package sql
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+	"unicode"
+
+	"github.com/davemolk/chuck/internal/tracing"
+	"go.uber.org/zap"
+)
+
+// primaryPool names the primary in traces, replicas go by their host.
+const primaryPool = "primary"
+
+// replicaPingTimeout bounds each replica's health check, so one that hangs
+// doesn't hold up the others.
+const replicaPingTimeout = 2 * time.Second
+
+// replica is a read-only copy of the primary that selects can go to while it
+// answers pings.
+type replica struct {
+	name    string
+	db      *sql.DB
+	healthy atomic.Bool
+	// checkedAt is unix nanos, zero until the first check
+	checkedAt atomic.Int64
+}
+
+func newReplica(name string, db *sql.DB) *replica {
+	r := &replica{name: name, db: db}
+	r.healthy.Store(true)
+	return r
+}
+
+// replicaName is the replica's host, which is what shows up in logs and
+// traces, so credentials in the url stay out of them.
+func replicaName(replicaURL string, i int) string {
+	u, err := url.Parse(replicaURL)
+	if err != nil || u.Host == "" {
+		return fmt.Sprintf("replica-%d", i)
+	}
+	return u.Host
+}
+
+// ReplicaStatus is how a replica looked at its last health check.
+type ReplicaStatus struct {
+	Name      string    `json:"name"`
+	Healthy   bool      `json:"healthy"`
+	CheckedAt time.Time `json:"checked_at,omitzero"`
+}
+
+// ReplicaStatus lists every replica, in the order they were configured.
+func (db *DB) ReplicaStatus() []ReplicaStatus {
+	status := make([]ReplicaStatus, 0, len(db.replicas))
+	for _, r := range db.replicas {
+		s := ReplicaStatus{Name: r.name, Healthy: r.healthy.Load()}
+		if at := r.checkedAt.Load(); at != 0 {
+			s.CheckedAt = time.Unix(0, at).UTC()
+		}
+		status = append(status, s)
+	}
+	return status
+}
+
+// ReplicaPools are the replicas' pools, keyed by name, for metrics.
+func (db *DB) ReplicaPools() map[string]*sql.DB {
+	pools := make(map[string]*sql.DB, len(db.replicas))
+	for _, r := range db.replicas {
+		pools[r.name] = r.db
+	}
+	return pools
+}
+
+// CheckReplicas pings every replica and marks it healthy or not. Reads stop
+// going to a replica as soon as it fails a check and start again once it
+// passes one.
+func (db *DB) CheckReplicas(ctx context.Context) {
+	for _, r := range db.replicas {
+		pingCtx, cancel := context.WithTimeout(ctx, replicaPingTimeout)
+		err := r.db.PingContext(pingCtx)
+		cancel()
+
+		r.checkedAt.Store(time.Now().UnixNano())
+		wasHealthy := r.healthy.Swap(err == nil)
+
+		switch {
+		case err != nil && wasHealthy:
+			db.logger.Warn("replica is down, reading from the others", zap.String("replica", r.name), zap.Error(err))
+		case err == nil && !wasHealthy:
+			db.logger.Info("replica is back", zap.String("replica", r.name))
+		}
+	}
+}
+
+// WatchReplicas checks the replicas right away and then every interval until
+// ctx is done. It's a no-op without replicas.
+func (db *DB) WatchReplicas(ctx context.Context, interval time.Duration) {
+	if len(db.replicas) == 0 {
+		return
+	}
+
+	db.CheckReplicas(ctx)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			db.CheckReplicas(ctx)
+		}
+	}
+}
+
+// reader picks the pool for a read: the next healthy replica in turn, or the
+// primary when there are none or ctx has already written, see ReadYourWrites.
+// A read in a transaction stays in it, see primary.
+func (db *DB) reader(ctx context.Context) (querier, string) {
+	if state, ok := ctx.Value(txKey{}).(*txState); ok && state.db == db {
+		return state.tx, primaryPool
+	}
+
+	n := uint64(len(db.replicas))
+	if n == 0 || wroteIn(ctx) {
+		return db.DB, primaryPool
+	}
+
+	start := db.next.Add(1)
+	for i := range n {
+		r := db.replicas[(start+i)%n]
+		if r.healthy.Load() {
+			return r.db, r.name
+		}
+	}
+
+	return db.DB, primaryPool
+}
+
+// ReadQueryContext and ReadQueryRowContext are QueryContext and
+// QueryRowContext for selects that can stand to be a little behind, see
+// reader. Replicas are read-only, so these are only for selects.
+
+func (db *DB) ReadQueryContext(ctx context.Context, query string, args ...any) (*Rows, error) {
+	pool, name := db.reader(ctx)
+
+	ctx, span := db.startQuery(ctx, "db.read_query", query, name)
+	defer span.End()
+
+	// see QueryContext
+	ctx, cancel := db.withTimeout(ctx)
+	defer db.logSlow(ctx, query, name, time.Now())
+
+	rows, err := pool.QueryContext(ctx, query, args...)
+	tracing.RecordError(span, err)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	return &Rows{Rows: rows, cancel: cancel}, nil
+}
+
+func (db *DB) ReadQueryRowContext(ctx context.Context, query string, args ...any) *Row {
+	pool, name := db.reader(ctx)
+
+	ctx, span := db.startQuery(ctx, "db.read_query_row", query, name)
+	defer span.End()
+
+	// see QueryRowContext
+	ctx, cancel := db.withTimeout(ctx)
+	defer db.logSlow(ctx, query, name, time.Now())
+
+	row := pool.QueryRowContext(ctx, query, args...)
+	tracing.RecordError(span, row.Err())
+
+	return &Row{Row: row, cancel: cancel}
+}
+
+type writesKey struct{}
+
+// writes is shared by everything using a ReadYourWrites context, so a write
+// deep in a service call sends the handler's later reads to the primary.
+type writes struct {
+	seen atomic.Bool
+}
+
+// ReadYourWrites has the Read methods use the primary for the rest of ctx
+// once anything has written through it, so a request sees its own writes
+// even while the replicas catch up. Without it, reads go to replicas
+// regardless.
+func ReadYourWrites(ctx context.Context) context.Context {
+	if _, ok := ctx.Value(writesKey{}).(*writes); ok {
+		return ctx
+	}
+	return context.WithValue(ctx, writesKey{}, &writes{})
+}
+
+func markWrite(ctx context.Context) {
+	if w, ok := ctx.Value(writesKey{}).(*writes); ok {
+		w.seen.Store(true)
+	}
+}
+
+func wroteIn(ctx context.Context) bool {
+	w, ok := ctx.Value(writesKey{}).(*writes)
+	return ok && w.seen.Load()
+}
+
+// isSelect guesses whether a query only reads. It errs toward calling it a
+// write, e.g. a with ... insert is one, so anything not starting with select
+// counts.
+func isSelect(query string) bool {
+	q := strings.TrimLeftFunc(query, unicode.IsSpace)
+	if len(q) < len("select") || !strings.EqualFold(q[:len("select")], "select") {
+		return false
+	}
+	return len(q) == len("select") || unicode.IsSpace(rune(q[len("select")]))
+}
@@ -0,0 +1,192 @@
+package sql
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"time"
+
+	"github.com/davemolk/chuck/internal/tracing"
+	"github.com/lib/pq"
+	"go.opentelemetry.io/otel/attribute"
+	"go.uber.org/zap"
+)
+
+// maxTxAttempts is how many times RunInTx tries a transaction postgres keeps
+// aborting before it gives up.
+const maxTxAttempts = 5
+
+// txBackoff is roughly the wait before the second attempt, it doubles for
+// each attempt after that. Half of it is random, so transactions that
+// collided once don't collide again in lockstep.
+const txBackoff = 10 * time.Millisecond
+
+type txKey struct{}
+
+// txState is the transaction a RunInTx callback's ctx is in, so RunInTx
+// calls made with it nest rather than begin another.
+type txState struct {
+	db *DB
+	tx *sql.Tx
+	// savepoints is how many have been made, for naming the next one
+	savepoints int
+}
+
+// RunInTx runs fn in a transaction, committing when it returns nil and
+// rolling back otherwise. nil opts is read committed and read write on
+// postgres. sqlite transactions are serializable whatever the isolation, and
+// a read-only one is only spared the write lock, sqlite doesn't stop it
+// writing.
+//
+// Transactions run on the primary, and ones that aren't read-only count as a
+// write for ReadYourWrites. The default query timeout bounds the whole call,
+// retries included.
+//
+// When postgres aborts the transaction over a serialization failure or a
+// deadlock, fn runs again in a new one, up to maxTxAttempts times. So fn has
+// to leave everything but tx as it found it, or at least be fine running
+// twice.
+//
+// fn gets a ctx that's in the transaction. The query methods called with it
+// run on tx, see primary, and RunInTx called with it runs in a savepoint
+// instead, where an error rolls back just the nested call's work
+// and leaves the caller to carry on or not. A nested call can't set opts,
+// and a retry is always of the outermost call.
+func (db *DB) RunInTx(ctx context.Context, opts *sql.TxOptions, fn func(context.Context, *sql.Tx) error) (err error) {
+	if state, ok := ctx.Value(txKey{}).(*txState); ok && state.db == db {
+		if opts != nil {
+			return errors.New("a nested transaction can't set options")
+		}
+		return state.savepoint(ctx, fn)
+	}
+
+	readOnly := opts != nil && opts.ReadOnly
+
+	ctx, span := tracing.Start(ctx, "db.tx", db.system(), attribute.Bool("db.tx.read_only", readOnly))
+	defer func() {
+		tracing.RecordError(span, err)
+		span.End()
+	}()
+
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+
+	if !readOnly {
+		markWrite(ctx)
+	}
+
+	for attempt := 1; ; attempt++ {
+		err = db.runTx(ctx, opts, fn)
+		if err == nil || !isRetryable(err) {
+			span.SetAttributes(attribute.Int("db.tx.attempts", attempt))
+			return err
+		}
+		if attempt == maxTxAttempts {
+			span.SetAttributes(attribute.Int("db.tx.attempts", attempt))
+			return fmt.Errorf("gave up after %d attempts: %w", attempt, err)
+		}
+
+		wait := backoff(attempt)
+		db.logger.Debug("retrying transaction", zap.Int("attempt", attempt), zap.Duration("wait", wait), zap.Error(err))
+
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(wait):
+		}
+	}
+}
+
+func (db *DB) runTx(ctx context.Context, opts *sql.TxOptions, fn func(context.Context, *sql.Tx) error) (err error) {
+	tx, err := db.BeginTx(ctx, opts)
+	if err != nil {
+		return fmt.Errorf("failed to begin tx: %w", err)
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			// rollback and panic again
+			_ = tx.Rollback()
+			panic(r)
+		} else if err != nil {
+			// just rollback
+			_ = tx.Rollback()
+		}
+	}()
+
+	if err = fn(context.WithValue(ctx, txKey{}, &txState{db: db, tx: tx}), tx); err != nil {
+		return err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit tx: %w", err)
+	}
+
+	return nil
+}
+
+// querier is what the query methods run on, the primary pool or a
+// transaction.
+type querier interface {
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+}
+
+// primary is the transaction ctx is in if it's one of db's, otherwise the
+// primary pool. Code that's handed a ctx from RunInTx but not the tx, like a
+// store method, still ends up in the transaction.
+func (db *DB) primary(ctx context.Context) querier {
+	if state, ok := ctx.Value(txKey{}).(*txState); ok && state.db == db {
+		return state.tx
+	}
+	return db.DB
+}
+
+// savepoint runs fn as a nested transaction, see RunInTx.
+func (s *txState) savepoint(ctx context.Context, fn func(context.Context, *sql.Tx) error) (err error) {
+	s.savepoints++
+	name := fmt.Sprintf("sp_%d", s.savepoints)
+
+	ctx, span := tracing.Start(ctx, "db.savepoint", s.db.system())
+	defer func() {
+		tracing.RecordError(span, err)
+		span.End()
+	}()
+
+	if _, err = s.tx.ExecContext(ctx, "savepoint "+name); err != nil {
+		return fmt.Errorf("failed to make savepoint: %w", err)
+	}
+
+	// a panic rolls back the whole transaction, see runTx
+	if err = fn(ctx, s.tx); err != nil {
+		if _, rbErr := s.tx.ExecContext(ctx, "rollback to savepoint "+name); rbErr != nil {
+			return errors.Join(err, fmt.Errorf("failed to roll back to savepoint: %w", rbErr))
+		}
+		return err
+	}
+
+	if _, err = s.tx.ExecContext(ctx, "release savepoint "+name); err != nil {
+		return fmt.Errorf("failed to release savepoint: %w", err)
+	}
+
+	return nil
+}
+
+// isRetryable reports whether postgres aborted a transaction in a way that
+// running it again could fix.
+func isRetryable(err error) bool {
+	var pqErr *pq.Error
+	if !errors.As(err, &pqErr) {
+		return false
+	}
+	return pqErr.Code.Name() == "serialization_failure" || pqErr.Code.Name() == "deadlock_detected"
+}
+
+// backoff is how long to wait after the attempt'th try.
+func backoff(attempt int) time.Duration {
+	d := txBackoff << (attempt - 1)
+	return d/2 + rand.N(d/2)
+}
@@ -0,0 +1,196 @@
+package sql_test
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"sync"
+	"testing"
+
+	sqldb "github.com/davemolk/chuck/internal/sql"
+	"github.com/davemolk/chuck/internal/sql/dbtest"
+	"github.com/lib/pq"
+	"github.com/stretchr/testify/require"
+)
+
+func setupCounter(t *testing.T, db *sqldb.DB) {
+	t.Helper()
+	ctx := context.Background()
+
+	_, err := db.ExecContext(ctx, `create table counter (id integer primary key, n integer not null)`)
+	require.NoError(t, err)
+	_, err = db.ExecContext(ctx, `insert into counter (id, n) values (1, 0)`)
+	require.NoError(t, err)
+}
+
+func counter(t *testing.T, db *sqldb.DB) int {
+	t.Helper()
+	var n int
+	require.NoError(t, db.QueryRowContext(context.Background(), `select n from counter where id = 1`).Scan(&n))
+	return n
+}
+
+func increment(ctx context.Context, tx *sql.Tx) error {
+	_, err := tx.ExecContext(ctx, `update counter set n = n + 1 where id = 1`)
+	return err
+}
+
+func TestRunInTx(t *testing.T) {
+	dbtest.Run(t, func(t *testing.T, db *sqldb.DB) {
+		ctx := context.Background()
+		setupCounter(t, db)
+
+		t.Run("commit and rollback", func(t *testing.T) {
+			require.NoError(t, db.RunInTx(ctx, nil, increment))
+			require.Equal(t, 1, counter(t, db))
+
+			errBoom := errors.New("boom")
+			err := db.RunInTx(ctx, nil, func(ctx context.Context, tx *sql.Tx) error {
+				require.NoError(t, increment(ctx, tx))
+				return errBoom
+			})
+			require.ErrorIs(t, err, errBoom)
+			require.Equal(t, 1, counter(t, db))
+		})
+
+		t.Run("savepoints", func(t *testing.T) {
+			before := counter(t, db)
+			errBoom := errors.New("boom")
+
+			err := db.RunInTx(ctx, nil, func(ctx context.Context, tx *sql.Tx) error {
+				require.NoError(t, increment(ctx, tx))
+
+				// undone on its own, the rest of the transaction carries on
+				err := db.RunInTx(ctx, nil, func(ctx context.Context, tx *sql.Tx) error {
+					require.NoError(t, increment(ctx, tx))
+					return errBoom
+				})
+				require.ErrorIs(t, err, errBoom)
+
+				require.NoError(t, db.RunInTx(ctx, nil, func(ctx context.Context, tx *sql.Tx) error {
+					return db.RunInTx(ctx, nil, increment)
+				}))
+
+				err = db.RunInTx(ctx, &sql.TxOptions{ReadOnly: true}, increment)
+				require.ErrorContains(t, err, "nested transaction can't set options")
+
+				return nil
+			})
+			require.NoError(t, err)
+			require.Equal(t, before+2, counter(t, db))
+		})
+
+		t.Run("query methods join the transaction", func(t *testing.T) {
+			before := counter(t, db)
+
+			err := db.RunInTx(ctx, nil, func(ctx context.Context, tx *sql.Tx) error {
+				_, err := db.ExecContext(ctx, `update counter set n = n + 1 where id = 1`)
+				require.NoError(t, err)
+
+				var n int
+				require.NoError(t, db.ReadQueryRowContext(ctx, `select n from counter where id = 1`).Scan(&n))
+				require.Equal(t, before+1, n)
+
+				return errors.New("boom")
+			})
+			require.Error(t, err)
+			require.Equal(t, before, counter(t, db))
+		})
+
+		t.Run("read only", func(t *testing.T) {
+			var n int
+			err := db.RunInTx(ctx, &sql.TxOptions{ReadOnly: true}, func(ctx context.Context, tx *sql.Tx) error {
+				return tx.QueryRowContext(ctx, `select n from counter where id = 1`).Scan(&n)
+			})
+			require.NoError(t, err)
+			require.Equal(t, counter(t, db), n)
+
+			// sqlite doesn't enforce it
+			if db.Driver() == sqldb.Postgres {
+				err = db.RunInTx(ctx, &sql.TxOptions{ReadOnly: true}, increment)
+				require.ErrorContains(t, err, "read-only transaction")
+			}
+		})
+
+		t.Run("retries", func(t *testing.T) {
+			for _, code := range []pq.ErrorCode{"40001", "40P01"} {
+				attempts := 0
+				err := db.RunInTx(ctx, nil, func(ctx context.Context, tx *sql.Tx) error {
+					attempts++
+					if attempts < 3 {
+						return &pq.Error{Code: code}
+					}
+					return nil
+				})
+				require.NoError(t, err)
+				require.Equal(t, 3, attempts)
+			}
+
+			attempts := 0
+			err := db.RunInTx(ctx, nil, func(ctx context.Context, tx *sql.Tx) error {
+				attempts++
+				return &pq.Error{Code: "40001"}
+			})
+			require.ErrorContains(t, err, "gave up after 5 attempts")
+			require.Equal(t, 5, attempts)
+
+			attempts = 0
+			err = db.RunInTx(ctx, nil, func(ctx context.Context, tx *sql.Tx) error {
+				attempts++
+				return &pq.Error{Code: "23505"}
+			})
+			require.Error(t, err)
+			require.Equal(t, 1, attempts)
+		})
+	})
+}
+
+// TestRunInTxSerializationConflict has two serializable transactions read
+// the counter before either writes it. Whichever updates second is aborted
+// when the first commits, and its retry sees the first's update.
+func TestRunInTxSerializationConflict(t *testing.T) {
+	db := dbtest.SetupTestDB(t)
+	setupCounter(t, db)
+
+	var read sync.WaitGroup
+	read.Add(2)
+
+	var mu sync.Mutex
+	attempts := 0
+
+	var done sync.WaitGroup
+	errs := make([]error, 2)
+	for i := range 2 {
+		done.Add(1)
+		go func() {
+			defer done.Done()
+
+			first := true
+			errs[i] = db.RunInTx(context.Background(), &sql.TxOptions{Isolation: sql.LevelSerializable}, func(ctx context.Context, tx *sql.Tx) error {
+				mu.Lock()
+				attempts++
+				mu.Unlock()
+
+				var n int
+				if err := tx.QueryRowContext(ctx, `select n from counter where id = 1`).Scan(&n); err != nil {
+					return err
+				}
+
+				if first {
+					first = false
+					read.Done()
+					read.Wait()
+				}
+
+				_, err := tx.ExecContext(ctx, `update counter set n = $1 where id = 1`, n+1)
+				return err
+			})
+		}()
+	}
+	done.Wait()
+
+	require.NoError(t, errs[0])
+	require.NoError(t, errs[1])
+	require.Equal(t, 3, attempts)
+	require.Equal(t, 2, counter(t, db))
+}
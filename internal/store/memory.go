@@ -0,0 +1,390 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/davemolk/chuck/internal/domain"
+)
+
+// Memory keeps everything in process and loses it on exit. It's safe for
+// concurrent use. Callers get copies, so changing what comes back doesn't
+// change what's stored.
+type Memory struct {
+	mu  sync.RWMutex
+	now func() time.Time
+
+	jokes        []*domain.Joke // in id order
+	jokesByExtID map[string]*domain.Joke
+	jokesByURL   map[string]*domain.Joke
+	lastJokeID   int64
+	users        map[int64]*domain.User
+	usersByEmail map[string]*domain.User // keyed by lowercased email
+	lastUserID   int64
+	tokens       map[string]*domain.Token // keyed by hash
+}
+
+var _ Store = (*Memory)(nil)
+
+func NewMemory() *Memory {
+	return &Memory{
+		now:          time.Now,
+		jokesByExtID: make(map[string]*domain.Joke),
+		jokesByURL:   make(map[string]*domain.Joke),
+		users:        make(map[int64]*domain.User),
+		usersByEmail: make(map[string]*domain.User),
+		tokens:       make(map[string]*domain.Token),
+	}
+}
+
+func copyJoke(j *domain.Joke) *domain.Joke {
+	c := *j
+	return &c
+}
+
+func (m *Memory) GetRandomJoke(ctx context.Context) (*domain.Joke, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if len(m.jokes) == 0 {
+		return nil, domain.ErrNotFound
+	}
+	return copyJoke(m.jokes[rand.IntN(len(m.jokes))]), nil
+}
+
+func (m *Memory) SearchJoke(ctx context.Context, query string) (*domain.Joke, error) {
+	want := words(query)
+	if len(want) == 0 {
+		return nil, domain.ErrNotFound
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var matches []*domain.Joke
+	for _, j := range m.jokes {
+		have := words(j.Content)
+		if !slices.ContainsFunc(want, func(w string) bool { return !slices.Contains(have, w) }) {
+			matches = append(matches, j)
+		}
+	}
+
+	if len(matches) == 0 {
+		return nil, domain.ErrNotFound
+	}
+	return copyJoke(matches[rand.IntN(len(matches))]), nil
+}
+
+// words splits text the way postgres' simple text search config does, near
+// enough: lowercased runs of letters and digits.
+func words(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+func (m *Memory) SaveJokes(ctx context.Context, jokes []*domain.Joke) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// each save can be undone, so a failure partway through leaves things as
+	// they were, like a rolled back transaction
+	var undos []func()
+	for _, joke := range jokes {
+		undo, err := m.saveJoke(joke)
+		if err != nil {
+			for _, undo := range slices.Backward(undos) {
+				undo()
+			}
+			return err
+		}
+		undos = append(undos, undo)
+	}
+
+	return nil
+}
+
+func (m *Memory) saveJoke(joke *domain.Joke) (func(), error) {
+	if owner, ok := m.jokesByURL[joke.URL]; ok && owner.ExternalID != joke.ExternalID {
+		return nil, fmt.Errorf("failed to save joke %s: url %s: %w", joke.ExternalID, joke.URL, ErrDuplicate)
+	}
+
+	if existing, ok := m.jokesByExtID[joke.ExternalID]; ok {
+		prev := *existing
+		delete(m.jokesByURL, existing.URL)
+		existing.URL = joke.URL
+		existing.Content = joke.Content
+		m.jokesByURL[joke.URL] = existing
+		joke.ID = existing.ID
+
+		return func() {
+			delete(m.jokesByURL, existing.URL)
+			*existing = prev
+			m.jokesByURL[existing.URL] = existing
+		}, nil
+	}
+
+	m.lastJokeID++
+	stored := copyJoke(joke)
+	stored.ID = m.lastJokeID
+	m.jokes = append(m.jokes, stored)
+	m.jokesByExtID[stored.ExternalID] = stored
+	m.jokesByURL[stored.URL] = stored
+	joke.ID = stored.ID
+
+	return func() {
+		m.jokes = m.jokes[:len(m.jokes)-1]
+		delete(m.jokesByExtID, stored.ExternalID)
+		delete(m.jokesByURL, stored.URL)
+	}, nil
+}
+
+func (m *Memory) GetJokesByExternalID(ctx context.Context, externalIDs []string) (map[string]*domain.Joke, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	jokes := make(map[string]*domain.Joke)
+	for _, id := range externalIDs {
+		if j, ok := m.jokesByExtID[id]; ok {
+			jokes[id] = copyJoke(j)
+		}
+	}
+	return jokes, nil
+}
+
+// EachJoke calls fn without holding the lock, so fn can take as long as it
+// likes, on a snapshot taken at the start.
+func (m *Memory) EachJoke(ctx context.Context, fn func(*domain.Joke) error) error {
+	m.mu.RLock()
+	snapshot := make([]*domain.Joke, len(m.jokes))
+	for i, j := range m.jokes {
+		snapshot[i] = copyJoke(j)
+	}
+	m.mu.RUnlock()
+
+	for _, j := range snapshot {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := fn(j); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func copyUser(u *domain.User) *domain.User {
+	c := *u
+	c.HashedPW = slices.Clone(u.HashedPW)
+	if u.VerifiedAt != nil {
+		verifiedAt := *u.VerifiedAt
+		c.VerifiedAt = &verifiedAt
+	}
+	return &c
+}
+
+func (m *Memory) CreateUser(ctx context.Context, email string, hashedPW []byte) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := strings.ToLower(email)
+	if _, ok := m.usersByEmail[key]; ok {
+		return 0, ErrDuplicate
+	}
+
+	m.lastUserID++
+	u := &domain.User{
+		ID:        m.lastUserID,
+		Email:     email,
+		HashedPW:  slices.Clone(hashedPW),
+		CreatedAt: m.now().UTC(),
+		Plan:      "free",
+	}
+	m.users[u.ID] = u
+	m.usersByEmail[key] = u
+
+	return u.ID, nil
+}
+
+func (m *Memory) GetUserByEmail(ctx context.Context, email string) (*domain.User, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	u, ok := m.usersByEmail[strings.ToLower(email)]
+	if !ok {
+		return nil, domain.ErrNotFound
+	}
+	return copyUser(u), nil
+}
+
+func (m *Memory) GetUserByID(ctx context.Context, id int64) (*domain.User, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	u, ok := m.users[id]
+	if !ok {
+		return nil, domain.ErrNotFound
+	}
+	return copyUser(u), nil
+}
+
+func (m *Memory) UpdatePassword(ctx context.Context, id int64, hashedPW []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	u, ok := m.users[id]
+	if !ok {
+		return domain.ErrNotFound
+	}
+	u.HashedPW = slices.Clone(hashedPW)
+	return nil
+}
+
+func (m *Memory) UpdateEmail(ctx context.Context, id int64, email string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	u, ok := m.users[id]
+	if !ok {
+		return domain.ErrNotFound
+	}
+
+	key := strings.ToLower(email)
+	if other, ok := m.usersByEmail[key]; ok && other.ID != id {
+		return ErrDuplicate
+	}
+
+	delete(m.usersByEmail, strings.ToLower(u.Email))
+	u.Email = email
+	u.VerifiedAt = nil
+	m.usersByEmail[key] = u
+
+	return nil
+}
+
+func (m *Memory) MarkVerified(ctx context.Context, id int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if u, ok := m.users[id]; ok && u.VerifiedAt == nil {
+		now := m.now().UTC()
+		u.VerifiedAt = &now
+	}
+	return nil
+}
+
+func (m *Memory) DeleteUser(ctx context.Context, id int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	u, ok := m.users[id]
+	if !ok {
+		return domain.ErrNotFound
+	}
+
+	for hash, t := range m.tokens {
+		if t.UserID == id {
+			delete(m.tokens, hash)
+		}
+	}
+	delete(m.usersByEmail, strings.ToLower(u.Email))
+	delete(m.users, id)
+
+	return nil
+}
+
+func copyToken(t *domain.Token) *domain.Token {
+	c := *t
+	c.Hash = slices.Clone(t.Hash)
+	return &c
+}
+
+func (m *Memory) CreateToken(ctx context.Context, token *domain.Token) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.users[token.UserID]; !ok {
+		return domain.ErrNotFound
+	}
+	if _, ok := m.tokens[string(token.Hash)]; ok {
+		return fmt.Errorf("failed to insert token: %w", ErrDuplicate)
+	}
+
+	token.CreatedAt = m.now().UTC()
+	stored := copyToken(token)
+	// like the tokens table, only the hash is kept
+	stored.Plaintext = ""
+	m.tokens[string(token.Hash)] = stored
+
+	return nil
+}
+
+func (m *Memory) GetTokenUserID(ctx context.Context, hash []byte, scope string) (int64, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	t, ok := m.tokens[string(hash)]
+	if !ok || t.Scope != scope || !t.ExpiresAt.After(m.now()) {
+		return 0, domain.ErrNotFound
+	}
+	return t.UserID, nil
+}
+
+func (m *Memory) ConsumeToken(ctx context.Context, hash []byte, scope string) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	t, ok := m.tokens[string(hash)]
+	if !ok || t.Scope != scope || !t.ExpiresAt.After(m.now()) {
+		return 0, domain.ErrNotFound
+	}
+
+	delete(m.tokens, string(hash))
+	return t.UserID, nil
+}
+
+func (m *Memory) DeleteToken(ctx context.Context, hash []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.tokens, string(hash))
+	return nil
+}
+
+func (m *Memory) DeleteTokens(ctx context.Context, userID int64, scope string, keep []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for hash, t := range m.tokens {
+		if t.UserID == userID && t.Scope == scope && !bytes.Equal(t.Hash, keep) {
+			delete(m.tokens, hash)
+		}
+	}
+	return nil
+}
+
+func (m *Memory) ListTokens(ctx context.Context, userID int64, scope string) ([]*domain.Token, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	now := m.now()
+
+	var tokens []*domain.Token
+	for _, t := range m.tokens {
+		if t.UserID == userID && t.Scope == scope && t.ExpiresAt.After(now) {
+			tokens = append(tokens, copyToken(t))
+		}
+	}
+	slices.SortFunc(tokens, func(a, b *domain.Token) int {
+		return a.CreatedAt.Compare(b.CreatedAt)
+	})
+
+	return tokens, nil
+}
@@ -0,0 +1,40 @@
+package store
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/davemolk/chuck/internal/domain"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemory(t *testing.T) {
+	testStore(t, func(t *testing.T) Store { return NewMemory() })
+}
+
+func TestMemoryTokenExpiry(t *testing.T) {
+	m := NewMemory()
+	now := time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC)
+	m.now = func() time.Time { return now }
+	ctx := context.Background()
+
+	id, err := m.CreateUser(ctx, "chuck@norris.com", []byte("hash"))
+	require.NoError(t, err)
+
+	token := testToken(id, "token", domain.ScopeAuthentication, time.Hour)
+	token.ExpiresAt = now.Add(time.Minute)
+	require.NoError(t, m.CreateToken(ctx, token))
+	require.Equal(t, now, token.CreatedAt)
+
+	_, err = m.GetTokenUserID(ctx, token.Hash, token.Scope)
+	require.NoError(t, err)
+
+	now = now.Add(time.Minute)
+	_, err = m.GetTokenUserID(ctx, token.Hash, token.Scope)
+	require.ErrorIs(t, err, domain.ErrNotFound)
+
+	tokens, err := m.ListTokens(ctx, id, token.Scope)
+	require.NoError(t, err)
+	require.Empty(t, tokens)
+}
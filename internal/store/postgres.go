@@ -0,0 +1,393 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/davemolk/chuck/internal/domain"
+	"github.com/davemolk/chuck/internal/outbox"
+	sqldb "github.com/davemolk/chuck/internal/sql"
+	"github.com/lib/pq"
+)
+
+// Postgres keeps everything in the tables from the migrations package.
+type Postgres struct {
+	db *sqldb.DB
+}
+
+var _ Store = (*Postgres)(nil)
+
+func NewPostgres(db *sqldb.DB) *Postgres {
+	return &Postgres{db: db}
+}
+
+// isViolation reports whether err is postgres refusing a write for breaking
+// a constraint, e.g. "unique_violation".
+func isViolation(err error, name string) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code.Name() == name
+}
+
+const jokeColumns = `id, external_id, joke_url, content, created_at`
+
+func scanJoke(row interface{ Scan(...any) error }) (*domain.Joke, error) {
+	var joke domain.Joke
+	if err := row.Scan(&joke.ID, &joke.ExternalID, &joke.URL, &joke.Content, &joke.CreatedAt); err != nil {
+		return nil, err
+	}
+	return &joke, nil
+}
+
+// GetRandomJoke, SearchJoke and EachJoke read from a replica when there are
+// any. A joke saved a moment ago may not be there yet, which is fine for
+// all three.
+func (p *Postgres) GetRandomJoke(ctx context.Context) (*domain.Joke, error) {
+	query := `select ` + jokeColumns + ` from jokes order by random() limit 1`
+
+	joke, err := scanJoke(p.db.ReadQueryRowContext(ctx, query))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, domain.ErrNotFound
+		}
+		return nil, fmt.Errorf("failed to get joke: %w", err)
+	}
+
+	return joke, nil
+}
+
+func (p *Postgres) SearchJoke(ctx context.Context, query string) (*domain.Joke, error) {
+	// plainto_tsquery ands the words together and, unlike to_tsquery,
+	// doesn't choke on punctuation in user input
+	q := `
+		select ` + jokeColumns + `
+		from jokes
+		where to_tsvector('simple', content) @@ plainto_tsquery('simple', $1)
+		order by random()
+		limit 1
+	`
+
+	joke, err := scanJoke(p.db.ReadQueryRowContext(ctx, q, query))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, domain.ErrNotFound
+		}
+		return nil, fmt.Errorf("failed to get joke by content: %w", err)
+	}
+
+	return joke, nil
+}
+
+func (p *Postgres) SaveJokes(ctx context.Context, jokes []*domain.Joke) error {
+	if len(jokes) == 0 {
+		return nil
+	}
+
+	// this presupposes that external id is a unique identifier, and it certainly
+	// appears to be, but there's no statement to that effect in the chuck norris
+	// api docs.
+	//
+	// the update also means we get the id back on a conflict, rather than
+	// having to check for sql.ErrNoRows.
+	query := `
+		insert into jokes (external_id, joke_url, content, created_at)
+		values ($1, $2, $3, $4)
+		on conflict (external_id) do update
+		set joke_url = excluded.joke_url, content = excluded.content
+		returning id
+	`
+
+	return p.db.RunInTx(ctx, nil, func(ctx context.Context, tx *sql.Tx) error {
+		for _, joke := range jokes {
+			if err := tx.QueryRowContext(ctx, query, joke.ExternalID, joke.URL, joke.Content, joke.CreatedAt).Scan(&joke.ID); err != nil {
+				if isViolation(err, "unique_violation") {
+					return fmt.Errorf("failed to save joke %s: url %s: %w", joke.ExternalID, joke.URL, ErrDuplicate)
+				}
+				return fmt.Errorf("failed to save joke %s: %w", joke.ExternalID, err)
+			}
+
+			event := outbox.JokeIngestedPayload{JokeID: joke.ID, ExternalID: joke.ExternalID}
+			if err := outbox.Add(ctx, tx, outbox.JokeIngested, event); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+func (p *Postgres) GetJokesByExternalID(ctx context.Context, externalIDs []string) (map[string]*domain.Joke, error) {
+	query := `select ` + jokeColumns + ` from jokes where external_id = any($1)`
+
+	rows, err := p.db.QueryContext(ctx, query, pq.Array(externalIDs))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get jokes: %w", err)
+	}
+	defer rows.Close()
+
+	jokes := make(map[string]*domain.Joke)
+	for rows.Next() {
+		joke, err := scanJoke(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan joke: %w", err)
+		}
+		jokes[joke.ExternalID] = joke
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to get jokes: %w", err)
+	}
+
+	return jokes, nil
+}
+
+// EachJoke is a single query, so it sees one consistent snapshot, and rows
+// go to fn as they arrive rather than being held in memory.
+func (p *Postgres) EachJoke(ctx context.Context, fn func(*domain.Joke) error) error {
+	query := `select ` + jokeColumns + ` from jokes order by id`
+
+	// it runs as long as fn takes, the caller's ctx is what bounds it
+	rows, err := p.db.ReadQueryContext(sqldb.NoQueryTimeout(ctx), query)
+	if err != nil {
+		return fmt.Errorf("failed to get jokes: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		joke, err := scanJoke(rows)
+		if err != nil {
+			return fmt.Errorf("failed to scan joke: %w", err)
+		}
+		if err = fn(joke); err != nil {
+			return err
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return fmt.Errorf("failed to get jokes: %w", err)
+	}
+
+	return nil
+}
+
+const userColumns = `id, email, hashed_pw, created_at, verified_at, plan, is_admin`
+
+func scanUser(row *sqldb.Row) (*domain.User, error) {
+	var u domain.User
+	err := row.Scan(&u.ID, &u.Email, &u.HashedPW, &u.CreatedAt, &u.VerifiedAt, &u.Plan, &u.IsAdmin)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, domain.ErrNotFound
+		}
+		return nil, fmt.Errorf("failed to get user: %w", err)
+	}
+	return &u, nil
+}
+
+func (p *Postgres) CreateUser(ctx context.Context, email string, hashedPW []byte) (int64, error) {
+	query := `
+		insert into users (email, hashed_pw)
+		values ($1, $2)
+		on conflict (email) do nothing
+		returning id`
+
+	var id int64
+	err := p.db.RunInTx(ctx, nil, func(ctx context.Context, tx *sql.Tx) error {
+		if err := tx.QueryRowContext(ctx, query, email, hashedPW).Scan(&id); err != nil {
+			// this would happen if the email is already stored, so
+			// we do nothing and consequently can't scan the id
+			if errors.Is(err, sql.ErrNoRows) {
+				return ErrDuplicate
+			}
+			return fmt.Errorf("failed to insert user: %w", err)
+		}
+
+		return outbox.Add(ctx, tx, outbox.UserRegistered, outbox.UserRegisteredPayload{UserID: id})
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return id, nil
+}
+
+func (p *Postgres) GetUserByEmail(ctx context.Context, email string) (*domain.User, error) {
+	query := `select ` + userColumns + ` from users where email = $1`
+	return scanUser(p.db.QueryRowContext(ctx, query, email))
+}
+
+func (p *Postgres) GetUserByID(ctx context.Context, id int64) (*domain.User, error) {
+	query := `select ` + userColumns + ` from users where id = $1`
+	return scanUser(p.db.QueryRowContext(ctx, query, id))
+}
+
+// updateUser runs an update of a single user, it's domain.ErrNotFound if
+// there's no such user.
+func (p *Postgres) updateUser(ctx context.Context, query string, args ...any) error {
+	res, err := p.db.ExecContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return domain.ErrNotFound
+	}
+
+	return nil
+}
+
+func (p *Postgres) UpdatePassword(ctx context.Context, id int64, hashedPW []byte) error {
+	err := p.updateUser(ctx, `update users set hashed_pw = $2 where id = $1`, id, hashedPW)
+	if err != nil && !errors.Is(err, domain.ErrNotFound) {
+		return fmt.Errorf("failed to update password: %w", err)
+	}
+	return err
+}
+
+func (p *Postgres) UpdateEmail(ctx context.Context, id int64, email string) error {
+	err := p.updateUser(ctx, `update users set email = $2, verified_at = null where id = $1`, id, email)
+	if isViolation(err, "unique_violation") {
+		return ErrDuplicate
+	}
+	if err != nil && !errors.Is(err, domain.ErrNotFound) {
+		return fmt.Errorf("failed to update email: %w", err)
+	}
+	return err
+}
+
+func (p *Postgres) MarkVerified(ctx context.Context, id int64) error {
+	query := `update users set verified_at = current_timestamp where id = $1 and verified_at is null`
+
+	if _, err := p.db.ExecContext(ctx, query, id); err != nil {
+		return fmt.Errorf("failed to verify user: %w", err)
+	}
+
+	return nil
+}
+
+// DeleteUser relies on on delete cascade for everything else that references
+// the user, totp and recovery codes included.
+func (p *Postgres) DeleteUser(ctx context.Context, id int64) error {
+	return p.db.RunInTx(ctx, nil, func(ctx context.Context, tx *sql.Tx) error {
+		// the cascade would take these anyway, but being explicit means a
+		// missed cascade on a future table can't leave live tokens behind
+		if _, err := tx.ExecContext(ctx, `delete from tokens where user_id = $1`, id); err != nil {
+			return fmt.Errorf("failed to revoke tokens: %w", err)
+		}
+
+		res, err := tx.ExecContext(ctx, `delete from users where id = $1`, id)
+		if err != nil {
+			return fmt.Errorf("failed to delete user: %w", err)
+		}
+
+		n, err := res.RowsAffected()
+		if err != nil {
+			return fmt.Errorf("failed to delete user: %w", err)
+		}
+		if n == 0 {
+			return domain.ErrNotFound
+		}
+
+		return nil
+	})
+}
+
+func (p *Postgres) CreateToken(ctx context.Context, token *domain.Token) error {
+	query := `
+		insert into tokens (hash, user_id, expires_at, scope)
+		values ($1, $2, $3, $4)
+		returning created_at
+	`
+
+	args := []any{token.Hash, token.UserID, token.ExpiresAt, token.Scope}
+
+	if err := p.db.QueryRowContext(ctx, query, args...).Scan(&token.CreatedAt); err != nil {
+		if isViolation(err, "foreign_key_violation") {
+			return domain.ErrNotFound
+		}
+		return fmt.Errorf("failed to insert token: %w", err)
+	}
+
+	return nil
+}
+
+func (p *Postgres) GetTokenUserID(ctx context.Context, hash []byte, scope string) (int64, error) {
+	query := `select user_id from tokens where hash = $1 and scope = $2 and expires_at > $3`
+
+	// expires_at is written from the app's clock, so compare it with that
+	// rather than the database's
+	var id int64
+	if err := p.db.QueryRowContext(ctx, query, hash, scope, time.Now()).Scan(&id); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, domain.ErrNotFound
+		}
+		return 0, fmt.Errorf("failed to get token: %w", err)
+	}
+
+	return id, nil
+}
+
+func (p *Postgres) ConsumeToken(ctx context.Context, hash []byte, scope string) (int64, error) {
+	query := `delete from tokens where hash = $1 and scope = $2 and expires_at > $3 returning user_id`
+
+	// a concurrent consume waits on the row lock, then finds the row gone
+	var id int64
+	if err := p.db.QueryRowContext(ctx, query, hash, scope, time.Now()).Scan(&id); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, domain.ErrNotFound
+		}
+		return 0, fmt.Errorf("failed to consume token: %w", err)
+	}
+
+	return id, nil
+}
+
+func (p *Postgres) DeleteToken(ctx context.Context, hash []byte) error {
+	if _, err := p.db.ExecContext(ctx, `delete from tokens where hash = $1`, hash); err != nil {
+		return fmt.Errorf("failed to delete token: %w", err)
+	}
+	return nil
+}
+
+func (p *Postgres) DeleteTokens(ctx context.Context, userID int64, scope string, keep []byte) error {
+	// a null keep makes hash <> $3 null, which would delete nothing
+	query := `delete from tokens where user_id = $1 and scope = $2 and hash is distinct from $3`
+
+	if _, err := p.db.ExecContext(ctx, query, userID, scope, keep); err != nil {
+		return fmt.Errorf("failed to delete tokens: %w", err)
+	}
+
+	return nil
+}
+
+func (p *Postgres) ListTokens(ctx context.Context, userID int64, scope string) ([]*domain.Token, error) {
+	query := `
+		select hash, user_id, expires_at, scope, created_at
+		from tokens
+		where user_id = $1 and scope = $2 and expires_at > $3
+		order by created_at`
+
+	rows, err := p.db.QueryContext(ctx, query, userID, scope, time.Now())
+	if err != nil {
+		return nil, fmt.Errorf("failed to get tokens: %w", err)
+	}
+	defer rows.Close()
+
+	var tokens []*domain.Token
+	for rows.Next() {
+		var t domain.Token
+		if err = rows.Scan(&t.Hash, &t.UserID, &t.ExpiresAt, &t.Scope, &t.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan token: %w", err)
+		}
+		tokens = append(tokens, &t)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to get tokens: %w", err)
+	}
+
+	return tokens, nil
+}
@@ -0,0 +1,40 @@
+package store
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/davemolk/chuck/internal/domain"
+	"github.com/davemolk/chuck/internal/sql/dbtest"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPostgres(t *testing.T) {
+	testStore(t, func(t *testing.T) Store { return NewPostgres(dbtest.SetupTestDB(t)) })
+}
+
+func TestPostgresOutbox(t *testing.T) {
+	db := dbtest.SetupTestDB(t)
+	testOutbox(t, db, NewPostgres(db))
+}
+
+func TestPostgresDeleteUserCascades(t *testing.T) {
+	db := dbtest.SetupTestDB(t)
+	p := NewPostgres(db)
+	ctx := context.Background()
+
+	id, err := p.CreateUser(ctx, "chuck@norris.com", []byte("hash"))
+	require.NoError(t, err)
+	require.NoError(t, p.CreateToken(ctx, testToken(id, "token", domain.ScopeAuthentication, time.Hour)))
+
+	_, err = db.ExecContext(ctx, `insert into recovery_codes (user_id, hash) values ($1, 'x')`, id)
+	require.NoError(t, err)
+
+	require.NoError(t, p.DeleteUser(ctx, id))
+
+	var codes int
+	err = db.QueryRowContext(ctx, `select count(*) from recovery_codes where user_id = $1`, id).Scan(&codes)
+	require.NoError(t, err)
+	require.Zero(t, codes)
+}
@@ -0,0 +1,383 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/davemolk/chuck/internal/domain"
+	"github.com/davemolk/chuck/internal/outbox"
+	sqldb "github.com/davemolk/chuck/internal/sql"
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+// SQLite keeps everything in the tables from the migrations package's sqlite
+// schema. Times are written in utc, they're stored as text and compared as
+// text, so they have to share a zone.
+type SQLite struct {
+	db *sqldb.DB
+}
+
+var _ Store = (*SQLite)(nil)
+
+func NewSQLite(db *sqldb.DB) *SQLite {
+	return &SQLite{db: db}
+}
+
+// New is the store for the database db is connected to.
+func New(db *sqldb.DB) Store {
+	if db.Driver() == sqldb.SQLite {
+		return NewSQLite(db)
+	}
+	return NewPostgres(db)
+}
+
+// isConstraint reports whether err is sqlite refusing a write for breaking a
+// constraint, e.g. sqlite3.SQLITE_CONSTRAINT_UNIQUE.
+func isConstraint(err error, code int) bool {
+	var sqliteErr *sqlite.Error
+	return errors.As(err, &sqliteErr) && sqliteErr.Code() == code
+}
+
+func (s *SQLite) GetRandomJoke(ctx context.Context) (*domain.Joke, error) {
+	query := `select ` + jokeColumns + ` from jokes order by random() limit 1`
+
+	joke, err := scanJoke(s.db.QueryRowContext(ctx, query))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, domain.ErrNotFound
+		}
+		return nil, fmt.Errorf("failed to get joke: %w", err)
+	}
+
+	return joke, nil
+}
+
+func (s *SQLite) SearchJoke(ctx context.Context, query string) (*domain.Joke, error) {
+	// each word is quoted so fts5 doesn't read it as an operator like NOT,
+	// and words side by side have to all match
+	terms := words(query)
+	if len(terms) == 0 {
+		return nil, domain.ErrNotFound
+	}
+	for i, t := range terms {
+		terms[i] = `"` + t + `"`
+	}
+
+	q := `
+		select ` + jokeColumns + `
+		from jokes
+		where id in (select rowid from jokes_fts where jokes_fts match $1)
+		order by random()
+		limit 1
+	`
+
+	joke, err := scanJoke(s.db.QueryRowContext(ctx, q, strings.Join(terms, " ")))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, domain.ErrNotFound
+		}
+		return nil, fmt.Errorf("failed to get joke by content: %w", err)
+	}
+
+	return joke, nil
+}
+
+func (s *SQLite) SaveJokes(ctx context.Context, jokes []*domain.Joke) error {
+	if len(jokes) == 0 {
+		return nil
+	}
+
+	// see Postgres.SaveJokes
+	query := `
+		insert into jokes (external_id, joke_url, content, created_at)
+		values ($1, $2, $3, $4)
+		on conflict (external_id) do update
+		set joke_url = excluded.joke_url, content = excluded.content
+		returning id
+	`
+
+	return s.db.RunInTx(ctx, nil, func(ctx context.Context, tx *sql.Tx) error {
+		for _, joke := range jokes {
+			if err := tx.QueryRowContext(ctx, query, joke.ExternalID, joke.URL, joke.Content, joke.CreatedAt.UTC()).Scan(&joke.ID); err != nil {
+				if isConstraint(err, sqlite3.SQLITE_CONSTRAINT_UNIQUE) {
+					return fmt.Errorf("failed to save joke %s: url %s: %w", joke.ExternalID, joke.URL, ErrDuplicate)
+				}
+				return fmt.Errorf("failed to save joke %s: %w", joke.ExternalID, err)
+			}
+
+			event := outbox.JokeIngestedPayload{JokeID: joke.ID, ExternalID: joke.ExternalID}
+			if err := outbox.Add(ctx, tx, outbox.JokeIngested, event); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+func (s *SQLite) GetJokesByExternalID(ctx context.Context, externalIDs []string) (map[string]*domain.Joke, error) {
+	// sqlite has no arrays, so the ids go in as a json one
+	ids, err := json.Marshal(externalIDs)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode external ids: %w", err)
+	}
+
+	query := `select ` + jokeColumns + ` from jokes where external_id in (select value from json_each($1))`
+
+	rows, err := s.db.QueryContext(ctx, query, string(ids))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get jokes: %w", err)
+	}
+	defer rows.Close()
+
+	jokes := make(map[string]*domain.Joke)
+	for rows.Next() {
+		joke, err := scanJoke(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan joke: %w", err)
+		}
+		jokes[joke.ExternalID] = joke
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to get jokes: %w", err)
+	}
+
+	return jokes, nil
+}
+
+// EachJoke reads from a single snapshot, like Postgres.EachJoke. In wal mode
+// that doesn't hold up writers.
+func (s *SQLite) EachJoke(ctx context.Context, fn func(*domain.Joke) error) error {
+	query := `select ` + jokeColumns + ` from jokes order by id`
+
+	// see Postgres.EachJoke
+	rows, err := s.db.QueryContext(sqldb.NoQueryTimeout(ctx), query)
+	if err != nil {
+		return fmt.Errorf("failed to get jokes: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		joke, err := scanJoke(rows)
+		if err != nil {
+			return fmt.Errorf("failed to scan joke: %w", err)
+		}
+		if err = fn(joke); err != nil {
+			return err
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return fmt.Errorf("failed to get jokes: %w", err)
+	}
+
+	return nil
+}
+
+func (s *SQLite) CreateUser(ctx context.Context, email string, hashedPW []byte) (int64, error) {
+	// email is collate nocase, so the conflict ignores case like citext
+	query := `
+		insert into users (email, hashed_pw, created_at)
+		values ($1, $2, $3)
+		on conflict (email) do nothing
+		returning id`
+
+	var id int64
+	err := s.db.RunInTx(ctx, nil, func(ctx context.Context, tx *sql.Tx) error {
+		if err := tx.QueryRowContext(ctx, query, email, hashedPW, time.Now().UTC()).Scan(&id); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return ErrDuplicate
+			}
+			return fmt.Errorf("failed to insert user: %w", err)
+		}
+
+		return outbox.Add(ctx, tx, outbox.UserRegistered, outbox.UserRegisteredPayload{UserID: id})
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return id, nil
+}
+
+func (s *SQLite) GetUserByEmail(ctx context.Context, email string) (*domain.User, error) {
+	query := `select ` + userColumns + ` from users where email = $1`
+	return scanUser(s.db.QueryRowContext(ctx, query, email))
+}
+
+func (s *SQLite) GetUserByID(ctx context.Context, id int64) (*domain.User, error) {
+	query := `select ` + userColumns + ` from users where id = $1`
+	return scanUser(s.db.QueryRowContext(ctx, query, id))
+}
+
+// updateUser is Postgres.updateUser.
+func (s *SQLite) updateUser(ctx context.Context, query string, args ...any) error {
+	res, err := s.db.ExecContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return domain.ErrNotFound
+	}
+
+	return nil
+}
+
+func (s *SQLite) UpdatePassword(ctx context.Context, id int64, hashedPW []byte) error {
+	err := s.updateUser(ctx, `update users set hashed_pw = $2 where id = $1`, id, hashedPW)
+	if err != nil && !errors.Is(err, domain.ErrNotFound) {
+		return fmt.Errorf("failed to update password: %w", err)
+	}
+	return err
+}
+
+func (s *SQLite) UpdateEmail(ctx context.Context, id int64, email string) error {
+	err := s.updateUser(ctx, `update users set email = $2, verified_at = null where id = $1`, id, email)
+	if isConstraint(err, sqlite3.SQLITE_CONSTRAINT_UNIQUE) {
+		return ErrDuplicate
+	}
+	if err != nil && !errors.Is(err, domain.ErrNotFound) {
+		return fmt.Errorf("failed to update email: %w", err)
+	}
+	return err
+}
+
+func (s *SQLite) MarkVerified(ctx context.Context, id int64) error {
+	query := `update users set verified_at = $2 where id = $1 and verified_at is null`
+
+	if _, err := s.db.ExecContext(ctx, query, id, time.Now().UTC()); err != nil {
+		return fmt.Errorf("failed to verify user: %w", err)
+	}
+
+	return nil
+}
+
+// DeleteUser relies on the cascades too, which is why foreign keys are
+// turned on for every connection.
+func (s *SQLite) DeleteUser(ctx context.Context, id int64) error {
+	return s.db.RunInTx(ctx, nil, func(ctx context.Context, tx *sql.Tx) error {
+		if _, err := tx.ExecContext(ctx, `delete from tokens where user_id = $1`, id); err != nil {
+			return fmt.Errorf("failed to revoke tokens: %w", err)
+		}
+
+		res, err := tx.ExecContext(ctx, `delete from users where id = $1`, id)
+		if err != nil {
+			return fmt.Errorf("failed to delete user: %w", err)
+		}
+
+		n, err := res.RowsAffected()
+		if err != nil {
+			return fmt.Errorf("failed to delete user: %w", err)
+		}
+		if n == 0 {
+			return domain.ErrNotFound
+		}
+
+		return nil
+	})
+}
+
+func (s *SQLite) CreateToken(ctx context.Context, token *domain.Token) error {
+	query := `
+		insert into tokens (hash, user_id, expires_at, scope, created_at)
+		values ($1, $2, $3, $4, $5)
+	`
+
+	// created_at comes from here rather than current_timestamp, which only
+	// has whole seconds, so tokens made in the same second keep their order
+	createdAt := time.Now().UTC()
+	args := []any{token.Hash, token.UserID, token.ExpiresAt.UTC(), token.Scope, createdAt}
+
+	if _, err := s.db.ExecContext(ctx, query, args...); err != nil {
+		if isConstraint(err, sqlite3.SQLITE_CONSTRAINT_FOREIGNKEY) {
+			return domain.ErrNotFound
+		}
+		return fmt.Errorf("failed to insert token: %w", err)
+	}
+	token.CreatedAt = createdAt
+
+	return nil
+}
+
+func (s *SQLite) GetTokenUserID(ctx context.Context, hash []byte, scope string) (int64, error) {
+	query := `select user_id from tokens where hash = $1 and scope = $2 and expires_at > $3`
+
+	var id int64
+	if err := s.db.QueryRowContext(ctx, query, hash, scope, time.Now().UTC()).Scan(&id); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, domain.ErrNotFound
+		}
+		return 0, fmt.Errorf("failed to get token: %w", err)
+	}
+
+	return id, nil
+}
+
+func (s *SQLite) ConsumeToken(ctx context.Context, hash []byte, scope string) (int64, error) {
+	query := `delete from tokens where hash = $1 and scope = $2 and expires_at > $3 returning user_id`
+
+	var id int64
+	if err := s.db.QueryRowContext(ctx, query, hash, scope, time.Now().UTC()).Scan(&id); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, domain.ErrNotFound
+		}
+		return 0, fmt.Errorf("failed to consume token: %w", err)
+	}
+
+	return id, nil
+}
+
+func (s *SQLite) DeleteToken(ctx context.Context, hash []byte) error {
+	if _, err := s.db.ExecContext(ctx, `delete from tokens where hash = $1`, hash); err != nil {
+		return fmt.Errorf("failed to delete token: %w", err)
+	}
+	return nil
+}
+
+func (s *SQLite) DeleteTokens(ctx context.Context, userID int64, scope string, keep []byte) error {
+	query := `delete from tokens where user_id = $1 and scope = $2 and hash is distinct from $3`
+
+	if _, err := s.db.ExecContext(ctx, query, userID, scope, keep); err != nil {
+		return fmt.Errorf("failed to delete tokens: %w", err)
+	}
+
+	return nil
+}
+
+func (s *SQLite) ListTokens(ctx context.Context, userID int64, scope string) ([]*domain.Token, error) {
+	query := `
+		select hash, user_id, expires_at, scope, created_at
+		from tokens
+		where user_id = $1 and scope = $2 and expires_at > $3
+		order by created_at, rowid`
+
+	rows, err := s.db.QueryContext(ctx, query, userID, scope, time.Now().UTC())
+	if err != nil {
+		return nil, fmt.Errorf("failed to get tokens: %w", err)
+	}
+	defer rows.Close()
+
+	var tokens []*domain.Token
+	for rows.Next() {
+		var t domain.Token
+		if err = rows.Scan(&t.Hash, &t.UserID, &t.ExpiresAt, &t.Scope, &t.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan token: %w", err)
+		}
+		tokens = append(tokens, &t)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to get tokens: %w", err)
+	}
+
+	return tokens, nil
+}
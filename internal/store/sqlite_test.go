@@ -0,0 +1,57 @@
+package store
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/davemolk/chuck/internal/domain"
+	"github.com/davemolk/chuck/internal/sql/dbtest"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSQLite(t *testing.T) {
+	testStore(t, func(t *testing.T) Store { return NewSQLite(dbtest.SetupSQLite(t)) })
+}
+
+func TestSQLiteOutbox(t *testing.T) {
+	db := dbtest.SetupSQLite(t)
+	testOutbox(t, db, NewSQLite(db))
+}
+
+func TestSQLiteDeleteUserCascades(t *testing.T) {
+	db := dbtest.SetupSQLite(t)
+	s := NewSQLite(db)
+	ctx := context.Background()
+
+	id, err := s.CreateUser(ctx, "chuck@norris.com", []byte("hash"))
+	require.NoError(t, err)
+	require.NoError(t, s.CreateToken(ctx, testToken(id, "token", domain.ScopeAuthentication, time.Hour)))
+
+	_, err = db.ExecContext(ctx, `insert into recovery_codes (user_id, hash) values ($1, 'x')`, id)
+	require.NoError(t, err)
+
+	require.NoError(t, s.DeleteUser(ctx, id))
+
+	var codes int
+	err = db.QueryRowContext(ctx, `select count(*) from recovery_codes where user_id = $1`, id).Scan(&codes)
+	require.NoError(t, err)
+	require.Zero(t, codes)
+}
+
+func TestSQLiteSearchOperators(t *testing.T) {
+	s := NewSQLite(dbtest.SetupSQLite(t))
+	ctx := context.Background()
+
+	require.NoError(t, s.SaveJokes(ctx, []*domain.Joke{testJoke(1, "Chuck Norris does NOT sleep OR rest. He waits AND watches.")}))
+
+	// fts5 would read these as syntax if they weren't quoted
+	for _, query := range []string{"not", "chuck AND", `"waits`, "norris*", "sleep OR rest", "(waits)"} {
+		_, err := s.SearchJoke(ctx, query)
+		require.NoError(t, err, query)
+	}
+
+	// or is just another word that has to be there
+	_, err := s.SearchJoke(ctx, "sleep OR nap")
+	require.ErrorIs(t, err, domain.ErrNotFound)
+}
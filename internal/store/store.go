@@ -0,0 +1,87 @@
+// Package store keeps jokes, users and tokens. The server runs on Postgres,
+// or SQLite when it's a single binary, see New. Memory keeps everything in
+// process for tests and anything else that shouldn't need a database. All
+// three pass the same tests, see store_test.go.
+//
+// A missing record is domain.ErrNotFound, and a unique constraint the write
+// would break is ErrDuplicate.
+//
+// Postgres and SQLite add an outbox event alongside each new user and saved
+// joke, see the outbox package. Memory has no outbox.
+package store
+
+import (
+	"context"
+	"errors"
+
+	"github.com/davemolk/chuck/internal/domain"
+)
+
+// ErrDuplicate is a write that would leave two jokes with the same url or two
+// users with the same email.
+var ErrDuplicate = errors.New("duplicate record")
+
+// Store is every store, which is what Postgres, SQLite and Memory are.
+type Store interface {
+	JokeStore
+	UserStore
+	TokenStore
+}
+
+type JokeStore interface {
+	// GetRandomJoke is domain.ErrNotFound when there are no jokes.
+	GetRandomJoke(ctx context.Context) (*domain.Joke, error)
+	// SearchJoke picks a random joke containing every word in query. Words
+	// match whole and ignore case, so "ninja" doesn't match "ninjas".
+	SearchJoke(ctx context.Context, query string) (*domain.Joke, error)
+	// SaveJokes upserts jokes by external id and fills in each one's id. The
+	// url and content of an existing joke are updated, created_at is kept.
+	// Either every joke is saved or none are.
+	SaveJokes(ctx context.Context, jokes []*domain.Joke) error
+	// GetJokesByExternalID returns the jokes that exist, keyed by external
+	// id.
+	GetJokesByExternalID(ctx context.Context, externalIDs []string) (map[string]*domain.Joke, error)
+	// EachJoke calls fn with every joke, oldest first, stopping at the first
+	// error fn returns.
+	EachJoke(ctx context.Context, fn func(*domain.Joke) error) error
+}
+
+// UserStore looks up users by email ignoring case, and an email can only
+// belong to one user regardless of case.
+type UserStore interface {
+	// CreateUser returns the new user's id. A new user is on the free plan,
+	// unverified and not an admin.
+	CreateUser(ctx context.Context, email string, hashedPW []byte) (int64, error)
+	GetUserByEmail(ctx context.Context, email string) (*domain.User, error)
+	GetUserByID(ctx context.Context, id int64) (*domain.User, error)
+	UpdatePassword(ctx context.Context, id int64, hashedPW []byte) error
+	// UpdateEmail also marks the user unverified.
+	UpdateEmail(ctx context.Context, id int64, email string) error
+	// MarkVerified is a no-op for a user that's already verified, so
+	// verified_at stays when they first verified.
+	MarkVerified(ctx context.Context, id int64) error
+	// DeleteUser deletes the user's tokens along with them.
+	DeleteUser(ctx context.Context, id int64) error
+}
+
+// TokenStore holds token hashes, never the plaintext.
+type TokenStore interface {
+	// CreateToken fills in the token's CreatedAt. It's domain.ErrNotFound
+	// if the user doesn't exist.
+	CreateToken(ctx context.Context, token *domain.Token) error
+	// GetTokenUserID returns the id of the user a token with the hash and
+	// scope belongs to, as long as it hasn't expired.
+	GetTokenUserID(ctx context.Context, hash []byte, scope string) (int64, error)
+	// ConsumeToken is GetTokenUserID for a single-use token, deleting it in
+	// the same statement so only one caller ever gets the id back.
+	ConsumeToken(ctx context.Context, hash []byte, scope string) (int64, error)
+	// DeleteToken deletes the token whatever its scope. A token that doesn't
+	// exist isn't an error.
+	DeleteToken(ctx context.Context, hash []byte) error
+	// DeleteTokens deletes the user's tokens with the scope, except the one
+	// with hash keep, if any.
+	DeleteTokens(ctx context.Context, userID int64, scope string, keep []byte) error
+	// ListTokens returns the user's unexpired tokens with the scope, oldest
+	// first.
+	ListTokens(ctx context.Context, userID int64, scope string) ([]*domain.Token, error)
+}
@@ -0,0 +1,456 @@
+package store
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/davemolk/chuck/internal/domain"
+	sqldb "github.com/davemolk/chuck/internal/sql"
+	"github.com/stretchr/testify/require"
+)
+
+// testStore is the conformance suite every Store has to pass. newStore gets
+// called once per group of tests and has to return an empty store.
+func testStore(t *testing.T, newStore func(t *testing.T) Store) {
+	t.Run("jokes", func(t *testing.T) { testJokes(t, newStore(t)) })
+	t.Run("users", func(t *testing.T) { testUsers(t, newStore(t)) })
+	t.Run("tokens", func(t *testing.T) { testTokens(t, newStore(t)) })
+	t.Run("concurrency", func(t *testing.T) { testConcurrency(t, newStore(t)) })
+}
+
+func testJoke(n int, content string) *domain.Joke {
+	return &domain.Joke{
+		ExternalID: fmt.Sprintf("joke-%d", n),
+		URL:        fmt.Sprintf("https://example.com/jokes/%d", n),
+		Content:    content,
+		// whole seconds, so it comes back from postgres unchanged
+		CreatedAt: time.Date(2024, 1, n, 12, 0, 0, 0, time.UTC),
+	}
+}
+
+func testJokes(t *testing.T, s Store) {
+	ctx := context.Background()
+
+	t.Run("empty", func(t *testing.T) {
+		_, err := s.GetRandomJoke(ctx)
+		require.ErrorIs(t, err, domain.ErrNotFound)
+
+		_, err = s.SearchJoke(ctx, "chuck")
+		require.ErrorIs(t, err, domain.ErrNotFound)
+
+		require.NoError(t, s.SaveJokes(ctx, nil))
+	})
+
+	jokes := []*domain.Joke{
+		testJoke(1, "Chuck Norris counted to infinity. Twice."),
+		testJoke(2, "Ninjas fear Chuck Norris."),
+		testJoke(3, "Chuck Norris can slam a revolving door."),
+	}
+	require.NoError(t, s.SaveJokes(ctx, jokes))
+
+	t.Run("save fills in ids", func(t *testing.T) {
+		require.NotZero(t, jokes[0].ID)
+		require.Less(t, jokes[0].ID, jokes[1].ID)
+		require.Less(t, jokes[1].ID, jokes[2].ID)
+	})
+
+	t.Run("random", func(t *testing.T) {
+		joke, err := s.GetRandomJoke(ctx)
+		require.NoError(t, err)
+		require.Contains(t, joke.Content, "Chuck Norris")
+	})
+
+	t.Run("search", func(t *testing.T) {
+		joke, err := s.SearchJoke(ctx, "infinity")
+		require.NoError(t, err)
+		require.Equal(t, jokes[0].ID, joke.ID)
+
+		// case doesn't matter, but whole words do
+		joke, err = s.SearchJoke(ctx, "NINJAS")
+		require.NoError(t, err)
+		require.Equal(t, jokes[1].ID, joke.ID)
+
+		_, err = s.SearchJoke(ctx, "ninja")
+		require.ErrorIs(t, err, domain.ErrNotFound)
+
+		joke, err = s.SearchJoke(ctx, "revolving door")
+		require.NoError(t, err)
+		require.Equal(t, jokes[2].ID, joke.ID)
+
+		_, err = s.SearchJoke(ctx, "revolving infinity")
+		require.ErrorIs(t, err, domain.ErrNotFound)
+	})
+
+	t.Run("get by external id", func(t *testing.T) {
+		got, err := s.GetJokesByExternalID(ctx, []string{"joke-1", "joke-3", "nope"})
+		require.NoError(t, err)
+		require.Len(t, got, 2)
+		require.Equal(t, jokes[0].ID, got["joke-1"].ID)
+		require.Equal(t, jokes[2].URL, got["joke-3"].URL)
+		require.True(t, jokes[2].CreatedAt.Equal(got["joke-3"].CreatedAt))
+	})
+
+	t.Run("upsert", func(t *testing.T) {
+		changed := testJoke(2, "Ninjas fear Chuck Norris. So do pirates.")
+		changed.URL = "https://example.com/jokes/two"
+		changed.CreatedAt = time.Now().UTC()
+		added := testJoke(4, "Chuck Norris doesn't read books.")
+
+		require.NoError(t, s.SaveJokes(ctx, []*domain.Joke{changed, added}))
+		require.Equal(t, jokes[1].ID, changed.ID)
+		require.Greater(t, added.ID, jokes[2].ID)
+
+		got, err := s.GetJokesByExternalID(ctx, []string{"joke-2"})
+		require.NoError(t, err)
+		require.Equal(t, changed.URL, got["joke-2"].URL)
+		require.Equal(t, changed.Content, got["joke-2"].Content)
+		// created_at is when the joke was first saved
+		require.True(t, jokes[1].CreatedAt.Equal(got["joke-2"].CreatedAt))
+	})
+
+	t.Run("error: duplicate url saves nothing", func(t *testing.T) {
+		fresh := testJoke(5, "Chuck Norris can hear sign language.")
+		taken := testJoke(6, "Chuck Norris makes onions cry.")
+		taken.URL = jokes[0].URL
+
+		err := s.SaveJokes(ctx, []*domain.Joke{fresh, taken})
+		require.ErrorIs(t, err, ErrDuplicate)
+
+		got, err := s.GetJokesByExternalID(ctx, []string{"joke-5", "joke-6"})
+		require.NoError(t, err)
+		require.Empty(t, got)
+	})
+
+	t.Run("each joke", func(t *testing.T) {
+		var ids []string
+		err := s.EachJoke(ctx, func(j *domain.Joke) error {
+			ids = append(ids, j.ExternalID)
+			return nil
+		})
+		require.NoError(t, err)
+		require.Equal(t, []string{"joke-1", "joke-2", "joke-3", "joke-4"}, ids)
+
+		stop := errors.New("stop")
+		calls := 0
+		err = s.EachJoke(ctx, func(j *domain.Joke) error {
+			calls++
+			return stop
+		})
+		require.ErrorIs(t, err, stop)
+		require.Equal(t, 1, calls)
+	})
+
+	t.Run("returned jokes are copies", func(t *testing.T) {
+		got, err := s.GetJokesByExternalID(ctx, []string{"joke-1"})
+		require.NoError(t, err)
+		got["joke-1"].Content = "changed"
+
+		again, err := s.GetJokesByExternalID(ctx, []string{"joke-1"})
+		require.NoError(t, err)
+		require.Equal(t, jokes[0].Content, again["joke-1"].Content)
+	})
+}
+
+func testUsers(t *testing.T, s Store) {
+	ctx := context.Background()
+	hash := []byte("hash")
+
+	_, err := s.GetUserByID(ctx, 1)
+	require.ErrorIs(t, err, domain.ErrNotFound)
+
+	id, err := s.CreateUser(ctx, "Chuck@Norris.com", hash)
+	require.NoError(t, err)
+	require.NotZero(t, id)
+
+	t.Run("new user", func(t *testing.T) {
+		u, err := s.GetUserByID(ctx, id)
+		require.NoError(t, err)
+		require.Equal(t, id, u.ID)
+		require.Equal(t, "Chuck@Norris.com", u.Email)
+		require.Equal(t, hash, u.HashedPW)
+		require.Equal(t, "free", u.Plan)
+		require.False(t, u.IsAdmin)
+		require.False(t, u.Verified())
+		require.WithinDuration(t, time.Now().UTC(), u.CreatedAt, time.Minute)
+	})
+
+	t.Run("email ignores case", func(t *testing.T) {
+		u, err := s.GetUserByEmail(ctx, "chuck@norris.COM")
+		require.NoError(t, err)
+		require.Equal(t, id, u.ID)
+
+		_, err = s.CreateUser(ctx, "CHUCK@norris.com", hash)
+		require.ErrorIs(t, err, ErrDuplicate)
+
+		_, err = s.GetUserByEmail(ctx, "walker@ranger.com")
+		require.ErrorIs(t, err, domain.ErrNotFound)
+	})
+
+	t.Run("update password", func(t *testing.T) {
+		require.NoError(t, s.UpdatePassword(ctx, id, []byte("new hash")))
+
+		u, err := s.GetUserByID(ctx, id)
+		require.NoError(t, err)
+		require.Equal(t, []byte("new hash"), u.HashedPW)
+
+		require.ErrorIs(t, s.UpdatePassword(ctx, id+100, hash), domain.ErrNotFound)
+	})
+
+	t.Run("mark verified", func(t *testing.T) {
+		require.NoError(t, s.MarkVerified(ctx, id))
+
+		u, err := s.GetUserByID(ctx, id)
+		require.NoError(t, err)
+		require.True(t, u.Verified())
+		verifiedAt := *u.VerifiedAt
+
+		// verifying again leaves the time alone
+		require.NoError(t, s.MarkVerified(ctx, id))
+		u, err = s.GetUserByID(ctx, id)
+		require.NoError(t, err)
+		require.True(t, verifiedAt.Equal(*u.VerifiedAt))
+	})
+
+	otherID, err := s.CreateUser(ctx, "walker@ranger.com", hash)
+	require.NoError(t, err)
+
+	t.Run("update email", func(t *testing.T) {
+		require.ErrorIs(t, s.UpdateEmail(ctx, otherID, "chuck@NORRIS.com"), ErrDuplicate)
+		require.ErrorIs(t, s.UpdateEmail(ctx, id+100, "nobody@example.com"), domain.ErrNotFound)
+
+		require.NoError(t, s.UpdateEmail(ctx, id, "chuck@roundhouse.com"))
+
+		u, err := s.GetUserByEmail(ctx, "chuck@roundhouse.com")
+		require.NoError(t, err)
+		require.Equal(t, id, u.ID)
+		require.False(t, u.Verified())
+
+		_, err = s.GetUserByEmail(ctx, "chuck@norris.com")
+		require.ErrorIs(t, err, domain.ErrNotFound)
+
+		// the old email is free again
+		require.NoError(t, s.UpdateEmail(ctx, otherID, "chuck@norris.com"))
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		token := &domain.Token{Hash: []byte("delete me"), UserID: id, Scope: domain.ScopeAuthentication, ExpiresAt: time.Now().Add(time.Hour)}
+		require.NoError(t, s.CreateToken(ctx, token))
+
+		require.NoError(t, s.DeleteUser(ctx, id))
+
+		_, err := s.GetUserByID(ctx, id)
+		require.ErrorIs(t, err, domain.ErrNotFound)
+		_, err = s.GetTokenUserID(ctx, token.Hash, token.Scope)
+		require.ErrorIs(t, err, domain.ErrNotFound)
+
+		require.ErrorIs(t, s.DeleteUser(ctx, id), domain.ErrNotFound)
+
+		// the other user is untouched
+		_, err = s.GetUserByID(ctx, otherID)
+		require.NoError(t, err)
+	})
+}
+
+func testToken(userID int64, plaintext, scope string, ttl time.Duration) *domain.Token {
+	hash := sha256.Sum256([]byte(plaintext))
+	return &domain.Token{
+		Plaintext: plaintext,
+		Hash:      hash[:],
+		UserID:    userID,
+		ExpiresAt: time.Now().Add(ttl),
+		Scope:     scope,
+	}
+}
+
+func testTokens(t *testing.T, s Store) {
+	ctx := context.Background()
+
+	t.Run("error: no user", func(t *testing.T) {
+		err := s.CreateToken(ctx, testToken(20, "nobody", domain.ScopeAuthentication, time.Hour))
+		require.ErrorIs(t, err, domain.ErrNotFound)
+	})
+
+	userID, err := s.CreateUser(ctx, "chuck@norris.com", []byte("hash"))
+	require.NoError(t, err)
+	otherID, err := s.CreateUser(ctx, "walker@ranger.com", []byte("hash"))
+	require.NoError(t, err)
+
+	first := testToken(userID, "first", domain.ScopeAuthentication, time.Hour)
+	second := testToken(userID, "second", domain.ScopeAuthentication, time.Hour)
+	expired := testToken(userID, "expired", domain.ScopeAuthentication, -time.Minute)
+	verification := testToken(userID, "verification", domain.ScopeVerification, time.Hour)
+	other := testToken(otherID, "other", domain.ScopeAuthentication, time.Hour)
+	for _, token := range []*domain.Token{first, second, expired, verification, other} {
+		require.NoError(t, s.CreateToken(ctx, token))
+		require.WithinDuration(t, time.Now().UTC(), token.CreatedAt, time.Minute)
+	}
+
+	t.Run("get user id", func(t *testing.T) {
+		id, err := s.GetTokenUserID(ctx, first.Hash, domain.ScopeAuthentication)
+		require.NoError(t, err)
+		require.Equal(t, userID, id)
+
+		id, err = s.GetTokenUserID(ctx, other.Hash, domain.ScopeAuthentication)
+		require.NoError(t, err)
+		require.Equal(t, otherID, id)
+
+		_, err = s.GetTokenUserID(ctx, first.Hash, domain.ScopeVerification)
+		require.ErrorIs(t, err, domain.ErrNotFound)
+
+		_, err = s.GetTokenUserID(ctx, expired.Hash, domain.ScopeAuthentication)
+		require.ErrorIs(t, err, domain.ErrNotFound)
+	})
+
+	t.Run("list", func(t *testing.T) {
+		tokens, err := s.ListTokens(ctx, userID, domain.ScopeAuthentication)
+		require.NoError(t, err)
+		require.Len(t, tokens, 2)
+		require.Equal(t, first.Hash, tokens[0].Hash)
+		require.Equal(t, second.Hash, tokens[1].Hash)
+		require.Empty(t, tokens[0].Plaintext)
+		require.Equal(t, domain.ScopeAuthentication, tokens[0].Scope)
+
+		tokens, err = s.ListTokens(ctx, otherID, domain.ScopeVerification)
+		require.NoError(t, err)
+		require.Empty(t, tokens)
+	})
+
+	t.Run("delete all but one", func(t *testing.T) {
+		require.NoError(t, s.DeleteTokens(ctx, userID, domain.ScopeAuthentication, second.Hash))
+
+		tokens, err := s.ListTokens(ctx, userID, domain.ScopeAuthentication)
+		require.NoError(t, err)
+		require.Len(t, tokens, 1)
+		require.Equal(t, second.Hash, tokens[0].Hash)
+
+		// other scopes and users are left alone
+		_, err = s.GetTokenUserID(ctx, verification.Hash, domain.ScopeVerification)
+		require.NoError(t, err)
+		_, err = s.GetTokenUserID(ctx, other.Hash, domain.ScopeAuthentication)
+		require.NoError(t, err)
+	})
+
+	t.Run("delete all", func(t *testing.T) {
+		require.NoError(t, s.DeleteTokens(ctx, userID, domain.ScopeAuthentication, nil))
+
+		tokens, err := s.ListTokens(ctx, userID, domain.ScopeAuthentication)
+		require.NoError(t, err)
+		require.Empty(t, tokens)
+	})
+
+	t.Run("delete one", func(t *testing.T) {
+		require.NoError(t, s.DeleteToken(ctx, other.Hash))
+		_, err := s.GetTokenUserID(ctx, other.Hash, domain.ScopeAuthentication)
+		require.ErrorIs(t, err, domain.ErrNotFound)
+
+		// already gone is fine
+		require.NoError(t, s.DeleteToken(ctx, other.Hash))
+	})
+
+	t.Run("consume", func(t *testing.T) {
+		_, err := s.ConsumeToken(ctx, verification.Hash, domain.ScopeAuthentication)
+		require.ErrorIs(t, err, domain.ErrNotFound)
+
+		id, err := s.ConsumeToken(ctx, verification.Hash, domain.ScopeVerification)
+		require.NoError(t, err)
+		require.Equal(t, userID, id)
+
+		_, err = s.ConsumeToken(ctx, verification.Hash, domain.ScopeVerification)
+		require.ErrorIs(t, err, domain.ErrNotFound)
+
+		expiredReset := testToken(userID, "expired reset", domain.ScopePasswordReset, -time.Minute)
+		require.NoError(t, s.CreateToken(ctx, expiredReset))
+		_, err = s.ConsumeToken(ctx, expiredReset.Hash, domain.ScopePasswordReset)
+		require.ErrorIs(t, err, domain.ErrNotFound)
+	})
+}
+
+func testConcurrency(t *testing.T, s Store) {
+	ctx := context.Background()
+
+	// everyone signs up with the same email at once, exactly one wins
+	const workers = 10
+	var wg sync.WaitGroup
+	errs := make(chan error, 2*workers)
+	for i := range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := s.CreateUser(ctx, "chuck@norris.com", []byte("hash"))
+			errs <- err
+
+			joke := testJoke(i+1, "Chuck Norris can win a game of Connect Four in three moves.")
+			errs <- s.SaveJokes(ctx, []*domain.Joke{joke})
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	var created, duplicates int
+	for err := range errs {
+		switch {
+		case err == nil:
+			created++
+		case errors.Is(err, ErrDuplicate):
+			duplicates++
+		default:
+			t.Fatal(err)
+		}
+	}
+	require.Equal(t, workers+1, created)
+	require.Equal(t, workers-1, duplicates)
+
+	count := 0
+	require.NoError(t, s.EachJoke(ctx, func(*domain.Joke) error {
+		count++
+		return nil
+	}))
+	require.Equal(t, workers, count)
+}
+
+// testOutbox checks the events a database backed store adds to the outbox
+// go in with the change, or not at all.
+func testOutbox(t *testing.T, db *sqldb.DB, s Store) {
+	ctx := context.Background()
+
+	events := func() []string {
+		t.Helper()
+		rows, err := db.QueryContext(ctx, `select type, payload from outbox order by id`)
+		require.NoError(t, err)
+		defer rows.Close()
+
+		var events []string
+		for rows.Next() {
+			var eventType, payload string
+			require.NoError(t, rows.Scan(&eventType, &payload))
+			events = append(events, eventType+" "+strings.ReplaceAll(payload, " ", ""))
+		}
+		require.NoError(t, rows.Err())
+		return events
+	}
+
+	id, err := s.CreateUser(ctx, "chuck@norris.com", []byte("hash"))
+	require.NoError(t, err)
+	_, err = s.CreateUser(ctx, "chuck@norris.com", []byte("hash"))
+	require.ErrorIs(t, err, ErrDuplicate)
+
+	jokes := []*domain.Joke{testJoke(1, "one"), testJoke(2, "two")}
+	require.NoError(t, s.SaveJokes(ctx, jokes))
+
+	// the second joke's url is taken, so neither is saved
+	clash := testJoke(3, "three")
+	clash.URL = jokes[0].URL
+	require.ErrorIs(t, s.SaveJokes(ctx, []*domain.Joke{testJoke(4, "four"), clash}), ErrDuplicate)
+
+	require.Equal(t, []string{
+		fmt.Sprintf(`user.registered {"user_id":%d}`, id),
+		fmt.Sprintf(`joke.ingested {"joke_id":%d,"external_id":"joke-1"}`, jokes[0].ID),
+		fmt.Sprintf(`joke.ingested {"joke_id":%d,"external_id":"joke-2"}`, jokes[1].ID),
+	}, events())
+}
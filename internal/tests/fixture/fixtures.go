@@ -4,7 +4,8 @@ import (
 	"context"
 	"testing"
 
-	"github.com/davemolk/chuck/internal/sql"
+	"github.com/davemolk/chuck/internal/hasher"
+	"github.com/davemolk/chuck/internal/store"
 	"github.com/stretchr/testify/require"
 	"go.uber.org/zap"
 	"golang.org/x/crypto/bcrypt"
@@ -16,21 +17,26 @@ func TestLogger(t *testing.T) *zap.Logger {
 	return logger
 }
 
-func AddUser(t *testing.T, db *sql.DB, email string) int64 {
+// TestHasher returns a password hasher with params cheap enough for tests.
+func TestHasher(t *testing.T) *hasher.Hasher {
+	h, err := hasher.New(hasher.Params{
+		Memory:      64,
+		Iterations:  1,
+		Parallelism: 1,
+		SaltLength:  16,
+		KeyLength:   32,
+	})
+	require.NoError(t, err)
+	return h
+}
+
+// AddUser creates a user with a legacy bcrypt hash of "password".
+func AddUser(t *testing.T, users store.UserStore, email string) int64 {
 	password := "password"
 	hash, err := bcrypt.GenerateFromPassword([]byte(password), 12)
 	require.NoError(t, err)
 
-	args := []any{email, hash}
-
-	query := `
-		insert into users (email, hashed_pw)
-		values ($1, $2)
-		on conflict (email) do nothing
-		returning id`
-
-	var id int64
-	err = db.QueryRowContext(context.Background(), query, args...).Scan(&id)
+	id, err := users.CreateUser(context.Background(), email, hash)
 	require.NoError(t, err)
 
 	return id
@@ -5,6 +5,7 @@ import (
 	"time"
 
 	"github.com/davemolk/chuck/internal/domain"
+	"github.com/davemolk/chuck/internal/jokeio"
 )
 
 type ChuckClient struct {
@@ -18,12 +19,28 @@ func (c *ChuckClient) Search(ctx context.Context, query string, limit int) ([]*d
 }
 
 type UserService struct {
-	CreateUserFn         func(ctx context.Context, email, password string) (int64, error)
-	CreateUserCalled     bool
-	GetUserByEmailFn     func(ctx context.Context, email string) (*domain.User, error)
-	GetUserByEmailCalled bool
-	GetUserByIDFn        func(ctx context.Context, id int64) (*domain.User, error)
-	GetUserByIDCalled    bool
+	CreateUserFn             func(ctx context.Context, email, password string) (int64, error)
+	CreateUserCalled         bool
+	GetUserByEmailFn         func(ctx context.Context, email string) (*domain.User, error)
+	GetUserByEmailCalled     bool
+	GetUserByIDFn            func(ctx context.Context, id int64) (*domain.User, error)
+	GetUserByIDCalled        bool
+	UpdatePasswordFn         func(ctx context.Context, userID int64, password string) error
+	UpdatePasswordCalled     bool
+	RehashPasswordFn         func(ctx context.Context, userID int64, password string) error
+	RehashPasswordCalled     bool
+	VerifyEmailFn            func(ctx context.Context, token string) error
+	VerifyEmailCalled        bool
+	ResendVerificationFn     func(ctx context.Context, userID int64) error
+	ResendVerificationCalled bool
+	GetUserStatsFn           func(ctx context.Context, userID int64) (*domain.UserStats, error)
+	GetUserStatsCalled       bool
+	ExportUserFn             func(ctx context.Context, userID int64) (*domain.UserExport, error)
+	ExportUserCalled         bool
+	UpdateEmailFn            func(ctx context.Context, userID int64, email string) error
+	UpdateEmailCalled        bool
+	DeleteUserFn             func(ctx context.Context, userID int64) error
+	DeleteUserCalled         bool
 }
 
 func (s *UserService) CreateUser(ctx context.Context, email, password string) (int64, error) {
@@ -41,27 +58,103 @@ func (s *UserService) GetUserByID(ctx context.Context, id int64) (*domain.User,
 	return s.GetUserByIDFn(ctx, id)
 }
 
+func (s *UserService) UpdatePassword(ctx context.Context, userID int64, password string) error {
+	s.UpdatePasswordCalled = true
+	return s.UpdatePasswordFn(ctx, userID, password)
+}
+
+func (s *UserService) RehashPassword(ctx context.Context, userID int64, password string) error {
+	s.RehashPasswordCalled = true
+	return s.RehashPasswordFn(ctx, userID, password)
+}
+
+func (s *UserService) VerifyEmail(ctx context.Context, token string) error {
+	s.VerifyEmailCalled = true
+	return s.VerifyEmailFn(ctx, token)
+}
+
+func (s *UserService) ResendVerification(ctx context.Context, userID int64) error {
+	s.ResendVerificationCalled = true
+	return s.ResendVerificationFn(ctx, userID)
+}
+
+func (s *UserService) GetUserStats(ctx context.Context, userID int64) (*domain.UserStats, error) {
+	s.GetUserStatsCalled = true
+	return s.GetUserStatsFn(ctx, userID)
+}
+
+func (s *UserService) ExportUser(ctx context.Context, userID int64) (*domain.UserExport, error) {
+	s.ExportUserCalled = true
+	return s.ExportUserFn(ctx, userID)
+}
+
+func (s *UserService) UpdateEmail(ctx context.Context, userID int64, email string) error {
+	s.UpdateEmailCalled = true
+	return s.UpdateEmailFn(ctx, userID, email)
+}
+
+func (s *UserService) DeleteUser(ctx context.Context, userID int64) error {
+	s.DeleteUserCalled = true
+	return s.DeleteUserFn(ctx, userID)
+}
+
 func (s *UserService) ResetCalls() {
 	s.CreateUserCalled = false
 	s.GetUserByIDCalled = false
 	s.GetUserByEmailCalled = false
+	s.UpdatePasswordCalled = false
+	s.RehashPasswordCalled = false
+	s.VerifyEmailCalled = false
+	s.ResendVerificationCalled = false
+	s.GetUserStatsCalled = false
+	s.ExportUserCalled = false
+	s.UpdateEmailCalled = false
+	s.DeleteUserCalled = false
 }
 
 type TokenService struct {
-	CreateTokenFn       func(ctx context.Context, userID int64, ttl time.Duration) (*domain.Token, error)
+	CreateTokenFn       func(ctx context.Context, userID int64, ttl time.Duration, scope string) (*domain.Token, error)
 	CreateTokenFnCalled bool
-	ValidateTokenFn     func(ctx context.Context, token string) (int64, error)
+	ValidateTokenFn     func(ctx context.Context, token, scope string) (int64, error)
 	ValidateTokenCalled bool
+	ConsumeTokenFn      func(ctx context.Context, token, scope string) (int64, error)
+	ConsumeTokenCalled  bool
+	DeleteTokenFn       func(ctx context.Context, token string) error
+	DeleteTokenCalled   bool
+	RevokeTokensFn      func(ctx context.Context, userID int64, scope, keep string) error
+	RevokeTokensCalled  bool
+	ListTokensFn        func(ctx context.Context, userID int64, scope string) ([]*domain.Token, error)
+	ListTokensCalled    bool
 }
 
-func (s *TokenService) CreateToken(ctx context.Context, userID int64, ttl time.Duration) (*domain.Token, error) {
+func (s *TokenService) CreateToken(ctx context.Context, userID int64, ttl time.Duration, scope string) (*domain.Token, error) {
 	s.CreateTokenFnCalled = true
-	return s.CreateTokenFn(ctx, userID, ttl)
+	return s.CreateTokenFn(ctx, userID, ttl, scope)
 }
 
-func (s *TokenService) ValidateToken(ctx context.Context, token string) (int64, error) {
+func (s *TokenService) ValidateToken(ctx context.Context, token, scope string) (int64, error) {
 	s.ValidateTokenCalled = true
-	return s.ValidateTokenFn(ctx, token)
+	return s.ValidateTokenFn(ctx, token, scope)
+}
+
+func (s *TokenService) ConsumeToken(ctx context.Context, token, scope string) (int64, error) {
+	s.ConsumeTokenCalled = true
+	return s.ConsumeTokenFn(ctx, token, scope)
+}
+
+func (s *TokenService) DeleteToken(ctx context.Context, token string) error {
+	s.DeleteTokenCalled = true
+	return s.DeleteTokenFn(ctx, token)
+}
+
+func (s *TokenService) RevokeTokens(ctx context.Context, userID int64, scope, keep string) error {
+	s.RevokeTokensCalled = true
+	return s.RevokeTokensFn(ctx, userID, scope, keep)
+}
+
+func (s *TokenService) ListTokens(ctx context.Context, userID int64, scope string) ([]*domain.Token, error) {
+	s.ListTokensCalled = true
+	return s.ListTokensFn(ctx, userID, scope)
 }
 
 type JokeService struct {
@@ -69,8 +162,12 @@ type JokeService struct {
 	GetPersonalizedJokeCalled  bool
 	GetRandomJokeFn            func(ctx context.Context) (*domain.Joke, error)
 	GetRandomJokeCalled        bool
-	GetRandomJokeByQueryFn     func(ctx context.Context, query string) (*domain.Joke, error)
+	GetRandomJokeByQueryFn     func(ctx context.Context, user *domain.User, query string) (*domain.Joke, error)
 	GetRandomJokeByQueryCalled bool
+	ExportJokesFn              func(ctx context.Context, w *jokeio.Writer) error
+	ExportJokesCalled          bool
+	ImportJokesFn              func(ctx context.Context, r *jokeio.Reader) (*domain.JokeImport, error)
+	ImportJokesCalled          bool
 }
 
 func (s *JokeService) GetPersonalizedJoke(ctx context.Context, name string) (*domain.Joke, error) {
@@ -83,27 +180,56 @@ func (s *JokeService) GetRandomJoke(ctx context.Context) (*domain.Joke, error) {
 	return s.GetRandomJokeFn(ctx)
 }
 
-func (s *JokeService) GetRandomJokeByQuery(ctx context.Context, query string) (*domain.Joke, error) {
+func (s *JokeService) GetRandomJokeByQuery(ctx context.Context, user *domain.User, query string) (*domain.Joke, error) {
 	s.GetRandomJokeByQueryCalled = true
-	return s.GetRandomJokeByQueryFn(ctx, query)
+	return s.GetRandomJokeByQueryFn(ctx, user, query)
+}
+
+func (s *JokeService) ExportJokes(ctx context.Context, w *jokeio.Writer) error {
+	s.ExportJokesCalled = true
+	return s.ExportJokesFn(ctx, w)
+}
+
+func (s *JokeService) ImportJokes(ctx context.Context, r *jokeio.Reader) (*domain.JokeImport, error) {
+	s.ImportJokesCalled = true
+	return s.ImportJokesFn(ctx, r)
 }
 
 func (s *JokeService) ResetCalls() {
 	s.GetPersonalizedJokeCalled = false
 	s.GetRandomJokeByQueryCalled = false
 	s.GetRandomJokeCalled = false
+	s.ExportJokesCalled = false
+	s.ImportJokesCalled = false
 }
 
 type AuthService struct {
-	LoginFn                 func(ctx context.Context, email, password string) (*domain.Token, error)
-	LoginFnCalled           bool
-	GetUserIDForTokenFn     func(ctx context.Context, token string) (*domain.User, error)
-	GetUserIDForTokenCalled bool
+	LoginFn                    func(ctx context.Context, email, password, ip string) (*domain.Token, error)
+	LoginFnCalled              bool
+	VerifyMFAFn                func(ctx context.Context, challenge, code, ip string) (*domain.Token, error)
+	VerifyMFACalled            bool
+	GetUserIDForTokenFn        func(ctx context.Context, token string) (*domain.User, error)
+	GetUserIDForTokenCalled    bool
+	ChangePasswordFn           func(ctx context.Context, userID int64, oldPassword, newPassword, currentToken string) error
+	ChangePasswordCalled       bool
+	RequestPasswordResetFn     func(ctx context.Context, email string) error
+	RequestPasswordResetCalled bool
+	ResetPasswordFn            func(ctx context.Context, token, password string) error
+	ResetPasswordCalled        bool
+	ChangeEmailFn              func(ctx context.Context, userID int64, password, email string) error
+	ChangeEmailCalled          bool
+	DeleteAccountFn            func(ctx context.Context, userID int64, password string) error
+	DeleteAccountCalled        bool
 }
 
-func (s *AuthService) Login(ctx context.Context, email, password string) (*domain.Token, error) {
+func (s *AuthService) Login(ctx context.Context, email, password, ip string) (*domain.Token, error) {
 	s.LoginFnCalled = true
-	return s.LoginFn(ctx, email, password)
+	return s.LoginFn(ctx, email, password, ip)
+}
+
+func (s *AuthService) VerifyMFA(ctx context.Context, challenge, code, ip string) (*domain.Token, error) {
+	s.VerifyMFACalled = true
+	return s.VerifyMFAFn(ctx, challenge, code, ip)
 }
 
 func (s *AuthService) GetUserIDForToken(ctx context.Context, token string) (*domain.User, error) {
@@ -111,7 +237,146 @@ func (s *AuthService) GetUserIDForToken(ctx context.Context, token string) (*dom
 	return s.GetUserIDForTokenFn(ctx, token)
 }
 
+func (s *AuthService) ChangePassword(ctx context.Context, userID int64, oldPassword, newPassword, currentToken string) error {
+	s.ChangePasswordCalled = true
+	return s.ChangePasswordFn(ctx, userID, oldPassword, newPassword, currentToken)
+}
+
+func (s *AuthService) RequestPasswordReset(ctx context.Context, email string) error {
+	s.RequestPasswordResetCalled = true
+	return s.RequestPasswordResetFn(ctx, email)
+}
+
+func (s *AuthService) ResetPassword(ctx context.Context, token, password string) error {
+	s.ResetPasswordCalled = true
+	return s.ResetPasswordFn(ctx, token, password)
+}
+
+func (s *AuthService) ChangeEmail(ctx context.Context, userID int64, password, email string) error {
+	s.ChangeEmailCalled = true
+	return s.ChangeEmailFn(ctx, userID, password, email)
+}
+
+func (s *AuthService) DeleteAccount(ctx context.Context, userID int64, password string) error {
+	s.DeleteAccountCalled = true
+	return s.DeleteAccountFn(ctx, userID, password)
+}
+
 func (s *AuthService) ResetCalls() {
 	s.LoginFnCalled = false
+	s.VerifyMFACalled = false
 	s.GetUserIDForTokenCalled = false
+	s.ChangePasswordCalled = false
+	s.RequestPasswordResetCalled = false
+	s.ResetPasswordCalled = false
+	s.ChangeEmailCalled = false
+	s.DeleteAccountCalled = false
+}
+
+type MFAService struct {
+	EnrollTOTPFn      func(ctx context.Context, user *domain.User) (*domain.TOTPEnrollment, error)
+	EnrollTOTPCalled  bool
+	ConfirmTOTPFn     func(ctx context.Context, userID int64, code string) ([]string, error)
+	ConfirmTOTPCalled bool
+	IsEnabledFn       func(ctx context.Context, userID int64) (bool, error)
+	IsEnabledCalled   bool
+	VerifyFn          func(ctx context.Context, userID int64, code string) error
+	VerifyCalled      bool
+	GetStatusFn       func(ctx context.Context, userID int64) (*domain.MFAStatus, error)
+	GetStatusCalled   bool
+}
+
+func (s *MFAService) EnrollTOTP(ctx context.Context, user *domain.User) (*domain.TOTPEnrollment, error) {
+	s.EnrollTOTPCalled = true
+	return s.EnrollTOTPFn(ctx, user)
+}
+
+func (s *MFAService) ConfirmTOTP(ctx context.Context, userID int64, code string) ([]string, error) {
+	s.ConfirmTOTPCalled = true
+	return s.ConfirmTOTPFn(ctx, userID, code)
+}
+
+func (s *MFAService) IsEnabled(ctx context.Context, userID int64) (bool, error) {
+	s.IsEnabledCalled = true
+	return s.IsEnabledFn(ctx, userID)
+}
+
+func (s *MFAService) Verify(ctx context.Context, userID int64, code string) error {
+	s.VerifyCalled = true
+	return s.VerifyFn(ctx, userID, code)
+}
+
+func (s *MFAService) GetStatus(ctx context.Context, userID int64) (*domain.MFAStatus, error) {
+	s.GetStatusCalled = true
+	return s.GetStatusFn(ctx, userID)
+}
+
+func (s *MFAService) ResetCalls() {
+	s.EnrollTOTPCalled = false
+	s.ConfirmTOTPCalled = false
+	s.IsEnabledCalled = false
+	s.VerifyCalled = false
+	s.GetStatusCalled = false
+}
+
+type UsageService struct {
+	RecordFn            func(ctx context.Context, user *domain.User, event string) error
+	RecordCalled        bool
+	RefundFn            func(ctx context.Context, user *domain.User, event string) error
+	RefundCalled        bool
+	GetUsageFn          func(ctx context.Context, user *domain.User, days int) (*domain.Usage, error)
+	GetUsageCalled      bool
+	ReportFn            func(ctx context.Context, from, to time.Time) ([]domain.UsageReportRow, error)
+	ReportCalled        bool
+	GetDailyUsageFn     func(ctx context.Context, userID int64) ([]domain.DailyUsage, error)
+	GetDailyUsageCalled bool
+}
+
+func (s *UsageService) Record(ctx context.Context, user *domain.User, event string) error {
+	s.RecordCalled = true
+	return s.RecordFn(ctx, user, event)
+}
+
+func (s *UsageService) Refund(ctx context.Context, user *domain.User, event string) error {
+	s.RefundCalled = true
+	return s.RefundFn(ctx, user, event)
+}
+
+func (s *UsageService) GetUsage(ctx context.Context, user *domain.User, days int) (*domain.Usage, error) {
+	s.GetUsageCalled = true
+	return s.GetUsageFn(ctx, user, days)
+}
+
+func (s *UsageService) Report(ctx context.Context, from, to time.Time) ([]domain.UsageReportRow, error) {
+	s.ReportCalled = true
+	return s.ReportFn(ctx, from, to)
+}
+
+func (s *UsageService) GetDailyUsage(ctx context.Context, userID int64) ([]domain.DailyUsage, error) {
+	s.GetDailyUsageCalled = true
+	return s.GetDailyUsageFn(ctx, userID)
+}
+
+func (s *UsageService) ResetCalls() {
+	s.RecordCalled = false
+	s.RefundCalled = false
+	s.GetUsageCalled = false
+	s.ReportCalled = false
+}
+
+type JokeStore struct {
+	GetJokesByExternalIDFn     func(ctx context.Context, externalIDs []string) (map[string]*domain.Joke, error)
+	GetJokesByExternalIDCalled bool
+	SaveJokesFn                func(ctx context.Context, jokes []*domain.Joke) error
+	SaveJokesCalled            bool
+}
+
+func (s *JokeStore) GetJokesByExternalID(ctx context.Context, externalIDs []string) (map[string]*domain.Joke, error) {
+	s.GetJokesByExternalIDCalled = true
+	return s.GetJokesByExternalIDFn(ctx, externalIDs)
+}
+
+func (s *JokeStore) SaveJokes(ctx context.Context, jokes []*domain.Joke) error {
+	s.SaveJokesCalled = true
+	return s.SaveJokesFn(ctx, jokes)
 }
@@ -0,0 +1,50 @@
+package tlscert
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// Client auth modes.
+const (
+	// ClientAuthNone doesn't ask for client certificates.
+	ClientAuthNone = "none"
+	// ClientAuthRequest verifies a client certificate if one is sent, callers
+	// without one carry on with bearer tokens or anonymously.
+	ClientAuthRequest = "request"
+	// ClientAuthRequire refuses the handshake without a verified client
+	// certificate.
+	ClientAuthRequire = "require"
+)
+
+// ClientAuthType maps a client auth mode to its tls setting.
+func ClientAuthType(mode string) (tls.ClientAuthType, error) {
+	switch mode {
+	case ClientAuthNone:
+		return tls.NoClientCert, nil
+	case ClientAuthRequest:
+		return tls.VerifyClientCertIfGiven, nil
+	case ClientAuthRequire:
+		return tls.RequireAndVerifyClientCert, nil
+	default:
+		return tls.NoClientCert, fmt.Errorf("unknown client auth mode %q", mode)
+	}
+}
+
+// LoadCAPool reads a bundle of PEM encoded CA certificates.
+func LoadCAPool(file string) (*x509.CertPool, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read client ca bundle: %w", err)
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(b) {
+		return nil, errors.New("failed to read client ca bundle: no certificates found")
+	}
+
+	return pool, nil
+}
@@ -0,0 +1,50 @@
+package tlscert
+
+import (
+	"crypto/tls"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/davemolk/chuck/internal/tests/fixture"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClientAuthType(t *testing.T) {
+	for mode, want := range map[string]tls.ClientAuthType{
+		ClientAuthNone:    tls.NoClientCert,
+		ClientAuthRequest: tls.VerifyClientCertIfGiven,
+		ClientAuthRequire: tls.RequireAndVerifyClientCert,
+	} {
+		got, err := ClientAuthType(mode)
+		require.NoError(t, err)
+		require.Equal(t, want, got)
+	}
+
+	_, err := ClientAuthType("sometimes")
+	require.Error(t, err)
+}
+
+func TestLoadCAPool(t *testing.T) {
+	dir := t.TempDir()
+	ca := fixture.TestCA(t)
+
+	bundle := filepath.Join(dir, "ca.pem")
+	require.NoError(t, os.WriteFile(bundle, ca.PEM(), 0o600))
+
+	pool, err := LoadCAPool(bundle)
+	require.NoError(t, err)
+	require.True(t, pool.Equal(ca.Pool()))
+
+	t.Run("error: not pem", func(t *testing.T) {
+		empty := filepath.Join(dir, "empty.pem")
+		require.NoError(t, os.WriteFile(empty, []byte("nope"), 0o600))
+		_, err := LoadCAPool(empty)
+		require.Error(t, err)
+	})
+
+	t.Run("error: missing", func(t *testing.T) {
+		_, err := LoadCAPool(filepath.Join(dir, "missing.pem"))
+		require.Error(t, err)
+	})
+}
@@ -0,0 +1,120 @@
+// Package tlscert serves a TLS certificate that can be replaced on disk
+// without restarting. Handshakes always get the last certificate that loaded
+// successfully, so a half written or broken file never takes the server down.
+package tlscert
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+type Reloader struct {
+	logger   *zap.Logger
+	certFile string
+	keyFile  string
+	cert     atomic.Pointer[tls.Certificate]
+
+	// mu serializes reloads and guards modTimes.
+	mu       sync.Mutex
+	modTimes [2]time.Time
+}
+
+// NewReloader loads the cert and key, failing if they can't be, since there's
+// no previous certificate to fall back on yet.
+func NewReloader(logger *zap.Logger, certFile, keyFile string) (*Reloader, error) {
+	r := &Reloader{
+		logger:   logger,
+		certFile: certFile,
+		keyFile:  keyFile,
+	}
+
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// Reload reads the cert and key from disk. On failure the current
+// certificate stays in use.
+func (r *Reloader) Reload() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	modTimes, err := r.stat()
+	if err != nil {
+		return err
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load tls certificate: %w", err)
+	}
+
+	r.cert.Store(&cert)
+	r.modTimes = modTimes
+
+	fields := []zap.Field{zap.String("cert_file", r.certFile)}
+	if cert.Leaf != nil {
+		fields = append(fields, zap.Time("not_after", cert.Leaf.NotAfter))
+	}
+	r.logger.Info("loaded tls certificate", fields...)
+
+	return nil
+}
+
+// GetCertificate is for tls.Config.GetCertificate.
+func (r *Reloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return r.cert.Load(), nil
+}
+
+// Watch reloads whenever the cert or key file changes, checking every
+// interval until ctx is done. Polling keeps it working for mounted secrets,
+// which are swapped by symlink and don't always raise file events. A change
+// that fails to load is only retried once the files change again.
+func (r *Reloader) Watch(ctx context.Context, every time.Duration) {
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+
+	r.mu.Lock()
+	seen := r.modTimes
+	r.mu.Unlock()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			modTimes, err := r.stat()
+			if err != nil || modTimes == seen {
+				// mid-rotation, or nothing new
+				continue
+			}
+			seen = modTimes
+
+			if err := r.Reload(); err != nil {
+				r.logger.Error("failed to reload tls certificate, keeping the current one", zap.Error(err))
+			}
+		}
+	}
+}
+
+func (r *Reloader) stat() ([2]time.Time, error) {
+	var modTimes [2]time.Time
+	for i, name := range []string{r.certFile, r.keyFile} {
+		info, err := os.Stat(name)
+		if err != nil {
+			return modTimes, fmt.Errorf("failed to stat tls file: %w", err)
+		}
+		modTimes[i] = info.ModTime()
+	}
+
+	return modTimes, nil
+}
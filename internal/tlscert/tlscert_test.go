@@ -0,0 +1,105 @@
+package tlscert
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+// writeCert writes a fresh self-signed cert for commonName and returns its
+// der bytes.
+func writeCert(t *testing.T, certFile, keyFile, commonName string) []byte {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{"localhost"},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.NoError(t, err)
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	require.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600))
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600))
+
+	return der
+}
+
+func current(t *testing.T, r *Reloader) []byte {
+	t.Helper()
+	cert, err := r.GetCertificate(&tls.ClientHelloInfo{})
+	require.NoError(t, err)
+	return cert.Certificate[0]
+}
+
+// bump moves the files' mtime forward, some filesystems are too coarse to
+// notice two writes in a row.
+func bump(t *testing.T, files ...string) {
+	t.Helper()
+	later := time.Now().Add(time.Minute)
+	for _, f := range files {
+		require.NoError(t, os.Chtimes(f, later, later))
+	}
+}
+
+func TestReloader(t *testing.T) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+
+	t.Run("error: missing files", func(t *testing.T) {
+		_, err := NewReloader(zap.NewNop(), certFile, keyFile)
+		require.Error(t, err)
+	})
+
+	first := writeCert(t, certFile, keyFile, "first")
+	r, err := NewReloader(zap.NewNop(), certFile, keyFile)
+	require.NoError(t, err)
+	require.Equal(t, first, current(t, r))
+
+	second := writeCert(t, certFile, keyFile, "second")
+	require.Equal(t, first, current(t, r), "nothing changes until a reload")
+	require.NoError(t, r.Reload())
+	require.Equal(t, second, current(t, r))
+
+	t.Run("error: broken file keeps the current cert", func(t *testing.T) {
+		require.NoError(t, os.WriteFile(keyFile, []byte("nope"), 0o600))
+		require.Error(t, r.Reload())
+		require.Equal(t, second, current(t, r))
+	})
+
+	t.Run("watch", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go r.Watch(ctx, 10*time.Millisecond)
+
+		third := writeCert(t, certFile, keyFile, "third")
+		bump(t, certFile, keyFile)
+
+		require.Eventually(t, func() bool {
+			cert, _ := r.GetCertificate(nil)
+			return string(cert.Certificate[0]) == string(third)
+		}, time.Second, 10*time.Millisecond)
+	})
+}
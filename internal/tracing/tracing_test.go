@@ -0,0 +1,54 @@
+package tracing
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestStart(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	tp := Install(exporter, "chuck-test")
+	ctx := context.Background()
+
+	require.Empty(t, LogFields(ctx))
+
+	ctx, parent := Start(ctx, "parent")
+	_, child := Start(ctx, "child")
+	RecordError(child, errors.New("nope"))
+	RecordError(parent, nil)
+	child.End()
+	parent.End()
+
+	fields := LogFields(ctx)
+	require.Len(t, fields, 2)
+	require.Equal(t, "trace_id", fields[0].Key)
+	require.Equal(t, parent.SpanContext().TraceID().String(), fields[0].String)
+
+	require.NoError(t, tp.ForceFlush(ctx))
+	spans := exporter.GetSpans()
+	require.Len(t, spans, 2)
+
+	require.Equal(t, "child", spans[0].Name)
+	require.Equal(t, codes.Error, spans[0].Status.Code)
+	require.Equal(t, parent.SpanContext().SpanID(), spans[0].Parent.SpanID())
+
+	require.Equal(t, "parent", spans[1].Name)
+	require.Equal(t, codes.Unset, spans[1].Status.Code)
+	name, ok := spans[1].Resource.Set().Value("service.name")
+	require.True(t, ok)
+	require.Equal(t, "chuck-test", name.AsString())
+}
+
+func TestSetup(t *testing.T) {
+	shutdown, err := Setup(context.Background(), Config{Exporter: "none"})
+	require.NoError(t, err)
+	require.NoError(t, shutdown(context.Background()))
+
+	_, err = Setup(context.Background(), Config{Exporter: "carrier-pigeon"})
+	require.Error(t, err)
+}